@@ -0,0 +1,133 @@
+package main
+
+// Admin endpoints for operators, served under /admin/.
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+var start_time = time.Now()
+
+// Rough per-entry cost of a map[string]string entry beyond the key and value
+// bytes: two string headers plus bucket overhead.
+const indexEntryOverhead = 48
+
+type AdminNodeStats struct {
+	Node               string    `json:"node"`
+	Bucket             string    `json:"bucket,omitempty"`
+	Keys               int       `json:"keys"`
+	BytesUsed          int64     `json:"bytes_used"`
+	MaxBytes           int64     `json:"max_bytes"`
+	Utilization        float64   `json:"utilization"`
+	FileBytes          int64     `json:"file_bytes"`
+	UnsyncedBytes      int64     `json:"unsynced_bytes"` // Written since the last sync, under the interval sync policy
+	Segments           int       `json:"segments"`
+	DeadBytes          int64     `json:"dead_bytes"`
+	LastCompaction     time.Time `json:"last_compaction"`
+	LastWrite          time.Time `json:"last_write,omitzero"` // Newest write time among the live keys
+	IndexBytesEstimate int64     `json:"index_bytes_estimate"`
+	BloomBytes         int64     `json:"bloom_bytes,omitempty"`
+}
+
+type AdminStats struct {
+	StartedAt     time.Time        `json:"started_at"`
+	UptimeSeconds float64          `json:"uptime_seconds"`
+	Nodes         []AdminNodeStats `json:"nodes"`
+	Cache         *CacheStats      `json:"cache,omitempty"` // nil unless cache_bytes is set
+	Quotas        []QuotaStats     `json:"quotas,omitempty"`
+	Followers     []FollowerStatus `json:"followers,omitempty"` // Replicas following this server and how far behind they are
+}
+
+// adminStats reports per-node space usage. Dead bytes are the overwritten or
+// deleted records still sitting in segment files until compaction drops
+// them.
+func adminStats(nodes []*ServerNode) AdminStats {
+	out := AdminStats{
+		StartedAt:     start_time,
+		UptimeSeconds: time.Since(start_time).Seconds(),
+		Nodes:         make([]AdminNodeStats, 0, len(nodes)),
+	}
+	for _, n := range nodes {
+		s := AdminNodeStats{Node: n.name, Bucket: n.bucket, MaxBytes: cfg().MaxStoreBytes}
+		n.mu.RLock()
+		s.Keys = len(n.node_store)
+		s.BytesUsed = n.size
+		s.LastCompaction = n.last_compaction
+		if n.segs != nil {
+			total, live := n.segs.fileBytes()
+			s.FileBytes = total
+			s.DeadBytes = total - live
+			s.Segments = len(n.segs.segments)
+			s.UnsyncedBytes = n.segs.unsynced()
+		}
+		for k := range n.node_store {
+			s.IndexBytesEstimate += int64(len(k)) + indexEntryOverhead
+			if t := n.modTimeLocked(k); t.After(s.LastWrite) {
+				s.LastWrite = t
+			}
+		}
+		if f := n.bloom.Load(); f != nil {
+			s.BloomBytes = f.sizeBytes()
+		}
+		n.mu.RUnlock()
+
+		if s.MaxBytes > 0 {
+			s.Utilization = float64(s.BytesUsed) / float64(s.MaxBytes)
+		}
+		out.Nodes = append(out.Nodes, s)
+	}
+	out.Quotas = quotaStats()
+	if replica == nil {
+		changes.mu.Lock()
+		seq := changes.seq
+		changes.mu.Unlock()
+		out.Followers = followers.status(seq)
+	}
+	if read_cache != nil {
+		cs := read_cache.stats()
+		out.Cache = &cs
+	}
+	return out
+}
+
+func adminStatsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, adminStats(allNodes()))
+}
+
+// adminIndexHandler manages secondary indexes: GET lists the indexed fields,
+// POST ?field= creates an index and DELETE ?field= drops it.
+func adminIndexHandler(w http.ResponseWriter, r *http.Request) {
+	field := r.URL.Query().Get("field")
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, indexedFields())
+		return
+	case http.MethodPost, http.MethodDelete:
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+	if field == "" {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "field is required and cannot be empty")
+		return
+	}
+
+	var err error
+	if r.Method == http.MethodPost {
+		err = addIndex(field)
+	} else {
+		err = dropIndex(field)
+	}
+	if err != nil {
+		if errors.Is(err, ErrNoIndex) {
+			writeError(w, r, http.StatusNotFound, codeNoIndex, "no index on field")
+		} else {
+			writeError(w, r, http.StatusInternalServerError, codeInternal, "internal server error")
+		}
+		return
+	}
+	writeMessage(w, r, "ok")
+}
@@ -0,0 +1,306 @@
+package main
+
+// Scoped API keys. Besides the credentials in the config, which can do
+// anything their access level allows, operators can hand out API keys limited
+// to some buckets (with "" standing for the default store and "*" for all of
+// them), to reading or to reading and writing, and optionally with their own
+// rate limit instead of rate_limit. They are managed with /admin/apikeys by a
+// configured read-write credential: POST creates a key and is the only time
+// its secret is shown, GET lists them and DELETE ?id= revokes one. Keys are
+// stored, as JSON under apikeys/<id>, in the _system bucket, which no request
+// can address directly, so they are written through Raft and replicated like
+// any other key; only a SHA-256 hash of the secret is kept. /buckets never
+// lists the bucket, and the endpoints spanning every bucket (/changes with
+// bucket=*, the replication snapshot) include it only for requests with
+// admin scope, so a replica needs a read-write replica_api_key to receive
+// the keys. A client presents
+// <id>.<secret> like any API key. Scoped keys reach only the endpoints that
+// work on one store (keys, /b/, /keys, /dump, /watch, /changes and the like),
+// never /admin/, /buckets, /stats, /metrics, pub/sub or replication. They are
+// only checked while authentication is on, that is while some credential is
+// configured; a proxy doesn't hold them and passes them on for its backends
+// to check only when it has no credentials of its own.
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	systemBucket  = "_system"
+	apiKeyPrefix  = "apikeys/"
+	maxAPIKeyBody = 64 << 10
+)
+
+// APIKey is a scoped API key as stored and listed. Hash never leaves the
+// server.
+type APIKey struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name,omitempty"`
+	Buckets   []string  `json:"buckets"` // "" is the default store, "*" every bucket
+	Access    string    `json:"access"`  // "read" or "write"
+	RateLimit float64   `json:"rate_limit,omitempty"`
+	RateBurst int       `json:"rate_burst,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	Hash      string    `json:"hash,omitempty"`
+}
+
+// NewAPIKey is the answer of POST /admin/apikeys, with the secret the client
+// presents.
+type NewAPIKey struct {
+	APIKey
+	Key string `json:"key"`
+}
+
+type apiKeyContext struct{}
+
+func (k *APIKey) access() access {
+	if k.Access == "write" {
+		return accessWrite
+	}
+	return accessRead
+}
+
+func (k *APIKey) allowsBucket(bucket string) bool {
+	return slices.Contains(k.Buckets, "*") && bucket != systemBucket || slices.Contains(k.Buckets, bucket)
+}
+
+// requestBucket is the bucket a request addresses, "" for the default store.
+func requestBucket(r *http.Request) string {
+	if rest, ok := strings.CutPrefix(r.URL.Path, "/b/"); ok {
+		bucket, _, _ := strings.Cut(rest, "/")
+		return bucket
+	}
+	return r.URL.Query().Get("bucket")
+}
+
+// scopedPath reports whether scoped keys may use path at all.
+func scopedPath(path string) bool {
+	switch path {
+	case "/buckets", "/stats", "/metrics", "/publish", "/subscribe":
+		return false
+	}
+	for _, prefix := range []string{"/admin/", "/debug/", "/replication/"} {
+		if strings.HasPrefix(path, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// permits returns why k may not make r, or "" if it may.
+func (k *APIKey) permits(r *http.Request) string {
+	switch {
+	case k.access() < requiredAccess(r):
+		return "forbidden: read-only credentials"
+	case !scopedPath(r.URL.Path):
+		return "forbidden: scoped API keys can't use " + r.URL.Path
+	case !k.allowsBucket(requestBucket(r)):
+		return "forbidden: API key has no access to this bucket"
+	}
+	return ""
+}
+
+// adminScope reports whether r was made with a configured read-write
+// credential, or with authentication off, as reaching _system requires.
+func adminScope(r *http.Request) bool {
+	if !requestConfig(r).authEnabled() {
+		return true
+	}
+	granted, scoped := requestAccess(r)
+	return granted == accessWrite && scoped == nil
+}
+
+// replicaScope reports whether r was made with a configured credential of
+// either access level, such as a replica's replica_api_key, or with
+// authentication off, as following the change log requires.
+func replicaScope(r *http.Request) bool {
+	if !requestConfig(r).authEnabled() {
+		return true
+	}
+	granted, scoped := requestAccess(r)
+	return granted >= accessRead && scoped == nil
+}
+
+// requestAPIKey returns the scoped key r was authenticated with, if any.
+func requestAPIKey(r *http.Request) *APIKey {
+	k, _ := r.Context().Value(apiKeyContext{}).(*APIKey)
+	return k
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// lookupAPIKey finds the scoped key presented as <id>.<secret>.
+func lookupAPIKey(presented string) *APIKey {
+	id, secret, ok := strings.Cut(presented, ".")
+	if !ok || id == "" || secret == "" {
+		return nil
+	}
+	k, err := readAPIKey(id)
+	if err != nil || subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(k.Hash)) != 1 {
+		return nil
+	}
+	return k
+}
+
+func readAPIKey(id string) (*APIKey, error) {
+	nodes, err := bucketNodes(systemBucket, false)
+	if err != nil {
+		return nil, err
+	}
+	n := getServerKey(apiKeyPrefix+id, nodes)
+	if n == nil {
+		return nil, ErrKeyNotFound
+	}
+	n.mu.RLock()
+	data, ok := n.node_store[apiKeyPrefix+id]
+	n.mu.RUnlock()
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	var k APIKey
+	if err := json.Unmarshal([]byte(data), &k); err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
+
+func listAPIKeys() []APIKey {
+	out := []APIKey{}
+	nodes, err := bucketNodes(systemBucket, false)
+	if err != nil {
+		return out
+	}
+	for _, n := range nodes {
+		n.mu.RLock()
+		for key, data := range n.node_store {
+			var k APIKey
+			if strings.HasPrefix(key, apiKeyPrefix) && json.Unmarshal([]byte(data), &k) == nil {
+				k.Hash = ""
+				out = append(out, k)
+			}
+		}
+		n.mu.RUnlock()
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+	return out
+}
+
+func (k *APIKey) validate() error {
+	if k.Access != "read" && k.Access != "write" {
+		return errors.New("access must be read or write")
+	}
+	if len(k.Buckets) == 0 {
+		return errors.New("buckets must list at least one bucket, \"\" for the default store or \"*\" for all")
+	}
+	for _, b := range k.Buckets {
+		if b != "" && b != "*" && (!validBucketName(b) || b == systemBucket) {
+			return fmt.Errorf("invalid bucket %q", b)
+		}
+	}
+	if k.RateLimit < 0 || k.RateBurst < 0 {
+		return errors.New("rate_limit and rate_burst cannot be negative")
+	}
+	return nil
+}
+
+// newAPIKeyID returns an ID no stored key has.
+func newAPIKeyID() string {
+	for {
+		var b [12]byte
+		rand.Read(b[:])
+		id := hex.EncodeToString(b[:])
+		if _, err := readAPIKey(id); errors.Is(err, ErrKeyNotFound) || errors.Is(err, ErrBucketNotFound) {
+			return id
+		}
+	}
+}
+
+// createAPIKey stores a new key with the scope of k.
+func createAPIKey(ctx context.Context, k APIKey) (NewAPIKey, error) {
+	var secret [32]byte
+	rand.Read(secret[:])
+	token := base64.RawURLEncoding.EncodeToString(secret[:])
+	k.ID = newAPIKeyID()
+	k.Hash = hashSecret(token)
+	k.CreatedAt = time.Now().UTC()
+	data, _ := json.Marshal(k)
+	nodes, err := bucketNodes(systemBucket, true)
+	if err != nil {
+		return NewAPIKey{}, err
+	}
+	if err := putTyped(ctx, apiKeyPrefix+k.ID, string(data), typeJSON, nodes); err != nil {
+		return NewAPIKey{}, err
+	}
+	k.Hash = ""
+	return NewAPIKey{APIKey: k, Key: k.ID + "." + token}, nil
+}
+
+// adminAPIKeysHandler serves GET, POST and DELETE /admin/apikeys.
+func adminAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if r.Method != http.MethodGet && r.Method != http.MethodHead && replica != nil {
+		writeError(w, r, http.StatusForbidden, codeReadOnly, "read-only replica; manage API keys on "+replica.primary)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		writeJSON(w, listAPIKeys())
+
+	case http.MethodPost:
+		if !requestConfig(r).authEnabled() {
+			writeError(w, r, http.StatusConflict, codeBadRequest, "scoped API keys only apply while authentication is on; configure api_keys_rw or basic_auth_rw first")
+			return
+		}
+		var k APIKey
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAPIKeyBody)).Decode(&k); err != nil {
+			writeError(w, r, http.StatusBadRequest, codeBadRequest, "invalid JSON")
+			return
+		}
+		if err := k.validate(); err != nil {
+			writeError(w, r, http.StatusBadRequest, codeBadRequest, err.Error())
+			return
+		}
+		created, err := createAPIKey(r.Context(), k)
+		if err != nil {
+			writeStoreError(w, r, err)
+			return
+		}
+		writeJSON(w, created)
+
+	case http.MethodDelete:
+		id := r.URL.Query().Get("id")
+		if _, err := readAPIKey(id); err != nil || id == "" {
+			writeError(w, r, http.StatusNotFound, codeKeyNotFound, "API key not found")
+			return
+		}
+		nodes, err := bucketNodes(systemBucket, false)
+		if err == nil {
+			err = deleteVal(r.Context(), apiKeyPrefix+id, nodes)
+		}
+		if err != nil {
+			writeStoreError(w, r, err)
+			return
+		}
+		writeMessage(w, r, "API key revoked")
+
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST, DELETE")
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestAPIKeysIgnoreLimits checks that quotas and max_store_bytes, which are
+// meant for user data, never stop credentials from being created.
+func TestAPIKeysIgnoreLimits(t *testing.T) {
+	withTestConfig(t, func(c *Config) {
+		c.APIKeysRW = []string{"rw-secret"}
+		c.BucketQuotas = map[string]int64{"*": 1}
+		c.MaxStoreBytes = 1
+	})
+	admin := func(method string, target string, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r.Header.Set("Authorization", "Bearer rw-secret")
+		w := httptest.NewRecorder()
+		test_handler.ServeHTTP(w, r)
+		return w
+	}
+	ids := map[string]bool{}
+	for range 3 {
+		var created NewAPIKey
+		w := admin(http.MethodPost, "/admin/apikeys", `{"buckets":["*"],"access":"read"}`)
+		if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil || created.ID == "" {
+			t.Fatalf("creating a key over the limits: %d %s", w.Code, w.Body)
+		}
+		if ids[created.ID] {
+			t.Fatalf("key ID %s issued twice", created.ID)
+		}
+		ids[created.ID] = true
+		t.Cleanup(func() { admin(http.MethodDelete, "/admin/apikeys?id="+created.ID, "") })
+	}
+}
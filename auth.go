@@ -0,0 +1,124 @@
+package main
+
+// Authentication for the HTTP API. Clients present either an API key
+// (Authorization: Bearer <key> or X-API-Key) or HTTP basic auth. Read-only
+// credentials may only read; writes and /admin/ need read-write credentials.
+// API keys may also be scoped ones created at runtime (see apikeys.go). When
+// no credentials are configured the API stays open. Either way the _system
+// bucket is reserved for the server and can't be addressed by requests.
+
+import (
+	"context"
+	"crypto/subtle"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+type access int
+
+const (
+	accessNone access = iota
+	accessRead
+	accessWrite
+)
+
+func (c *Config) authEnabled() bool {
+	return len(c.APIKeysRW)+len(c.APIKeysRO)+len(c.BasicAuthRW)+len(c.BasicAuthRO) > 0
+}
+
+// credentialIn reports whether secret matches one of the configured values,
+// comparing every entry in constant time.
+func credentialIn(secret string, allowed []string) bool {
+	found := 0
+	for _, a := range allowed {
+		found |= subtle.ConstantTimeCompare([]byte(secret), []byte(a))
+	}
+	return found == 1
+}
+
+// requestAccess resolves the access level granted by the request
+// credentials, along with the scoped key they are if so.
+func requestAccess(r *http.Request) (access, *APIKey) {
+	c := requestConfig(r)
+	key := r.Header.Get("X-API-Key")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		key = strings.TrimPrefix(auth, "Bearer ")
+	}
+	if key != "" {
+		switch {
+		case credentialIn(key, c.APIKeysRW):
+			return accessWrite, nil
+		case credentialIn(key, c.APIKeysRO):
+			return accessRead, nil
+		}
+		if k := lookupAPIKey(key); k != nil {
+			return k.access(), k
+		}
+		return accessNone, nil
+	}
+
+	if user, pass, ok := r.BasicAuth(); ok {
+		pair := user + ":" + pass
+		switch {
+		case credentialIn(pair, c.BasicAuthRW):
+			return accessWrite, nil
+		case credentialIn(pair, c.BasicAuthRO):
+			return accessRead, nil
+		}
+	}
+	return accessNone, nil
+}
+
+// requiredAccess classifies a request as a read or a write.
+func requiredAccess(r *http.Request) access {
+	switch {
+	case r.URL.Path == "/put", r.URL.Path == "/delete":
+		return accessWrite
+	case strings.HasPrefix(r.URL.Path, "/admin/"):
+		return accessWrite
+	case strings.HasPrefix(r.URL.Path, "/debug/"): // Where net/http/pprof registers itself too
+		return accessWrite
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return accessRead
+	}
+	return accessWrite
+}
+
+func authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := requestConfig(r)
+		if requestBucket(r) == systemBucket {
+			writeError(w, r, http.StatusForbidden, codeForbidden, "forbidden: the "+systemBucket+" bucket is reserved")
+			return
+		}
+		if !c.authEnabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		granted, scoped := requestAccess(r)
+		if granted == accessNone {
+			if len(c.BasicAuthRW)+len(c.BasicAuthRO) > 0 {
+				w.Header().Set("WWW-Authenticate", `Basic realm="kvstore"`)
+			}
+			writeError(w, r, http.StatusUnauthorized, codeUnauthorized, "unauthorized")
+			return
+		}
+		if granted < requiredAccess(r) {
+			slog.Debug("write rejected for read-only credentials", "method", r.Method, "path", r.URL.Path)
+			writeError(w, r, http.StatusForbidden, codeForbidden, "forbidden: read-only credentials")
+			return
+		}
+		if scoped != nil {
+			if reason := scoped.permits(r); reason != "" {
+				slog.Debug("request outside API key scope", "key", scoped.ID, "method", r.Method, "path", r.URL.Path)
+				writeError(w, r, http.StatusForbidden, codeForbidden, reason)
+				return
+			}
+			r = r.WithContext(context.WithValue(r.Context(), apiKeyContext{}, scoped))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,386 @@
+package main
+
+// Backups to S3-compatible object storage, for nodes whose disks don't
+// outlive them. With backup_url=s3://bucket/prefix a full backup of every
+// store is uploaded every backup_interval, and every
+// backup_incremental_interval an incremental one holding the change log
+// records (see changelog.go) since the previous backup, plus a last one on
+// shutdown. Objects are named
+//
+//	<prefix>/<time>-full-<seq>.json.gz              a Snapshot up to change seq
+//	<prefix>/<time>-incr-<first>-<last>.ndjson.gz   changes first to last
+//
+// so they sort in the order they were taken. An incremental backup becomes a
+// full one when there is no full backup since startup yet, or the change log
+// no longer has the records it needs, which in memory mode is whenever
+// anything changed.
+//
+// restore_from=s3://bucket/prefix restores the newest full backup under
+// prefix on startup, then replays the incremental backups taken after it;
+// naming a full backup object restores that one instead. The restore is
+// skipped when the stores already hold keys, so a node that kept its disk
+// keeps its newer data.
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const backupTimeFormat = "20060102T150405.000Z"
+
+var errNoBackup = errors.New("no full backup found")
+
+// errNothingToBackUp means nothing changed since the previous backup.
+var errNothingToBackUp = errors.New("nothing changed since the last backup")
+
+type BackupInfo struct {
+	Key      string    `json:"key"`
+	Full     bool      `json:"full"`
+	FirstSeq uint64    `json:"first_seq,omitempty"` // First change of an incremental backup
+	Seq      uint64    `json:"seq"`                 // Last change included
+	Bytes    int       `json:"bytes"`
+	Time     time.Time `json:"time"`
+}
+
+type BackupStatus struct {
+	URL       string      `json:"url"`
+	Last      *BackupInfo `json:"last,omitempty"`
+	LastFull  *BackupInfo `json:"last_full,omitempty"`
+	LastError string      `json:"last_error,omitempty"`
+}
+
+type backupper struct {
+	s3     *s3Client
+	bucket string
+	prefix string // Ends in / unless empty
+
+	mu     sync.Mutex // Held for the whole of a backup
+	seq    uint64     // Last change in the previous backup
+	based  bool       // A full backup was taken, so incremental ones can follow
+	status BackupStatus
+}
+
+// backups is set when backup_url is.
+var backups *backupper
+
+func newBackupper() (*backupper, error) {
+	bucket, prefix, err := parseS3URL(cfg().BackupURL)
+	if err != nil {
+		return nil, err
+	}
+	s3, err := newS3Client()
+	if err != nil {
+		return nil, err
+	}
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return &backupper{s3: s3, bucket: bucket, prefix: prefix, status: BackupStatus{URL: cfg().BackupURL}}, nil
+}
+
+// run takes backups on schedule until ctx is done.
+func (b *backupper) run(ctx context.Context) {
+	full := time.NewTicker(cfg().BackupInterval)
+	defer full.Stop()
+	var incremental <-chan time.Time
+	if cfg().BackupIncrementalInterval > 0 {
+		t := time.NewTicker(cfg().BackupIncrementalInterval)
+		defer t.Stop()
+		incremental = t.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-full.C:
+			b.backup(ctx, true)
+		case <-incremental:
+			b.backup(ctx, false)
+		}
+	}
+}
+
+// backup takes a full or incremental backup, recording the outcome.
+func (b *backupper) backup(ctx context.Context, full bool) (BackupInfo, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var info BackupInfo
+	var err error
+	if !full && b.based {
+		info, err = b.incremental(ctx)
+		if errors.Is(err, ErrChangesTrimmed) {
+			slog.Warn("change log no longer has the changes since the last backup; taking a full backup", "seq", b.seq)
+			full = true
+		}
+	} else {
+		full = true
+	}
+	if full {
+		info, err = b.full(ctx)
+	}
+
+	switch {
+	case errors.Is(err, errNothingToBackUp):
+		slog.Debug("backup skipped", "error", err)
+	case err != nil:
+		metrics.backupErrors.Add(1)
+		b.status.LastError = err.Error()
+		slog.Error("backup failed", "full", full, "error", err)
+	default:
+		metrics.backups.Add(1)
+		b.status.Last, b.status.LastError = &info, ""
+		if info.Full {
+			b.status.LastFull = &info
+		}
+		slog.Info("backup uploaded", "key", info.Key, "full", info.Full, "seq", info.Seq, "bytes", info.Bytes)
+	}
+	return info, err
+}
+
+func (b *backupper) full(ctx context.Context) (BackupInfo, error) {
+	snap := snapshot()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(zw).Encode(snap); err != nil {
+		return BackupInfo{}, err
+	}
+	if err := zw.Close(); err != nil {
+		return BackupInfo{}, err
+	}
+	now := time.Now().UTC()
+	info := BackupInfo{
+		Key:   b.prefix + now.Format(backupTimeFormat) + "-full-" + strconv.FormatUint(snap.Seq, 10) + ".json.gz",
+		Full:  true,
+		Seq:   snap.Seq,
+		Bytes: buf.Len(),
+		Time:  now,
+	}
+	if err := b.s3.put(ctx, b.bucket, info.Key, buf.Bytes(), "application/gzip"); err != nil {
+		return BackupInfo{}, err
+	}
+	b.seq, b.based = snap.Seq, true
+	return info, nil
+}
+
+func (b *backupper) incremental(ctx context.Context) (BackupInfo, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	enc := json.NewEncoder(zw)
+	first, seq := uint64(0), b.seq
+	for {
+		page, err := changes.since(seq, maxChanges, func(ChangeEvent) bool { return true })
+		if err != nil {
+			return BackupInfo{}, err
+		}
+		for _, ev := range page.Changes {
+			if first == 0 {
+				first = ev.Seq
+			}
+			if err := enc.Encode(ev); err != nil {
+				return BackupInfo{}, err
+			}
+		}
+		if len(page.Changes) == 0 || page.Next >= page.LastSeq {
+			seq = page.Next
+			break
+		}
+		seq = page.Next
+	}
+	if first == 0 {
+		return BackupInfo{}, errNothingToBackUp
+	}
+	if err := zw.Close(); err != nil {
+		return BackupInfo{}, err
+	}
+	now := time.Now().UTC()
+	info := BackupInfo{
+		Key:      fmt.Sprintf("%s%s-incr-%d-%d.ndjson.gz", b.prefix, now.Format(backupTimeFormat), first, seq),
+		FirstSeq: first,
+		Seq:      seq,
+		Bytes:    buf.Len(),
+		Time:     now,
+	}
+	if err := b.s3.put(ctx, b.bucket, info.Key, buf.Bytes(), "application/gzip"); err != nil {
+		return BackupInfo{}, err
+	}
+	b.seq = seq
+	return info, nil
+}
+
+// final uploads the changes since the last backup on shutdown.
+func (b *backupper) final() error {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg().ShutdownTimeout)
+	defer cancel()
+	if _, err := b.backup(ctx, false); err != nil && !errors.Is(err, errNothingToBackUp) {
+		return err
+	}
+	return nil
+}
+
+func (b *backupper) currentStatus() BackupStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.status
+}
+
+// parseBackupName reports whether name is a backup object and which changes
+// it holds: up to last for a full backup, first to last for an incremental.
+func parseBackupName(name string) (full bool, first uint64, last uint64, ok bool) {
+	name = name[strings.LastIndex(name, "/")+1:]
+	parts := strings.Split(name, "-")
+	var err1, err2 error
+	switch {
+	case len(parts) == 3 && parts[1] == "full" && strings.HasSuffix(parts[2], ".json.gz"):
+		last, err1 = strconv.ParseUint(strings.TrimSuffix(parts[2], ".json.gz"), 10, 64)
+		return true, 0, last, err1 == nil
+	case len(parts) == 4 && parts[1] == "incr" && strings.HasSuffix(parts[3], ".ndjson.gz"):
+		first, err1 = strconv.ParseUint(parts[2], 10, 64)
+		last, err2 = strconv.ParseUint(strings.TrimSuffix(parts[3], ".ndjson.gz"), 10, 64)
+		return false, first, last, err1 == nil && err2 == nil
+	}
+	return false, 0, 0, false
+}
+
+// restoreBackup restores the stores from restore_from unless they already
+// hold keys.
+func restoreBackup(ctx context.Context) error {
+	if n := count("", allNodes()); n > 0 {
+		slog.Info("stores are not empty; skipping restore", "keys", n, "restore_from", cfg().RestoreFrom)
+		return nil
+	}
+	s3, err := newS3Client()
+	if err != nil {
+		return err
+	}
+	bucket, key, err := parseS3URL(cfg().RestoreFrom)
+	if err != nil {
+		return err
+	}
+	prefix, start := key, ""
+	if full, _, _, ok := parseBackupName(key); ok && full {
+		prefix, start = key[:strings.LastIndex(key, "/")+1], key
+	} else if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	all, err := s3.list(ctx, bucket, prefix)
+	if err != nil {
+		return err
+	}
+	var names []string // Backups directly under prefix
+	for _, name := range all {
+		if _, _, _, ok := parseBackupName(name); ok && !strings.Contains(name[len(prefix):], "/") {
+			names = append(names, name)
+		}
+	}
+	if start == "" {
+		for _, name := range names {
+			if full, _, _, _ := parseBackupName(name); full {
+				start = name // Names sort by time, so the last one wins
+			}
+		}
+		if start == "" {
+			return fmt.Errorf("%w under s3://%s/%s", errNoBackup, bucket, prefix)
+		}
+	}
+
+	var snap Snapshot
+	if err := readBackupObject(ctx, s3, bucket, start, func(dec *json.Decoder) error { return dec.Decode(&snap) }); err != nil {
+		return fmt.Errorf("%s: %w", start, err)
+	}
+	if err := restoreSnapshot(snap); err != nil {
+		return err
+	}
+	seq, replayed := snap.Seq, 0
+	for _, name := range names {
+		full, first, last, _ := parseBackupName(name)
+		if full || name <= start || last <= seq {
+			continue
+		}
+		if first > seq+1 {
+			slog.Warn("incremental backups have a gap; restoring up to it", "seq", seq, "next", name)
+			break
+		}
+		err := readBackupObject(ctx, s3, bucket, name, func(dec *json.Decoder) error {
+			for {
+				var ev ChangeEvent
+				if err := dec.Decode(&ev); errors.Is(err, io.EOF) {
+					return nil
+				} else if err != nil {
+					return err
+				}
+				if ev.Seq <= seq {
+					continue
+				}
+				if err := applyChange(ev); err != nil {
+					return err
+				}
+				seq = ev.Seq
+			}
+		})
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		replayed++
+	}
+	slog.Info("restored from backup", "full", start, "incremental", replayed, "seq", seq, "stores", len(snap.Stores))
+	return nil
+}
+
+// readBackupObject calls read with a decoder of the gzipped JSON object key.
+func readBackupObject(ctx context.Context, s3 *s3Client, bucket string, key string, read func(*json.Decoder) error) error {
+	body, err := s3.get(ctx, bucket, key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	zr, err := gzip.NewReader(body)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	return read(json.NewDecoder(zr))
+}
+
+// adminBackupHandler serves GET /admin/backup, the backup status, and POST
+// /admin/backup[?full=true], which takes a backup now.
+func adminBackupHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.Header().Set("Allow", "GET, POST")
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+	if backups == nil {
+		writeError(w, r, http.StatusNotFound, codeBackupsDisabled, "backups are not enabled; set backup_url")
+		return
+	}
+	if r.Method == http.MethodGet {
+		writeJSON(w, backups.currentStatus())
+		return
+	}
+	full, err := strconv.ParseBool(r.URL.Query().Get("full"))
+	if err != nil && r.URL.Query().Has("full") {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "full must be true or false")
+		return
+	}
+	info, err := backups.backup(r.Context(), full)
+	if errors.Is(err, errNothingToBackUp) {
+		writeMessage(w, r, err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, r, http.StatusBadGateway, codeBackupFailed, err.Error())
+		return
+	}
+	writeJSON(w, info)
+}
@@ -0,0 +1,395 @@
+package main
+
+// kvstore bench: a load generator. It drives a mix of reads and writes from
+// -concurrency workers for -duration (or -ops operations in total), then
+// reports throughput and latency percentiles per operation. With -target it
+// talks to a running server over HTTP; without one it runs against an
+// in-process store opened in a temporary data directory, configured by any
+// server flags given after --, e.g.
+//
+//	kvstore bench -read-ratio 0.5 -value-size 100-4000 -- -sync-policy interval
+//
+// Keys are preloaded before the clock starts so reads hit.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type benchConfig struct {
+	target      string
+	apiKey      string
+	duration    time.Duration
+	ops         int64
+	concurrency int
+	readRatio   float64
+	keys        int
+	keySize     int
+	valueMin    int
+	valueMax    int
+	zipf        bool
+	preload     bool
+}
+
+// benchClient is the store under test.
+type benchClient interface {
+	get(key string) error
+	put(key string, value string) error
+	load(values map[string]string) error
+}
+
+type benchResult struct {
+	reads  []time.Duration
+	writes []time.Duration
+	errors int
+}
+
+func parseBenchFlags(args []string) (*benchConfig, []string, error) {
+	c := &benchConfig{}
+	var valueSize, dist string
+	fs := flag.NewFlagSet("kvstore bench", flag.ContinueOnError)
+	fs.StringVar(&c.target, "target", "", "base URL of a running server, e.g. http://localhost:8090; empty for an in-process store")
+	fs.StringVar(&c.apiKey, "api-key", "", "API key sent with every HTTP request")
+	fs.DurationVar(&c.duration, "duration", 10*time.Second, "how long to run, unless -ops is set")
+	fs.Int64Var(&c.ops, "ops", 0, "total operations to run instead of a fixed duration")
+	fs.IntVar(&c.concurrency, "concurrency", 8, "concurrent workers")
+	fs.Float64Var(&c.readRatio, "read-ratio", 0.9, "share of operations that are reads, 0 to 1")
+	fs.IntVar(&c.keys, "keys", 10000, "number of distinct keys")
+	fs.IntVar(&c.keySize, "key-size", 16, "key length in bytes")
+	fs.StringVar(&valueSize, "value-size", "128", "value length in bytes, or MIN-MAX for a uniform spread")
+	fs.StringVar(&dist, "key-dist", "uniform", "key popularity: uniform or zipf")
+	fs.BoolVar(&c.preload, "preload", true, "write every key once before starting")
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	lo, hi, found := strings.Cut(valueSize, "-")
+	var err1, err2 error
+	c.valueMin, err1 = strconv.Atoi(lo)
+	c.valueMax = c.valueMin
+	if found {
+		c.valueMax, err2 = strconv.Atoi(hi)
+	}
+	var errs []error
+	if err1 != nil || err2 != nil || c.valueMin < 0 || c.valueMax < c.valueMin {
+		errs = append(errs, fmt.Errorf("invalid -value-size %q", valueSize))
+	}
+	switch dist {
+	case "uniform":
+	case "zipf":
+		c.zipf = true
+	default:
+		errs = append(errs, fmt.Errorf("-key-dist must be uniform or zipf, not %q", dist))
+	}
+	if c.concurrency <= 0 {
+		errs = append(errs, errors.New("-concurrency must be positive"))
+	}
+	if c.readRatio < 0 || c.readRatio > 1 {
+		errs = append(errs, errors.New("-read-ratio must be between 0 and 1"))
+	}
+	if c.keys <= 0 || c.keySize <= 0 {
+		errs = append(errs, errors.New("-keys and -key-size must be positive"))
+	}
+	if c.ops <= 0 && c.duration <= 0 {
+		errs = append(errs, errors.New("one of -ops or -duration must be positive"))
+	}
+	return c, fs.Args(), errors.Join(errs...)
+}
+
+// runBench runs the bench subcommand and returns the process exit code.
+func runBench(args []string) int {
+	bc, serverArgs, err := parseBenchFlags(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return 0
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "invalid bench configuration:", err)
+		return 2
+	}
+
+	var client benchClient
+	if bc.target != "" {
+		client = newHTTPBenchClient(bc)
+	} else {
+		local, cleanup, err := newLocalBenchClient(serverArgs)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "failed to open store:", err)
+			return 1
+		}
+		defer cleanup()
+		client = local
+	}
+
+	keys := make([]string, bc.keys)
+	for i := range keys {
+		keys[i] = benchKey(i, bc.keySize)
+	}
+	if bc.preload {
+		start := time.Now()
+		if err := preload(client, bc, keys); err != nil {
+			fmt.Fprintln(os.Stderr, "preload failed:", err)
+			return 1
+		}
+		fmt.Printf("preloaded %d keys in %v\n", len(keys), time.Since(start).Round(time.Millisecond))
+	}
+
+	start := time.Now()
+	res := drive(client, bc, keys)
+	elapsed := time.Since(start)
+	report(os.Stdout, bc, res, elapsed)
+	if res.errors > 0 && len(res.reads)+len(res.writes) == 0 {
+		return 1
+	}
+	return 0
+}
+
+// benchKey pads i to size bytes so every key has the same length.
+func benchKey(i int, size int) string {
+	k := strconv.Itoa(i)
+	if len(k) >= size {
+		return k
+	}
+	return strings.Repeat("k", size-len(k)) + k
+}
+
+func benchValue(rng *rand.Rand, bc *benchConfig) string {
+	n := bc.valueMin
+	if bc.valueMax > bc.valueMin {
+		n += rng.IntN(bc.valueMax - bc.valueMin + 1)
+	}
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = 'a' + byte(rng.IntN(26))
+	}
+	return string(b)
+}
+
+func preload(client benchClient, bc *benchConfig, keys []string) error {
+	rng := rand.New(rand.NewPCG(0, 0))
+	batch := make(map[string]string, importBatchSize)
+	for _, k := range keys {
+		batch[k] = benchValue(rng, bc)
+		if len(batch) == importBatchSize {
+			if err := client.load(batch); err != nil {
+				return err
+			}
+			clear(batch)
+		}
+	}
+	if len(batch) == 0 {
+		return nil
+	}
+	return client.load(batch)
+}
+
+// drive runs the workers and collects every latency.
+func drive(client benchClient, bc *benchConfig, keys []string) benchResult {
+	deadline := time.Now().Add(bc.duration)
+	var issued atomic.Int64
+	results := make([]benchResult, bc.concurrency)
+	var wg sync.WaitGroup
+	for w := range bc.concurrency {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rng := rand.New(rand.NewPCG(uint64(w), uint64(time.Now().UnixNano())))
+			var zipf *rand.Zipf
+			if bc.zipf {
+				zipf = rand.NewZipf(rng, 1.1, 1, uint64(len(keys)-1))
+			}
+			res := &results[w]
+			for {
+				if bc.ops > 0 {
+					if issued.Add(1) > bc.ops {
+						return
+					}
+				} else if time.Now().After(deadline) {
+					return
+				}
+				var key string
+				if zipf != nil {
+					key = keys[zipf.Uint64()]
+				} else {
+					key = keys[rng.IntN(len(keys))]
+				}
+				read := rng.Float64() < bc.readRatio
+				var value string
+				if !read {
+					value = benchValue(rng, bc)
+				}
+
+				start := time.Now()
+				var err error
+				if read {
+					err = client.get(key)
+				} else {
+					err = client.put(key, value)
+				}
+				took := time.Since(start)
+				switch {
+				case err != nil && !errors.Is(err, ErrKeyNotFound):
+					res.errors++
+				case read:
+					res.reads = append(res.reads, took)
+				default:
+					res.writes = append(res.writes, took)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	var all benchResult
+	for _, r := range results {
+		all.reads = append(all.reads, r.reads...)
+		all.writes = append(all.writes, r.writes...)
+		all.errors += r.errors
+	}
+	return all
+}
+
+func report(w io.Writer, bc *benchConfig, res benchResult, elapsed time.Duration) {
+	target := bc.target
+	if target == "" {
+		target = "in-process store"
+	}
+	total := len(res.reads) + len(res.writes)
+	fmt.Fprintf(w, "target: %s, concurrency: %d, keys: %d, read ratio: %.2f\n", target, bc.concurrency, bc.keys, bc.readRatio)
+	fmt.Fprintf(w, "%d ops in %v: %.0f ops/s, %d errors\n", total, elapsed.Round(time.Millisecond), float64(total)/elapsed.Seconds(), res.errors)
+	fmt.Fprintf(w, "%-6s %10s %10s %10s %10s %10s %10s\n", "op", "count", "p50", "p90", "p99", "p99.9", "max")
+	for _, op := range []struct {
+		name string
+		lat  []time.Duration
+	}{{"read", res.reads}, {"write", res.writes}} {
+		if len(op.lat) == 0 {
+			continue
+		}
+		sort.Slice(op.lat, func(i, j int) bool { return op.lat[i] < op.lat[j] })
+		pct := func(p float64) time.Duration {
+			return op.lat[min(int(p*float64(len(op.lat))), len(op.lat)-1)]
+		}
+		fmt.Fprintf(w, "%-6s %10d %10v %10v %10v %10v %10v\n", op.name, len(op.lat),
+			pct(0.5), pct(0.9), pct(0.99), pct(0.999), op.lat[len(op.lat)-1])
+	}
+}
+
+// localBenchClient calls the store directly, as the HTTP handlers do.
+type localBenchClient struct{}
+
+func (localBenchClient) get(key string) error {
+	_, err := get(context.Background(), key, server_nodes)
+	return err
+}
+
+func (localBenchClient) put(key string, value string) error {
+	return put(context.Background(), key, value, server_nodes)
+}
+
+func (localBenchClient) load(values map[string]string) error {
+	return putBatchLocal(context.Background(), values, server_nodes)
+}
+
+// newLocalBenchClient opens an in-process store in a temporary directory,
+// unless serverArgs name a data directory of their own.
+func newLocalBenchClient(serverArgs []string) (benchClient, func(), error) {
+	dir, err := os.MkdirTemp("", "kvstore-bench-")
+	if err != nil {
+		return nil, nil, err
+	}
+	c, err := loadConfig(append([]string{"-data-dir", dir, "-log-level", "warn"}, serverArgs...))
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, nil, err
+	}
+	live_cfg.Store(c)
+	log_level.Set(cfg().LogLevel)
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: log_level})))
+	if len(cfg().RaftPeers) > 0 || cfg().ReplicaOf != "" || cfg().Proxy {
+		os.RemoveAll(dir)
+		return nil, nil, errors.New("the in-process bench runs a single standalone store; use -target for clusters")
+	}
+	openStores()
+	cleanup := func() {
+		for _, n := range allNodes() {
+			n.mu.Lock()
+			n.closeSegments()
+			n.mu.Unlock()
+		}
+		os.RemoveAll(dir)
+	}
+	return localBenchClient{}, cleanup, nil
+}
+
+type httpBenchClient struct {
+	base   string
+	apiKey string
+	client *http.Client
+}
+
+func newHTTPBenchClient(bc *benchConfig) *httpBenchClient {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = bc.concurrency
+	return &httpBenchClient{
+		base:   strings.TrimSuffix(bc.target, "/"),
+		apiKey: bc.apiKey,
+		client: &http.Client{Transport: transport, Timeout: 30 * time.Second},
+	}
+}
+
+func (c *httpBenchClient) do(method string, path string, body string) error {
+	req, err := http.NewRequest(method, c.base+path, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if c.apiKey != "" {
+		req.Header.Set("X-API-Key", c.apiKey)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body) // Lets the connection be reused
+	switch {
+	case resp.StatusCode == http.StatusNotFound && method == http.MethodGet:
+		return ErrKeyNotFound
+	case resp.StatusCode/100 != 2:
+		return fmt.Errorf("%s %s: %s", method, path, resp.Status)
+	}
+	return nil
+}
+
+func (c *httpBenchClient) get(key string) error {
+	return c.do(http.MethodGet, "/"+url.PathEscape(key), "")
+}
+
+func (c *httpBenchClient) put(key string, value string) error {
+	body, _ := json.Marshal(struct {
+		Value string `json:"value"`
+	}{value})
+	return c.do(http.MethodPost, "/"+url.PathEscape(key), string(body))
+}
+
+func (c *httpBenchClient) load(values map[string]string) error {
+	var b strings.Builder
+	enc := json.NewEncoder(&b)
+	for k, v := range values {
+		enc.Encode(exportRecord{Key: k, Value: v})
+	}
+	return c.do(http.MethodPost, "/admin/import", b.String())
+}
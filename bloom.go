@@ -0,0 +1,176 @@
+package main
+
+// Optional bloom filter per node store (bloom_filter: true). get consults it
+// before taking the node lock, so lookups for keys that were never written
+// are answered without touching the store. Deletes can't clear bits, so the
+// filter is rebuilt from the live keys after every segment compaction. On
+// shutdown it is written to the store's segment directory along with a
+// fingerprint of the segments, and on startup it is loaded from there instead
+// of rehashing every key, as long as the fingerprint still matches.
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"math"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+const (
+	bloomBitsPerKey = 10 // About 1% false positives with bloomHashes
+	bloomHashes     = 7
+	bloomMinKeys    = 1024
+	bloomMagic      = 0x4b564246            // "KVBF"
+	bloomHeaderLen  = 4 + 4 + 8 + 4 + 8 + 8 // Magic, snapshot checksum, bits, hashes, count, capacity
+)
+
+type bloomFilter struct {
+	bits     []atomic.Uint64
+	m        uint64 // Number of bits
+	k        uint32
+	count    int // Keys added; only changed with the owning node's lock held
+	capacity int // Keys the filter was sized for
+}
+
+func newBloomFilter(capacity int) *bloomFilter {
+	capacity = max(capacity, bloomMinKeys)
+	words := (uint64(capacity)*bloomBitsPerKey + 63) / 64
+	return &bloomFilter{bits: make([]atomic.Uint64, words), m: words * 64, k: bloomHashes, capacity: capacity}
+}
+
+// bloomHash derives the two base hashes used for double hashing.
+func bloomHash(key string) (uint64, uint64) {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	return sum, sum>>33 | sum<<31 | 1
+}
+
+func (f *bloomFilter) add(key string) {
+	h1, h2 := bloomHash(key)
+	for i := uint64(0); i < uint64(f.k); i++ {
+		bit := (h1 + i*h2) % f.m
+		f.bits[bit/64].Or(1 << (bit % 64))
+	}
+	f.count++
+}
+
+// mayContain reports false only if key was never added. Safe to call
+// without the node lock.
+func (f *bloomFilter) mayContain(key string) bool {
+	h1, h2 := bloomHash(key)
+	for i := uint64(0); i < uint64(f.k); i++ {
+		bit := (h1 + i*h2) % f.m
+		if f.bits[bit/64].Load()&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *bloomFilter) sizeBytes() int64 {
+	return int64(len(f.bits)) * 8
+}
+
+func (f *bloomFilter) marshal(snapshotSum uint32) []byte {
+	p := make([]byte, bloomHeaderLen+len(f.bits)*8)
+	binary.LittleEndian.PutUint32(p[0:], bloomMagic)
+	binary.LittleEndian.PutUint32(p[4:], snapshotSum)
+	binary.LittleEndian.PutUint64(p[8:], f.m)
+	binary.LittleEndian.PutUint32(p[16:], f.k)
+	binary.LittleEndian.PutUint64(p[20:], uint64(f.count))
+	binary.LittleEndian.PutUint64(p[28:], uint64(f.capacity))
+	for i := range f.bits {
+		binary.LittleEndian.PutUint64(p[bloomHeaderLen+i*8:], f.bits[i].Load())
+	}
+	return frame(p)
+}
+
+func unmarshalBloom(data []byte) (*bloomFilter, uint32, error) {
+	p, n, err := decodeFrame(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	if n != int64(len(data)) || len(p) < bloomHeaderLen || binary.LittleEndian.Uint32(p[0:]) != bloomMagic {
+		return nil, 0, ErrCorruptRecord
+	}
+	f := &bloomFilter{
+		m:        binary.LittleEndian.Uint64(p[8:]),
+		k:        binary.LittleEndian.Uint32(p[16:]),
+		count:    int(binary.LittleEndian.Uint64(p[20:])),
+		capacity: int(binary.LittleEndian.Uint64(p[28:])),
+	}
+	if f.m == 0 || f.m%64 != 0 || f.m/64 != uint64(len(p)-bloomHeaderLen)/8 || f.k == 0 || f.count > math.MaxInt32 {
+		return nil, 0, ErrCorruptRecord
+	}
+	f.bits = make([]atomic.Uint64, f.m/64)
+	for i := range f.bits {
+		f.bits[i].Store(binary.LittleEndian.Uint64(p[bloomHeaderLen+i*8:]))
+	}
+	return f, binary.LittleEndian.Uint32(p[4:]), nil
+}
+
+func (n *ServerNode) bloomFile() string {
+	return filepath.Join(n.dir, "bloom")
+}
+
+// bloomAddLocked records key in the filter, growing it once it holds more
+// keys than it was sized for. Must be called with n.mu held.
+func (n *ServerNode) bloomAddLocked(key string) {
+	f := n.bloom.Load()
+	if f == nil {
+		return
+	}
+	if f.count >= f.capacity {
+		n.rebuildBloomLocked()
+		return
+	}
+	f.add(key)
+}
+
+// rebuildBloomLocked replaces the filter with one holding exactly the live
+// keys. Must be called with n.mu held.
+func (n *ServerNode) rebuildBloomLocked() {
+	if !cfg().BloomFilter {
+		return
+	}
+	f := newBloomFilter(2 * len(n.node_store))
+	for k := range n.node_store {
+		f.add(k)
+	}
+	n.bloom.Store(f)
+}
+
+// loadBloomLocked restores the filter saved for the segments whose
+// fingerprint is snapshotSum, rebuilding it when the file is missing or was
+// saved for different segments. Must be called with n.mu held.
+func (n *ServerNode) loadBloomLocked(snapshotSum uint32) {
+	if !cfg().BloomFilter {
+		return
+	}
+	if data, err := os.ReadFile(n.bloomFile()); err == nil {
+		f, sum, err := unmarshalBloom(data)
+		if err == nil && sum == snapshotSum && f.count == len(n.node_store) {
+			n.bloom.Store(f)
+			return
+		}
+	}
+	n.rebuildBloomLocked()
+}
+
+// saveBloomLocked rebuilds the filter, dropping deleted keys, and writes it
+// out for the segments whose fingerprint is snapshotSum. Must be called with
+// n.mu held.
+func (n *ServerNode) saveBloomLocked(snapshotSum uint32) error {
+	if !cfg().BloomFilter || read_only.Load() {
+		return nil
+	}
+	n.rebuildBloomLocked()
+	tmp := n.bloomFile() + ".tmp"
+	if err := os.WriteFile(tmp, n.bloom.Load().marshal(snapshotSum), 0o644); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, n.bloomFile())
+}
@@ -0,0 +1,174 @@
+package main
+
+// Reading BoltDB (bbolt) files for kvstore import, straight from the page
+// layout so no Bolt library is needed. The file is only read, using the
+// newer of its two meta pages, so it must not be open for writing while it
+// is imported.
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+)
+
+const (
+	boltMagic      = 0xED0CDAED
+	boltVersion    = 2
+	boltPageHeader = 16 // id, flags, count and overflow
+	boltElemSize   = 16 // Size of a branch or leaf page element
+	boltMaxDepth   = 64
+
+	boltBranchPage = 0x01
+	boltLeafPage   = 0x02
+	boltBucketLeaf = 0x01 // Leaf element holding a nested bucket
+)
+
+type boltFile struct {
+	f        *os.File
+	pageSize int
+}
+
+// readBolt calls emit with the bucket path, key and value of every key of the
+// BoltDB file at path.
+func readBolt(path string, emit func(buckets []string, key string, value string) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	bf := &boltFile{f: f}
+	root, err := bf.readMeta()
+	if err != nil {
+		return err
+	}
+	p, err := bf.page(root)
+	if err != nil {
+		return err
+	}
+	return bf.walk(p, nil, emit)
+}
+
+// readMeta returns the root page of the newer valid meta page.
+func (bf *boltFile) readMeta() (uint64, error) {
+	var root, txid uint64
+	found := false
+	for i := 0; i < 2; i++ {
+		buf := make([]byte, boltPageHeader+64)
+		off := int64(0)
+		if i == 1 {
+			if bf.pageSize == 0 {
+				break
+			}
+			off = int64(bf.pageSize)
+		}
+		if _, err := bf.f.ReadAt(buf, off); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return 0, err
+		}
+		m := buf[boltPageHeader:]
+		if binary.LittleEndian.Uint32(m[0:]) != boltMagic || binary.LittleEndian.Uint32(m[4:]) != boltVersion {
+			continue
+		}
+		h := fnv.New64a()
+		h.Write(m[:56])
+		if h.Sum64() != binary.LittleEndian.Uint64(m[56:]) {
+			continue
+		}
+		if bf.pageSize == 0 {
+			bf.pageSize = int(binary.LittleEndian.Uint32(m[8:]))
+			if bf.pageSize < 1024 || bf.pageSize > 1<<20 {
+				return 0, fmt.Errorf("bad page size %d", bf.pageSize)
+			}
+		}
+		if tx := binary.LittleEndian.Uint64(m[48:]); !found || tx > txid {
+			root, txid, found = binary.LittleEndian.Uint64(m[16:]), tx, true
+		}
+	}
+	if !found {
+		return 0, errors.New("not a BoltDB file, or both meta pages are corrupt")
+	}
+	return root, nil
+}
+
+// page reads page id along with its overflow pages.
+func (bf *boltFile) page(id uint64) ([]byte, error) {
+	off := int64(id) * int64(bf.pageSize)
+	hdr := make([]byte, boltPageHeader)
+	if _, err := bf.f.ReadAt(hdr, off); err != nil {
+		return nil, fmt.Errorf("page %d: %w", id, err)
+	}
+	overflow := binary.LittleEndian.Uint32(hdr[12:])
+	if overflow > 1<<20 {
+		return nil, fmt.Errorf("page %d: bad overflow count %d", id, overflow)
+	}
+	p := make([]byte, (int(overflow)+1)*bf.pageSize)
+	if _, err := bf.f.ReadAt(p, off); err != nil {
+		return nil, fmt.Errorf("page %d: %w", id, err)
+	}
+	return p, nil
+}
+
+// walk calls emit for every key below page p of the bucket at path.
+func (bf *boltFile) walk(p []byte, path []string, emit func([]string, string, string) error) error {
+	if len(path) > boltMaxDepth {
+		return errors.New("buckets nested too deeply")
+	}
+	if len(p) < boltPageHeader {
+		return errors.New("truncated page")
+	}
+	flags := binary.LittleEndian.Uint16(p[8:])
+	count := int(binary.LittleEndian.Uint16(p[10:]))
+	if boltPageHeader+count*boltElemSize > len(p) {
+		return errors.New("corrupt page")
+	}
+	for i := range count {
+		e := boltPageHeader + i*boltElemSize
+		switch {
+		case flags&boltBranchPage != 0:
+			child, err := bf.page(binary.LittleEndian.Uint64(p[e+8:]))
+			if err != nil {
+				return err
+			}
+			if err := bf.walk(child, path, emit); err != nil {
+				return err
+			}
+		case flags&boltLeafPage != 0:
+			elemFlags := binary.LittleEndian.Uint32(p[e:])
+			start := e + int(binary.LittleEndian.Uint32(p[e+4:]))
+			ksize := int(binary.LittleEndian.Uint32(p[e+8:]))
+			vsize := int(binary.LittleEndian.Uint32(p[e+12:]))
+			if ksize < 0 || vsize < 0 || start+ksize+vsize > len(p) {
+				return errors.New("corrupt leaf element")
+			}
+			key := string(p[start : start+ksize])
+			value := p[start+ksize : start+ksize+vsize]
+			if elemFlags&boltBucketLeaf == 0 {
+				if err := emit(path, key, string(value)); err != nil {
+					return err
+				}
+				continue
+			}
+			if len(value) < 16 {
+				return errors.New("corrupt bucket header")
+			}
+			child := value[16:] // Inline bucket
+			if root := binary.LittleEndian.Uint64(value); root != 0 {
+				var err error
+				if child, err = bf.page(root); err != nil {
+					return err
+				}
+			}
+			if err := bf.walk(child, append(path[:len(path):len(path)], key), emit); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unexpected page type %#x", flags)
+		}
+	}
+	return nil
+}
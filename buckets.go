@@ -0,0 +1,208 @@
+package main
+
+// Buckets give applications sharing a server their own key space. Each
+// bucket is a separate set of node stores kept in its own segment directory
+// (<node>@<bucket>.segments), so buckets never see each other's keys and can
+// be listed or dropped as a unit. Buckets are created on first write.
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const maxBucketNameLen = 64
+
+var ErrBucketNotFound = errors.New("bucket not found")
+var ErrInvalidBucket = errors.New("invalid bucket name")
+
+var (
+	bucket_mu    sync.RWMutex
+	bucket_nodes = make(map[string][]*ServerNode) // Bucket name -> one store per server node
+)
+
+type BucketInfo struct {
+	Name  string `json:"name"`
+	Keys  int    `json:"keys"`
+	Bytes int64  `json:"bytes"`
+	Quota int64  `json:"quota,omitempty"`
+}
+
+func validBucketName(name string) bool {
+	if name == "" || len(name) > maxBucketNameLen {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return name != "." && name != ".."
+}
+
+func newBucketNode(parent *ServerNode, bucket string) *ServerNode {
+	n := newServerNode(parent.name, cfg().DataDir) // Same name so con_hash routes keys as usual
+	n.bucket = bucket
+	n.dir = filepath.Join(cfg().DataDir, parent.name+"@"+bucket+segmentDirSuffix)
+	if cfg().Memory {
+		return n
+	}
+	go n.syncLoop()
+	if cfg().CheckpointInterval > 0 {
+		go n.checkpointLoop(cfg().CheckpointInterval)
+	}
+	return n
+}
+
+// loadBuckets opens every bucket found in the data directory, including
+// buckets still in the snapshot files of older versions.
+func loadBuckets() error {
+	bucket_mu.Lock()
+	defer bucket_mu.Unlock()
+	for i, parent := range server_nodes {
+		files, err := filepath.Glob(filepath.Join(cfg().DataDir, parent.name+"@*"))
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			name := strings.TrimPrefix(filepath.Base(f), parent.name+"@")
+			if base, ok := strings.CutSuffix(name, segmentDirSuffix); ok {
+				name = base
+			} else if base, ok := strings.CutSuffix(name, ".bin"); ok {
+				name = base
+			} else {
+				continue
+			}
+			if !validBucketName(name) {
+				continue
+			}
+			if _, ok := bucket_nodes[name]; ok && bucket_nodes[name][i].segs != nil {
+				continue // Both a segment directory and a leftover snapshot
+			}
+			if _, ok := bucket_nodes[name]; !ok {
+				bucket_nodes[name] = newBucketNodes(name)
+			}
+			if err := bucket_nodes[name][i].load(); err != nil {
+				slog.Error("failed to load bucket", "bucket", name, "node", parent.name, "error", err)
+			}
+		}
+	}
+	return nil
+}
+
+// bucketNodes returns the stores backing bucket, creating the bucket when
+// create is set.
+func bucketNodes(bucket string, create bool) ([]*ServerNode, error) {
+	if !validBucketName(bucket) {
+		return nil, ErrInvalidBucket
+	}
+	bucket_mu.RLock()
+	nodes, ok := bucket_nodes[bucket]
+	bucket_mu.RUnlock()
+	if ok {
+		return nodes, nil
+	}
+	if !create {
+		return nil, ErrBucketNotFound
+	}
+
+	bucket_mu.Lock()
+	defer bucket_mu.Unlock()
+	if nodes, ok := bucket_nodes[bucket]; ok {
+		return nodes, nil
+	}
+	nodes = newBucketNodes(bucket)
+	bucket_nodes[bucket] = nodes
+	slog.Info("bucket created", "bucket", bucket)
+	return nodes, nil
+}
+
+// dropBucket deletes bucket, through the Raft log when clustered.
+func dropBucket(ctx context.Context, bucket string) error {
+	if cluster != nil {
+		if !validBucketName(bucket) {
+			return ErrInvalidBucket
+		}
+		return cluster.apply(ctx, command{Op: "drop_bucket", Bucket: bucket})
+	}
+	return deleteBucket(bucket)
+}
+
+// deleteBucket drops every key in bucket and removes its files.
+func deleteBucket(bucket string) error {
+	if !validBucketName(bucket) {
+		return ErrInvalidBucket
+	}
+	bucket_mu.Lock()
+	nodes, ok := bucket_nodes[bucket]
+	delete(bucket_nodes, bucket)
+	bucket_mu.Unlock()
+	if !ok {
+		return ErrBucketNotFound
+	}
+
+	var errs []error
+	for _, n := range nodes {
+		n.mu.Lock()
+		n.node_store = make(map[string]string)
+		n.indexes = nil
+		n.rebuildUseLocked()
+		n.rebuildAccessLocked(keyStatsSnapshot{})
+		n.rebuildBloomLocked()
+		n.setSizeLocked(0)
+		n.dirty = false
+		n.dropped = true
+		if n.segs != nil {
+			n.segs.f.Close()
+		}
+		if !cfg().Memory {
+			if err := os.RemoveAll(n.dir); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		n.mu.Unlock()
+	}
+	clearReadCache()
+	errs = append(errs, changes.publish("drop_bucket", bucket, "", "", typeNone))
+	slog.Info("bucket deleted", "bucket", bucket)
+	return errors.Join(errs...)
+}
+
+func listBuckets() []BucketInfo {
+	bucket_mu.RLock()
+	defer bucket_mu.RUnlock()
+	out := make([]BucketInfo, 0, len(bucket_nodes))
+	for name, nodes := range bucket_nodes {
+		info := BucketInfo{Name: name, Quota: bucketQuota(cfg(), name)}
+		for _, n := range nodes {
+			n.mu.RLock()
+			info.Keys += len(n.node_store)
+			info.Bytes += n.size
+			n.mu.RUnlock()
+		}
+		out = append(out, info)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// allNodes returns the default node stores followed by every bucket store.
+func allNodes() []*ServerNode {
+	bucket_mu.RLock()
+	defer bucket_mu.RUnlock()
+	out := append([]*ServerNode{}, server_nodes...)
+	names := make([]string, 0, len(bucket_nodes))
+	for name := range bucket_nodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		out = append(out, bucket_nodes[name]...)
+	}
+	return out
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+// TestWriteToDroppedBucket checks that a write holding the stores of a bucket
+// dropped under it fails instead of landing in a store nothing reads.
+func TestWriteToDroppedBucket(t *testing.T) {
+	const bucket = "dropped-under-write"
+	nodes, err := bucketNodes(bucket, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := put(context.Background(), "k", "v", nodes); err != nil {
+		t.Fatal(err)
+	}
+	if w := do(http.MethodDelete, "/b/"+bucket, ""); w.Code != http.StatusOK {
+		t.Fatalf("DELETE bucket: %d %s", w.Code, w.Body)
+	}
+	if err := put(context.Background(), "k2", "v", nodes); !errors.Is(err, ErrBucketNotFound) {
+		t.Fatalf("put to a dropped bucket's store: %v, want %v", err, ErrBucketNotFound)
+	}
+	if err := putBatchLocal(context.Background(), map[string]string{"a": "1"}, nodes); !errors.Is(err, ErrBucketNotFound) {
+		t.Fatalf("batch to a dropped bucket's store: %v, want %v", err, ErrBucketNotFound)
+	}
+}
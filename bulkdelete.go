@@ -0,0 +1,110 @@
+package main
+
+// Bulk deletes. DELETE /keys?prefix=p[&bucket=b] deletes every key starting
+// with p, taking each node's lock once and syncing its segments once rather
+// than once per key; with dry_run=true it only counts them. The prefix can't
+// be empty, so a missing parameter doesn't wipe the store.
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type DeleteResult struct {
+	Deleted int  `json:"deleted"` // Keys deleted, or that would be with dry_run
+	DryRun  bool `json:"dry_run,omitempty"`
+}
+
+func deletePrefix(ctx context.Context, prefix string, nodes []*ServerNode) (deleted int, err error) {
+	ctx, span := startOp(ctx, "delete_prefix", prefix, nodes)
+	defer func() { recordOp("delete_prefix", err); endSpan(span, err) }()
+	if cluster != nil {
+		step := startStep(ctx, "raft.apply")
+		res, err := cluster.applyResponse(ctx, command{Op: "delete_prefix", Bucket: nodes[0].bucket, Key: prefix})
+		endSpan(step, err)
+		deleted, _ = res.(int)
+		return deleted, err
+	}
+	return deletePrefixLocal(ctx, prefix, nodes)
+}
+
+// deletePrefixLocal tombstones the keys of nodes starting with prefix.
+func deletePrefixLocal(ctx context.Context, prefix string, nodes []*ServerNode) (int, error) {
+	deleted := 0
+	var errs []error
+	for _, n := range nodes {
+		lock := startStep(ctx, "store.lock_wait")
+		err := n.lockCtx(ctx)
+		endSpan(lock, err)
+		if err != nil {
+			errs = append(errs, err)
+			break
+		}
+		before := deleted
+		write := startStep(ctx, "store.write")
+		for k, v := range n.node_store {
+			if !strings.HasPrefix(k, prefix) {
+				continue
+			}
+			// The deletes of a node replay all or none after a crash
+			if deleted == before {
+				if err = n.beginGroupLocked(); err != nil {
+					break
+				}
+			}
+			if err = n.appendLocked(opDelete, k, "", typeNone); err != nil {
+				break
+			}
+			err = n.removeLocked(k, v)
+			deleted++
+			if err != nil {
+				break
+			}
+		}
+		err = errors.Join(err, n.commitGroupLocked())
+		endSpan(write, err)
+		errs = append(errs, err)
+		if deleted > before {
+			errs = append(errs, n.persistTraced(ctx))
+		}
+		n.mu.Unlock()
+		if err != nil {
+			break
+		}
+	}
+	return deleted, errors.Join(errs...)
+}
+
+// deletePrefixHandler serves DELETE /keys.
+func deletePrefixHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("prefix") == "" {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "prefix is required and cannot be empty")
+		return
+	}
+	prefix, ok := requestPrefix(w, r)
+	if !ok {
+		return
+	}
+	dryRun, err := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+	if err != nil && r.URL.Query().Has("dry_run") {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "dry_run must be true or false")
+		return
+	}
+	nodes, ok := requestNodes(w, r, false)
+	if !ok {
+		return
+	}
+	if dryRun {
+		writeJSON(w, DeleteResult{Deleted: count(prefix, nodes), DryRun: true})
+		return
+	}
+	deleted, err := deletePrefix(r.Context(), prefix, nodes)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	writeJSON(w, DeleteResult{Deleted: deleted})
+}
@@ -0,0 +1,144 @@
+package main
+
+// LRU read cache for hot keys (cache_bytes > 0). get checks it before taking
+// the node lock, so repeated reads of the same keys don't queue up behind
+// writers. Entries are filled while the node's read lock is held and dropped
+// by every put and delete under the write lock, so the cache never serves a
+// value older than the store's.
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+const cacheEntryOverhead = 64 // Rough per-entry cost of the list element and map slot
+
+type cacheEntry struct {
+	key   string // Bucket and key, see cacheKey
+	value string
+}
+
+type lruCache struct {
+	mu        sync.Mutex
+	max_bytes int64
+	bytes     int64
+	entries   map[string]*list.Element
+	order     *list.List // Front is most recently used
+	hits      atomic.Uint64
+	misses    atomic.Uint64
+}
+
+type CacheStats struct {
+	Hits     uint64 `json:"hits"`
+	Misses   uint64 `json:"misses"`
+	Entries  int    `json:"entries"`
+	Bytes    int64  `json:"bytes"`
+	MaxBytes int64  `json:"max_bytes"`
+}
+
+// read_cache is nil when caching is disabled.
+var read_cache *lruCache
+
+func newLRUCache(maxBytes int64) *lruCache {
+	return &lruCache{max_bytes: maxBytes, entries: make(map[string]*list.Element), order: list.New()}
+}
+
+// cacheKey keeps keys from different buckets apart.
+func cacheKey(bucket string, key string) string {
+	return bucket + "\x00" + key
+}
+
+func entrySize(e *cacheEntry) int64 {
+	return int64(len(e.key)+len(e.value)) + cacheEntryOverhead
+}
+
+func (c *lruCache) get(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		c.misses.Add(1)
+		return "", false
+	}
+	c.order.MoveToFront(el)
+	c.hits.Add(1)
+	return el.Value.(*cacheEntry).value, true
+}
+
+func (c *lruCache) add(key string, value string) {
+	e := &cacheEntry{key: key, value: value}
+	if entrySize(e) > c.max_bytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.removeElement(el)
+	}
+	c.entries[key] = c.order.PushFront(e)
+	c.bytes += entrySize(e)
+	for c.bytes > c.max_bytes {
+		c.removeElement(c.order.Back())
+	}
+}
+
+func (c *lruCache) remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.removeElement(el)
+	}
+}
+
+func (c *lruCache) removeElement(el *list.Element) {
+	e := c.order.Remove(el).(*cacheEntry)
+	delete(c.entries, e.key)
+	c.bytes -= entrySize(e)
+}
+
+func (c *lruCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]*list.Element)
+	c.order.Init()
+	c.bytes = 0
+}
+
+func (c *lruCache) stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{Hits: c.hits.Load(), Misses: c.misses.Load(), Entries: len(c.entries), Bytes: c.bytes, MaxBytes: c.max_bytes}
+}
+
+// cacheLookup returns key's cached value in n's bucket.
+func (n *ServerNode) cacheLookup(key string) (string, bool) {
+	if read_cache == nil {
+		return "", false
+	}
+	return read_cache.get(cacheKey(n.bucket, key))
+}
+
+// cacheFillLocked caches a value just read from n. Must be called with n.mu
+// held so a concurrent write can't be overtaken by the stale value.
+func (n *ServerNode) cacheFillLocked(key string, value string) {
+	if read_cache != nil {
+		read_cache.add(cacheKey(n.bucket, key), value)
+	}
+}
+
+// cacheInvalidateLocked drops key after a write. Must be called with n.mu
+// held.
+func (n *ServerNode) cacheInvalidateLocked(key string) {
+	if read_cache != nil {
+		read_cache.remove(cacheKey(n.bucket, key))
+	}
+}
+
+// clearReadCache empties the cache after a bulk change such as dropping a
+// bucket or loading a snapshot.
+func clearReadCache() {
+	if read_cache != nil {
+		read_cache.clear()
+	}
+}
@@ -0,0 +1,521 @@
+package main
+
+// Persistent change feed. Every mutation published by the change broker is
+// appended to changes.log in the data directory with its sequence number, so
+// sequence numbers keep increasing across restarts and consumers can tail
+// the store with GET /changes?since=<seq>. Once the log grows past
+// changes_max_bytes its older half is discarded; consumers asking for
+// discarded history get 410 Gone and must resync, apart from replication
+// followers the discarded changes were kept for (handoff.go).
+//
+// Record layout (little endian):
+//
+//	u32 payload length | u32 CRC-32 (IEEE) of payload | payload
+//	payload: u64 seq | i64 unix nanos | u8 op | u16 bucket len | u32 key len |
+//	         u32 value len | bucket | key | value
+//
+// The op is 1 for a put, 2 for a delete and 3 for the drop of a bucket, with
+// the value's type tag in its high four bits.
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	changeHeaderLen = 8                     // Length and checksum
+	changeFixedLen  = 8 + 8 + 1 + 2 + 4 + 4 // Payload fields before the variable parts
+	changeMarkEvery = 256                   // Records between sparse index marks
+	maxChangeRecord = 1 << 30               // Sanity bound on a single record
+	defaultChanges  = 1000                  // Changes returned per /changes call by default
+	maxChanges      = 10000
+	opPut, opDelete = byte(1), byte(2)
+)
+
+var ErrCorruptRecord = errors.New("corrupt change record")
+var ErrChangesTrimmed = errors.New("requested changes are no longer retained")
+
+type logMark struct {
+	seq uint64
+	off int64
+}
+
+type changeLog struct {
+	mu     sync.RWMutex
+	path   string
+	f      *os.File
+	size   int64
+	synced int64     // Size at the last sync
+	first  uint64    // Oldest retained sequence number, 0 when empty
+	last   uint64    // Newest sequence number ever written
+	marks  []logMark // Sparse seq -> offset index
+	count  int       // Records since the last mark
+}
+
+// frame prefixes payload with its length and checksum.
+func frame(payload []byte) []byte {
+	buf := make([]byte, changeHeaderLen+len(payload))
+	binary.LittleEndian.PutUint32(buf[0:], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(buf[4:], crc32.ChecksumIEEE(payload))
+	copy(buf[changeHeaderLen:], payload)
+	return buf
+}
+
+// readFrame reads one framed payload, returning it with the number of bytes
+// consumed. A short or mismatched frame is reported as ErrCorruptRecord or
+// io.ErrUnexpectedEOF.
+func readFrame(r io.Reader) ([]byte, int64, error) {
+	var hdr [changeHeaderLen]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, 0, err
+	}
+	payloadLen := binary.LittleEndian.Uint32(hdr[0:])
+	if payloadLen > maxChangeRecord {
+		return nil, 0, ErrCorruptRecord
+	}
+	p := make([]byte, payloadLen)
+	if _, err := io.ReadFull(r, p); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, 0, err
+	}
+	if crc32.ChecksumIEEE(p) != binary.LittleEndian.Uint32(hdr[4:]) {
+		return nil, 0, ErrCorruptRecord
+	}
+	return p, int64(changeHeaderLen) + int64(payloadLen), nil
+}
+
+// decodeFrame is readFrame for a frame at the start of b.
+func decodeFrame(b []byte) ([]byte, int64, error) {
+	if len(b) < changeHeaderLen {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	payloadLen := uint64(binary.LittleEndian.Uint32(b[0:]))
+	if payloadLen > maxChangeRecord {
+		return nil, 0, ErrCorruptRecord
+	}
+	if payloadLen > uint64(len(b)-changeHeaderLen) {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	p := b[changeHeaderLen : changeHeaderLen+int(payloadLen)]
+	if crc32.ChecksumIEEE(p) != binary.LittleEndian.Uint32(b[4:]) {
+		return nil, 0, ErrCorruptRecord
+	}
+	return p, int64(changeHeaderLen) + int64(payloadLen), nil
+}
+
+// replaceFile renames the synced tmp over path and reopens path with flag,
+// returning the new handle. Both files are closed first since Windows won't
+// rename a file that is open. If the rename fails tmp is removed and path is
+// reopened as it was.
+func replaceFile(tmp *os.File, old *os.File, path string, flag int) (*os.File, error) {
+	name := tmp.Name()
+	err := tmp.Close()
+	old.Close()
+	if err == nil {
+		err = os.Rename(name, path)
+	}
+	if err != nil {
+		os.Remove(name)
+	}
+	f, openErr := os.OpenFile(path, flag, 0o644)
+	if openErr != nil {
+		return nil, errors.Join(err, openErr)
+	}
+	return f, err
+}
+
+func encodeChange(ev ChangeEvent) []byte {
+	op := opPut
+	switch ev.Op {
+	case "delete":
+		op = opDelete
+	case "drop_bucket":
+		op = opClear
+	}
+	p := make([]byte, changeFixedLen+len(ev.Bucket)+len(ev.Key)+len(ev.Value))
+	binary.LittleEndian.PutUint64(p[0:], ev.Seq)
+	binary.LittleEndian.PutUint64(p[8:], uint64(ev.Time.UnixNano()))
+	p[16] = op | byte(ev.Type)<<4 // Records from before type tags have none
+	binary.LittleEndian.PutUint16(p[17:], uint16(len(ev.Bucket)))
+	binary.LittleEndian.PutUint32(p[19:], uint32(len(ev.Key)))
+	binary.LittleEndian.PutUint32(p[23:], uint32(len(ev.Value)))
+	n := copy(p[changeFixedLen:], ev.Bucket)
+	n += copy(p[changeFixedLen+n:], ev.Key)
+	copy(p[changeFixedLen+n:], ev.Value)
+	return frame(p)
+}
+
+func decodeChangePayload(p []byte) (ChangeEvent, error) {
+	if len(p) < changeFixedLen {
+		return ChangeEvent{}, ErrCorruptRecord
+	}
+	bucketLen := uint64(binary.LittleEndian.Uint16(p[17:]))
+	keyLen := uint64(binary.LittleEndian.Uint32(p[19:]))
+	valueLen := uint64(binary.LittleEndian.Uint32(p[23:]))
+	// Summed as uint64 so garbage lengths can't wrap around on 32-bit builds
+	if changeFixedLen+bucketLen+keyLen+valueLen != uint64(len(p)) {
+		return ChangeEvent{}, ErrCorruptRecord
+	}
+	ev := ChangeEvent{
+		Seq:  binary.LittleEndian.Uint64(p[0:]),
+		Time: time.Unix(0, int64(binary.LittleEndian.Uint64(p[8:]))).UTC(),
+	}
+	ev.Type = valueType(p[16] >> 4)
+	switch p[16] & 0x0f {
+	case opPut:
+		ev.Op = "put"
+	case opDelete:
+		ev.Op = "delete"
+	case opClear:
+		ev.Op = "drop_bucket"
+	default:
+		return ChangeEvent{}, ErrCorruptRecord
+	}
+	rest := p[changeFixedLen:]
+	ev.Bucket = string(rest[:bucketLen])
+	ev.Key = string(rest[bucketLen : bucketLen+keyLen])
+	ev.Value = string(rest[bucketLen+keyLen:])
+	return ev, nil
+}
+
+// readChange reads the record at the reader's position, returning its total
+// encoded length.
+func readChange(r io.Reader) (ChangeEvent, int64, error) {
+	p, n, err := readFrame(r)
+	if err != nil {
+		return ChangeEvent{}, 0, err
+	}
+	ev, err := decodeChangePayload(p)
+	return ev, n, err
+}
+
+// openChangeLog opens (or creates) the log and scans it to rebuild the
+// sparse index. A torn or corrupt tail left by a crash is truncated.
+func openChangeLog(path string) (*changeLog, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	l := &changeLog{path: path, f: f}
+	if err := l.scan(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *changeLog) scan() error {
+	l.size, l.first, l.marks, l.count = 0, 0, nil, 0
+	r := bufio.NewReader(io.NewSectionReader(l.f, 0, 1<<62))
+	for {
+		ev, n, err := readChange(r)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			info, statErr := l.f.Stat()
+			if statErr != nil {
+				return statErr
+			}
+			slog.Warn("truncating damaged change log tail", "path", l.path, "offset", l.size, "dropped_bytes", info.Size()-l.size, "error", err)
+			return l.f.Truncate(l.size)
+		}
+		l.noteRecord(ev.Seq, l.size)
+		l.size += n
+	}
+}
+
+func (l *changeLog) noteRecord(seq uint64, off int64) {
+	if l.first == 0 {
+		l.first = seq
+	}
+	if seq > l.last {
+		l.last = seq
+	}
+	if l.count == 0 {
+		l.marks = append(l.marks, logMark{seq: seq, off: off})
+	}
+	l.count = (l.count + 1) % changeMarkEvery
+}
+
+func (l *changeLog) append(ev ChangeEvent) error {
+	buf := encodeChange(ev)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.f.WriteAt(buf, l.size); err != nil {
+		return err
+	}
+	l.noteRecord(ev.Seq, l.size)
+	l.size += int64(len(buf))
+	if cfg().ChangesMaxBytes > 0 && l.size > cfg().ChangesMaxBytes {
+		if err := l.trimLocked(cfg().ChangesMaxBytes / 2); err != nil {
+			slog.Error("failed to trim change log", "error", err)
+		}
+	}
+	return nil
+}
+
+// sync flushes appended records to disk. Every store's sync calls it, so
+// it returns at once when nothing was appended since the last one.
+func (l *changeLog) sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.size == l.synced {
+		return nil
+	}
+	if err := l.f.Sync(); err != nil {
+		return err
+	}
+	l.synced = l.size
+	return nil
+}
+
+// trimLocked drops the oldest records so at most keep bytes remain, cutting
+// at a sparse index mark. Must be called with l.mu held.
+func (l *changeLog) trimLocked(keep int64) error {
+	i := sort.Search(len(l.marks), func(i int) bool { return l.size-l.marks[i].off <= keep })
+	if i == 0 || i == len(l.marks) {
+		return nil
+	}
+	cut := l.marks[i].off
+	followers.spillTrimmed(l, cut, l.marks[i].seq)
+	tmp := l.path + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, io.NewSectionReader(l.f, cut, l.size-cut)); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	f, err := replaceFile(out, l.f, l.path, os.O_RDWR)
+	if f != nil {
+		l.f = f
+	}
+	if err != nil {
+		return err
+	}
+	l.size -= cut
+	l.synced = l.size // The copy was synced
+	l.first = l.marks[i].seq
+	marks := make([]logMark, 0, len(l.marks)-i)
+	for _, m := range l.marks[i:] {
+		marks = append(marks, logMark{seq: m.seq, off: m.off - cut})
+	}
+	l.marks = marks
+	slog.Info("change log trimmed", "oldest_seq", l.first, "bytes", l.size)
+	return nil
+}
+
+// since returns up to limit changes with a sequence number above seq that
+// match, plus the sequence number to resume from on the next call.
+func (l *changeLog) since(seq uint64, limit int, match func(ChangeEvent) bool) ([]ChangeEvent, uint64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	out := []ChangeEvent{}
+	if l.first == 0 {
+		return out, seq, nil
+	}
+	if seq+1 < l.first {
+		return nil, seq, ErrChangesTrimmed
+	}
+	i := sort.Search(len(l.marks), func(i int) bool { return l.marks[i].seq > seq+1 })
+	start := int64(0)
+	if i > 0 {
+		start = l.marks[i-1].off
+	}
+
+	next := seq
+	r := bufio.NewReader(io.NewSectionReader(l.f, start, l.size-start))
+	for len(out) < limit {
+		ev, _, err := readChange(r)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, seq, fmt.Errorf("reading change log: %w", err)
+		}
+		if ev.Seq <= seq {
+			continue
+		}
+		next = ev.Seq
+		if match(ev) {
+			out = append(out, ev)
+		}
+	}
+	return out, next, nil
+}
+
+func (l *changeLog) bounds() (first uint64, last uint64) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.first, l.last
+}
+
+func (l *changeLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
+
+func changeLogPath() string {
+	return filepath.Join(cfg().DataDir, "changes.log")
+}
+
+type ChangesPage struct {
+	Changes   []ChangeEvent `json:"changes"`
+	Next      uint64        `json:"next"`       // Pass as since= to continue
+	OldestSeq uint64        `json:"oldest_seq"` // Oldest change still retained
+	LastSeq   uint64        `json:"last_seq"`   // Newest sequence number assigned
+}
+
+func (b *changeBroker) since(seq uint64, limit int, match func(ChangeEvent) bool) (ChangesPage, error) {
+	b.mu.Lock()
+	l, last := b.log, b.seq
+	b.mu.Unlock()
+	if l == nil {
+		// Memory mode keeps no history, so only a caller that is already
+		// caught up can continue
+		page := ChangesPage{Changes: []ChangeEvent{}, Next: seq, OldestSeq: last + 1, LastSeq: last}
+		if seq < last {
+			return page, ErrChangesTrimmed
+		}
+		return page, nil
+	}
+	events, next, err := l.since(seq, limit, match)
+	first, _ := l.bounds()
+	return ChangesPage{Changes: events, Next: next, OldestSeq: first, LastSeq: last}, err
+}
+
+// wait blocks until a change after seq is published, ctx is done or timeout
+// passes.
+func (b *changeBroker) wait(ctx context.Context, seq uint64, timeout time.Duration) {
+	b.mu.Lock()
+	current, advanced := b.seq, b.advanced
+	b.mu.Unlock()
+	if current > seq {
+		return
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-advanced:
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
+
+// changesHandler serves GET /changes?since=<seq>[&limit=][&bucket=][&prefix=][&wait=][&follower=],
+// returning the recorded mutations after seq in order. bucket=* selects every
+// bucket; wait holds the request open until a change arrives; follower
+// identifies a replica, see handoff.go.
+func changesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+	q := r.URL.Query()
+	var since uint64
+	if s := q.Get("since"); s != "" {
+		var err error
+		if since, err = strconv.ParseUint(s, 10, 64); err != nil {
+			writeError(w, r, http.StatusBadRequest, codeBadRequest, "invalid since")
+			return
+		}
+	}
+	limit := defaultChanges
+	if s := q.Get("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil || limit < 1 {
+			writeError(w, r, http.StatusBadRequest, codeBadRequest, "invalid limit")
+			return
+		}
+		limit = min(limit, maxChanges)
+	}
+	var wait time.Duration
+	if s := q.Get("wait"); s != "" {
+		var err error
+		if wait, err = time.ParseDuration(s); err != nil || wait < 0 {
+			writeError(w, r, http.StatusBadRequest, codeBadRequest, "invalid wait")
+			return
+		}
+		wait = min(wait, maxChangesWait)
+	}
+	bucket := q.Get("bucket")
+	if bucket != "" && bucket != "*" && !validBucketName(bucket) {
+		writeError(w, r, http.StatusBadRequest, codeInvalidBucket, "invalid bucket name")
+		return
+	}
+	prefix, ok := requestPrefix(w, r)
+	if !ok {
+		return
+	}
+	follower := q.Get("follower")
+	if follower != "" && !validFollowerID(follower) {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "invalid follower")
+		return
+	}
+	system := adminScope(r)
+	match := func(ev ChangeEvent) bool {
+		if bucket == "*" {
+			return (ev.Bucket != systemBucket || system) && ev.under(prefix)
+		}
+		return ev.Bucket == bucket && ev.under(prefix)
+	}
+
+	if follower != "" {
+		if !replicaScope(r) {
+			writeError(w, r, http.StatusForbidden, codeForbidden, "forbidden: following needs replication credentials")
+			return
+		}
+		if !followers.seen(follower, r.RemoteAddr, since) {
+			// Gone like trimmed changes, so the replica registers again with a snapshot
+			writeError(w, r, http.StatusGone, codeUnknownFollower, "unknown follower; take a snapshot with register=true")
+			return
+		}
+	}
+	page, err := changes.since(since, limit, match)
+	if err == nil && wait > 0 && page.Next == since {
+		changes.wait(r.Context(), since, wait)
+		page, err = changes.since(since, limit, match)
+	}
+	if errors.Is(err, ErrChangesTrimmed) && follower != "" {
+		if events, next, ok := followers.replay(follower, since, limit, match); ok {
+			page.Changes, page.Next, err = events, next, nil
+		}
+	}
+	if errors.Is(err, ErrChangesTrimmed) {
+		writeError(w, r, http.StatusGone, codeChangesTrimmed, fmt.Sprintf("%v; oldest available seq is %d", err, page.OldestSeq))
+		return
+	}
+	if err != nil {
+		slog.Error("failed to read change log", "error", err)
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "internal error")
+		return
+	}
+	for i := range page.Changes {
+		page.Changes[i].Key = encodeKey(r, page.Changes[i].Key)
+	}
+	writeJSON(w, page)
+}
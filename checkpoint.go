@@ -0,0 +1,334 @@
+package main
+
+// Index checkpoints. Replaying every segment on startup reads all of a
+// store's history, garbage included. Every index_checkpoint_interval (and on
+// shutdown) the segments are synced and idx is written to <dir>/index along
+// with the size of every segment, the last of which is the high-water mark.
+// On startup the values are read straight from the offsets in the checkpoint
+// and only records appended after the high-water mark are replayed. A
+// checkpoint that no longer matches the segments on disk, say because a
+// segment was compacted away since, is ignored in favour of a full replay.
+// Kept history (see history.go) is checkpointed alongside idx.
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	checkpointMagic  = 0x4b564932 // "KVI2"
+	checkpointFile   = "index"
+	checkpointLocLen = 4 + 8 + 4 + 8 + 8 + 1 // Segment, offset, size, version, timestamp, flags
+)
+
+type segSize struct {
+	id   uint32
+	size int64
+}
+
+func (s *segmentStore) checkpointPath() string {
+	return filepath.Join(s.dir, checkpointFile)
+}
+
+// checkpoint syncs the active segment and writes idx to the index file,
+// unless nothing was appended since the last one.
+func (s *segmentStore) checkpoint() error {
+	if read_only.Load() {
+		return nil // Storage is left untouched, see readonly.go
+	}
+	active := s.active()
+	if s.checkpointed == (segSize{active.id, active.size}) {
+		return nil
+	}
+	if err := s.sync(); err != nil {
+		return err
+	}
+
+	sizes := make([]segSize, len(s.segments))
+	for i, seg := range s.segments {
+		sizes[i] = segSize{seg.id, seg.size}
+	}
+	data := encodeCheckpoint(sizes, s.idx, s.hist)
+
+	tmp := s.checkpointPath() + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, s.checkpointPath())
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	s.checkpointed = segSize{active.id, active.size}
+	return nil
+}
+
+// encodeCheckpoint lays out the index file, the inverse of decodeCheckpoint.
+func encodeCheckpoint(sizes []segSize, idx map[string]segLoc, hist map[string][]segLoc) []byte {
+	p := binary.LittleEndian.AppendUint32(nil, checkpointMagic)
+	p = binary.LittleEndian.AppendUint32(p, uint32(len(sizes)))
+	for _, sz := range sizes {
+		p = binary.LittleEndian.AppendUint32(p, sz.id)
+		p = binary.LittleEndian.AppendUint64(p, uint64(sz.size))
+	}
+	p = binary.LittleEndian.AppendUint64(p, uint64(len(idx)))
+	for key, loc := range idx {
+		p = binary.LittleEndian.AppendUint32(p, uint32(len(key)))
+		p = append(p, key...)
+		p = appendLoc(p, loc)
+	}
+	p = binary.LittleEndian.AppendUint64(p, uint64(len(hist)))
+	for key, locs := range hist {
+		p = binary.LittleEndian.AppendUint32(p, uint32(len(key)))
+		p = append(p, key...)
+		p = binary.LittleEndian.AppendUint32(p, uint32(len(locs)))
+		for _, loc := range locs {
+			p = appendLoc(p, loc)
+		}
+	}
+	return frame(p)
+}
+
+func appendLoc(p []byte, loc segLoc) []byte {
+	p = binary.LittleEndian.AppendUint32(p, loc.seg)
+	p = binary.LittleEndian.AppendUint64(p, uint64(loc.off))
+	p = binary.LittleEndian.AppendUint32(p, uint32(loc.size))
+	p = binary.LittleEndian.AppendUint64(p, loc.ver)
+	p = binary.LittleEndian.AppendUint64(p, uint64(loc.ts))
+	flags := byte(loc.typ) << 1 & recTypeMask // Same bits as in segment records
+	if loc.del {
+		flags |= 1
+	}
+	return append(p, flags)
+}
+
+// readCheckpoint reads and decodes the index file.
+func readCheckpoint(path string) ([]segSize, map[string]segLoc, map[string][]segLoc, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return decodeCheckpoint(data)
+}
+
+func decodeCheckpoint(data []byte) ([]segSize, map[string]segLoc, map[string][]segLoc, error) {
+	p, n, err := decodeFrame(data)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if n != int64(len(data)) {
+		return nil, nil, nil, ErrCorruptRecord
+	}
+	next := func(size uint32) []byte {
+		if uint64(len(p)) < uint64(size) {
+			err = ErrCorruptRecord
+			return make([]byte, checkpointLocLen) // Enough for any fixed field; the result is discarded
+		}
+		b := p[:size]
+		p = p[size:]
+		return b
+	}
+	nextLoc := func() segLoc {
+		b := next(checkpointLocLen)
+		if len(b) < checkpointLocLen {
+			return segLoc{}
+		}
+		return segLoc{
+			seg:  binary.LittleEndian.Uint32(b[0:]),
+			off:  int64(binary.LittleEndian.Uint64(b[4:])),
+			size: int64(binary.LittleEndian.Uint32(b[12:])),
+			ver:  binary.LittleEndian.Uint64(b[16:]),
+			ts:   int64(binary.LittleEndian.Uint64(b[24:])),
+			del:  b[32]&1 != 0,
+			typ:  valueType(b[32] & recTypeMask >> 1),
+		}
+	}
+	if binary.LittleEndian.Uint32(next(4)) != checkpointMagic {
+		return nil, nil, nil, ErrCorruptRecord
+	}
+	segs := binary.LittleEndian.Uint32(next(4))
+	if err != nil || uint64(segs) > uint64(len(p)/12) {
+		return nil, nil, nil, ErrCorruptRecord
+	}
+	sizes := make([]segSize, segs)
+	for i := range sizes {
+		sizes[i].id = binary.LittleEndian.Uint32(next(4))
+		sizes[i].size = int64(binary.LittleEndian.Uint64(next(8)))
+	}
+	count := binary.LittleEndian.Uint64(next(8))
+	if err != nil || count > uint64(len(p)) {
+		return nil, nil, nil, ErrCorruptRecord
+	}
+	idx := make(map[string]segLoc, count)
+	for i := uint64(0); i < count && err == nil; i++ {
+		key := string(next(binary.LittleEndian.Uint32(next(4))))
+		idx[key] = nextLoc()
+	}
+	count = binary.LittleEndian.Uint64(next(8))
+	if err != nil || count > uint64(len(p)) {
+		return nil, nil, nil, ErrCorruptRecord
+	}
+	hist := make(map[string][]segLoc, count)
+	for i := uint64(0); i < count && err == nil; i++ {
+		key := string(next(binary.LittleEndian.Uint32(next(4))))
+		locs := binary.LittleEndian.Uint32(next(4))
+		if uint64(locs) > uint64(len(p)/checkpointLocLen) {
+			return nil, nil, nil, ErrCorruptRecord
+		}
+		for range locs {
+			hist[key] = append(hist[key], nextLoc())
+		}
+	}
+	if err != nil || len(p) != 0 {
+		return nil, nil, nil, ErrCorruptRecord
+	}
+	return sizes, idx, hist, nil
+}
+
+// loadCheckpoint restores idx and the segment sizes from the index file and
+// feeds every live value to apply. It returns how many segments it covered;
+// replay continues from the end of the last of them. Nothing is applied
+// unless the whole checkpoint checks out.
+func (s *segmentStore) loadCheckpoint(apply func(op byte, key string, value string)) (int, error) {
+	sizes, idx, hist, err := readCheckpoint(s.checkpointPath())
+	if err != nil {
+		return 0, err
+	}
+	if len(sizes) == 0 || len(sizes) > len(s.segments) {
+		return 0, errors.New("checkpoint does not match segments")
+	}
+	for i, sz := range sizes {
+		seg := s.segments[i]
+		info, err := os.Stat(seg.path)
+		if err != nil {
+			return 0, err
+		}
+		// Sealed segments never change; the last one may have grown since
+		if seg.id != sz.id || info.Size() < sz.size || (i < len(sizes)-1 && info.Size() != sz.size) {
+			return 0, errors.New("checkpoint does not match segments")
+		}
+	}
+
+	// Read the values segment by segment in file order
+	bySeg := make(map[uint32][]string)
+	for key, loc := range idx {
+		bySeg[loc.seg] = append(bySeg[loc.seg], key)
+	}
+	keys := make([][]string, len(sizes))
+	for i, sz := range sizes {
+		keys[i] = bySeg[sz.id]
+		delete(bySeg, sz.id)
+	}
+	if len(bySeg) > 0 {
+		return 0, errors.New("checkpoint refers to missing segments")
+	}
+	parts := make([]map[string]string, len(sizes))
+	err = forEachParallel(len(sizes), func(i int) error {
+		sort.Slice(keys[i], func(a, b int) bool { return idx[keys[i][a]].off < idx[keys[i][b]].off })
+		parts[i] = make(map[string]string, len(keys[i]))
+		return readValues(s.segments[i].path, keys[i], idx, sizes[i].size, parts[i])
+	})
+	if err != nil {
+		return 0, err
+	}
+	limits := make(map[uint32]int64, len(sizes))
+	for _, sz := range sizes {
+		limits[sz.id] = sz.size
+	}
+	for _, locs := range hist {
+		for _, loc := range locs {
+			if limit, ok := limits[loc.seg]; !ok || loc.off < 0 || loc.off+loc.size > limit {
+				return 0, errors.New("checkpoint refers to missing segments")
+			}
+		}
+	}
+
+	s.idx = idx
+	s.hist = hist
+	for i, sz := range sizes {
+		s.segments[i].size = sz.size
+	}
+	for _, loc := range idx {
+		s.segment(loc.seg).live += loc.size
+	}
+	for _, locs := range hist {
+		for _, loc := range locs {
+			s.segment(loc.seg).live += loc.size
+		}
+	}
+	for _, values := range parts {
+		for key, value := range values {
+			apply(opPut, key, value)
+		}
+	}
+	s.checkpointed = sizes[len(sizes)-1]
+	return len(sizes), nil
+}
+
+// readValues reads the records of keys, sorted by offset, from one segment.
+func readValues(path string, keys []string, idx map[string]segLoc, limit int64, values map[string]string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for _, key := range keys {
+		loc := idx[key]
+		if loc.off < 0 || loc.off+loc.size > limit {
+			return ErrCorruptRecord
+		}
+		p, _, err := readFrame(io.NewSectionReader(f, loc.off, loc.size))
+		if err != nil {
+			return err
+		}
+		rec, err := decodeSegmentRecord(p)
+		if err != nil {
+			return err
+		}
+		if rec.op != opPut || rec.key != key {
+			return ErrCorruptRecord
+		}
+		values[key] = rec.value
+	}
+	return nil
+}
+
+// checkpointLoop writes an index checkpoint every interval until the store's
+// bucket is dropped.
+func (n *ServerNode) checkpointLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		n.mu.Lock()
+		if n.dropped {
+			n.mu.Unlock()
+			return
+		}
+		if n.segs != nil {
+			if err := n.segs.checkpoint(); err != nil {
+				slog.Error("failed to write index checkpoint", "node", n.name, "bucket", n.bucket, "error", err)
+			} else {
+				n.dirty = false // The checkpoint synced the segments
+			}
+			if err := n.saveAccessLocked(); err != nil {
+				slog.Error("failed to save key statistics", "node", n.name, "bucket", n.bucket, "error", err)
+			}
+		}
+		n.mu.Unlock()
+	}
+}
@@ -0,0 +1,292 @@
+// Package client is a typed Go client for the kv store HTTP API, for services
+// that would rather not write the HTTP calls themselves. The API it talks to
+// is described at GET /openapi.json on any server.
+//
+//	c := client.New("http://localhost:8090", client.WithAPIKey(key))
+//	if err := c.Put(ctx, "greeting", "hello"); err != nil { ... }
+//	value, err := c.Get(ctx, "greeting")
+//	if errors.Is(err, client.ErrKeyNotFound) { ... }
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// ErrKeyNotFound is matched by the error Get and Delete return for a
+// missing key.
+var ErrKeyNotFound = errors.New("key not found")
+
+// Error is an error answered by the server.
+type Error struct {
+	Status  int    // HTTP status code
+	Code    string // Stable error code, e.g. KEY_NOT_FOUND or QUOTA_EXCEEDED
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("kv store: %s (%d)", e.Message, e.Status)
+	}
+	return fmt.Sprintf("kv store: %s (%d %s)", e.Message, e.Status, e.Code)
+}
+
+func (e *Error) Is(target error) bool {
+	return target == ErrKeyNotFound && e.Code == "KEY_NOT_FOUND"
+}
+
+// Client talks to one server or proxy. It is safe for concurrent use.
+type Client struct {
+	addr     string
+	apiKey   string
+	user     string
+	password string
+	bucket   string // Empty for the default key space
+	http     *http.Client
+}
+
+type Option func(*Client)
+
+// WithAPIKey authenticates with an API key sent as a bearer token.
+func WithAPIKey(key string) Option {
+	return func(c *Client) { c.apiKey = key }
+}
+
+// WithBasicAuth authenticates with HTTP basic auth.
+func WithBasicAuth(user string, password string) Option {
+	return func(c *Client) { c.user, c.password = user, password }
+}
+
+// WithBucket makes the client operate on a bucket instead of the default
+// store.
+func WithBucket(bucket string) Option {
+	return func(c *Client) { c.bucket = bucket }
+}
+
+// WithHTTPClient sets the HTTP client used for requests, for TLS settings or
+// a timeout. http.DefaultClient is used otherwise.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.http = hc }
+}
+
+// New returns a client for the server at addr, e.g. http://localhost:8090,
+// or unix:///run/kvstore.sock for a server's unix_socket. The client made for
+// a unix socket is replaced by WithHTTPClient, so dial the socket yourself
+// if you pass both.
+func New(addr string, opts ...Option) *Client {
+	c := &Client{addr: strings.TrimRight(addr, "/"), http: http.DefaultClient}
+	if path, ok := strings.CutPrefix(addr, "unix://"); ok {
+		c.addr = "http://unix"
+		c.http = &http.Client{Transport: UnixTransport(path)}
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// UnixTransport returns an HTTP transport that connects to the unix socket
+// at path whatever the request's host.
+func UnixTransport(path string) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = nil
+	t.DialContext = func(ctx context.Context, _ string, _ string) (net.Conn, error) {
+		var d net.Dialer
+		return d.DialContext(ctx, "unix", path)
+	}
+	return t
+}
+
+// H2CTransport returns an HTTP transport that speaks HTTP/2 without TLS, for
+// servers with h2c on (the default), so that a busy service multiplexes its
+// requests over one connection rather than opening more as they pile up.
+// Use it with WithHTTPClient.
+func H2CTransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	t.Protocols = &protocols
+	return t
+}
+
+// Bucket returns a client for bucket sharing c's address and credentials.
+func (c *Client) Bucket(bucket string) *Client {
+	out := *c
+	out.bucket = bucket
+	return &out
+}
+
+// Get returns the value stored at key.
+func (c *Client) Get(ctx context.Context, key string) (string, error) {
+	var out struct {
+		Value string `json:"value"`
+	}
+	if err := c.do(ctx, http.MethodGet, c.keyPath(key), "", nil, &out); err != nil {
+		return "", err
+	}
+	return out.Value, nil
+}
+
+// Put stores value at key.
+func (c *Client) Put(ctx context.Context, key string, value string) error {
+	body, err := json.Marshal(struct {
+		Value string `json:"value"`
+	}{value})
+	if err != nil {
+		return err
+	}
+	return c.do(ctx, http.MethodPut, c.keyPath(key), "application/json", body, nil)
+}
+
+// Delete removes key.
+func (c *Client) Delete(ctx context.Context, key string) error {
+	return c.do(ctx, http.MethodDelete, c.keyPath(key), "", nil, nil)
+}
+
+// Batch stores every pair in values. The server writes them in batches of
+// up to 1000, each applied at once; should one fail, the batches before it
+// stay written. It needs read-write credentials, as any write does.
+func (c *Client) Batch(ctx context.Context, values map[string]string) error {
+	if len(values) == 0 {
+		return nil
+	}
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for k, v := range values {
+		if err := enc.Encode(struct {
+			Key   string `json:"key"`
+			Value string `json:"value"`
+		}{k, v}); err != nil {
+			return err
+		}
+	}
+	return c.do(ctx, http.MethodPost, "/admin/import?"+c.query(nil).Encode(), "application/x-ndjson", body.Bytes(), nil)
+}
+
+// Scan returns every pair whose key starts with prefix; an empty prefix
+// returns the whole store.
+func (c *Client) Scan(ctx context.Context, prefix string) (map[string]string, error) {
+	out := map[string]string{}
+	err := c.do(ctx, http.MethodGet, "/dump?"+c.query(url.Values{"prefix": {prefix}}).Encode(), "", nil, &out)
+	return out, err
+}
+
+// Exists reports whether key exists, without transferring its value.
+func (c *Client) Exists(ctx context.Context, key string) (bool, error) {
+	var out struct {
+		Exists bool `json:"exists"`
+	}
+	err := c.do(ctx, http.MethodGet, "/exists?"+c.query(url.Values{"key": {key}}).Encode(), "", nil, &out)
+	return out.Exists, err
+}
+
+// Count returns how many keys start with prefix.
+func (c *Client) Count(ctx context.Context, prefix string) (int, error) {
+	var out struct {
+		Count int `json:"count"`
+	}
+	err := c.do(ctx, http.MethodGet, "/count?"+c.query(url.Values{"prefix": {prefix}}).Encode(), "", nil, &out)
+	return out.Count, err
+}
+
+// Keys returns the sorted keys starting with prefix.
+func (c *Client) Keys(ctx context.Context, prefix string) ([]string, error) {
+	var out []string
+	err := c.do(ctx, http.MethodGet, "/keys?"+c.query(url.Values{"prefix": {prefix}}).Encode(), "", nil, &out)
+	return out, err
+}
+
+// Publish sends message to the current subscribers of channel and returns
+// how many received it. Channels are not tied to buckets.
+func (c *Client) Publish(ctx context.Context, channel string, message []byte) (int, error) {
+	var out struct {
+		Receivers int `json:"receivers"`
+	}
+	err := c.do(ctx, http.MethodPost, "/publish?"+url.Values{"channel": {channel}}.Encode(), "application/octet-stream", message, &out)
+	return out.Receivers, err
+}
+
+func (c *Client) keyPath(key string) string {
+	if c.bucket != "" {
+		return "/b/" + url.PathEscape(c.bucket) + "/" + url.PathEscape(key)
+	}
+	return "/" + url.PathEscape(key)
+}
+
+// query adds the bucket parameter to q.
+func (c *Client) query(q url.Values) url.Values {
+	if q == nil {
+		q = url.Values{}
+	}
+	if c.bucket != "" {
+		q.Set("bucket", c.bucket)
+	}
+	return q
+}
+
+// do sends a request and decodes a JSON response into out unless it is nil.
+func (c *Client) do(ctx context.Context, method string, path string, contentType string, payload []byte, out any) error {
+	var body io.Reader
+	if payload != nil {
+		body = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.addr+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	switch {
+	case c.apiKey != "":
+		req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	case c.user != "":
+		req.SetBasicAuth(c.user, c.password)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return responseError(resp)
+	}
+	if out == nil {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("kv store: decoding %s %s response: %w", method, path, err)
+	}
+	return nil
+}
+
+// responseError turns an error response into an *Error.
+func responseError(resp *http.Response) error {
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	var body struct {
+		Error struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	e := &Error{Status: resp.StatusCode}
+	if json.Unmarshal(data, &body) == nil && body.Error.Code != "" {
+		e.Code, e.Message = body.Error.Code, body.Error.Message
+	} else {
+		e.Message = strings.TrimSpace(string(data)) // A proxy or load balancer in between
+	}
+	if e.Message == "" {
+		e.Message = http.StatusText(resp.StatusCode)
+	}
+	return e
+}
@@ -0,0 +1,473 @@
+package main
+
+// Raft clustering. When raft_peers is set the servers listed there form a
+// consensus group: every write is appended to the Raft log on the leader and
+// applied to each server's stores once a majority has it, so acknowledged
+// writes survive the loss of a minority. Followers redirect writes (and reads
+// asking for ?consistent=true) to the leader's HTTP address; other reads are
+// served locally and may lag slightly. Peers are listed as
+// id=raft_host:port@http_host:port, and every server bootstraps the cluster
+// from the same list the first time it starts.
+//
+// The stores are durable on their own, so they aren't rebuilt from a Raft
+// snapshot and the log on every start: once a batch of entries is applied and
+// synced, the index of its last entry is written to raft_applied.json, and
+// after a restart the entries up to it are skipped rather than applied a
+// second time. Only when a snapshot is newer than that, say after the stores
+// lost unsynced writes, is it restored first.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+)
+
+const (
+	raftApplyTimeout = 10 * time.Second
+	raftSnapshots    = 2 // Snapshots kept on disk
+)
+
+var ErrNotLeader = errors.New("not the cluster leader")
+
+// cluster is set when this server is part of a Raft group.
+var cluster *raftCluster
+
+// command is a write replicated through the Raft log.
+type command struct {
+	Op          string            `json:"op"` // put, add, replace, put_conditional, put_batch, merge, delete, delete_prefix or drop_bucket
+	Bucket      string            `json:"bucket,omitempty"`
+	Key         string            `json:"key,omitempty"`
+	Value       string            `json:"value,omitempty"`
+	Type        valueType         `json:"type,omitempty"`
+	IfMatch     string            `json:"if_match,omitempty"`
+	IfNoneMatch string            `json:"if_none_match,omitempty"`
+	Values      map[string]string `json:"values,omitempty"` // put_batch
+	Merge       string            `json:"merge,omitempty"`  // Operator name for merge
+}
+
+type raftPeer struct {
+	id       raft.ServerID
+	raftAddr raft.ServerAddress
+	httpAddr string
+}
+
+type raftCluster struct {
+	raft  *raft.Raft
+	store *raftStore
+	peers map[raft.ServerID]raftPeer
+}
+
+type ClusterStatus struct {
+	ID           string            `json:"id"`
+	State        string            `json:"state"`
+	Leader       string            `json:"leader"`
+	LeaderHTTP   string            `json:"leader_http,omitempty"`
+	Peers        []string          `json:"peers"`
+	LastIndex    uint64            `json:"last_index"`
+	AppliedIndex uint64            `json:"applied_index"`
+	Stats        map[string]string `json:"stats"`
+}
+
+func parseRaftPeers(list []string) (map[raft.ServerID]raftPeer, error) {
+	peers := make(map[raft.ServerID]raftPeer, len(list))
+	for _, entry := range list {
+		id, addrs, ok := strings.Cut(entry, "=")
+		raftAddr, httpAddr, ok2 := strings.Cut(addrs, "@")
+		if !ok || !ok2 || id == "" || raftAddr == "" || httpAddr == "" {
+			return nil, fmt.Errorf("raft peer %q is not id=raft_host:port@http_host:port", entry)
+		}
+		if _, dup := peers[raft.ServerID(id)]; dup {
+			return nil, fmt.Errorf("raft peer %q listed twice", id)
+		}
+		peers[raft.ServerID(id)] = raftPeer{id: raft.ServerID(id), raftAddr: raft.ServerAddress(raftAddr), httpAddr: httpAddr}
+	}
+	return peers, nil
+}
+
+func raftNodeID() raft.ServerID {
+	if cfg().RaftNodeID != "" {
+		return raft.ServerID(cfg().RaftNodeID)
+	}
+	return raft.ServerID(cfg().NodeName)
+}
+
+// startCluster joins (or bootstraps) the Raft group described by the config.
+func startCluster() (*raftCluster, error) {
+	peers, err := parseRaftPeers(cfg().RaftPeers)
+	if err != nil {
+		return nil, err
+	}
+	self, ok := peers[raftNodeID()]
+	if !ok {
+		return nil, fmt.Errorf("raft_peers has no entry for this node (%s)", raftNodeID())
+	}
+
+	dir := filepath.Join(cfg().DataDir, "raft")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	store, err := openRaftStore(filepath.Join(dir, "log"), filepath.Join(dir, "stable.json"))
+	if err != nil {
+		return nil, fmt.Errorf("opening raft log: %w", err)
+	}
+	snaps, err := raft.NewFileSnapshotStore(dir, raftSnapshots, os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	advertise, err := net.ResolveTCPAddr("tcp", string(self.raftAddr))
+	if err != nil {
+		return nil, err
+	}
+	bind := cfg().RaftBind
+	if bind == "" {
+		bind = string(self.raftAddr)
+	}
+	transport, err := raft.NewTCPTransport(bind, advertise, 3, 10*time.Second, os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+
+	fsm := &kvFSM{}
+	if fsm.applied, err = loadRaftApplied(); err != nil {
+		return nil, fmt.Errorf("reading applied raft index: %w", err)
+	}
+	rc := raft.DefaultConfig()
+	rc.LocalID = self.id
+	rc.Logger = hclog.New(&hclog.LoggerOptions{Name: "raft", Level: hclog.LevelFromString(cfg().LogLevel.String()), Output: os.Stderr})
+	rc.SnapshotThreshold = cfg().RaftSnapshotThreshold
+	applied := fsm.applied // Owned by the FSM goroutine once raft starts
+	if list, err := snaps.List(); err == nil && (len(list) == 0 || list[0].Index <= applied) {
+		rc.NoSnapshotRestoreOnStart = true // The stores already hold everything in it
+	}
+	r, err := raft.NewRaft(rc, fsm, store, store, snaps, transport)
+	if err != nil {
+		return nil, err
+	}
+
+	existing, err := raft.HasExistingState(store, store, snaps)
+	if err != nil {
+		return nil, err
+	}
+	if !existing {
+		var servers []raft.Server
+		for _, p := range peers {
+			servers = append(servers, raft.Server{ID: p.id, Address: p.raftAddr})
+		}
+		if err := r.BootstrapCluster(raft.Configuration{Servers: servers}).Error(); err != nil && !errors.Is(err, raft.ErrCantBootstrap) {
+			return nil, err
+		}
+		slog.Info("raft cluster bootstrapped", "peers", len(servers))
+	}
+	slog.Info("raft started", "id", self.id, "addr", self.raftAddr, "applied_index", applied)
+	return &raftCluster{raft: r, store: store, peers: peers}, nil
+}
+
+// apply replicates cmd through the Raft log and returns the result of
+// applying it.
+func (c *raftCluster) apply(ctx context.Context, cmd command) error {
+	_, err := c.applyResponse(ctx, cmd)
+	return err
+}
+
+// applyResponse is apply returning what the FSM answered for cmd.
+func (c *raftCluster) applyResponse(ctx context.Context, cmd command) (any, error) {
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	timeout := raftApplyTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = min(timeout, time.Until(deadline))
+	}
+	f := c.raft.Apply(data, timeout)
+	if err := f.Error(); err != nil {
+		if errors.Is(err, raft.ErrNotLeader) || errors.Is(err, raft.ErrLeadershipLost) {
+			return nil, ErrNotLeader
+		}
+		if errors.Is(err, raft.ErrEnqueueTimeout) && ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	if err, ok := f.Response().(error); ok {
+		return nil, err
+	}
+	return f.Response(), nil
+}
+
+func (c *raftCluster) isLeader() bool {
+	return c.raft.State() == raft.Leader
+}
+
+// leaderHTTP returns the leader's HTTP address, or "" when there is no
+// leader.
+func (c *raftCluster) leaderHTTP() string {
+	_, id := c.raft.LeaderWithID()
+	return c.peers[id].httpAddr
+}
+
+func (c *raftCluster) shutdown() error {
+	err := c.raft.Shutdown().Error()
+	return errors.Join(err, c.store.Close())
+}
+
+func (c *raftCluster) status() ClusterStatus {
+	addr, id := c.raft.LeaderWithID()
+	st := ClusterStatus{
+		ID:           string(raftNodeID()),
+		State:        c.raft.State().String(),
+		Leader:       string(id),
+		LeaderHTTP:   c.leaderHTTP(),
+		LastIndex:    c.raft.LastIndex(),
+		AppliedIndex: c.raft.AppliedIndex(),
+		Stats:        c.raft.Stats(),
+		Peers:        []string{},
+	}
+	if id == "" && addr != "" {
+		st.Leader = string(addr)
+	}
+	if f := c.raft.GetConfiguration(); f.Error() == nil {
+		for _, s := range f.Configuration().Servers {
+			st.Peers = append(st.Peers, string(s.ID)+"="+string(s.Address))
+		}
+	}
+	return st
+}
+
+func raftAppliedFile() string {
+	return filepath.Join(cfg().DataDir, "raft_applied.json")
+}
+
+type raftAppliedState struct {
+	Index uint64 `json:"index"`
+}
+
+// loadRaftApplied returns the index of the last entry the stores are known
+// to hold, 0 when none is recorded.
+func loadRaftApplied() (uint64, error) {
+	data, err := os.ReadFile(raftAppliedFile())
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	var st raftAppliedState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return 0, err
+	}
+	return st.Index, nil
+}
+
+// saveRaftApplied replaces raft_applied.json, syncing it before it takes the
+// old one's place.
+func saveRaftApplied(index uint64) error {
+	data, err := json.Marshal(raftAppliedState{Index: index})
+	if err != nil {
+		return err
+	}
+	tmp := raftAppliedFile() + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, raftAppliedFile())
+}
+
+// kvFSM applies committed commands to the local stores. Raft calls it from a
+// single goroutine.
+type kvFSM struct {
+	applied uint64 // Last entry the stores hold
+}
+
+func (f *kvFSM) Apply(l *raft.Log) any {
+	return f.ApplyBatch([]*raft.Log{l})[0]
+}
+
+// ApplyBatch applies the entries the stores don't hold yet, then records the
+// last index once they are on disk.
+func (f *kvFSM) ApplyBatch(logs []*raft.Log) []any {
+	out := make([]any, len(logs))
+	for i, l := range logs {
+		if l.Index <= f.applied || l.Type != raft.LogCommand {
+			continue // Applied before the last restart
+		}
+		out[i] = applyCommand(l)
+	}
+	if last := logs[len(logs)-1].Index; last > f.applied {
+		if err := f.record(last); err != nil {
+			slog.Error("failed to record applied raft index", "index", last, "error", err)
+		}
+	}
+	return out
+}
+
+// record syncs every store and notes that they hold the entries up to index.
+// Until it succeeds, a restart applies those entries again.
+func (f *kvFSM) record(index uint64) error {
+	f.applied = index
+	var errs []error
+	for _, n := range allNodes() {
+		n.mu.Lock()
+		if err := n.syncLocked(); err != nil {
+			errs = append(errs, err)
+		} else {
+			n.dirty = false
+		}
+		n.mu.Unlock()
+	}
+	errs = append(errs, changes.sync())
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	return saveRaftApplied(index)
+}
+
+func applyCommand(l *raft.Log) any {
+	var cmd command
+	if err := json.Unmarshal(l.Data, &cmd); err != nil {
+		slog.Error("skipping undecodable raft command", "index", l.Index, "error", err)
+		return err
+	}
+	if cmd.Op == "drop_bucket" {
+		return deleteBucket(cmd.Bucket)
+	}
+	nodes := server_nodes
+	if cmd.Bucket != "" {
+		var err error
+		if nodes, err = bucketNodes(cmd.Bucket, cmd.Op != "delete" && cmd.Op != "delete_prefix"); err != nil {
+			return err
+		}
+	}
+	switch cmd.Op {
+	case "put":
+		return putLocal(context.Background(), cmd.Key, cmd.Value, cmd.Type, nodes)
+	case "add", "replace":
+		return putIfLocal(context.Background(), cmd.Op, cmd.Key, cmd.Value, nodes)
+	case "put_batch":
+		return putBatchLocal(context.Background(), cmd.Values, nodes)
+	case "put_conditional":
+		return putConditionalLocal(context.Background(), cmd.Key, cmd.Value, cmd.Type, cmd.IfMatch, cmd.IfNoneMatch, nodes)
+	case "merge":
+		return mergeLocal(context.Background(), cmd.Merge, cmd.Key, cmd.Value, nodes)
+	case "delete":
+		return deleteLocal(context.Background(), cmd.Key, nodes)
+	case "delete_prefix":
+		deleted, err := deletePrefixLocal(context.Background(), cmd.Key, nodes)
+		if err != nil {
+			return err
+		}
+		return deleted
+	}
+	return fmt.Errorf("unknown raft command %q", cmd.Op)
+}
+
+func (f *kvFSM) Snapshot() (raft.FSMSnapshot, error) {
+	return kvSnapshot{Snapshot: snapshot(), Applied: f.applied}, nil
+}
+
+func (f *kvFSM) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+	var snap kvSnapshot
+	if err := json.NewDecoder(rc).Decode(&snap); err != nil {
+		return err
+	}
+	slog.Info("restoring stores from raft snapshot", "stores", len(snap.Stores), "applied_index", snap.Applied)
+	if err := restoreSnapshot(snap.Snapshot); err != nil {
+		return err
+	}
+	return f.record(snap.Applied)
+}
+
+// kvSnapshot is a Snapshot with the index of the last entry it holds, 0 in
+// snapshots taken before that was recorded.
+type kvSnapshot struct {
+	Snapshot
+	Applied uint64 `json:"applied,omitempty"`
+}
+
+func (s kvSnapshot) Persist(sink raft.SnapshotSink) error {
+	if err := json.NewEncoder(sink).Encode(s); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (kvSnapshot) Release() {}
+
+// clusterRedirect sends writes, and reads that ask for ?consistent=true, to
+// the leader. The leader confirms it still holds leadership before serving a
+// consistent read.
+func clusterRedirect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cluster == nil || strings.HasPrefix(r.URL.Path, "/admin/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		write := requiredAccess(r) == accessWrite
+		consistent := r.URL.Query().Get("consistent") == "true"
+		if !write && !consistent {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !cluster.isLeader() {
+			leader := cluster.leaderHTTP()
+			if leader == "" {
+				w.Header().Set("Retry-After", "1")
+				writeError(w, r, http.StatusServiceUnavailable, codeNoLeader, "no cluster leader elected")
+				return
+			}
+			scheme := "http"
+			if cfg().TLSCert != "" {
+				scheme = "https"
+			}
+			http.Redirect(w, r, scheme+"://"+leader+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+			return
+		}
+		if consistent && !write {
+			if err := cluster.raft.VerifyLeader().Error(); err != nil {
+				w.Header().Set("Retry-After", "1")
+				writeError(w, r, http.StatusServiceUnavailable, codeNotLeader, ErrNotLeader.Error())
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func adminClusterHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+	if cluster == nil {
+		writeError(w, r, http.StatusNotFound, codeClusterDisabled, "clustering is not enabled")
+		return
+	}
+	writeJSON(w, cluster.status())
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// startTestCluster starts a single-member Raft group on a free port and
+// waits for it to lead.
+func startTestCluster(t *testing.T) *raftCluster {
+	t.Helper()
+	c, err := startCluster()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cluster = c
+	deadline := time.Now().Add(10 * time.Second)
+	for !c.isLeader() {
+		if time.Now().After(deadline) {
+			t.Fatal("no leader elected")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err := c.raft.Barrier(5 * time.Second).Error(); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestClusterRestartDoesNotReapply(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	withTestConfig(t, func(c *Config) {
+		c.RaftNodeID = "n1"
+		c.RaftPeers = []string{"n1=" + addr + "@127.0.0.1:1"}
+		c.LogLevel = slog.LevelError
+	})
+	t.Cleanup(func() {
+		if cluster != nil {
+			cluster.shutdown()
+			cluster = nil
+		}
+		os.RemoveAll(raftAppliedFile())
+	})
+
+	const bucket = "raft-restart"
+	c := startTestCluster(t)
+	nodes, err := bucketNodes(bucket, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for _, part := range []string{"a", "b", "c"} {
+		if err := merge(ctx, "append", "k", part, nodes); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	cluster = nil
+	applied, err := loadRaftApplied()
+	if err != nil || applied == 0 {
+		t.Fatalf("applied index %d recorded (%v)", applied, err)
+	}
+
+	nodes = reopenBucket(t, bucket)
+	startTestCluster(t)
+	if got, err := get(ctx, "k", nodes); err != nil || got != "abc" {
+		t.Fatalf("after a restart k = %q (%v), want abc", got, err)
+	}
+	if err := merge(ctx, "append", "k", "d", nodes); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := get(ctx, "k", nodes); got != "abcd" {
+		t.Fatalf("k = %q after appending again, want abcd", got)
+	}
+}
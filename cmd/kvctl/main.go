@@ -0,0 +1,292 @@
+package main
+
+// kvctl is a small command line client for the kv store HTTP API.
+//
+//	kvctl get <key>
+//	kvctl put <key> [value]    (value read from stdin when omitted or "-")
+//	kvctl put -f <file> <key>
+//	kvctl del <key>
+//	kvctl keys [prefix]
+//	kvctl dump
+//	kvctl stats
+//	kvctl shell
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+type kvClient struct {
+	addr   string
+	apiKey string
+	bucket string // Empty for the default key space
+	http   *http.Client
+}
+
+func main() {
+	defaultAddr := os.Getenv("KVCTL_ADDR")
+	if defaultAddr == "" {
+		defaultAddr = "http://localhost:8090"
+	}
+	addr := flag.String("addr", defaultAddr, "base URL of the kv store, or unix:///path for a unix socket (env KVCTL_ADDR)")
+	timeout := flag.Duration("timeout", 10*time.Second, "request timeout")
+	caFile := flag.String("cacert", "", "PEM CA bundle used to verify the server certificate")
+	certFile := flag.String("cert", "", "PEM client certificate for mutual TLS")
+	keyFile := flag.String("key", "", "PEM private key for -cert")
+	bucket := flag.String("bucket", os.Getenv("KVCTL_BUCKET"), "bucket to operate on (env KVCTL_BUCKET)")
+	apiKey := flag.String("api-key", os.Getenv("KVCTL_API_KEY"), "API key sent as a bearer token (env KVCTL_API_KEY); use user:pass@ in -addr for basic auth")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+	tlsConf, err := clientTLSConfig(*caFile, *certFile, *keyFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "kvctl:", err)
+		os.Exit(1)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	base := strings.TrimRight(*addr, "/")
+	if path, ok := strings.CutPrefix(base, "unix://"); ok {
+		transport.Proxy = nil
+		transport.DialContext = func(ctx context.Context, _ string, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", path)
+		}
+		base = "http://unix"
+	}
+	transport.TLSClientConfig = tlsConf
+	c := &kvClient{addr: base, apiKey: *apiKey, bucket: *bucket, http: &http.Client{Timeout: *timeout, Transport: transport}}
+	if err := run(c, flag.Arg(0), flag.Args()[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, "kvctl:", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprint(os.Stderr, `usage: kvctl [-addr URL] <command> [args]
+
+commands:
+  get <key>              print the value stored at key
+  put <key> [value]      store value (read from stdin when omitted or "-")
+  put -f <file> <key>    store the contents of file
+  del <key>              delete key
+  keys [prefix]          list keys, optionally filtered by prefix
+  dump                   print every key-value pair as JSON
+  stats                  print node statistics as JSON
+  shell                  start an interactive shell
+
+flags:
+`)
+	flag.PrintDefaults()
+}
+
+func clientTLSConfig(caFile string, certFile string, keyFile string) (*tls.Config, error) {
+	conf := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.RootCAs = x509.NewCertPool()
+		if !conf.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s contains no PEM certificates", caFile)
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	return conf, nil
+}
+
+func run(c *kvClient, cmd string, args []string) error {
+	switch cmd {
+	case "get":
+		if len(args) != 1 {
+			return errors.New("usage: get <key>")
+		}
+		value, err := c.get(args[0])
+		if err != nil {
+			return err
+		}
+		fmt.Println(value)
+	case "put":
+		key, value, err := putArgs(args)
+		if err != nil {
+			return err
+		}
+		return c.put(key, value)
+	case "del":
+		if len(args) != 1 {
+			return errors.New("usage: del <key>")
+		}
+		return c.del(args[0])
+	case "keys":
+		if len(args) > 1 {
+			return errors.New("usage: keys [prefix]")
+		}
+		prefix := ""
+		if len(args) == 1 {
+			prefix = args[0]
+		}
+		keys, err := c.keys(prefix)
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			fmt.Println(k)
+		}
+	case "dump":
+		return c.printJSON("/dump?" + strings.TrimPrefix(c.bucketParam(), "&"))
+	case "stats":
+		return c.printJSON("/admin/stats")
+	case "shell":
+		return runShell(c)
+	default:
+		return fmt.Errorf("unknown command %q", cmd)
+	}
+	return nil
+}
+
+// putArgs resolves the key and value for put from the command line, a file,
+// or stdin.
+func putArgs(args []string) (string, string, error) {
+	fs := flag.NewFlagSet("put", flag.ContinueOnError)
+	file := fs.String("f", "", "read the value from file")
+	if err := fs.Parse(args); err != nil {
+		return "", "", err
+	}
+	args = fs.Args()
+	if len(args) == 0 || len(args) > 2 || (*file != "" && len(args) != 1) {
+		return "", "", errors.New("usage: put <key> [value] | put -f <file> <key>")
+	}
+	key := args[0]
+
+	switch {
+	case *file != "":
+		data, err := os.ReadFile(*file)
+		if err != nil {
+			return "", "", err
+		}
+		return key, string(data), nil
+	case len(args) == 2 && args[1] != "-":
+		return key, args[1], nil
+	default:
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return "", "", err
+		}
+		return key, string(data), nil
+	}
+}
+
+func (c *kvClient) keyPath(key string) string {
+	if c.bucket != "" {
+		return "/b/" + url.PathEscape(c.bucket) + "/" + url.PathEscape(key)
+	}
+	return "/" + url.PathEscape(key)
+}
+
+func (c *kvClient) bucketParam() string {
+	if c.bucket == "" {
+		return ""
+	}
+	return "&bucket=" + url.QueryEscape(c.bucket)
+}
+
+func (c *kvClient) get(key string) (string, error) {
+	body, err := c.do(http.MethodGet, c.keyPath(key), nil)
+	return string(body), err
+}
+
+func (c *kvClient) put(key string, value string) error {
+	payload, err := json.Marshal(struct {
+		Value string `json:"value"`
+	}{value})
+	if err != nil {
+		return err
+	}
+	_, err = c.do(http.MethodPost, c.keyPath(key), payload)
+	return err
+}
+
+func (c *kvClient) del(key string) error {
+	_, err := c.do(http.MethodDelete, c.keyPath(key), nil)
+	return err
+}
+
+func (c *kvClient) keys(prefix string) ([]string, error) {
+	body, err := c.do(http.MethodGet, "/keys?prefix="+url.QueryEscape(prefix)+c.bucketParam(), nil)
+	if err != nil {
+		return nil, err
+	}
+	var keys []string
+	if err := json.Unmarshal(body, &keys); err != nil {
+		return nil, fmt.Errorf("decoding keys: %w", err)
+	}
+	return keys, nil
+}
+
+func (c *kvClient) printJSON(path string) error {
+	body, err := c.do(http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+	var out bytes.Buffer
+	if err := json.Indent(&out, bytes.TrimSpace(body), "", "  "); err != nil {
+		os.Stdout.Write(body)
+		return nil
+	}
+	out.WriteByte('\n')
+	_, err = out.WriteTo(os.Stdout)
+	return err
+}
+
+func (c *kvClient) do(method string, path string, payload []byte) ([]byte, error) {
+	var reqBody io.Reader
+	if payload != nil {
+		reqBody = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequest(method, c.addr+path, reqBody)
+	if err != nil {
+		return nil, err
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
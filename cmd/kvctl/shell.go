@@ -0,0 +1,265 @@
+package main
+
+// Interactive shell for kvctl. On a terminal it runs a small line editor with
+// history (up/down arrows, persisted to ~/.kvctl_history) and tab completion
+// of commands and keys; otherwise it reads commands line by line so scripts
+// can be piped in.
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	shellPrompt     = "kv> "
+	maxShellHistory = 500
+)
+
+var shellCommands = []string{"get", "put", "del", "keys", "dump", "stats", "history", "help", "exit"}
+
+type shell struct {
+	c           *kvClient
+	history     []string
+	historyFile string
+	in          *bufio.Reader
+}
+
+func runShell(c *kvClient) error {
+	sh := &shell{c: c, in: bufio.NewReader(os.Stdin)}
+	if home, err := os.UserHomeDir(); err == nil {
+		sh.historyFile = filepath.Join(home, ".kvctl_history")
+		sh.loadHistory()
+	}
+
+	interactive := isTerminal(os.Stdin)
+	if interactive {
+		fmt.Printf("connected to %s, type \"help\" for commands\n", c.addr)
+	}
+	for {
+		var line string
+		var err error
+		if interactive {
+			line, err = sh.readLineRaw()
+		} else {
+			line, err = sh.in.ReadString('\n')
+			if err == io.EOF && line != "" {
+				err = nil
+			}
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				if interactive {
+					fmt.Println()
+				}
+				return nil
+			}
+			return err
+		}
+
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		sh.addHistory(line)
+		if line == "exit" || line == "quit" {
+			return nil
+		}
+		if err := sh.exec(line); err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+		}
+	}
+}
+
+func (sh *shell) exec(line string) error {
+	cmd, rest, _ := strings.Cut(line, " ")
+	rest = strings.TrimSpace(rest)
+	switch cmd {
+	case "help":
+		fmt.Print(`commands:
+  get <key>            print the value stored at key
+  put <key> <value>    store value (the rest of the line, spaces included)
+  del <key>            delete key
+  keys [prefix]        list keys, optionally filtered by prefix
+  dump                 print every key-value pair as JSON
+  stats                print node statistics as JSON
+  history              show command history
+  exit                 leave the shell
+`)
+		return nil
+	case "history":
+		for i, h := range sh.history {
+			fmt.Printf("%4d  %s\n", i+1, h)
+		}
+		return nil
+	case "put":
+		key, value, ok := strings.Cut(rest, " ")
+		if !ok || key == "" {
+			return errors.New("usage: put <key> <value>")
+		}
+		if err := sh.c.put(key, value); err != nil {
+			return err
+		}
+		fmt.Println("ok")
+		return nil
+	case "del":
+		if err := run(sh.c, cmd, strings.Fields(rest)); err != nil {
+			return err
+		}
+		fmt.Println("ok")
+		return nil
+	}
+	return run(sh.c, cmd, strings.Fields(rest))
+}
+
+func (sh *shell) loadHistory() {
+	data, err := os.ReadFile(sh.historyFile)
+	if err != nil {
+		return
+	}
+	for _, l := range strings.Split(string(data), "\n") {
+		if l != "" {
+			sh.history = append(sh.history, l)
+		}
+	}
+	if len(sh.history) > maxShellHistory {
+		sh.history = sh.history[len(sh.history)-maxShellHistory:]
+	}
+}
+
+func (sh *shell) addHistory(line string) {
+	if n := len(sh.history); n > 0 && sh.history[n-1] == line {
+		return // Skip consecutive duplicates
+	}
+	sh.history = append(sh.history, line)
+	if len(sh.history) > maxShellHistory {
+		sh.history = sh.history[1:]
+	}
+	if sh.historyFile == "" {
+		return
+	}
+	f, err := os.OpenFile(sh.historyFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	fmt.Fprintln(f, line)
+}
+
+// readLineRaw reads one line with the terminal in raw mode. The terminal is
+// restored before returning so command output prints normally.
+func (sh *shell) readLineRaw() (string, error) {
+	restore, err := makeRaw(os.Stdin)
+	if err != nil {
+		fmt.Print(shellPrompt)
+		return sh.in.ReadString('\n')
+	}
+	defer restore()
+
+	var line []rune
+	histPos := len(sh.history)
+	redraw := func() {
+		fmt.Print("\r\x1b[K" + shellPrompt + string(line))
+	}
+	redraw()
+
+	for {
+		r, _, err := sh.in.ReadRune()
+		if err != nil {
+			return "", err
+		}
+		switch r {
+		case '\r', '\n':
+			fmt.Print("\r\n")
+			return string(line), nil
+		case 3: // Ctrl-C drops the current line
+			fmt.Print("^C\r\n")
+			line = line[:0]
+			histPos = len(sh.history)
+			redraw()
+		case 4: // Ctrl-D exits on an empty line
+			if len(line) == 0 {
+				return "", io.EOF
+			}
+		case 21: // Ctrl-U clears the line
+			line = line[:0]
+			redraw()
+		case 127, 8:
+			if len(line) > 0 {
+				line = line[:len(line)-1]
+				redraw()
+			}
+		case '\t':
+			line = []rune(sh.complete(string(line)))
+			redraw()
+		case 27: // Escape sequences: only up/down arrows are handled
+			if b, _ := sh.in.ReadByte(); b != '[' {
+				continue
+			}
+			b, _ := sh.in.ReadByte()
+			switch {
+			case b == 'A' && histPos > 0:
+				histPos--
+				line = []rune(sh.history[histPos])
+			case b == 'B' && histPos < len(sh.history):
+				histPos++
+				line = line[:0]
+				if histPos < len(sh.history) {
+					line = []rune(sh.history[histPos])
+				}
+			}
+			redraw()
+		default:
+			if r >= ' ' {
+				line = append(line, r)
+				fmt.Print(string(r))
+			}
+		}
+	}
+}
+
+// complete expands the word being typed: the first word against the shell
+// commands and the second against the keys currently in the store. Ambiguous
+// input is extended to the longest common prefix and the candidates listed.
+func (sh *shell) complete(line string) string {
+	var candidates []string
+	head, word := "", line
+	if i := strings.LastIndexByte(line, ' '); i >= 0 {
+		head, word = line[:i+1], line[i+1:]
+		if strings.Count(strings.TrimLeft(head, " "), " ") != 1 {
+			return line // Only the command and the key are completed
+		}
+		keys, err := sh.c.keys(word)
+		if err != nil {
+			return line
+		}
+		candidates = keys
+	} else {
+		for _, c := range shellCommands {
+			if strings.HasPrefix(c, word) {
+				candidates = append(candidates, c)
+			}
+		}
+	}
+
+	switch len(candidates) {
+	case 0:
+		return line
+	case 1:
+		return head + candidates[0] + " "
+	}
+	sort.Strings(candidates)
+	fmt.Print("\r\n" + strings.Join(candidates, "  ") + "\r\n")
+	prefix := candidates[0]
+	for _, c := range candidates[1:] {
+		for !strings.HasPrefix(c, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	return head + prefix
+}
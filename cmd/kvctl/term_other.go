@@ -0,0 +1,19 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// Raw terminal mode is only implemented for Linux; elsewhere the shell falls
+// back to plain line input without history navigation or completion.
+
+func isTerminal(f *os.File) bool {
+	return false
+}
+
+func makeRaw(f *os.File) (func(), error) {
+	return nil, errors.New("raw terminal mode not supported on this platform")
+}
@@ -0,0 +1,185 @@
+package main
+
+// Compaction on demand. Segments are compacted automatically as they fill up
+// with garbage (see segment.go), unless compact_auto is off or a store holds
+// fewer than compact_dead_bytes of dead records. POST /admin/compact starts a
+// run in the background that compacts every sealed segment holding any
+// garbage, in every store or only those of ?bucket=, so operators can
+// reclaim space during a quiet window instead; GET /admin/compact/status
+// reports the progress of the current or last run. One run goes at a time,
+// and it waits for automatic compactions of the same store to finish rather
+// than racing them.
+
+import (
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// CompactionStatus is the answer of GET /admin/compact/status.
+type CompactionStatus struct {
+	Running              bool      `json:"running"`
+	Bucket               string    `json:"bucket,omitempty"` // Set when the run is limited to one bucket
+	StartedAt            time.Time `json:"started_at,omitzero"`
+	FinishedAt           time.Time `json:"finished_at,omitzero"`
+	Segments             int       `json:"segments"` // Sealed segments picked for the run
+	SegmentsDone         int       `json:"segments_done"`
+	BytesTotal           int64     `json:"bytes_total"` // Size of the segments picked
+	BytesRead            int64     `json:"bytes_read"`
+	BytesRewritten       int64     `json:"bytes_rewritten"` // Live records copied to the active segments
+	KeysRetained         int64     `json:"keys_retained"`   // Records copied, current and kept versions alike
+	BytesReclaimed       int64     `json:"bytes_reclaimed"`
+	EstimatedSecondsLeft float64   `json:"estimated_seconds_left,omitempty"`
+	Error                string    `json:"error,omitempty"`
+}
+
+// compactionRun tracks a run started with POST /admin/compact.
+type compactionRun struct {
+	mu        sync.Mutex
+	status    CompactionStatus
+	rewritten int64 // Bytes copied out of the segment being compacted
+}
+
+var compaction compactionRun
+
+// record counts one record read by a run; copied records were rewritten.
+func (c *compactionRun) record(size int64, copied bool) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.status.BytesRead += size
+	if copied {
+		c.status.BytesRewritten += size
+		c.status.KeysRetained++
+		c.rewritten += size
+	}
+}
+
+func (c *compactionRun) segmentDone(seg *segment, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	rewritten := c.rewritten
+	c.rewritten = 0
+	if err != nil {
+		c.status.Error = err.Error()
+		return
+	}
+	c.status.SegmentsDone++
+	c.status.BytesReclaimed += seg.size - rewritten
+}
+
+func (c *compactionRun) currentStatus() CompactionStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st := c.status
+	if st.Running && st.BytesRead > 0 {
+		elapsed := time.Since(st.StartedAt).Seconds()
+		st.EstimatedSecondsLeft = elapsed * float64(st.BytesTotal-st.BytesRead) / float64(st.BytesRead)
+	}
+	return st
+}
+
+// start begins a run over nodes, unless one is running already.
+func (c *compactionRun) start(bucket string, nodes []*ServerNode) (CompactionStatus, bool) {
+	c.mu.Lock()
+	if c.status.Running {
+		c.mu.Unlock()
+		return c.currentStatus(), false
+	}
+	c.status = CompactionStatus{Running: true, Bucket: bucket, StartedAt: time.Now().UTC()}
+	picked := make(map[*ServerNode][]*segment, len(nodes))
+	for _, n := range nodes {
+		n.mu.RLock()
+		if n.segs != nil && !n.dropped {
+			for _, seg := range n.segs.segments[:len(n.segs.segments)-1] {
+				if seg.live < seg.size {
+					picked[n] = append(picked[n], seg)
+					c.status.Segments++
+					c.status.BytesTotal += seg.size
+				}
+			}
+		}
+		n.mu.RUnlock()
+	}
+	st := c.status
+	c.mu.Unlock()
+	slog.Info("compaction started", "bucket", bucket, "segments", st.Segments, "bytes", st.BytesTotal)
+	go c.run(nodes, picked)
+	return st, true
+}
+
+func (c *compactionRun) run(nodes []*ServerNode, picked map[*ServerNode][]*segment) {
+	for _, n := range nodes {
+		for _, seg := range picked[n] {
+			if !n.claimCompaction() {
+				break // Dropped, or read-only mode came on
+			}
+			c.segmentDone(seg, n.runCompaction(seg, c))
+		}
+	}
+	c.mu.Lock()
+	c.status.Running = false
+	c.status.FinishedAt = time.Now().UTC()
+	c.mu.Unlock()
+	st := c.currentStatus()
+	slog.Info("compaction finished", "segments", st.SegmentsDone, "bytes_reclaimed", st.BytesReclaimed, "duration", st.FinishedAt.Sub(st.StartedAt), "error", st.Error)
+}
+
+// claimCompaction waits for any compaction of n to finish and marks n as
+// compacting, reporting false if n can't be compacted any more.
+func (n *ServerNode) claimCompaction() bool {
+	for {
+		n.mu.Lock()
+		if n.dropped || n.segs == nil || read_only.Load() {
+			n.mu.Unlock()
+			return false
+		}
+		if !n.compacting {
+			n.compacting = true
+			n.mu.Unlock()
+			return true
+		}
+		n.mu.Unlock()
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// adminCompactHandler serves POST /admin/compact[?bucket=b].
+func adminCompactHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+	if read_only.Load() {
+		writeStoreError(w, r, ErrReadOnly)
+		return
+	}
+	nodes := allNodes()
+	bucket := r.URL.Query().Get("bucket")
+	if bucket != "" {
+		var ok bool
+		if nodes, ok = requestNodes(w, r, false); !ok {
+			return
+		}
+	}
+	st, started := compaction.start(bucket, nodes)
+	if !started {
+		writeError(w, r, http.StatusConflict, codeCompactionRunning, "a compaction is already running")
+		return
+	}
+	writeJSON(w, st)
+}
+
+// adminCompactStatusHandler serves GET /admin/compact/status.
+func adminCompactStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, compaction.currentStatus())
+}
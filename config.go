@@ -0,0 +1,1116 @@
+package main
+
+// Server configuration. Values are resolved in order of increasing priority:
+// built-in defaults, the optional config file (-config / KV_CONFIG), KV_*
+// environment variables, then command line flags. The config file is a flat
+// YAML mapping using the same names as the table below, e.g.
+//
+//	port: 8091
+//	data_dir: /var/lib/kvstore
+//	max_store_bytes: 64MB
+//	sync_policy: interval
+//
+// Fields marked reload can be changed while running: edit the file and send
+// SIGHUP or POST /admin/reload (see reload.go).
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	syncAlways   = "always"   // Save the node store after every write
+	syncInterval = "interval" // Save dirty node stores every SyncInterval
+)
+
+type Config struct {
+	Host                      string
+	Port                      string
+	TCP                       bool        // Listen on Host:Port
+	UnixSocket                string      // Unix socket path to listen on, empty for none
+	UnixSocketMode            os.FileMode // Permissions of UnixSocket
+	NodeName                  string
+	DataDir                   string
+	MaxStoreBytes             int64 // Sum of key and value bytes per node, 0 for no limit
+	EvictionPolicy            string
+	MaxKeyBytes               int64
+	MaxValueBytes             int64
+	BucketQuotas              map[string]int64 // Bucket name, or * for the rest, -> bytes across its stores
+	SyncPolicy                string
+	SyncInterval              time.Duration
+	LogLevel                  slog.Level
+	MemcachedPort             string
+	ShutdownTimeout           time.Duration
+	RequestTimeout            time.Duration // Deadline for each HTTP request, 0 for none
+	ReadHeaderTimeout         time.Duration
+	ReadTimeout               time.Duration
+	WriteTimeout              time.Duration
+	IdleTimeout               time.Duration
+	H2C                       bool    // Serve HTTP/2 without TLS on plaintext listeners
+	KeepAlives                bool    // Keep HTTP/1.1 connections open between requests
+	MaxConns                  int     // Open HTTP connections across listeners, 0 for no limit
+	MaxHeaderBytes            int64   // Size of a request's headers
+	LogSampleRate             float64 // Fraction of successful requests written to the access log
+	LogRedact                 bool    // Hide values passed in query strings from the access log
+	TLSCert                   string
+	TLSKey                    string
+	TLSClientCA               string // PEM bundle used to verify client certificates
+	TLSRequireClientCert      bool
+	APIKeysRW                 []string // Credentials allowed to read and write
+	APIKeysRO                 []string // Credentials allowed to read only
+	BasicAuthRW               []string // user:password pairs allowed to read and write
+	BasicAuthRO               []string // user:password pairs allowed to read only
+	RateLimit                 float64  // Requests per second per client, 0 for no limit
+	RateBurst                 int
+	MaxInFlight               int           // Concurrent HTTP requests, 0 for no limit
+	ChangesMaxBytes           int64         // Size at which the change log drops its older half, 0 for no limit
+	ReplicaOf                 string        // Primary to follow as a read-only replica (host:port or URL)
+	ReplicaAPIKey             string        // Credential presented to the primary
+	HandoffMaxBytes           int64         // Changes kept per unreachable follower, 0 to keep none
+	HandoffExpiry             time.Duration // How long an unreachable follower is kept for
+	RaftNodeID                string        // Defaults to NodeName
+	RaftPeers                 []string      // id=raft_host:port@http_host:port for every cluster member, this one included
+	RaftBind                  string        // Raft listen address when it differs from the advertised one
+	RaftSnapshotThreshold     uint64        // Log entries between Raft snapshots
+	Proxy                     bool          // Route requests to Nodes instead of storing data
+	Nodes                     []string      // Backend stores for proxy mode (host:port or URL)
+	Gossip                    bool          // Take part in gossip membership, see gossip.go
+	GossipSeeds               []string      // Members to join the cluster through (host:port or URL)
+	GossipAdvertise           string        // Address other members reach this server at, defaults to hostname:port
+	GossipAPIKey              string        // Credential presented to other members
+	GossipInterval            time.Duration // Between gossip rounds
+	GossipFailureTimeout      time.Duration // Silence after which a member is considered failed
+	BloomFilter               bool          // Keep a bloom filter per store to skip lookups of missing keys
+	CacheBytes                int64         // Size of the LRU read cache, 0 to disable
+	MutexProfileFraction      int           // Report 1 in this many mutex contention events to the mutex profile, 0 to disable
+	Gzip                      bool          // Compress GET responses for clients that accept gzip
+	CacheMaxAge               time.Duration // How long caches may reuse a read without revalidating it
+	SegmentBytes              int64         // Size at which the active segment is sealed
+	CompactAuto               bool          // Compact segments as they fill up with garbage
+	CompactDeadBytes          int64         // Garbage a store must hold before it is compacted automatically
+	CheckpointInterval        time.Duration // How often the segment index is checkpointed, 0 for only on shutdown
+	RecoveryWorkers           int           // Segments read at once on startup, 0 for GOMAXPROCS
+	Memory                    bool          // Keep data in RAM only, never touching DataDir
+	Repair                    bool          // Truncate segments damaged in place instead of only reporting them
+	HistoryVersions           int           // Previous versions kept per key
+	HistoryMaxAge             time.Duration // Previous versions younger than this are kept too
+	BackupURL                 string        // s3://bucket/prefix backups are uploaded to, empty to disable
+	BackupEndpoint            string        // S3-compatible endpoint, empty for AWS
+	BackupRegion              string
+	BackupAccessKeyID         string
+	BackupSecretAccessKey     string
+	BackupSessionToken        string
+	BackupInterval            time.Duration // Between full backups
+	BackupIncrementalInterval time.Duration // Between incremental backups, 0 for none
+	RestoreFrom               string        // s3://bucket/key restored into empty stores on startup
+	ReadOnly                  bool          // Refuse writes, see readonly.go
+	KeyStats                  bool          // Count reads and writes per key for GET /admin/hotkeys
+	KeyStatsCheckpoint        bool          // Save the counts with index checkpoints
+}
+
+var (
+	live_cfg  atomic.Pointer[Config] // Swapped whole by reloads, see reload.go
+	log_level = new(slog.LevelVar)   // Shared with the slog handler so the level can change at runtime
+)
+
+func init() {
+	live_cfg.Store(defaultConfig())
+}
+
+// cfg returns the running config. Code serving a request reads the copy
+// requestConfig took when the request came in instead.
+func cfg() *Config {
+	return live_cfg.Load()
+}
+
+type configContext struct{}
+
+// withConfig pins the running config to a request, so that a reload part
+// way through doesn't mix old and new settings within it.
+func withConfig(r *http.Request) *http.Request {
+	if _, ok := r.Context().Value(configContext{}).(*Config); ok {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), configContext{}, cfg()))
+}
+
+// requestConfig returns the config pinned to r by withConfig.
+func requestConfig(r *http.Request) *Config {
+	return configFrom(r.Context())
+}
+
+// configFrom returns the config pinned to the request ctx belongs to, or the
+// current one for work that isn't serving a request.
+func configFrom(ctx context.Context) *Config {
+	if c, ok := ctx.Value(configContext{}).(*Config); ok {
+		return c
+	}
+	return cfg()
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Port:                      "8090",
+		TCP:                       true,
+		UnixSocketMode:            0o660,
+		NodeName:                  "kvNode1",
+		DataDir:                   ".",
+		EvictionPolicy:            evictNone,
+		MaxKeyBytes:               4 << 10,
+		MaxValueBytes:             1 << 20,
+		SyncPolicy:                syncAlways,
+		SyncInterval:              time.Second,
+		LogLevel:                  slog.LevelInfo,
+		ShutdownTimeout:           10 * time.Second,
+		RequestTimeout:            30 * time.Second,
+		ReadHeaderTimeout:         10 * time.Second,
+		IdleTimeout:               2 * time.Minute,
+		H2C:                       true,
+		KeepAlives:                true,
+		MaxHeaderBytes:            1 << 20,
+		Gzip:                      true,
+		LogSampleRate:             1,
+		LogRedact:                 true,
+		RateBurst:                 20,
+		ChangesMaxBytes:           64 << 20,
+		HandoffMaxBytes:           1 << 30,
+		HandoffExpiry:             24 * time.Hour,
+		SegmentBytes:              64 << 20,
+		CompactAuto:               true,
+		CheckpointInterval:        time.Minute,
+		BackupRegion:              "us-east-1",
+		BackupInterval:            24 * time.Hour,
+		BackupIncrementalInterval: 5 * time.Minute,
+		GossipInterval:            time.Second,
+		GossipFailureTimeout:      10 * time.Second,
+		RaftSnapshotThreshold:     8192,
+	}
+}
+
+type configField struct {
+	name    string   // Config file key; the flag name uses dashes instead of underscores
+	env     []string // Environment variables, first match wins
+	usage   string
+	boolean bool // Flag can be given without a value
+	reload  bool // Applied by a config reload; other fields need a restart
+	get     func(c *Config) string
+	set     func(c *Config, v string) error
+}
+
+var configFields = []configField{
+	{
+		name: "host", env: []string{"KV_HOST"},
+		usage: "interface to listen on (all interfaces when empty)",
+		get:   func(c *Config) string { return c.Host },
+		set:   func(c *Config, v string) error { c.Host = v; return nil },
+	},
+	{
+		name: "port", env: []string{"KV_PORT", "PORT"},
+		usage: "port to listen on",
+		get:   func(c *Config) string { return c.Port },
+		set:   func(c *Config, v string) error { c.Port = v; return nil },
+	},
+	{
+		name: "tcp", env: []string{"KV_TCP"},
+		usage:   "listen on host:port; turn off to serve only on unix_socket or systemd sockets",
+		boolean: true,
+		get:     func(c *Config) string { return strconv.FormatBool(c.TCP) },
+		set:     func(c *Config, v string) (err error) { c.TCP, err = strconv.ParseBool(v); return },
+	},
+	{
+		name: "unix_socket", env: []string{"KV_UNIX_SOCKET"},
+		usage: "unix socket path to serve HTTP on as well as TCP (disabled when empty)",
+		get:   func(c *Config) string { return c.UnixSocket },
+		set:   func(c *Config, v string) error { c.UnixSocket = v; return nil },
+	},
+	{
+		name: "unix_socket_mode", env: []string{"KV_UNIX_SOCKET_MODE"},
+		usage: "octal permissions of unix_socket",
+		get:   func(c *Config) string { return fmt.Sprintf("%#o", c.UnixSocketMode) },
+		set: func(c *Config, v string) error {
+			mode, err := strconv.ParseUint(v, 8, 32)
+			if err != nil || mode > 0o777 {
+				return fmt.Errorf("%q is not an octal file mode", v)
+			}
+			c.UnixSocketMode = os.FileMode(mode)
+			return nil
+		},
+	},
+	{
+		name: "node", env: []string{"KV_NODE", "NODE_NAME"},
+		usage: "node name",
+		get:   func(c *Config) string { return c.NodeName },
+		set:   func(c *Config, v string) error { c.NodeName = v; return nil },
+	},
+	{
+		name: "data_dir", env: []string{"KV_DATA_DIR"},
+		usage: "directory holding the node store files",
+		get:   func(c *Config) string { return c.DataDir },
+		set:   func(c *Config, v string) error { c.DataDir = v; return nil },
+	},
+	{
+		name: "max_store_bytes", env: []string{"KV_MAX_STORE_BYTES"},
+		usage:  "maximum bytes of keys and values per node and bucket, 0 for no limit (accepts KB/MB/GB suffixes)",
+		reload: true,
+		get:    func(c *Config) string { return strconv.FormatInt(c.MaxStoreBytes, 10) },
+		set:    func(c *Config, v string) (err error) { c.MaxStoreBytes, err = parseSize(v); return },
+	},
+	{
+		name: "eviction_policy", env: []string{"KV_EVICTION_POLICY"},
+		usage: "what a full store does with a write: none fails it, lru, lfu or fifo evict keys to make room",
+		get:   func(c *Config) string { return c.EvictionPolicy },
+		set:   func(c *Config, v string) error { c.EvictionPolicy = v; return nil },
+	},
+	{
+		name: "max_key_bytes", env: []string{"KV_MAX_KEY_BYTES"},
+		usage:  "maximum size of a single key (accepts KB/MB/GB suffixes)",
+		reload: true,
+		get:    func(c *Config) string { return strconv.FormatInt(c.MaxKeyBytes, 10) },
+		set:    func(c *Config, v string) (err error) { c.MaxKeyBytes, err = parseSize(v); return },
+	},
+	{
+		name: "max_value_bytes", env: []string{"KV_MAX_VALUE_BYTES"},
+		usage:  "maximum size of a single value (accepts KB/MB/GB suffixes, at most 256MB)",
+		reload: true,
+		get:    func(c *Config) string { return strconv.FormatInt(c.MaxValueBytes, 10) },
+		set:    func(c *Config, v string) (err error) { c.MaxValueBytes, err = parseSize(v); return },
+	},
+	{
+		name: "bucket_quotas", env: []string{"KV_BUCKET_QUOTAS"},
+		usage:  "comma-separated bucket=size byte budgets, * for buckets not listed (accepts KB/MB/GB suffixes)",
+		reload: true,
+		get:    func(c *Config) string { return formatQuotas(c.BucketQuotas) },
+		set:    func(c *Config, v string) (err error) { c.BucketQuotas, err = parseQuotas(splitList(v)); return },
+	},
+	{
+		name: "segment_bytes", env: []string{"KV_SEGMENT_BYTES"},
+		usage: "size at which a store's active segment file is sealed and a new one started (accepts KB/MB/GB suffixes)",
+		get:   func(c *Config) string { return strconv.FormatInt(c.SegmentBytes, 10) },
+		set:   func(c *Config, v string) (err error) { c.SegmentBytes, err = parseSize(v); return },
+	},
+	{
+		name: "compact_auto", env: []string{"KV_COMPACT_AUTO"},
+		usage:   "compact sealed segments automatically once they are mostly garbage; turn off to only compact with POST /admin/compact",
+		boolean: true,
+		reload:  true,
+		get:     func(c *Config) string { return strconv.FormatBool(c.CompactAuto) },
+		set:     func(c *Config, v string) (err error) { c.CompactAuto, err = strconv.ParseBool(v); return },
+	},
+	{
+		name: "compact_dead_bytes", env: []string{"KV_COMPACT_DEAD_BYTES"},
+		usage:  "dead bytes a store must hold before its segments are compacted automatically (accepts KB/MB/GB suffixes), 0 for any",
+		reload: true,
+		get:    func(c *Config) string { return strconv.FormatInt(c.CompactDeadBytes, 10) },
+		set:    func(c *Config, v string) (err error) { c.CompactDeadBytes, err = parseSize(v); return },
+	},
+	{
+		name: "index_checkpoint_interval", env: []string{"KV_INDEX_CHECKPOINT_INTERVAL"},
+		usage: "how often each store's segment index is checkpointed so startup can skip replaying old segments, 0 for only on shutdown",
+		get:   func(c *Config) string { return c.CheckpointInterval.String() },
+		set:   func(c *Config, v string) (err error) { c.CheckpointInterval, err = time.ParseDuration(v); return },
+	},
+	{
+		name: "recovery_workers", env: []string{"KV_RECOVERY_WORKERS"},
+		usage: "segments read in parallel when a store is loaded, 0 for one per CPU",
+		get:   func(c *Config) string { return strconv.Itoa(c.RecoveryWorkers) },
+		set:   func(c *Config, v string) (err error) { c.RecoveryWorkers, err = strconv.Atoi(v); return },
+	},
+	{
+		name: "memory", env: []string{"KV_MEMORY"},
+		usage:   "keep all data in memory only; nothing is read from or written to data_dir and everything is lost on exit",
+		boolean: true,
+		get:     func(c *Config) string { return strconv.FormatBool(c.Memory) },
+		set:     func(c *Config, v string) (err error) { c.Memory, err = strconv.ParseBool(v); return },
+	},
+	{
+		name: "repair", env: []string{"KV_REPAIR"},
+		usage:   "on startup, truncate segment files damaged in place at the last valid record and log every record dropped",
+		boolean: true,
+		get:     func(c *Config) string { return strconv.FormatBool(c.Repair) },
+		set:     func(c *Config, v string) (err error) { c.Repair, err = strconv.ParseBool(v); return },
+	},
+	{
+		name: "history_versions", env: []string{"KV_HISTORY_VERSIONS"},
+		usage: "previous versions of each key kept for /history and ?version= reads, 0 to keep none",
+		get:   func(c *Config) string { return strconv.Itoa(c.HistoryVersions) },
+		set:   func(c *Config, v string) (err error) { c.HistoryVersions, err = strconv.Atoi(v); return },
+	},
+	{
+		name: "history_max_age", env: []string{"KV_HISTORY_MAX_AGE"},
+		usage: "also keep previous versions younger than this, 0 to go by history_versions alone",
+		get:   func(c *Config) string { return c.HistoryMaxAge.String() },
+		set:   func(c *Config, v string) (err error) { c.HistoryMaxAge, err = time.ParseDuration(v); return },
+	},
+	{
+		name: "sync_policy", env: []string{"KV_SYNC_POLICY"},
+		usage:  "when writes are saved to disk: always or interval",
+		reload: true,
+		get:    func(c *Config) string { return c.SyncPolicy },
+		set:    func(c *Config, v string) error { c.SyncPolicy = v; return nil },
+	},
+	{
+		name: "sync_interval", env: []string{"KV_SYNC_INTERVAL"},
+		usage:  "save interval for the interval sync policy",
+		reload: true,
+		get:    func(c *Config) string { return c.SyncInterval.String() },
+		set:    func(c *Config, v string) (err error) { c.SyncInterval, err = time.ParseDuration(v); return },
+	},
+	{
+		name: "log_level", env: []string{"KV_LOG_LEVEL"},
+		usage:  "log level: debug, info, warn or error",
+		reload: true,
+		get:    func(c *Config) string { return strings.ToLower(c.LogLevel.String()) },
+		set:    func(c *Config, v string) error { return c.LogLevel.UnmarshalText([]byte(v)) },
+	},
+	{
+		name: "memcached_port", env: []string{"KV_MEMCACHED_PORT"},
+		usage: "port for the memcached text protocol listener (disabled when empty)",
+		get:   func(c *Config) string { return c.MemcachedPort },
+		set:   func(c *Config, v string) error { c.MemcachedPort = v; return nil },
+	},
+	{
+		name: "shutdown_timeout", env: []string{"KV_SHUTDOWN_TIMEOUT"},
+		usage:  "how long to wait for in-flight requests on SIGINT/SIGTERM",
+		reload: true,
+		get:    func(c *Config) string { return c.ShutdownTimeout.String() },
+		set:    func(c *Config, v string) (err error) { c.ShutdownTimeout, err = time.ParseDuration(v); return },
+	},
+	{
+		name: "request_timeout", env: []string{"KV_REQUEST_TIMEOUT"},
+		usage:  "deadline for each HTTP request, streaming endpoints excepted; 0 for none",
+		reload: true,
+		get:    func(c *Config) string { return c.RequestTimeout.String() },
+		set:    func(c *Config, v string) (err error) { c.RequestTimeout, err = time.ParseDuration(v); return },
+	},
+	{
+		name: "read_header_timeout", env: []string{"KV_READ_HEADER_TIMEOUT"},
+		usage: "how long a client may take to send request headers, 0 for no limit",
+		get:   func(c *Config) string { return c.ReadHeaderTimeout.String() },
+		set:   func(c *Config, v string) (err error) { c.ReadHeaderTimeout, err = time.ParseDuration(v); return },
+	},
+	{
+		name: "read_timeout", env: []string{"KV_READ_TIMEOUT"},
+		usage: "how long a client may take to send a whole request, body included, 0 for no limit",
+		get:   func(c *Config) string { return c.ReadTimeout.String() },
+		set:   func(c *Config, v string) (err error) { c.ReadTimeout, err = time.ParseDuration(v); return },
+	},
+	{
+		name: "write_timeout", env: []string{"KV_WRITE_TIMEOUT"},
+		usage: "how long writing a response may take, 0 for no limit (also cuts off /watch and /changes streams)",
+		get:   func(c *Config) string { return c.WriteTimeout.String() },
+		set:   func(c *Config, v string) (err error) { c.WriteTimeout, err = time.ParseDuration(v); return },
+	},
+	{
+		name: "idle_timeout", env: []string{"KV_IDLE_TIMEOUT"},
+		usage: "how long an idle keep-alive connection is kept open, 0 for no limit",
+		get:   func(c *Config) string { return c.IdleTimeout.String() },
+		set:   func(c *Config, v string) (err error) { c.IdleTimeout, err = time.ParseDuration(v); return },
+	},
+	{
+		name: "h2c", env: []string{"KV_H2C"},
+		usage:   "serve HTTP/2 without TLS (h2c) on plaintext listeners, next to HTTP/1.1",
+		boolean: true,
+		get:     func(c *Config) string { return strconv.FormatBool(c.H2C) },
+		set:     func(c *Config, v string) (err error) { c.H2C, err = strconv.ParseBool(v); return },
+	},
+	{
+		name: "keep_alives", env: []string{"KV_KEEP_ALIVES"},
+		usage:   "keep HTTP/1.1 connections open between requests; off closes each after its response",
+		boolean: true,
+		get:     func(c *Config) string { return strconv.FormatBool(c.KeepAlives) },
+		set:     func(c *Config, v string) (err error) { c.KeepAlives, err = strconv.ParseBool(v); return },
+	},
+	{
+		name: "max_conns", env: []string{"KV_MAX_CONNS"},
+		usage: "maximum open HTTP connections across listeners, 0 for no limit; further clients wait to be accepted",
+		get:   func(c *Config) string { return strconv.Itoa(c.MaxConns) },
+		set:   func(c *Config, v string) (err error) { c.MaxConns, err = strconv.Atoi(v); return },
+	},
+	{
+		name: "max_header_bytes", env: []string{"KV_MAX_HEADER_BYTES"},
+		usage: "maximum size of a request's headers (accepts KB/MB/GB suffixes)",
+		get:   func(c *Config) string { return strconv.FormatInt(c.MaxHeaderBytes, 10) },
+		set:   func(c *Config, v string) (err error) { c.MaxHeaderBytes, err = parseSize(v); return },
+	},
+	{
+		name: "log_sample_rate", env: []string{"KV_LOG_SAMPLE_RATE"},
+		usage:  "fraction (0-1) of successful requests written to the access log; errors are always logged",
+		reload: true,
+		get:    func(c *Config) string { return strconv.FormatFloat(c.LogSampleRate, 'g', -1, 64) },
+		set:    func(c *Config, v string) (err error) { c.LogSampleRate, err = strconv.ParseFloat(v, 64); return },
+	},
+	{
+		name: "log_redact", env: []string{"KV_LOG_REDACT"},
+		usage:   "redact values passed in query strings from the access log",
+		boolean: true,
+		reload:  true,
+		get:     func(c *Config) string { return strconv.FormatBool(c.LogRedact) },
+		set:     func(c *Config, v string) (err error) { c.LogRedact, err = strconv.ParseBool(v); return },
+	},
+	{
+		name: "tls_cert", env: []string{"KV_TLS_CERT"},
+		usage:  "PEM certificate file; enables TLS on the HTTP listener (reloaded on SIGHUP)",
+		reload: true,
+		get:    func(c *Config) string { return c.TLSCert },
+		set:    func(c *Config, v string) error { c.TLSCert = v; return nil },
+	},
+	{
+		name: "tls_key", env: []string{"KV_TLS_KEY"},
+		usage:  "PEM private key file for tls_cert",
+		reload: true,
+		get:    func(c *Config) string { return c.TLSKey },
+		set:    func(c *Config, v string) error { c.TLSKey = v; return nil },
+	},
+	{
+		name: "tls_client_ca", env: []string{"KV_TLS_CLIENT_CA"},
+		usage:  "PEM CA bundle used to verify client certificates",
+		reload: true,
+		get:    func(c *Config) string { return c.TLSClientCA },
+		set:    func(c *Config, v string) error { c.TLSClientCA = v; return nil },
+	},
+	{
+		name: "tls_require_client_cert", env: []string{"KV_TLS_REQUIRE_CLIENT_CERT"},
+		usage:   "require clients to present a certificate signed by tls_client_ca (mutual TLS)",
+		boolean: true,
+		reload:  true,
+		get:     func(c *Config) string { return strconv.FormatBool(c.TLSRequireClientCert) },
+		set:     func(c *Config, v string) (err error) { c.TLSRequireClientCert, err = strconv.ParseBool(v); return },
+	},
+	{
+		name: "api_keys_rw", env: []string{"KV_API_KEYS_RW"},
+		usage:  "comma-separated API keys with read-write access (Authorization: Bearer or X-API-Key)",
+		reload: true,
+		get:    func(c *Config) string { return strings.Join(c.APIKeysRW, ",") },
+		set:    func(c *Config, v string) error { c.APIKeysRW = splitList(v); return nil },
+	},
+	{
+		name: "api_keys_ro", env: []string{"KV_API_KEYS_RO"},
+		usage:  "comma-separated API keys with read-only access",
+		reload: true,
+		get:    func(c *Config) string { return strings.Join(c.APIKeysRO, ",") },
+		set:    func(c *Config, v string) error { c.APIKeysRO = splitList(v); return nil },
+	},
+	{
+		name: "basic_auth_rw", env: []string{"KV_BASIC_AUTH_RW"},
+		usage:  "comma-separated user:password pairs with read-write access",
+		reload: true,
+		get:    func(c *Config) string { return strings.Join(c.BasicAuthRW, ",") },
+		set:    func(c *Config, v string) error { c.BasicAuthRW = splitList(v); return nil },
+	},
+	{
+		name: "basic_auth_ro", env: []string{"KV_BASIC_AUTH_RO"},
+		usage:  "comma-separated user:password pairs with read-only access",
+		reload: true,
+		get:    func(c *Config) string { return strings.Join(c.BasicAuthRO, ",") },
+		set:    func(c *Config, v string) error { c.BasicAuthRO = splitList(v); return nil },
+	},
+	{
+		name: "rate_limit", env: []string{"KV_RATE_LIMIT"},
+		usage:  "requests per second allowed per client (API key, user or IP), 0 for no limit",
+		reload: true,
+		get:    func(c *Config) string { return strconv.FormatFloat(c.RateLimit, 'g', -1, 64) },
+		set:    func(c *Config, v string) (err error) { c.RateLimit, err = strconv.ParseFloat(v, 64); return },
+	},
+	{
+		name: "rate_burst", env: []string{"KV_RATE_BURST"},
+		usage:  "requests a client may burst above rate_limit",
+		reload: true,
+		get:    func(c *Config) string { return strconv.Itoa(c.RateBurst) },
+		set:    func(c *Config, v string) (err error) { c.RateBurst, err = strconv.Atoi(v); return },
+	},
+	{
+		name: "max_in_flight", env: []string{"KV_MAX_IN_FLIGHT"},
+		usage:  "maximum concurrent HTTP requests, 0 for no limit",
+		reload: true,
+		get:    func(c *Config) string { return strconv.Itoa(c.MaxInFlight) },
+		set:    func(c *Config, v string) (err error) { c.MaxInFlight, err = strconv.Atoi(v); return },
+	},
+	{
+		name: "changes_max_bytes", env: []string{"KV_CHANGES_MAX_BYTES"},
+		usage: "size of the change log (changes.log) before older changes are discarded, 0 for no limit",
+		get:   func(c *Config) string { return strconv.FormatInt(c.ChangesMaxBytes, 10) },
+		set:   func(c *Config, v string) (err error) { c.ChangesMaxBytes, err = parseSize(v); return },
+	},
+	{
+		name: "replica_of", env: []string{"KV_REPLICA_OF"},
+		usage: "host:port or URL of a primary to follow; makes this server a read-only replica",
+		get:   func(c *Config) string { return c.ReplicaOf },
+		set:   func(c *Config, v string) error { c.ReplicaOf = v; return nil },
+	},
+	{
+		name: "replica_api_key", env: []string{"KV_REPLICA_API_KEY"},
+		usage: "API key the replica presents to the primary",
+		get:   func(c *Config) string { return c.ReplicaAPIKey },
+		set:   func(c *Config, v string) error { c.ReplicaAPIKey = v; return nil },
+	},
+	{
+		name: "handoff_max_bytes", env: []string{"KV_HANDOFF_MAX_BYTES"},
+		usage:  "changes kept per unreachable replica once the change log discards them (e.g. 1GB), 0 to keep none; a replica missing more resyncs",
+		reload: true,
+		get:    func(c *Config) string { return strconv.FormatInt(c.HandoffMaxBytes, 10) },
+		set:    func(c *Config, v string) (err error) { c.HandoffMaxBytes, err = parseSize(v); return },
+	},
+	{
+		name: "handoff_expiry", env: []string{"KV_HANDOFF_EXPIRY"},
+		usage:  "how long a replica can stay away before the changes kept for it are dropped",
+		reload: true,
+		get:    func(c *Config) string { return c.HandoffExpiry.String() },
+		set:    func(c *Config, v string) (err error) { c.HandoffExpiry, err = time.ParseDuration(v); return },
+	},
+	{
+		name: "backup_url", env: []string{"KV_BACKUP_URL"},
+		usage: "s3://bucket/prefix to upload full and incremental backups to; empty to disable backups",
+		get:   func(c *Config) string { return c.BackupURL },
+		set:   func(c *Config, v string) error { c.BackupURL = v; return nil },
+	},
+	{
+		name: "backup_endpoint", env: []string{"KV_BACKUP_ENDPOINT"},
+		usage: "URL of an S3-compatible service such as MinIO for backup_url and restore_from (AWS when empty)",
+		get:   func(c *Config) string { return c.BackupEndpoint },
+		set:   func(c *Config, v string) error { c.BackupEndpoint = v; return nil },
+	},
+	{
+		name: "backup_region", env: []string{"KV_BACKUP_REGION", "AWS_REGION"},
+		usage: "region of the backup bucket",
+		get:   func(c *Config) string { return c.BackupRegion },
+		set:   func(c *Config, v string) error { c.BackupRegion = v; return nil },
+	},
+	{
+		name: "backup_access_key_id", env: []string{"KV_BACKUP_ACCESS_KEY_ID", "AWS_ACCESS_KEY_ID"},
+		usage: "access key for the backup bucket; requests are unsigned when empty",
+		get:   func(c *Config) string { return c.BackupAccessKeyID },
+		set:   func(c *Config, v string) error { c.BackupAccessKeyID = v; return nil },
+	},
+	{
+		name: "backup_secret_access_key", env: []string{"KV_BACKUP_SECRET_ACCESS_KEY", "AWS_SECRET_ACCESS_KEY"},
+		usage: "secret key for the backup bucket",
+		get:   func(c *Config) string { return c.BackupSecretAccessKey },
+		set:   func(c *Config, v string) error { c.BackupSecretAccessKey = v; return nil },
+	},
+	{
+		name: "backup_session_token", env: []string{"KV_BACKUP_SESSION_TOKEN", "AWS_SESSION_TOKEN"},
+		usage: "session token for temporary backup credentials",
+		get:   func(c *Config) string { return c.BackupSessionToken },
+		set:   func(c *Config, v string) error { c.BackupSessionToken = v; return nil },
+	},
+	{
+		name: "backup_interval", env: []string{"KV_BACKUP_INTERVAL"},
+		usage: "how often a full backup is taken",
+		get:   func(c *Config) string { return c.BackupInterval.String() },
+		set:   func(c *Config, v string) (err error) { c.BackupInterval, err = time.ParseDuration(v); return },
+	},
+	{
+		name: "backup_incremental_interval", env: []string{"KV_BACKUP_INCREMENTAL_INTERVAL"},
+		usage: "how often the changes since the last backup are uploaded, 0 for full backups only",
+		get:   func(c *Config) string { return c.BackupIncrementalInterval.String() },
+		set: func(c *Config, v string) (err error) {
+			c.BackupIncrementalInterval, err = time.ParseDuration(v)
+			return
+		},
+	},
+	{
+		name: "restore_from", env: []string{"KV_RESTORE_FROM"},
+		usage: "s3://bucket/prefix (newest backup) or s3://bucket/key (that full backup) to restore on startup when the stores are empty",
+		get:   func(c *Config) string { return c.RestoreFrom },
+		set:   func(c *Config, v string) error { c.RestoreFrom = v; return nil },
+	},
+	{
+		name: "read_only", env: []string{"KV_READ_ONLY"},
+		usage:   "refuse writes with 403 while serving reads; POST /admin/readonly changes it at runtime",
+		boolean: true,
+		get:     func(c *Config) string { return strconv.FormatBool(c.ReadOnly) },
+		set:     func(c *Config, v string) (err error) { c.ReadOnly, err = strconv.ParseBool(v); return },
+	},
+	{
+		name: "key_stats", env: []string{"KV_KEY_STATS"},
+		usage:   "count reads and writes and track the last access of every key for GET /admin/hotkeys",
+		boolean: true,
+		get:     func(c *Config) string { return strconv.FormatBool(c.KeyStats) },
+		set:     func(c *Config, v string) (err error) { c.KeyStats, err = strconv.ParseBool(v); return },
+	},
+	{
+		name: "key_stats_checkpoint", env: []string{"KV_KEY_STATS_CHECKPOINT"},
+		usage:   "save key statistics with every index checkpoint and on shutdown so they survive restarts",
+		boolean: true,
+		get:     func(c *Config) string { return strconv.FormatBool(c.KeyStatsCheckpoint) },
+		set:     func(c *Config, v string) (err error) { c.KeyStatsCheckpoint, err = strconv.ParseBool(v); return },
+	},
+	{
+		name: "raft_node_id", env: []string{"KV_RAFT_NODE_ID"},
+		usage: "this server's ID in raft_peers (defaults to the node name)",
+		get:   func(c *Config) string { return c.RaftNodeID },
+		set:   func(c *Config, v string) error { c.RaftNodeID = v; return nil },
+	},
+	{
+		name: "raft_peers", env: []string{"KV_RAFT_PEERS"},
+		usage: "comma-separated id=raft_host:port@http_host:port entries for every cluster member; enables Raft clustering",
+		get:   func(c *Config) string { return strings.Join(c.RaftPeers, ",") },
+		set:   func(c *Config, v string) error { c.RaftPeers = splitList(v); return nil },
+	},
+	{
+		name: "raft_bind", env: []string{"KV_RAFT_BIND"},
+		usage: "address the Raft transport listens on (defaults to this node's raft_peers address)",
+		get:   func(c *Config) string { return c.RaftBind },
+		set:   func(c *Config, v string) error { c.RaftBind = v; return nil },
+	},
+	{
+		name: "raft_snapshot_threshold", env: []string{"KV_RAFT_SNAPSHOT_THRESHOLD"},
+		usage: "Raft log entries written between snapshots, which bound how much log a lagging or new member replays",
+		get:   func(c *Config) string { return strconv.FormatUint(c.RaftSnapshotThreshold, 10) },
+		set: func(c *Config, v string) (err error) {
+			c.RaftSnapshotThreshold, err = strconv.ParseUint(v, 10, 64)
+			return
+		},
+	},
+	{
+		name: "proxy", env: []string{"KV_PROXY"},
+		usage:   "run as a proxy that consistent-hashes keys across the stores in nodes",
+		boolean: true,
+		get:     func(c *Config) string { return strconv.FormatBool(c.Proxy) },
+		set:     func(c *Config, v string) (err error) { c.Proxy, err = strconv.ParseBool(v); return },
+	},
+	{
+		name: "nodes", env: []string{"KV_NODES"},
+		usage: "comma-separated backend stores (host:port or URL) for proxy mode",
+		get:   func(c *Config) string { return strings.Join(c.Nodes, ",") },
+		set:   func(c *Config, v string) error { c.Nodes = splitList(v); return nil },
+	},
+	{
+		name: "gossip", env: []string{"KV_GOSSIP"},
+		usage:   "discover the other members of the cluster and detect their failures by gossip; proxies route to the stores found this way",
+		boolean: true,
+		get:     func(c *Config) string { return strconv.FormatBool(c.Gossip) },
+		set:     func(c *Config, v string) (err error) { c.Gossip, err = strconv.ParseBool(v); return },
+	},
+	{
+		name: "gossip_seeds", env: []string{"KV_GOSSIP_SEEDS"},
+		usage: "comma-separated members (host:port or URL) to join the cluster through; empty for the first member",
+		get:   func(c *Config) string { return strings.Join(c.GossipSeeds, ",") },
+		set:   func(c *Config, v string) error { c.GossipSeeds = splitList(v); return nil },
+	},
+	{
+		name: "gossip_advertise", env: []string{"KV_GOSSIP_ADVERTISE"},
+		usage: "host:port or URL other members reach this server at (defaults to the hostname and port)",
+		get:   func(c *Config) string { return c.GossipAdvertise },
+		set:   func(c *Config, v string) error { c.GossipAdvertise = v; return nil },
+	},
+	{
+		name: "gossip_api_key", env: []string{"KV_GOSSIP_API_KEY"},
+		usage: "API key presented to other members when gossiping; needs read-write access there",
+		get:   func(c *Config) string { return c.GossipAPIKey },
+		set:   func(c *Config, v string) error { c.GossipAPIKey = v; return nil },
+	},
+	{
+		name: "gossip_interval", env: []string{"KV_GOSSIP_INTERVAL"},
+		usage: "how often membership is gossiped to a few other members",
+		get:   func(c *Config) string { return c.GossipInterval.String() },
+		set:   func(c *Config, v string) (err error) { c.GossipInterval, err = time.ParseDuration(v); return },
+	},
+	{
+		name: "gossip_failure_timeout", env: []string{"KV_GOSSIP_FAILURE_TIMEOUT"},
+		usage: "how long a member can go without a heartbeat before it is considered failed",
+		get:   func(c *Config) string { return c.GossipFailureTimeout.String() },
+		set:   func(c *Config, v string) (err error) { c.GossipFailureTimeout, err = time.ParseDuration(v); return },
+	},
+	{
+		name: "bloom_filter", env: []string{"KV_BLOOM_FILTER"},
+		usage:   "keep a bloom filter per store so lookups of missing keys skip the store",
+		boolean: true,
+		get:     func(c *Config) string { return strconv.FormatBool(c.BloomFilter) },
+		set:     func(c *Config, v string) (err error) { c.BloomFilter, err = strconv.ParseBool(v); return },
+	},
+	{
+		name: "cache_bytes", env: []string{"KV_CACHE_BYTES"},
+		usage: "size of the LRU cache for hot keys (e.g. 32MB), 0 to disable",
+		get:   func(c *Config) string { return strconv.FormatInt(c.CacheBytes, 10) },
+		set:   func(c *Config, v string) (err error) { c.CacheBytes, err = parseSize(v); return },
+	},
+	{
+		name: "mutex_profile_fraction", env: []string{"KV_MUTEX_PROFILE_FRACTION"},
+		usage:  "sample 1 in this many mutex contention events for /admin/debug/pprof/mutex, 0 to disable",
+		reload: true,
+		get:    func(c *Config) string { return strconv.Itoa(c.MutexProfileFraction) },
+		set:    func(c *Config, v string) (err error) { c.MutexProfileFraction, err = strconv.Atoi(v); return },
+	},
+	{
+		name: "gzip", env: []string{"KV_GZIP"},
+		usage:   "gzip GET responses larger than 1KB for clients that accept it",
+		boolean: true,
+		reload:  true,
+		get:     func(c *Config) string { return strconv.FormatBool(c.Gzip) },
+		set:     func(c *Config, v string) (err error) { c.Gzip, err = strconv.ParseBool(v); return },
+	},
+	{
+		name: "cache_max_age", env: []string{"KV_CACHE_MAX_AGE"},
+		usage:  "how long clients and caches may reuse a read before revalidating it with its ETag, 0 to always revalidate",
+		reload: true,
+		get:    func(c *Config) string { return c.CacheMaxAge.String() },
+		set:    func(c *Config, v string) (err error) { c.CacheMaxAge, err = time.ParseDuration(v); return },
+	},
+}
+
+// loadConfig builds the configuration from defaults, the config file, the
+// environment and the given command line arguments, then validates it.
+func loadConfig(args []string) (*Config, error) {
+	defaults := defaultConfig()
+	fs := flag.NewFlagSet("kvstore", flag.ContinueOnError)
+	configPath := fs.String("config", os.Getenv("KV_CONFIG"), "path to a YAML config file (env KV_CONFIG)")
+	flagValues := make(map[string]*configFlag, len(configFields))
+	for _, f := range configFields {
+		usage := f.usage + " (env " + strings.Join(f.env, ", ") + ")"
+		flagValues[f.name] = &configFlag{value: f.get(defaults), boolean: f.boolean}
+		fs.Var(flagValues[f.name], strings.ReplaceAll(f.name, "_", "-"), usage)
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	c := defaults
+	if *configPath != "" {
+		if err := c.loadFile(*configPath); err != nil {
+			return nil, err
+		}
+	}
+	for _, f := range configFields {
+		for _, env := range f.env {
+			if v, ok := os.LookupEnv(env); ok {
+				if err := f.set(c, v); err != nil {
+					return nil, fmt.Errorf("%s: %w", env, err)
+				}
+				break
+			}
+		}
+	}
+	var flagErr error
+	fs.Visit(func(fl *flag.Flag) { // Only flags given explicitly override the file and environment
+		for _, f := range configFields {
+			if strings.ReplaceAll(f.name, "_", "-") == fl.Name && flagErr == nil {
+				if err := f.set(c, flagValues[f.name].value); err != nil {
+					flagErr = fmt.Errorf("-%s: %w", fl.Name, err)
+				}
+			}
+		}
+	})
+	if flagErr != nil {
+		return nil, flagErr
+	}
+	return c, c.validate()
+}
+
+// configFlag holds the raw command line value for a config field; it is
+// applied to the Config only when the flag was given explicitly.
+type configFlag struct {
+	value   string
+	boolean bool
+}
+
+func (f *configFlag) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.value
+}
+
+func (f *configFlag) Set(v string) error {
+	f.value = v
+	return nil
+}
+
+func (f *configFlag) IsBoolFlag() bool {
+	return f.boolean
+}
+
+// loadFile applies a flat "key: value" YAML file. Blank lines and # comments
+// are ignored and values may be quoted.
+func (c *Config) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return fmt.Errorf("%s:%d: expected \"key: value\"", path, lineNo)
+		}
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+		if i := strings.Index(value, " #"); i >= 0 {
+			value = strings.TrimSpace(value[:i])
+		}
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+
+		found := false
+		for _, f := range configFields {
+			if f.name == key {
+				if err := f.set(c, value); err != nil {
+					return fmt.Errorf("%s:%d: %s: %w", path, lineNo, key, err)
+				}
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s:%d: unknown config key %q", path, lineNo, key)
+		}
+	}
+	return scanner.Err()
+}
+
+func (c *Config) validate() error {
+	var errs []error
+	if p, err := strconv.Atoi(c.Port); c.TCP && (err != nil || p < 1 || p > 65535) {
+		errs = append(errs, fmt.Errorf("port %q is not a valid port number", c.Port))
+	}
+	if c.MemcachedPort != "" {
+		if p, err := strconv.Atoi(c.MemcachedPort); err != nil || p < 1 || p > 65535 {
+			errs = append(errs, fmt.Errorf("memcached_port %q is not a valid port number", c.MemcachedPort))
+		}
+	}
+	if c.NodeName == "" {
+		errs = append(errs, errors.New("node name cannot be empty"))
+	}
+	if c.DataDir == "" {
+		errs = append(errs, errors.New("data_dir cannot be empty"))
+	}
+	if c.ShutdownTimeout <= 0 {
+		errs = append(errs, errors.New("shutdown_timeout must be positive"))
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		errs = append(errs, errors.New("tls_cert and tls_key must be set together"))
+	}
+	if (c.TLSClientCA != "" || c.TLSRequireClientCert) && c.TLSCert == "" {
+		errs = append(errs, errors.New("client certificate options require tls_cert and tls_key"))
+	}
+	if c.TLSRequireClientCert && c.TLSClientCA == "" {
+		errs = append(errs, errors.New("tls_require_client_cert requires tls_client_ca"))
+	}
+	for _, pair := range append(append([]string{}, c.BasicAuthRW...), c.BasicAuthRO...) {
+		if user, _, ok := strings.Cut(pair, ":"); !ok || user == "" {
+			errs = append(errs, errors.New("basic auth credentials must be user:password pairs"))
+			break
+		}
+	}
+	if c.RateLimit < 0 || c.MaxInFlight < 0 {
+		errs = append(errs, errors.New("rate_limit and max_in_flight cannot be negative"))
+	}
+	if c.MaxConns < 0 {
+		errs = append(errs, errors.New("max_conns cannot be negative"))
+	}
+	if c.MaxHeaderBytes < 1<<10 || c.MaxHeaderBytes > 64<<20 {
+		errs = append(errs, errors.New("max_header_bytes must be between 1KB and 64MB"))
+	}
+	if c.RateLimit > 0 && c.RateBurst < 1 {
+		errs = append(errs, errors.New("rate_burst must be at least 1 when rate_limit is set"))
+	}
+	if c.LogSampleRate < 0 || c.LogSampleRate > 1 {
+		errs = append(errs, errors.New("log_sample_rate must be between 0 and 1"))
+	}
+	if c.MaxStoreBytes < 0 {
+		errs = append(errs, errors.New("max_store_bytes cannot be negative"))
+	}
+	switch c.EvictionPolicy {
+	case evictNone:
+	case evictLRU, evictLFU, evictFIFO:
+		if c.MaxStoreBytes == 0 {
+			errs = append(errs, errors.New("eviction_policy requires max_store_bytes"))
+		}
+		if len(c.RaftPeers) > 0 && c.EvictionPolicy != evictFIFO {
+			errs = append(errs, errors.New("a raft cluster can only use the fifo eviction_policy"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unknown eviction_policy %q (want %s, %s, %s or %s)", c.EvictionPolicy, evictNone, evictLRU, evictLFU, evictFIFO))
+	}
+	for name, q := range c.BucketQuotas {
+		if q <= 0 {
+			errs = append(errs, fmt.Errorf("bucket quota for %s must be positive", name))
+		}
+	}
+	if c.MaxKeyBytes <= 0 || c.MaxKeyBytes > maxValueBytesLimit {
+		errs = append(errs, errors.New("max_key_bytes must be between 1 and 256MB"))
+	}
+	if c.MaxValueBytes <= 0 || c.MaxValueBytes > maxValueBytesLimit {
+		errs = append(errs, errors.New("max_value_bytes must be between 1 and 256MB"))
+	}
+	if c.CheckpointInterval < 0 {
+		errs = append(errs, errors.New("index_checkpoint_interval cannot be negative"))
+	}
+	if c.RecoveryWorkers < 0 {
+		errs = append(errs, errors.New("recovery_workers cannot be negative"))
+	}
+	if c.SegmentBytes <= 0 {
+		errs = append(errs, errors.New("segment_bytes must be positive"))
+	}
+	if c.CompactDeadBytes < 0 {
+		errs = append(errs, errors.New("compact_dead_bytes cannot be negative"))
+	}
+	if c.ChangesMaxBytes < 0 {
+		errs = append(errs, errors.New("changes_max_bytes cannot be negative"))
+	}
+	if c.HandoffMaxBytes < 0 {
+		errs = append(errs, errors.New("handoff_max_bytes cannot be negative"))
+	}
+	if c.HandoffExpiry <= 0 {
+		errs = append(errs, errors.New("handoff_expiry must be positive"))
+	}
+	if c.RequestTimeout < 0 || c.ReadHeaderTimeout < 0 || c.ReadTimeout < 0 || c.WriteTimeout < 0 || c.IdleTimeout < 0 {
+		errs = append(errs, errors.New("request_timeout, read_header_timeout, read_timeout, write_timeout and idle_timeout cannot be negative"))
+	}
+	if c.CacheMaxAge < 0 {
+		errs = append(errs, errors.New("cache_max_age cannot be negative"))
+	}
+	if c.MutexProfileFraction < 0 {
+		errs = append(errs, errors.New("mutex_profile_fraction cannot be negative"))
+	}
+	if c.CacheBytes < 0 {
+		errs = append(errs, errors.New("cache_bytes cannot be negative"))
+	}
+	if c.HistoryVersions < 0 {
+		errs = append(errs, errors.New("history_versions cannot be negative"))
+	}
+	if c.HistoryMaxAge < 0 {
+		errs = append(errs, errors.New("history_max_age cannot be negative"))
+	}
+	if c.Memory && len(c.RaftPeers) > 0 {
+		errs = append(errs, errors.New("memory mode cannot be combined with raft_peers, which needs durable storage"))
+	}
+	if len(c.RaftPeers) > 0 {
+		if _, err := parseRaftPeers(c.RaftPeers); err != nil {
+			errs = append(errs, err)
+		}
+		if c.ReplicaOf != "" {
+			errs = append(errs, errors.New("replica_of cannot be combined with raft_peers"))
+		}
+		if c.RaftSnapshotThreshold == 0 {
+			errs = append(errs, errors.New("raft_snapshot_threshold must be positive"))
+		}
+	}
+	if c.Proxy {
+		if len(c.Nodes) == 0 && !c.Gossip {
+			errs = append(errs, errors.New("proxy mode requires nodes or gossip"))
+		}
+		for _, n := range c.Nodes {
+			if u, err := url.Parse(baseURL(n)); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+				errs = append(errs, fmt.Errorf("node %q must be host:port or an http(s) URL", n))
+			}
+		}
+		if c.ReplicaOf != "" || len(c.RaftPeers) > 0 || c.MemcachedPort != "" {
+			errs = append(errs, errors.New("proxy mode cannot be combined with replica_of, raft_peers or memcached_port"))
+		}
+	}
+	if c.Gossip {
+		for _, n := range append(slices.Clone(c.GossipSeeds), c.GossipAdvertise) {
+			if n == "" {
+				continue
+			}
+			if u, err := url.Parse(baseURL(n)); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+				errs = append(errs, fmt.Errorf("gossip address %q must be host:port or an http(s) URL", n))
+			}
+		}
+		if c.GossipAdvertise == "" && !c.TCP {
+			errs = append(errs, errors.New("gossip_advertise is required when tcp is off"))
+		}
+		if c.GossipInterval <= 0 {
+			errs = append(errs, errors.New("gossip_interval must be positive"))
+		}
+		if c.GossipFailureTimeout <= c.GossipInterval {
+			errs = append(errs, errors.New("gossip_failure_timeout must be longer than gossip_interval"))
+		}
+	}
+	if c.ReplicaOf != "" {
+		if u, err := url.Parse(baseURL(c.ReplicaOf)); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			errs = append(errs, errors.New("replica_of must be host:port or an http(s) URL"))
+		}
+	}
+	for _, u := range []string{c.BackupURL, c.RestoreFrom} {
+		if u == "" {
+			continue
+		}
+		if _, _, err := parseS3URL(u); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if c.Proxy && (c.BackupURL != "" || c.RestoreFrom != "") {
+		errs = append(errs, errors.New("backup_url and restore_from cannot be used in proxy mode"))
+	}
+	if c.BackupURL != "" && c.BackupInterval <= 0 {
+		errs = append(errs, errors.New("backup_interval must be positive"))
+	}
+	if c.BackupIncrementalInterval < 0 {
+		errs = append(errs, errors.New("backup_incremental_interval cannot be negative"))
+	}
+	if c.RestoreFrom != "" && (len(c.RaftPeers) > 0 || c.ReplicaOf != "") {
+		errs = append(errs, errors.New("restore_from cannot be combined with raft_peers or replica_of, which copy their data from other servers"))
+	}
+	if c.KeyStatsCheckpoint && !c.KeyStats {
+		errs = append(errs, errors.New("key_stats_checkpoint requires key_stats"))
+	}
+	if c.ReadOnly && (c.Proxy || len(c.RaftPeers) > 0 || c.ReplicaOf != "") {
+		errs = append(errs, errors.New("read_only cannot be used in proxy, raft or replica mode"))
+	}
+	if (c.BackupAccessKeyID == "") != (c.BackupSecretAccessKey == "") {
+		errs = append(errs, errors.New("backup_access_key_id and backup_secret_access_key must be set together"))
+	}
+	switch c.SyncPolicy {
+	case syncAlways:
+	case syncInterval:
+		if c.SyncInterval <= 0 {
+			errs = append(errs, errors.New("sync_interval must be positive for the interval sync policy"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unknown sync_policy %q (want %s or %s)", c.SyncPolicy, syncAlways, syncInterval))
+	}
+	return errors.Join(errs...)
+}
+
+// splitList splits a comma-separated list, dropping empty entries.
+func splitList(v string) []string {
+	var out []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// parseSize parses a byte count with an optional KB, MB or GB suffix (powers
+// of 1024).
+func parseSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	mult := int64(1)
+	for _, u := range []struct {
+		suffix string
+		mult   int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(s, u.suffix) {
+			s, mult = strings.TrimSpace(strings.TrimSuffix(s, u.suffix)), u.mult
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * mult, nil
+}
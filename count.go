@@ -0,0 +1,94 @@
+package main
+
+// Existence checks and counts. GET /exists?key=k and GET /count?prefix=p
+// answer from the key maps alone: they don't fill the read cache, count as a
+// use for eviction or encode any values, so checks that only need to know
+// whether keys are there stay cheap however large the values are.
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+type ExistsResult struct {
+	Key    string `json:"key"`
+	Exists bool   `json:"exists"`
+}
+
+type CountResult struct {
+	Prefix string `json:"prefix"`
+	Count  int    `json:"count"`
+}
+
+func exists(ctx context.Context, key string, nodes []*ServerNode) (found bool, err error) {
+	ctx, span := startOp(ctx, "exists", key, nodes)
+	defer func() { recordOp("exists", err); endSpan(span, err) }()
+	n := getServerKey(key, nodes)
+	if n == nil {
+		return false, errors.New("no node found for key")
+	}
+
+	if f := n.bloom.Load(); f != nil && !f.mayContain(key) {
+		metrics.bloomNegatives.Add(1)
+		return false, nil
+	}
+	lock := startStep(ctx, "store.lock_wait")
+	err = n.rlockCtx(ctx)
+	endSpan(lock, err)
+	if err != nil {
+		return false, err
+	}
+	defer n.mu.RUnlock()
+	_, found = n.node_store[key]
+	return found, nil
+}
+
+// count returns how many keys across nodes start with prefix.
+func count(prefix string, nodes []*ServerNode) int {
+	total := 0
+	for _, n := range nodes {
+		n.mu.RLock()
+		if prefix == "" {
+			total += len(n.node_store)
+		} else {
+			for k := range n.node_store {
+				if strings.HasPrefix(k, prefix) {
+					total++
+				}
+			}
+		}
+		n.mu.RUnlock()
+	}
+	return total
+}
+
+func existsHandler(w http.ResponseWriter, r *http.Request) {
+	key, ok := requestKey(w, r)
+	if !ok {
+		return
+	}
+	nodes, ok := requestNodes(w, r, false)
+	if !ok {
+		return
+	}
+	found, err := exists(r.Context(), key, nodes)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	writeJSON(w, ExistsResult{Key: encodeKey(r, key), Exists: found})
+}
+
+func countHandler(w http.ResponseWriter, r *http.Request) {
+	nodes, ok := requestNodes(w, r, false)
+	if !ok {
+		return
+	}
+	prefix, ok := requestPrefix(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, CountResult{Prefix: encodeKey(r, prefix), Count: count(prefix, nodes)})
+}
@@ -0,0 +1,33 @@
+package main
+
+// Syncing segment data on Linux. fdatasync writes out a file's dirty pages
+// and the metadata needed to read them back, such as a grown file size, but
+// unlike fsync skips timestamps, so a sync after an append costs the pages
+// appended and little else.
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+func syncData(f *os.File) error {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	if err := rc.Control(func(fd uintptr) {
+		for {
+			if serr = syscall.Fdatasync(int(fd)); !errors.Is(serr, syscall.EINTR) {
+				return
+			}
+		}
+	}); err != nil {
+		return err
+	}
+	if serr != nil {
+		return &os.PathError{Op: "fdatasync", Path: f.Name(), Err: serr}
+	}
+	return nil
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+// Syncing segment data elsewhere: a plain fsync, as there is no portable
+// data-only variant.
+
+import "os"
+
+func syncData(f *os.File) error {
+	return f.Sync()
+}
@@ -0,0 +1,81 @@
+package main
+
+// Runtime diagnostics for operators. The net/http/pprof handlers are served
+// under /admin/debug/pprof/, so they need admin credentials like the rest of
+// /admin/ (go tool pprof http://host:port/admin/debug/pprof/profile), and
+// GET /admin/debug reports goroutines, memory, GC pauses and how long
+// goroutines have waited on mutexes. Mutex profiles are only collected with
+// mutex_profile_fraction set.
+
+import (
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	runtimemetrics "runtime/metrics"
+	"time"
+)
+
+type DebugStats struct {
+	GoVersion        string    `json:"go_version"`
+	GOMAXPROCS       int       `json:"gomaxprocs"`
+	Goroutines       int       `json:"goroutines"`
+	HeapAllocBytes   uint64    `json:"heap_alloc_bytes"`
+	HeapInuseBytes   uint64    `json:"heap_inuse_bytes"`
+	HeapObjects      uint64    `json:"heap_objects"`
+	SysBytes         uint64    `json:"sys_bytes"`
+	NextGCBytes      uint64    `json:"next_gc_bytes"`
+	GCCycles         uint32    `json:"gc_cycles"`
+	GCPauseTotal     float64   `json:"gc_pause_total_seconds"`
+	GCLastPause      float64   `json:"gc_last_pause_seconds"`
+	GCLastTime       time.Time `json:"gc_last_time,omitzero"`
+	GCCPUFraction    float64   `json:"gc_cpu_fraction"`
+	MutexWaitSeconds float64   `json:"mutex_wait_seconds"` // Total time goroutines spent blocked on sync.Mutex and RWMutex
+}
+
+func debugStats() DebugStats {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	s := DebugStats{
+		GoVersion:      runtime.Version(),
+		GOMAXPROCS:     runtime.GOMAXPROCS(0),
+		Goroutines:     runtime.NumGoroutine(),
+		HeapAllocBytes: ms.HeapAlloc,
+		HeapInuseBytes: ms.HeapInuse,
+		HeapObjects:    ms.HeapObjects,
+		SysBytes:       ms.Sys,
+		NextGCBytes:    ms.NextGC,
+		GCCycles:       ms.NumGC,
+		GCPauseTotal:   time.Duration(ms.PauseTotalNs).Seconds(),
+		GCCPUFraction:  ms.GCCPUFraction,
+	}
+	if ms.NumGC > 0 {
+		s.GCLastPause = time.Duration(ms.PauseNs[(ms.NumGC+255)%256]).Seconds()
+		s.GCLastTime = time.Unix(0, int64(ms.LastGC)).UTC()
+	}
+	sample := []runtimemetrics.Sample{{Name: "/sync/mutex/wait/total:seconds"}}
+	runtimemetrics.Read(sample)
+	if sample[0].Value.Kind() == runtimemetrics.KindFloat64 {
+		s.MutexWaitSeconds = sample[0].Value.Float64()
+	}
+	return s
+}
+
+func adminDebugHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, debugStats())
+}
+
+// registerDebug adds the diagnostics endpoints to mux.
+func registerDebug(mux *http.ServeMux) {
+	// pprof.Index looks profiles up by their name under /debug/pprof/.
+	mux.Handle("/admin/debug/pprof/", http.StripPrefix("/admin", http.HandlerFunc(pprof.Index)))
+	mux.HandleFunc("/admin/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/admin/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/admin/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/admin/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/admin/debug", adminDebugHandler)
+}
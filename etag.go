@@ -0,0 +1,136 @@
+package main
+
+// Conditional requests on the REST key path. GET returns an ETag derived from
+// the value's contents, so it is the same on every node and survives restarts,
+// and answers If-None-Match (or, without it, If-Modified-Since) with 304.
+// Cache-Control tells caches to revalidate every time, or lets them keep a
+// value for cache_max_age; reads of a numbered version never change and may
+// be kept for good. Responses to authenticated clients are marked private. POST and PUT honour If-Match (write only
+// if the value is unchanged, 412 otherwise) and If-None-Match (write only if
+// the value differs, or with * only if the key is new). The check and the
+// write happen under the node lock, and in a cluster as one Raft command.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+func etagOf(value string) string {
+	h := fnv.New64a()
+	h.Write([]byte(value))
+	return fmt.Sprintf("%q", fmt.Sprintf("%016x", h.Sum64()))
+}
+
+// etagMatches reports whether header, a comma-separated list of ETags or *,
+// matches the current value. Weak ETags compare like strong ones since only
+// strong ones are handed out, and the tag of the gzipped form like the plain
+// one.
+func etagMatches(header string, value string, exists bool) bool {
+	if !exists {
+		return false
+	}
+	tag := etagOf(value)
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+		if t == "*" || t == tag || t == gzipETag(tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheControl returns the Cache-Control header for a read.
+func cacheControl(r *http.Request, immutable bool) string {
+	c := requestConfig(r)
+	v := "no-cache"
+	switch {
+	case immutable:
+		v = "max-age=31536000, immutable"
+	case c.CacheMaxAge > 0:
+		v = "max-age=" + strconv.Itoa(int(c.CacheMaxAge.Seconds()))
+	}
+	if c.authEnabled() {
+		v = "private, " + v
+	}
+	return v
+}
+
+// writeRead answers a read of key with its validators, or with 304 when the
+// client's copy is current. modified is zero when unknown; immutable marks a
+// value that can never change, such as an old version.
+func writeRead(w http.ResponseWriter, r *http.Request, key string, value string, meta valueMeta, immutable bool) {
+	modified := meta.modified
+	w.Header().Set("ETag", etagOf(value))
+	w.Header().Set("Cache-Control", cacheControl(r, immutable))
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.Format(http.TimeFormat))
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if etagMatches(inm, value, true) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	} else if ims, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !modified.IsZero() && !modified.Truncate(time.Second).After(ims) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	writeValue(w, r, key, value, meta)
+}
+
+// checkPreconditions applies If-Match and If-None-Match to the key's current
+// state. Empty headers are not checked.
+func checkPreconditions(ifMatch string, ifNoneMatch string, value string, exists bool) error {
+	if ifMatch != "" && !etagMatches(ifMatch, value, exists) {
+		return ErrPreconditionFailed
+	}
+	if ifNoneMatch != "" && etagMatches(ifNoneMatch, value, exists) {
+		return ErrPreconditionFailed
+	}
+	return nil
+}
+
+func putConditional(ctx context.Context, key string, value string, typ valueType, ifMatch string, ifNoneMatch string, nodes []*ServerNode) (err error) {
+	defer func() { recordOp("put", err) }()
+	if err := checkSize(ctx, key, value); err != nil {
+		return err
+	}
+	if err := typ.check(value); err != nil {
+		return err
+	}
+	if cluster != nil {
+		return cluster.apply(ctx, command{Op: "put_conditional", Bucket: nodes[0].bucket, Key: key, Value: value, Type: typ, IfMatch: ifMatch, IfNoneMatch: ifNoneMatch})
+	}
+	return putConditionalLocal(ctx, key, value, typ, ifMatch, ifNoneMatch, nodes)
+}
+
+func putConditionalLocal(ctx context.Context, key string, value string, typ valueType, ifMatch string, ifNoneMatch string, nodes []*ServerNode) error {
+	n := getServerKey(key, nodes)
+	if n == nil {
+		return errors.New("no node found for key")
+	}
+
+	if err := n.lockCtx(ctx); err != nil {
+		return err
+	}
+	defer n.mu.Unlock()
+	cur, exists := n.node_store[key]
+	if err := checkPreconditions(ifMatch, ifNoneMatch, cur, exists); err != nil {
+		return err
+	}
+	if err := n.setLocked(ctx, key, value, typ); err != nil {
+		slog.Debug("conditional put failed", "key", key, "node", n.name, "error", err)
+		return err
+	}
+	slog.Debug("conditional put successful", "key", key, "node", n.name)
+
+	return n.persist(ctx)
+}
@@ -0,0 +1,182 @@
+package main
+
+// Eviction, for using the store as a bounded persistent cache. With
+// eviction_policy set, a write that would take a node store past
+// max_store_bytes evicts other keys until it fits instead of failing with
+// "store full":
+//
+//	lru   evicts the keys read or written longest ago
+//	lfu   evicts the least used of the evictionSamples least recently used keys
+//	fifo  evicts the keys written longest ago, however often they are read
+//
+// An evicted key is deleted like any other: a tombstone is appended, watchers
+// and replicas see a delete, and compaction of the segments it leaves mostly
+// garbage gives the disk space back. Use is tracked in memory and ordered by
+// the write times in the segment index on startup, so reads from before a
+// restart are forgotten. Bucket quotas still fail writes rather than evict.
+// A Raft cluster only allows fifo, since every member has to evict the same
+// keys and reads aren't replicated.
+
+import (
+	"container/list"
+	"log/slog"
+	"sort"
+	"sync"
+)
+
+const (
+	evictNone = "none"
+	evictLRU  = "lru"
+	evictLFU  = "lfu"
+	evictFIFO = "fifo"
+)
+
+const evictionSamples = 8
+
+type keyUse struct {
+	key  string
+	hits uint64
+}
+
+// usageTracker orders the keys of a store for eviction. It has a lock of its
+// own since reads record their use holding only the node's read lock, or no
+// lock at all when the read cache answers.
+type usageTracker struct {
+	mu    sync.Mutex
+	keys  map[string]*list.Element
+	order *list.List // Front is evicted first
+}
+
+func newUsageTracker() *usageTracker {
+	return &usageTracker{keys: make(map[string]*list.Element), order: list.New()}
+}
+
+// touch records a read or write of key. Reads of keys the tracker doesn't
+// know, which were deleted meanwhile, are ignored.
+func (u *usageTracker) touch(key string, write bool) {
+	if u == nil {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	el, ok := u.keys[key]
+	if !ok {
+		if !write {
+			return
+		}
+		el = u.order.PushBack(&keyUse{key: key})
+		u.keys[key] = el
+	}
+	el.Value.(*keyUse).hits++
+	if write || cfg().EvictionPolicy != evictFIFO {
+		u.order.MoveToBack(el)
+	}
+}
+
+func (u *usageTracker) remove(key string) {
+	if u == nil {
+		return
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if el, ok := u.keys[key]; ok {
+		u.order.Remove(el)
+		delete(u.keys, key)
+	}
+}
+
+// reset replaces the tracked keys with keys, ordered from first to last to
+// evict.
+func (u *usageTracker) reset(keys []string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.keys = make(map[string]*list.Element, len(keys))
+	u.order.Init()
+	for _, k := range keys {
+		u.keys[k] = u.order.PushBack(&keyUse{key: k})
+	}
+}
+
+// victim returns the next key to evict other than keep.
+func (u *usageTracker) victim(keep string) (string, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	samples := 1
+	if cfg().EvictionPolicy == evictLFU {
+		samples = evictionSamples
+	}
+	var best *keyUse
+	for el := u.order.Front(); el != nil && samples > 0; el = el.Next() {
+		ku := el.Value.(*keyUse)
+		if ku.key == keep {
+			continue
+		}
+		if best == nil || ku.hits < best.hits {
+			best = ku
+		}
+		samples--
+	}
+	if best == nil {
+		return "", false
+	}
+	return best.key, true
+}
+
+// rebuildUseLocked orders the keys of n by when they were last written. Must
+// be called with n.mu held.
+func (n *ServerNode) rebuildUseLocked() {
+	if n.use == nil {
+		return
+	}
+	keys := make([]string, 0, len(n.node_store))
+	for k := range n.node_store {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return n.modTimeLocked(keys[i]).Before(n.modTimeLocked(keys[j])) })
+	n.use.reset(keys)
+}
+
+// evictLocked frees at least need bytes of n by evicting keys other than
+// keep, failing with ErrStoreFull when eviction is off or even evicting
+// everything else wouldn't do. Must be called with n.mu held.
+func (n *ServerNode) evictLocked(need int64, keep string) error {
+	if n.use == nil {
+		return ErrStoreFull
+	}
+	evictable := n.size
+	if v, ok := n.node_store[keep]; ok {
+		evictable -= int64(len(keep) + len(v))
+	}
+	if need > evictable {
+		return ErrStoreFull
+	}
+	evicted := 0
+	defer func() {
+		if evicted > 0 {
+			metrics.evictions.Add(uint64(evicted))
+			slog.Debug("evicted keys", "node", n.name, "bucket", n.bucket, "keys", evicted)
+			go n.compactSegments()
+		}
+	}()
+	for freed := int64(0); freed < need; {
+		key, ok := n.use.victim(keep)
+		if !ok {
+			return ErrStoreFull
+		}
+		value, exists := n.node_store[key]
+		if !exists {
+			n.use.remove(key)
+			continue
+		}
+		if err := n.appendLocked(opDelete, key, "", typeNone); err != nil {
+			return err
+		}
+		err := n.removeLocked(key, value)
+		freed += int64(len(key) + len(value))
+		evicted++
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
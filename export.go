@@ -0,0 +1,264 @@
+package main
+
+// Bulk export and import. GET /admin/export streams every live pair as JSON
+// lines ({"bucket":"b","key":"k","value":"v"}, bucket left out for the
+// default store), optionally limited to one bucket and a key prefix. POST
+// /admin/import reads the same JSON lines, or CSV rows of key,value[,bucket]
+// with ?format=csv or Content-Type: text/csv, into the store. Imported pairs
+// are written in batches: each node's lock is taken once per batch and its
+// segments synced once, and in a cluster a batch is one Raft command.
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+)
+
+const importBatchSize = 1000
+
+type exportRecord struct {
+	Bucket string `json:"bucket,omitempty"`
+	Key    string `json:"key"`
+	Value  string `json:"value"`
+}
+
+type ImportResult struct {
+	Imported int `json:"imported"`
+}
+
+// exportHandler serves GET /admin/export[?bucket=b][&prefix=p].
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+	nodes := allNodes()
+	if r.URL.Query().Get("bucket") != "" {
+		var ok bool
+		if nodes, ok = requestNodes(w, r, false); !ok {
+			return
+		}
+	}
+	prefix, ok := requestPrefix(w, r)
+	if !ok {
+		return
+	}
+	it := newIterator(nodes, prefix)
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	setSnapshotSeq(w, it.Seq())
+	w.WriteHeader(http.StatusOK)
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	for it.Next() {
+		if err := enc.Encode(exportRecord{Bucket: it.Bucket(), Key: encodeKey(r, it.Key()), Value: it.Value()}); err != nil {
+			return // Client went away
+		}
+	}
+	bw.Flush()
+}
+
+// importReader returns a function yielding the records of body one at a time,
+// io.EOF after the last.
+func importReader(r *http.Request) func() (exportRecord, error) {
+	format := r.URL.Query().Get("format")
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); format == "" && mt == "text/csv" {
+		format = "csv"
+	}
+	if format != "csv" {
+		dec := json.NewDecoder(r.Body)
+		return func() (rec exportRecord, err error) {
+			err = dec.Decode(&rec)
+			if err == nil && rec.Key == "" {
+				err = errors.New("key is required and cannot be empty")
+			}
+			return rec, err
+		}
+	}
+
+	cr := csv.NewReader(r.Body)
+	cr.FieldsPerRecord = -1
+	first := true
+	return func() (exportRecord, error) {
+		for {
+			row, err := cr.Read()
+			if err != nil {
+				return exportRecord{}, err
+			}
+			if first && len(row) >= 2 && row[0] == "key" && row[1] == "value" {
+				first = false
+				continue // Header
+			}
+			first = false
+			if len(row) < 2 || len(row) > 3 || row[0] == "" {
+				return exportRecord{}, errors.New("expected key,value[,bucket]")
+			}
+			rec := exportRecord{Key: row[0], Value: row[1]}
+			if len(row) == 3 {
+				rec.Bucket = row[2]
+			}
+			return rec, nil
+		}
+	}
+}
+
+// importHandler serves POST /admin/import[?bucket=b][&format=csv]. Records
+// without a bucket of their own go to bucket b, or the default store.
+func importHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+	if replica != nil {
+		writeError(w, r, http.StatusForbidden, codeReadOnly, "read-only replica; send writes to "+replica.primary)
+		return
+	}
+	bucket := r.URL.Query().Get("bucket")
+	if bucket != "" && !validBucketName(bucket) {
+		writeError(w, r, http.StatusBadRequest, codeInvalidBucket, "invalid bucket name")
+		return
+	}
+
+	b64, err := keyBase64(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+	next := importReader(r)
+	if b64 {
+		read := next
+		next = func() (exportRecord, error) {
+			rec, err := read()
+			if err == nil {
+				if rec.Key, err = decodeBase64Key(rec.Key); err != nil || rec.Key == "" {
+					err = errors.New("key is not valid non-empty base64")
+				}
+			}
+			return rec, err
+		}
+	}
+	imported := 0
+	batch := make([]exportRecord, 0, importBatchSize)
+	flush := func() error {
+		err := importBatch(r.Context(), batch)
+		if err == nil {
+			imported += len(batch)
+		}
+		batch = batch[:0]
+		return err
+	}
+	for {
+		rec, err := next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			if ferr := flush(); ferr != nil {
+				writeStoreError(w, r, ferr)
+				return
+			}
+			writeError(w, r, http.StatusBadRequest, codeBadRequest,
+				fmt.Sprintf("record %d: %v; %d records imported", imported+1, err, imported))
+			return
+		}
+		if rec.Bucket == "" {
+			rec.Bucket = bucket
+		}
+		batch = append(batch, rec)
+		if len(batch) == importBatchSize {
+			if err := flush(); err != nil {
+				slog.Error("import failed", "imported", imported, "error", err)
+				writeStoreError(w, r, err)
+				return
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		slog.Error("import failed", "imported", imported, "error", err)
+		writeStoreError(w, r, err)
+		return
+	}
+	slog.Info("import finished", "imported", imported)
+	writeJSON(w, ImportResult{imported})
+}
+
+// importBatch writes a batch of records, one putBatch per bucket.
+func importBatch(ctx context.Context, batch []exportRecord) error {
+	byBucket := make(map[string]map[string]string)
+	for _, rec := range batch {
+		if byBucket[rec.Bucket] == nil {
+			byBucket[rec.Bucket] = make(map[string]string)
+		}
+		byBucket[rec.Bucket][rec.Key] = rec.Value // Later records for a key win
+	}
+	for bucket, values := range byBucket {
+		nodes := server_nodes
+		if bucket != "" {
+			var err error
+			if nodes, err = bucketNodes(bucket, true); err != nil {
+				return err
+			}
+		}
+		if err := putBatch(ctx, values, nodes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func putBatch(ctx context.Context, values map[string]string, nodes []*ServerNode) error {
+	for k, v := range values {
+		if err := checkSize(ctx, k, v); err != nil {
+			return fmt.Errorf("key %q: %w", k, err)
+		}
+	}
+	if cluster != nil {
+		return cluster.apply(ctx, command{Op: "put_batch", Bucket: nodes[0].bucket, Values: values})
+	}
+	return putBatchLocal(ctx, values, nodes)
+}
+
+// putBatchLocal writes values to nodes, syncing each node once at the end.
+func putBatchLocal(ctx context.Context, values map[string]string, nodes []*ServerNode) error {
+	parts := make(map[*ServerNode]map[string]string, len(nodes))
+	for k, v := range values {
+		n := getServerKey(k, nodes)
+		if n == nil {
+			return errors.New("no node found for key")
+		}
+		if parts[n] == nil {
+			parts[n] = make(map[string]string)
+		}
+		parts[n][k] = v
+	}
+
+	var errs []error
+	for n, part := range parts {
+		if err := n.lockCtx(ctx); err != nil {
+			errs = append(errs, err)
+			break
+		}
+		// A crash mid-part replays to none of it. A failed write ends the
+		// group early instead, keeping what was applied, as memory does.
+		err := n.beginGroupLocked()
+		for k, v := range part {
+			if err != nil {
+				break
+			}
+			err = n.setLocked(ctx, k, v, typeNone)
+		}
+		errs = append(errs, err, n.commitGroupLocked(), n.persist(ctx))
+		n.mu.Unlock()
+	}
+	return errors.Join(errs...)
+}
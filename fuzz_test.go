@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func FuzzDecodeFrame(f *testing.F) {
+	f.Add(frame(nil))
+	f.Add(frame([]byte("hello")))
+	f.Add(encodeSegmentRecord(segRecord{op: opPut, ver: 1, ts: 1, key: "k", value: "v"}))
+	f.Add(encodeChange(ChangeEvent{Seq: 1, Op: "put", Key: "k", Value: "v"}))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		p, n, err := decodeFrame(b)
+		if err != nil {
+			return
+		}
+		if n > int64(len(b)) || !bytes.Equal(frame(p), b[:n]) {
+			t.Fatalf("decoded %d bytes into %q, which doesn't frame back to the input", n, p)
+		}
+	})
+}
+
+func FuzzDecodeSegmentRecord(f *testing.F) {
+	for _, rec := range []segRecord{
+		{op: opPut, ver: 3, ts: time.Now().UnixNano(), typ: typeJSON, key: "key", value: `{"a":1}`},
+		{op: opDelete, ver: 4, key: "key", grouped: true},
+		{op: opPut, historic: true, ver: 2, key: "k", value: "v"},
+		{op: opClear},
+		{op: opBegin},
+		{op: opCommit, value: "\x02\x00\x00\x00"},
+	} {
+		p, _, _ := decodeFrame(encodeSegmentRecord(rec))
+		f.Add(p)
+	}
+	f.Fuzz(func(t *testing.T, p []byte) {
+		rec, err := decodeSegmentRecord(p)
+		if err != nil || p[0]&opVersioned == 0 {
+			return // Records from before versions are read but never written
+		}
+		again, err := decodeSegmentRecord(encodeSegmentRecord(rec)[changeHeaderLen:])
+		if err != nil || !reflect.DeepEqual(again, rec) {
+			t.Fatalf("record %+v decoded again as %+v (%v)", rec, again, err)
+		}
+	})
+}
+
+func FuzzDecodeChangePayload(f *testing.F) {
+	for _, ev := range []ChangeEvent{
+		{Seq: 1, Time: time.Unix(0, 1).UTC(), Op: "put", Key: "k", Value: "v"},
+		{Seq: 2, Time: time.Now().UTC(), Op: "delete", Bucket: "b", Key: "\x00\xff"},
+		{Seq: 3, Time: time.Now().UTC(), Op: "put", Key: "n", Value: "42", Type: typeInt},
+	} {
+		p, _, _ := decodeFrame(encodeChange(ev))
+		f.Add(p)
+	}
+	f.Fuzz(func(t *testing.T, p []byte) {
+		ev, err := decodeChangePayload(p)
+		if err != nil {
+			return
+		}
+		if got := encodeChange(ev)[changeHeaderLen:]; !bytes.Equal(got, p) {
+			t.Fatalf("event %+v encodes to %x, not %x", ev, got, p)
+		}
+	})
+}
+
+func FuzzDecodeCheckpoint(f *testing.F) {
+	f.Add(encodeCheckpoint(nil, nil, nil))
+	f.Add(encodeCheckpoint(
+		[]segSize{{1, 4096}, {2, 100}},
+		map[string]segLoc{"a": {seg: 1, off: 0, size: 40, ver: 2, ts: 5, typ: typeString}, "b": {seg: 2, off: 60, size: 40, ver: 1}},
+		map[string][]segLoc{"a": {{seg: 1, off: 200, size: 40, ver: 1, del: true}}},
+	))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		sizes, idx, hist, err := decodeCheckpoint(data)
+		if err != nil {
+			return
+		}
+		sizes2, idx2, hist2, err := decodeCheckpoint(encodeCheckpoint(sizes, idx, hist))
+		if err != nil || !reflect.DeepEqual(sizes, sizes2) || !reflect.DeepEqual(idx, idx2) || !reflect.DeepEqual(hist, hist2) {
+			t.Fatalf("checkpoint doesn't survive encoding again (%v)", err)
+		}
+	})
+}
+
+// FuzzRequestBody sends arbitrary bodies to the endpoints that parse one.
+func FuzzRequestBody(f *testing.F) {
+	targets := []struct{ method, path string }{
+		{http.MethodPut, "/fuzz-body"},
+		{http.MethodPatch, "/fuzz-body"},
+		{http.MethodPost, "/fuzz-body"},
+		{http.MethodPost, "/admin/import"},
+		{http.MethodPost, "/admin/import?format=csv"},
+		{http.MethodPost, "/admin/apikeys"},
+	}
+	f.Add(uint8(0), `{"value":"v"}`)
+	f.Add(uint8(0), `{"value":"42","type":"int"}`)
+	f.Add(uint8(1), `[{"op":"add","path":"/a","value":1}]`)
+	f.Add(uint8(2), `{"value":"tail"}`)
+	f.Add(uint8(3), `{"key":"a","value":"1"}`+"\n"+`{"bucket":"b","key":"b","value":"2"}`)
+	f.Add(uint8(4), "a,1\nb,2,bucket\n")
+	f.Add(uint8(5), `{"buckets":["*"],"access":"read"}`)
+	f.Fuzz(func(t *testing.T, target uint8, body string) {
+		tg := targets[int(target)%len(targets)]
+		if w := do(tg.method, tg.path, body); w.Code == http.StatusInternalServerError {
+			t.Fatalf("%s %s answered 500: %s", tg.method, tg.path, w.Body)
+		}
+	})
+}
+
+// FuzzRequestQuery sends arbitrary query strings to the endpoints that parse
+// one.
+func FuzzRequestQuery(f *testing.F) {
+	targets := []struct{ method, path string }{
+		{http.MethodGet, "/get"},
+		{http.MethodGet, "/exists"},
+		{http.MethodPost, "/put"},
+		{http.MethodPost, "/append"},
+		{http.MethodGet, "/mget"},
+		{http.MethodGet, "/keys"},
+		{http.MethodGet, "/count"},
+		{http.MethodGet, "/dump"},
+		{http.MethodGet, "/query"},
+		{http.MethodGet, "/history"},
+		{http.MethodGet, "/changes"},
+		{http.MethodGet, "/admin/export"},
+		{http.MethodGet, "/admin/hotkeys"},
+		{http.MethodDelete, "/keys"},
+	}
+	f.Add(uint8(0), "key=a")
+	f.Add(uint8(2), "key=a&value=1&type=int")
+	f.Add(uint8(2), "key=YQ&value=1&key_encoding=base64")
+	f.Add(uint8(4), "keys=a,b&bucket=b")
+	f.Add(uint8(5), "prefix=a&limit=10&cursor=x")
+	f.Add(uint8(9), "key=a&version=1")
+	f.Add(uint8(10), "since=0&limit=5&bucket=*&wait=1s")
+	f.Add(uint8(12), "top=5&by=reads")
+	f.Fuzz(func(t *testing.T, target uint8, query string) {
+		tg := targets[int(target)%len(targets)]
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond) // For ?wait=
+		defer cancel()
+		r := httptest.NewRequestWithContext(ctx, tg.method, tg.path, nil)
+		r.URL.RawQuery = strings.ReplaceAll(query, "#", "%23")
+		w := httptest.NewRecorder()
+		test_handler.ServeHTTP(w, r)
+		if w.Code == http.StatusInternalServerError {
+			t.Fatalf("%s %s?%s answered 500: %s", tg.method, tg.path, query, w.Body)
+		}
+	})
+}
@@ -0,0 +1,388 @@
+package main
+
+// Cluster membership by gossip. With gossip on, every server (store, replica,
+// raft member or proxy) keeps a table of the cluster's members, each with a
+// heartbeat counter that only its owner increments. Every gossip_interval a
+// server bumps its own heartbeat and POSTs its table to a few random live
+// members at /admin/gossip, getting theirs back; both keep whichever entry of
+// each member is newer. A new server joins by gossiping with gossip_seeds, and
+// from then on learns about everyone else the same way, so the seeds only need
+// to include a few of the members. A member whose heartbeat hasn't moved for
+// gossip_failure_timeout is marked failed; one that shuts down cleanly gossips
+// that it left first. Failed members are no longer gossiped, so they can't
+// come back to life from stale copies, and are forgotten after a while. A
+// restarted server starts a new incarnation, which supersedes the entries of
+// its previous one. Proxies route to the stores the table reports alive
+// (proxy.go); GET /admin/members shows it.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	gossipFanout       = 3       // Members gossiped with each round
+	gossipForgetFactor = 10      // Failed and departed members are forgotten after this many failure timeouts
+	maxGossipBytes     = 4 << 20 // Largest membership table accepted
+)
+
+const (
+	roleStore   = "store"
+	roleReplica = "replica"
+	roleRaft    = "raft"
+	roleProxy   = "proxy"
+)
+
+const (
+	memberAlive  = "alive"
+	memberFailed = "failed"
+	memberLeft   = "left"
+)
+
+// members is set when gossip is on.
+var members *gossiper
+
+// Member is one entry of the gossiped membership table.
+type Member struct {
+	Addr        string `json:"addr"` // Base URL the member is reached at, which identifies it
+	Name        string `json:"name"`
+	Role        string `json:"role"`
+	Incarnation int64  `json:"incarnation"` // Start time in Unix nanoseconds
+	Heartbeat   uint64 `json:"heartbeat"`
+	Left        bool   `json:"left,omitempty"`
+}
+
+// MemberStatus is one entry of GET /admin/members.
+type MemberStatus struct {
+	Member
+	State    string    `json:"state"`
+	Self     bool      `json:"self,omitempty"`
+	LastSeen time.Time `json:"last_seen,omitzero"` // When the heartbeat last moved, as seen here
+}
+
+type memberEntry struct {
+	m     Member
+	state string
+	seen  time.Time
+}
+
+type gossiper struct {
+	self   string
+	seeds  []string
+	client *http.Client
+
+	mu       sync.Mutex
+	members  map[string]*memberEntry
+	stores   []string              // Alive stores, as last reported to onChange
+	onChange func(stores []string) // Called with mu held
+}
+
+// gossipRole is what this server is to the rest of the cluster.
+func gossipRole() string {
+	switch {
+	case cfg().Proxy:
+		return roleProxy
+	case cfg().ReplicaOf != "":
+		return roleReplica
+	case len(cfg().RaftPeers) > 0:
+		return roleRaft
+	}
+	return roleStore
+}
+
+// gossipAdvertise is the address other members reach this server at.
+func gossipAdvertise() string {
+	if cfg().GossipAdvertise != "" {
+		return baseURL(cfg().GossipAdvertise)
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	scheme := "http"
+	if cfg().TLSCert != "" {
+		scheme = "https"
+	}
+	return scheme + "://" + net.JoinHostPort(host, cfg().Port)
+}
+
+func newGossiper(onChange func(stores []string)) *gossiper {
+	g := &gossiper{
+		self:     gossipAdvertise(),
+		client:   &http.Client{Timeout: cfg().GossipInterval},
+		members:  make(map[string]*memberEntry),
+		onChange: onChange,
+	}
+	for _, s := range cfg().GossipSeeds {
+		if s = baseURL(s); s != g.self {
+			g.seeds = append(g.seeds, s)
+		}
+	}
+	g.members[g.self] = &memberEntry{
+		m:     Member{Addr: g.self, Name: cfg().NodeName, Role: gossipRole(), Incarnation: time.Now().UnixNano()},
+		state: memberAlive,
+		seen:  time.Now(),
+	}
+	slog.Info("gossip membership started", "advertise", g.self, "role", gossipRole(), "seeds", len(g.seeds))
+	return g
+}
+
+// run gossips every gossip_interval until ctx is cancelled.
+func (g *gossiper) run(ctx context.Context) {
+	ticker := time.NewTicker(cfg().GossipInterval)
+	defer ticker.Stop()
+	for {
+		for _, target := range g.round() {
+			go g.exchange(ctx, target)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// round bumps this server's heartbeat, updates the state of the other
+// members and picks who to gossip with: a few random live members, plus one
+// seed that isn't one of them so partitions and restarted seeds heal.
+func (g *gossiper) round() []string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.members[g.self].m.Heartbeat++
+	g.members[g.self].seen = time.Now()
+	g.reapLocked()
+
+	var alive []string
+	for addr, e := range g.members {
+		if addr != g.self && e.state == memberAlive {
+			alive = append(alive, addr)
+		}
+	}
+	rand.Shuffle(len(alive), func(i, j int) { alive[i], alive[j] = alive[j], alive[i] })
+	targets := alive[:min(gossipFanout, len(alive))]
+	var seeds []string
+	for _, s := range g.seeds {
+		if !slices.Contains(targets, s) {
+			seeds = append(seeds, s)
+		}
+	}
+	if len(seeds) > 0 {
+		targets = append(targets, seeds[rand.IntN(len(seeds))])
+	}
+	return targets
+}
+
+// reapLocked marks members whose heartbeat stopped as failed and forgets
+// those that have been gone long enough. Must be called with g.mu held.
+func (g *gossiper) reapLocked() {
+	now := time.Now()
+	for addr, e := range g.members {
+		if addr == g.self {
+			continue
+		}
+		idle := now.Sub(e.seen)
+		switch {
+		case e.state == memberAlive && idle > cfg().GossipFailureTimeout:
+			e.state = memberFailed
+			slog.Warn("cluster member failed", "member", addr, "name", e.m.Name, "role", e.m.Role, "last_seen", e.seen)
+		case e.state != memberAlive && idle > gossipForgetFactor*cfg().GossipFailureTimeout:
+			delete(g.members, addr)
+			slog.Debug("cluster member forgotten", "member", addr)
+		}
+	}
+	g.notifyLocked()
+}
+
+// table is what this server gossips: every member it knows to be alive or
+// to have left, itself included.
+func (g *gossiper) table() []Member {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	out := make([]Member, 0, len(g.members))
+	for _, e := range g.members {
+		if e.state != memberFailed {
+			out = append(out, e.m)
+		}
+	}
+	return out
+}
+
+// merge takes in a table from another member, keeping the newer entry of
+// each member.
+func (g *gossiper) merge(table []Member) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	for _, m := range table {
+		if m.Addr == g.self || m.Addr == "" {
+			continue
+		}
+		e := g.members[m.Addr]
+		if e == nil {
+			if m.Left {
+				continue
+			}
+			e = &memberEntry{}
+			g.members[m.Addr] = e
+		} else if m.Incarnation < e.m.Incarnation || m.Incarnation == e.m.Incarnation && m.Heartbeat <= e.m.Heartbeat {
+			continue
+		}
+		state := memberAlive
+		if m.Left {
+			state = memberLeft
+		}
+		switch {
+		case state == e.state:
+		case state == memberLeft:
+			slog.Info("cluster member left", "member", m.Addr, "name", m.Name, "role", m.Role)
+		case e.state == memberFailed:
+			slog.Info("cluster member recovered", "member", m.Addr, "name", m.Name, "role", m.Role)
+		default:
+			slog.Info("cluster member joined", "member", m.Addr, "name", m.Name, "role", m.Role)
+		}
+		e.m, e.state, e.seen = m, state, now
+	}
+	g.notifyLocked()
+}
+
+// notifyLocked reports the alive stores to onChange if they changed. Must be
+// called with g.mu held.
+func (g *gossiper) notifyLocked() {
+	var stores []string
+	for addr, e := range g.members {
+		if e.state == memberAlive && e.m.Role == roleStore {
+			stores = append(stores, addr)
+		}
+	}
+	sort.Strings(stores)
+	if slices.Equal(stores, g.stores) {
+		return
+	}
+	g.stores = stores
+	if g.onChange != nil {
+		g.onChange(slices.Clone(stores))
+	}
+}
+
+// exchange gossips with one member and merges its answer.
+func (g *gossiper) exchange(ctx context.Context, target string) {
+	var theirs []Member
+	if err := g.post(ctx, target, g.table(), &theirs); err != nil {
+		slog.Debug("gossip failed", "member", target, "error", err)
+		return
+	}
+	g.merge(theirs)
+}
+
+func (g *gossiper) post(ctx context.Context, target string, table []Member, out any) error {
+	body, err := json.Marshal(table)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target+"/admin/gossip", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if cfg().GossipAPIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg().GossipAPIKey)
+	}
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("member returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, maxGossipBytes)).Decode(out)
+}
+
+// leave tells a few members that this server is shutting down, so they stop
+// routing to it without waiting for the failure timeout.
+func (g *gossiper) leave() {
+	g.mu.Lock()
+	self := g.members[g.self]
+	self.m.Heartbeat++
+	self.m.Left = true
+	g.mu.Unlock()
+
+	table := g.table()
+	targets := g.round()
+	ctx, cancel := context.WithTimeout(context.Background(), cfg().GossipInterval)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, target := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			g.post(ctx, target, table, nil)
+		}()
+	}
+	wg.Wait()
+	slog.Info("left the cluster", "told", len(targets))
+}
+
+func (g *gossiper) status() []MemberStatus {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	out := make([]MemberStatus, 0, len(g.members))
+	for addr, e := range g.members {
+		out = append(out, MemberStatus{Member: e.m, State: e.state, Self: addr == g.self, LastSeen: e.seen.UTC()})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Addr < out[j].Addr })
+	return out
+}
+
+// adminGossipHandler serves POST /admin/gossip: the caller's membership table
+// in, this server's out.
+func adminGossipHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+	if members == nil {
+		writeError(w, r, http.StatusNotFound, codeGossipDisabled, "gossip is not enabled")
+		return
+	}
+	var table []Member
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxGossipBytes)).Decode(&table); err != nil {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "body must be a JSON array of members")
+		return
+	}
+	members.merge(table)
+	writeJSON(w, members.table())
+}
+
+// adminMembersHandler answers GET /admin/members.
+func adminMembersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+	if members == nil {
+		writeError(w, r, http.StatusNotFound, codeGossipDisabled, "gossip is not enabled")
+		return
+	}
+	writeJSON(w, members.status())
+}
@@ -0,0 +1,172 @@
+package main
+
+// Response compression. With gzip on, GET responses to clients that send
+// Accept-Encoding: gzip are compressed once they grow past gzipMinBytes;
+// smaller ones aren't worth the CPU and go out as they are. That covers
+// large values as well as /dump, /keys and /admin/export, which is
+// compressed as it streams. /watch, /changes and /subscribe, whose events
+// must reach the client as they happen, and pprof profiles, which come compressed,
+// are left alone. A compressed response is a different representation, so a
+// strong ETag on it gets a -gzip suffix; If-None-Match accepts either form.
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	gzipMinBytes   = 1024
+	gzipETagSuffix = "-gzip"
+)
+
+var gzipWriters = sync.Pool{New: func() any { return gzip.NewWriter(nil) }}
+
+// acceptsGzip reports whether the client listed gzip in Accept-Encoding
+// without refusing it with q=0.
+func acceptsGzip(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		if !strings.EqualFold(strings.TrimSpace(coding), "gzip") {
+			continue
+		}
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			v, err := strconv.ParseFloat(q, 64)
+			return err == nil && v > 0
+		}
+		return true
+	}
+	return false
+}
+
+// gzipWriter holds back the first gzipMinBytes of a response to decide
+// whether compressing it pays off.
+type gzipWriter struct {
+	http.ResponseWriter
+	status int
+	buf    []byte
+	gz     *gzip.Writer
+	done   bool // Headers sent, compressed or not
+}
+
+func (g *gzipWriter) WriteHeader(status int) {
+	if g.status == 0 {
+		g.status = status
+	}
+	if status != http.StatusOK || g.Header().Get("Content-Encoding") != "" {
+		g.send(false) // Errors are small and 304s have no body
+	}
+}
+
+func (g *gzipWriter) Write(b []byte) (int, error) {
+	if g.status == 0 {
+		g.status = http.StatusOK
+	}
+	switch {
+	case g.gz != nil:
+		return g.gz.Write(b)
+	case g.done:
+		return g.ResponseWriter.Write(b)
+	}
+	g.buf = append(g.buf, b...)
+	if len(g.buf) >= gzipMinBytes {
+		if err := g.send(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// send writes the headers and whatever has been held back.
+func (g *gzipWriter) send(compress bool) error {
+	if g.done {
+		return nil
+	}
+	g.done = true
+	if g.status == 0 {
+		g.status = http.StatusOK
+	}
+	if compress {
+		g.Header().Set("Content-Encoding", "gzip")
+		g.Header().Del("Content-Length")
+		if tag := g.Header().Get("ETag"); strings.HasPrefix(tag, `"`) {
+			g.Header().Set("ETag", gzipETag(tag))
+		}
+		g.gz = gzipWriters.Get().(*gzip.Writer)
+		g.gz.Reset(g.ResponseWriter)
+	}
+	g.ResponseWriter.WriteHeader(g.status)
+	var err error
+	if g.gz != nil {
+		_, err = g.gz.Write(g.buf)
+	} else if len(g.buf) > 0 {
+		_, err = g.ResponseWriter.Write(g.buf)
+	}
+	g.buf = nil
+	return err
+}
+
+// Flush sends what was written so far, compressed since a flushing handler
+// is producing more than one piece.
+func (g *gzipWriter) Flush() {
+	g.send(true)
+	if g.gz != nil {
+		g.gz.Flush()
+	}
+	http.NewResponseController(g.ResponseWriter).Flush()
+}
+
+func (g *gzipWriter) Unwrap() http.ResponseWriter {
+	return g.ResponseWriter
+}
+
+// close finishes the response.
+func (g *gzipWriter) close() {
+	if !g.done {
+		if g.status == 0 {
+			return // Nothing was written; the server answers 200 itself
+		}
+		g.send(false)
+	}
+	if g.gz != nil {
+		g.gz.Close()
+		gzipWriters.Put(g.gz)
+		g.gz = nil
+	}
+}
+
+// gzipETag returns the ETag of the compressed form of the response tagged
+// tag, a strong quoted ETag.
+func gzipETag(tag string) string {
+	return strings.TrimSuffix(tag, `"`) + gzipETagSuffix + `"`
+}
+
+// compressible reports whether responses for path may be compressed.
+func compressible(path string) bool {
+	switch {
+	case path == "/watch", path == "/changes", path == "/subscribe":
+		return false
+	case strings.HasPrefix(path, "/admin/debug/pprof/"):
+		return false // Profiles are gzipped already
+	}
+	return true
+}
+
+func gzipResponses(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !requestConfig(r).Gzip || r.Method != http.MethodGet || !compressible(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		g := &gzipWriter{ResponseWriter: w}
+		defer g.close()
+		next.ServeHTTP(g, r)
+	})
+}
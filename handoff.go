@@ -0,0 +1,463 @@
+package main
+
+// Hinted handoff for replication. A primary remembers every follower that
+// polls it (replicas pass follower=<id> to /changes and
+// /replication/snapshot) along with the last change each one has
+// acknowledged. Follower IDs are issued by the primary: a replica asks for
+// one with register=true when it takes a snapshot, and keeps it while the
+// primary still knows it. Both that and follower= need replication
+// credentials (replicaScope), an unknown follower= is refused so the replica
+// registers again, and at most maxFollowers are tracked, since each may hold
+// up to handoff_max_bytes of disk. When changes_max_bytes makes the change log discard changes
+// a follower hasn't fetched yet, because it is down or cut off, those
+// changes are first copied to the follower's spill file, handoff/<id>.log in
+// the data directory, in the change log's own record format. A follower that
+// comes back is served from its spill file until it reaches the log, and the
+// file is deleted once it has caught up, instead of the follower having to
+// start over from a snapshot. A spill file growing past handoff_max_bytes is
+// given up on, and so are followers not heard from for handoff_expiry; those
+// resync when they return. In memory mode there is no change log to trim, so
+// nothing is spilled. The acknowledged sequence number and lag of each
+// follower are reported by /admin/replication and /admin/stats.
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	handoffDir      = "handoff"
+	followersFile   = "followers.json"
+	followerTimeout = 2 * replicaPollWait // Silence after which a follower counts as disconnected
+	maxFollowerID   = 64
+	maxFollowers    = 32
+)
+
+var ErrTooManyFollowers = errors.New("too many replication followers")
+
+// FollowerStatus is one follower of a primary.
+type FollowerStatus struct {
+	ID             string    `json:"id"`
+	Addr           string    `json:"addr"` // Where its last request came from
+	AckedSeq       uint64    `json:"acked_seq"`
+	Lag            uint64    `json:"lag"` // Changes it has yet to fetch
+	LastSeen       time.Time `json:"last_seen"`
+	Connected      bool      `json:"connected"`
+	SpilledChanges int       `json:"spilled_changes,omitempty"`
+	SpillBytes     int64     `json:"spill_bytes,omitempty"`
+}
+
+type follower struct {
+	Addr     string    `json:"addr"`
+	Acked    uint64    `json:"acked"`
+	LastSeen time.Time `json:"last_seen"`
+	spill    *spillFile
+}
+
+// spillFile holds changes trimmed from the change log that one follower has
+// yet to fetch, oldest first.
+type spillFile struct {
+	path  string
+	f     *os.File
+	w     *bufio.Writer
+	size  int64
+	first uint64
+	last  uint64
+	count int
+}
+
+type followerRegistry struct {
+	mu        sync.Mutex
+	dir       string // Empty until opened, and in memory mode
+	followers map[string]*follower
+}
+
+var followers = &followerRegistry{followers: make(map[string]*follower)}
+
+func handoffPath() string {
+	return filepath.Join(cfg().DataDir, handoffDir)
+}
+
+func validFollowerID(id string) bool {
+	if id == "" || len(id) > maxFollowerID {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// newFollowerID issues the ID of a new follower.
+func newFollowerID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// open loads the followers known before a restart and their spill files.
+func (fr *followerRegistry) open(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	fr.dir = dir
+	data, err := os.ReadFile(filepath.Join(dir, followersFile))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &fr.followers); err != nil {
+			return err
+		}
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	spilled := 0
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".log")
+		if !ok {
+			continue
+		}
+		path := filepath.Join(dir, e.Name())
+		f := fr.followers[id]
+		if f == nil {
+			os.Remove(path) // Left behind by a follower that was given up on
+			continue
+		}
+		if f.spill, err = openSpill(path); err != nil {
+			return err
+		}
+		spilled++
+	}
+	if len(fr.followers) > 0 {
+		slog.Info("replication followers loaded", "followers", len(fr.followers), "spilled", spilled)
+	}
+	return nil
+}
+
+// openSpill reopens a spill file, dropping a torn tail like the change log
+// does.
+func openSpill(path string) (*spillFile, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	s := &spillFile{path: path, f: f}
+	r := bufio.NewReader(f)
+	for {
+		ev, n, err := readChange(r)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				slog.Warn("truncating damaged spill file tail", "path", path, "offset", s.size, "error", err)
+				err = f.Truncate(s.size)
+			} else {
+				err = nil
+			}
+			if err == nil {
+				_, err = f.Seek(s.size, io.SeekStart)
+			}
+			if err != nil {
+				f.Close()
+				return nil, err
+			}
+			s.w = bufio.NewWriter(f)
+			return s, nil
+		}
+		s.note(ev.Seq, n)
+	}
+}
+
+func createSpill(path string) (*spillFile, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &spillFile{path: path, f: f, w: bufio.NewWriter(f)}, nil
+}
+
+func (s *spillFile) note(seq uint64, n int64) {
+	if s.first == 0 {
+		s.first = seq
+	}
+	s.last = seq
+	s.size += n
+	s.count++
+}
+
+func (s *spillFile) append(ev ChangeEvent) error {
+	buf := encodeChange(ev)
+	if _, err := s.w.Write(buf); err != nil {
+		return err
+	}
+	s.note(ev.Seq, int64(len(buf)))
+	return nil
+}
+
+func (s *spillFile) sync() error {
+	if err := s.w.Flush(); err != nil {
+		return err
+	}
+	return s.f.Sync()
+}
+
+func (s *spillFile) remove() {
+	s.f.Close()
+	if err := os.Remove(s.path); err != nil {
+		slog.Error("failed to remove spill file", "path", s.path, "error", err)
+	}
+}
+
+// register returns the ID a follower taking a snapshot up to acked goes on
+// with: id while it is still known, otherwise a newly issued one.
+func (fr *followerRegistry) register(id string, addr string, acked uint64) (string, error) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	if fr.followers[id] == nil {
+		fr.expireLocked()
+		if len(fr.followers) >= maxFollowers {
+			return "", ErrTooManyFollowers
+		}
+		id = newFollowerID()
+		fr.followers[id] = &follower{}
+		slog.Info("replication follower registered", "follower", id, "addr", addr, "acked_seq", acked)
+		defer fr.saveLocked()
+	}
+	fr.seenLocked(id, addr, acked)
+	return id, nil
+}
+
+// seen records that follower id asked for the changes after acked, which it
+// therefore has. It reports false for an ID that wasn't issued or has been
+// forgotten.
+func (fr *followerRegistry) seen(id string, addr string, acked uint64) bool {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	if fr.followers[id] == nil {
+		return false
+	}
+	fr.seenLocked(id, addr, acked)
+	return true
+}
+
+// seenLocked is seen for a known follower. Must be called with fr.mu held.
+func (fr *followerRegistry) seenLocked(id string, addr string, acked uint64) {
+	f := fr.followers[id]
+	f.Addr, f.Acked, f.LastSeen = addr, acked, time.Now()
+	if f.spill != nil && f.spill.last <= acked {
+		slog.Info("follower caught up with its spilled changes", "follower", id, "changes", f.spill.count)
+		f.spill.remove()
+		f.spill = nil
+	}
+}
+
+// spillTrimmed copies the changes in the first cut bytes of the change log,
+// those before seq cutSeq which are about to be discarded, to the spill
+// files of the followers that haven't fetched them. Called with the change
+// log's lock held.
+func (fr *followerRegistry) spillTrimmed(l *changeLog, cut int64, cutSeq uint64) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	if fr.dir == "" || cfg().HandoffMaxBytes == 0 {
+		return
+	}
+	fr.expireLocked()
+	behind := map[string]*follower{}
+	for id, f := range fr.followers {
+		// A follower already missing changes, which neither the log nor its
+		// spill file has, must resync anyway; spilling for it is wasted
+		has := f.Acked+1 >= l.first
+		if f.spill != nil {
+			has = f.spill.first <= f.Acked+1
+		}
+		if has && f.Acked+1 < cutSeq {
+			behind[id] = f
+		}
+	}
+	if len(behind) == 0 {
+		return
+	}
+
+	r := bufio.NewReader(io.NewSectionReader(l.f, 0, cut))
+	for {
+		ev, _, err := readChange(r)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				slog.Error("failed to read trimmed changes for followers", "error", err)
+			}
+			break
+		}
+		for id, f := range behind {
+			if ev.Seq <= f.Acked || f.spill != nil && ev.Seq <= f.spill.last {
+				continue
+			}
+			if f.spill == nil {
+				if f.spill, err = createSpill(filepath.Join(fr.dir, id+".log")); err != nil {
+					slog.Error("failed to create spill file", "follower", id, "error", err)
+					delete(behind, id)
+					continue
+				}
+			}
+			if err := f.spill.append(ev); err != nil {
+				slog.Error("failed to spill changes", "follower", id, "error", err)
+				fr.dropLocked(id)
+				delete(behind, id)
+				continue
+			}
+			if f.spill.size > cfg().HandoffMaxBytes {
+				slog.Warn("follower is too far behind to keep its changes; it will resync", "follower", id, "spill_bytes", f.spill.size)
+				fr.dropLocked(id)
+				delete(behind, id)
+			}
+		}
+	}
+	for id, f := range behind {
+		if f.spill == nil {
+			continue
+		}
+		if err := f.spill.sync(); err != nil {
+			slog.Error("failed to sync spill file", "follower", id, "error", err)
+			fr.dropLocked(id)
+			continue
+		}
+		slog.Info("spilled changes for follower", "follower", id, "acked_seq", f.Acked, "spilled_through", f.spill.last, "spill_bytes", f.spill.size)
+	}
+	fr.saveLocked()
+}
+
+// replay serves a follower's request for the changes after seq from its
+// spill file, reporting false if the spill file doesn't have them.
+func (fr *followerRegistry) replay(id string, seq uint64, limit int, match func(ChangeEvent) bool) ([]ChangeEvent, uint64, bool) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	f := fr.followers[id]
+	if f == nil || f.spill == nil {
+		return nil, seq, false
+	}
+	s := f.spill
+	if s.first > seq+1 {
+		slog.Warn("spill file starts after what the follower has; it will resync", "follower", id, "since", seq, "spill_first", s.first)
+		s.remove()
+		f.spill = nil
+		return nil, seq, false
+	}
+	if err := s.w.Flush(); err != nil {
+		slog.Error("failed to flush spill file", "follower", id, "error", err)
+		return nil, seq, false
+	}
+	out := []ChangeEvent{}
+	next := seq
+	r := bufio.NewReader(io.NewSectionReader(s.f, 0, s.size))
+	for len(out) < limit {
+		ev, _, err := readChange(r)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				slog.Error("failed to read spill file", "follower", id, "error", err)
+				return nil, seq, false
+			}
+			break
+		}
+		if ev.Seq <= seq {
+			continue
+		}
+		next = ev.Seq
+		if match(ev) {
+			out = append(out, ev)
+		}
+	}
+	return out, next, true
+}
+
+// dropLocked forgets a follower and its spill file. Must be called with
+// fr.mu held.
+func (fr *followerRegistry) dropLocked(id string) {
+	if f := fr.followers[id]; f != nil && f.spill != nil {
+		f.spill.remove()
+	}
+	delete(fr.followers, id)
+}
+
+// expireLocked forgets the followers not heard from for handoff_expiry. Must
+// be called with fr.mu held.
+func (fr *followerRegistry) expireLocked() {
+	for id, f := range fr.followers {
+		if time.Since(f.LastSeen) > cfg().HandoffExpiry {
+			slog.Warn("forgetting replication follower", "follower", id, "last_seen", f.LastSeen)
+			fr.dropLocked(id)
+		}
+	}
+}
+
+// saveLocked writes the followers out so spilling goes on for them across
+// restarts. Must be called with fr.mu held.
+func (fr *followerRegistry) saveLocked() {
+	if fr.dir == "" {
+		return
+	}
+	data, err := json.Marshal(fr.followers)
+	if err == nil {
+		tmp := filepath.Join(fr.dir, followersFile+".tmp")
+		if err = os.WriteFile(tmp, data, 0o644); err == nil {
+			err = os.Rename(tmp, filepath.Join(fr.dir, followersFile))
+		}
+	}
+	if err != nil {
+		slog.Error("failed to save replication followers", "error", err)
+	}
+}
+
+func (fr *followerRegistry) status(last uint64) []FollowerStatus {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	fr.expireLocked()
+	out := make([]FollowerStatus, 0, len(fr.followers))
+	for id, f := range fr.followers {
+		st := FollowerStatus{
+			ID:        id,
+			Addr:      f.Addr,
+			AckedSeq:  f.Acked,
+			LastSeen:  f.LastSeen,
+			Connected: time.Since(f.LastSeen) < followerTimeout,
+		}
+		if last > f.Acked {
+			st.Lag = last - f.Acked
+		}
+		if f.spill != nil {
+			st.SpilledChanges, st.SpillBytes = f.spill.count, f.spill.size
+		}
+		out = append(out, st)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out
+}
+
+func (fr *followerRegistry) close() error {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	var errs []error
+	for _, f := range fr.followers {
+		if f.spill != nil {
+			errs = append(errs, f.spill.sync(), f.spill.f.Close())
+			f.spill = nil
+		}
+	}
+	fr.saveLocked()
+	fr.dir = ""
+	return errors.Join(errs...)
+}
@@ -0,0 +1,238 @@
+package main
+
+// Version history. With history_versions or history_max_age set, a key's
+// overwritten and deleted versions stay referenced from hist instead of
+// becoming garbage, so GET /history?key=k lists them and GET /<key>?version=N
+// reads one back. A previous version is kept while it is among the key's last
+// history_versions or younger than history_max_age; compaction applies the
+// age limit before picking a segment and only copies what is still kept.
+// Memory mode has no segments and so keeps no history.
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	historyDefaultLimit = 10
+	historyMaxLimit     = 1000
+)
+
+var (
+	ErrVersionNotFound = errors.New("version not found")
+	ErrNoHistory       = errors.New("history is not kept in memory mode")
+)
+
+type Version struct {
+	Version uint64    `json:"version"`
+	Time    time.Time `json:"time,omitzero"` // Zero for records written before versions
+	Deleted bool      `json:"deleted,omitempty"`
+	Value   string    `json:"value,omitempty"`
+}
+
+type KeyHistory struct {
+	Key      string    `json:"key"`
+	Versions []Version `json:"versions"`
+}
+
+func historyEnabled() bool {
+	return cfg().HistoryVersions > 0 || cfg().HistoryMaxAge > 0
+}
+
+// addHistory keeps loc as a previous version of key.
+func (s *segmentStore) addHistory(key string, loc segLoc) {
+	h := s.hist[key]
+	i := sort.Search(len(h), func(i int) bool { return h[i].ver >= loc.ver })
+	if loc.ver != 0 && i < len(h) && h[i].ver == loc.ver {
+		return // Another copy of a version we already point at
+	}
+	s.hist[key] = slices.Insert(h, i, loc)
+	s.segment(loc.seg).live += loc.size
+}
+
+// trimHistory drops the previous versions of key the retention policy no
+// longer covers.
+func (s *segmentStore) trimHistory(key string, now time.Time) {
+	h := s.hist[key]
+	if len(h) == 0 {
+		return
+	}
+	keep := h[:0]
+	for i, loc := range h {
+		recent := len(h)-i <= cfg().HistoryVersions
+		young := cfg().HistoryMaxAge > 0 && now.Sub(time.Unix(0, loc.ts)) < cfg().HistoryMaxAge
+		if recent || young {
+			keep = append(keep, loc)
+		} else {
+			s.release(loc)
+		}
+	}
+	if len(keep) == 0 {
+		delete(s.hist, key)
+	} else {
+		s.hist[key] = keep
+	}
+}
+
+func (s *segmentStore) trimAllHistory(now time.Time) {
+	for key := range s.hist {
+		s.trimHistory(key, now)
+	}
+}
+
+// readRecord reads back the record at loc.
+func (s *segmentStore) readRecord(loc segLoc) (segRecord, error) {
+	seg := s.segment(loc.seg)
+	if seg == nil {
+		return segRecord{}, ErrCorruptRecord
+	}
+	f, err := os.Open(seg.path)
+	if err != nil {
+		return segRecord{}, err
+	}
+	defer f.Close()
+	p, _, err := readFrame(io.NewSectionReader(f, loc.off, loc.size))
+	if err != nil {
+		return segRecord{}, err
+	}
+	return decodeSegmentRecord(p)
+}
+
+// versionsLocked returns the locations of every version of key, newest first,
+// starting with the current one. Must be called with n.mu held.
+func (n *ServerNode) versionsLocked(key string) ([]segLoc, error) {
+	if cfg().Memory {
+		return nil, ErrNoHistory
+	}
+	if n.segs == nil {
+		return nil, ErrKeyNotFound // Nothing was written to this store yet
+	}
+	var locs []segLoc
+	if loc, ok := n.segs.idx[key]; ok {
+		locs = append(locs, loc)
+	}
+	h := n.segs.hist[key]
+	for i := len(h) - 1; i >= 0; i-- {
+		locs = append(locs, h[i])
+	}
+	if len(locs) == 0 {
+		return nil, ErrKeyNotFound
+	}
+	return locs, nil
+}
+
+// readVersionLocked fills in the value of the version at loc. Must be called
+// with n.mu held.
+func (n *ServerNode) readVersionLocked(key string, loc segLoc) (Version, error) {
+	v := Version{Version: loc.ver, Deleted: loc.del}
+	if loc.ts != 0 {
+		v.Time = time.Unix(0, loc.ts).UTC()
+	}
+	if loc.del {
+		return v, nil
+	}
+	if cur, ok := n.segs.idx[key]; ok && cur == loc {
+		v.Value = n.node_store[key]
+		return v, nil
+	}
+	rec, err := n.segs.readRecord(loc)
+	if err != nil {
+		return Version{}, err
+	}
+	if rec.key != key || rec.ver != loc.ver {
+		return Version{}, ErrCorruptRecord
+	}
+	v.Value = rec.value
+	return v, nil
+}
+
+// history returns up to limit versions of key, newest first.
+func history(ctx context.Context, key string, limit int, nodes []*ServerNode) ([]Version, error) {
+	n := getServerKey(key, nodes)
+	if n == nil {
+		return nil, errors.New("no node found for key")
+	}
+	if err := n.rlockCtx(ctx); err != nil {
+		return nil, err
+	}
+	defer n.mu.RUnlock()
+	locs, err := n.versionsLocked(key)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]Version, 0, min(limit, len(locs)))
+	for _, loc := range locs[:min(limit, len(locs))] {
+		v, err := n.readVersionLocked(key, loc)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+	}
+	return out, nil
+}
+
+// getVersion returns the value key had at version ver.
+func getVersion(ctx context.Context, key string, ver uint64, nodes []*ServerNode) (string, valueMeta, error) {
+	n := getServerKey(key, nodes)
+	if n == nil {
+		return "", valueMeta{}, errors.New("no node found for key")
+	}
+	if err := n.rlockCtx(ctx); err != nil {
+		return "", valueMeta{}, err
+	}
+	defer n.mu.RUnlock()
+	locs, err := n.versionsLocked(key)
+	if err != nil {
+		return "", valueMeta{}, err
+	}
+	for _, loc := range locs {
+		if loc.ver != ver {
+			continue
+		}
+		if loc.del {
+			return "", valueMeta{}, ErrKeyNotFound
+		}
+		v, err := n.readVersionLocked(key, loc)
+		return v.Value, metaOfLoc(loc), err
+	}
+	return "", valueMeta{}, ErrVersionNotFound
+}
+
+// historyHandler serves GET /history?key=k[&limit=n][&bucket=b].
+func historyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+	key, ok := requestKey(w, r)
+	if !ok {
+		return
+	}
+	limit := historyDefaultLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeError(w, r, http.StatusBadRequest, codeBadRequest, "limit must be a positive integer")
+			return
+		}
+		limit = min(n, historyMaxLimit)
+	}
+	nodes, ok := requestNodes(w, r, false)
+	if !ok {
+		return
+	}
+	versions, err := history(r.Context(), key, limit, nodes)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	writeJSON(w, KeyHistory{encodeKey(r, key), versions})
+}
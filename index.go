@@ -0,0 +1,217 @@
+package main
+
+// Secondary indexes over JSON values. An index is registered on a field
+// (dotted paths reach into nested objects, e.g. "address.city") and maps each
+// field value to the keys whose JSON document holds it. Indexes are kept up
+// to date on every put and delete and rebuilt from the node stores when they
+// are loaded; only the list of indexed fields is saved (indexes.json in the
+// data directory).
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var ErrNoIndex = errors.New("no index on field")
+
+var (
+	index_mu     sync.RWMutex
+	index_fields []string
+)
+
+func indexFile() string {
+	return filepath.Join(cfg().DataDir, "indexes.json")
+}
+
+func loadIndexFields() error {
+	data, err := os.ReadFile(indexFile())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	index_mu.Lock()
+	defer index_mu.Unlock()
+	return json.Unmarshal(data, &index_fields)
+}
+
+func saveIndexFieldsLocked() error {
+	if cfg().Memory {
+		return nil
+	}
+	data, err := json.Marshal(index_fields)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(indexFile(), data, 0o644)
+}
+
+func indexedFields() []string {
+	index_mu.RLock()
+	defer index_mu.RUnlock()
+	return slices.Clone(index_fields)
+}
+
+func isIndexed(field string) bool {
+	index_mu.RLock()
+	defer index_mu.RUnlock()
+	return slices.Contains(index_fields, field)
+}
+
+// addIndex registers field and builds its index over every store.
+func addIndex(field string) error {
+	index_mu.Lock()
+	if slices.Contains(index_fields, field) {
+		index_mu.Unlock()
+		return nil
+	}
+	index_fields = append(index_fields, field)
+	sort.Strings(index_fields)
+	err := saveIndexFieldsLocked()
+	index_mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for _, n := range allNodes() {
+		n.mu.Lock()
+		n.buildIndexLocked(field)
+		n.mu.Unlock()
+	}
+	slog.Info("index created", "field", field)
+	return nil
+}
+
+func dropIndex(field string) error {
+	index_mu.Lock()
+	i := slices.Index(index_fields, field)
+	if i < 0 {
+		index_mu.Unlock()
+		return ErrNoIndex
+	}
+	index_fields = slices.Delete(index_fields, i, i+1)
+	err := saveIndexFieldsLocked()
+	index_mu.Unlock()
+
+	for _, n := range allNodes() {
+		n.mu.Lock()
+		delete(n.indexes, field)
+		n.mu.Unlock()
+	}
+	slog.Info("index dropped", "field", field)
+	return err
+}
+
+// jsonField extracts field from a JSON object value as an index entry.
+// Strings index as themselves, numbers, booleans and null as their JSON text;
+// objects, arrays and non-JSON values are not indexed.
+func jsonField(value string, field string) (string, bool) {
+	var doc any
+	if err := json.Unmarshal([]byte(value), &doc); err != nil {
+		return "", false
+	}
+	for _, part := range strings.Split(field, ".") {
+		obj, ok := doc.(map[string]any)
+		if !ok {
+			return "", false
+		}
+		if doc, ok = obj[part]; !ok {
+			return "", false
+		}
+	}
+	switch v := doc.(type) {
+	case string:
+		return v, true
+	case map[string]any, []any:
+		return "", false
+	default:
+		b, _ := json.Marshal(v)
+		return string(b), true
+	}
+}
+
+// buildIndexLocked rebuilds the index for field from scratch. Must be called
+// with n.mu held.
+func (n *ServerNode) buildIndexLocked(field string) {
+	idx := make(map[string]map[string]struct{})
+	for k, v := range n.node_store {
+		if fv, ok := jsonField(v, field); ok {
+			if idx[fv] == nil {
+				idx[fv] = make(map[string]struct{})
+			}
+			idx[fv][k] = struct{}{}
+		}
+	}
+	if n.indexes == nil {
+		n.indexes = make(map[string]map[string]map[string]struct{})
+	}
+	n.indexes[field] = idx
+}
+
+func (n *ServerNode) rebuildIndexesLocked() {
+	n.indexes = nil
+	for _, field := range indexedFields() {
+		n.buildIndexLocked(field)
+	}
+}
+
+// indexLocked adds key to every index its value has a field for. Must be
+// called with n.mu held.
+func (n *ServerNode) indexLocked(key string, value string) {
+	for _, field := range indexedFields() {
+		fv, ok := jsonField(value, field)
+		if !ok {
+			continue
+		}
+		if n.indexes == nil {
+			n.indexes = make(map[string]map[string]map[string]struct{})
+		}
+		if n.indexes[field] == nil {
+			n.indexes[field] = make(map[string]map[string]struct{})
+		}
+		if n.indexes[field][fv] == nil {
+			n.indexes[field][fv] = make(map[string]struct{})
+		}
+		n.indexes[field][fv][key] = struct{}{}
+	}
+}
+
+// unindexLocked removes key's entries for its old value. Must be called with
+// n.mu held.
+func (n *ServerNode) unindexLocked(key string, value string) {
+	for field, idx := range n.indexes {
+		fv, ok := jsonField(value, field)
+		if !ok {
+			continue
+		}
+		delete(idx[fv], key)
+		if len(idx[fv]) == 0 {
+			delete(idx, fv)
+		}
+	}
+}
+
+// query returns the sorted keys whose value has field equal to value.
+func query(field string, value string, nodes []*ServerNode) ([]string, error) {
+	if !isIndexed(field) {
+		return nil, ErrNoIndex
+	}
+	out := []string{}
+	for _, n := range nodes {
+		n.mu.RLock()
+		for k := range n.indexes[field][value] {
+			out = append(out, k)
+		}
+		n.mu.RUnlock()
+	}
+	sort.Strings(out)
+	return out, nil
+}
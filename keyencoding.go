@@ -0,0 +1,113 @@
+package main
+
+// Key encoding. Keys are arbitrary bytes and are stored as they are. By
+// default they travel percent-encoded like any URL text: in the path of
+// /{key} and /b/{bucket}/{key}, where any byte may be written as %XX and '/'
+// must be when it would make an empty, "." or ".." path segment (those paths
+// are cleaned up and redirected otherwise), and in the key and prefix query
+// parameters. Keys that aren't valid UTF-8 come back mangled in JSON though,
+// so a request may ask for base64 instead with key_encoding=base64 or the
+// X-Key-Encoding: base64 header: every key and prefix it names is then read
+// as base64url (unpadded; padding and the standard alphabet are accepted
+// too), and every key in the response, whether in JSON, export lines or
+// change events, is written back the same way. Values are not affected.
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+const keyEncodingHeader = "X-Key-Encoding"
+
+var errKeyEncoding = errors.New("key_encoding must be raw or base64")
+
+// keyBase64 reports whether r asks for base64 keys. The query parameter
+// takes precedence over the header.
+func keyBase64(r *http.Request) (bool, error) {
+	enc := r.URL.Query().Get("key_encoding")
+	if enc == "" {
+		enc = r.Header.Get(keyEncodingHeader)
+	}
+	switch strings.ToLower(enc) {
+	case "", "raw":
+		return false, nil
+	case "base64":
+		return true, nil
+	}
+	return false, errKeyEncoding
+}
+
+func decodeBase64Key(s string) (string, error) {
+	s = strings.TrimRight(s, "=")
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		b, err = base64.RawStdEncoding.DecodeString(s)
+	}
+	return string(b), err
+}
+
+// decodeKey reads a key or prefix named by r in the encoding it asked for,
+// answering 400 and returning false if it can't be decoded.
+func decodeKey(w http.ResponseWriter, r *http.Request, s string) (string, bool) {
+	b64, err := keyBase64(r)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, err.Error())
+		return "", false
+	}
+	if !b64 {
+		return s, true
+	}
+	key, err := decodeBase64Key(s)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "invalid base64 key: "+s)
+		return "", false
+	}
+	return key, true
+}
+
+// requestKey reads the required key query parameter.
+func requestKey(w http.ResponseWriter, r *http.Request) (string, bool) {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "key is required and cannot be empty")
+		return "", false
+	}
+	return decodeKey(w, r, key)
+}
+
+// requestPrefix reads the optional prefix query parameter.
+func requestPrefix(w http.ResponseWriter, r *http.Request) (string, bool) {
+	return decodeKey(w, r, r.URL.Query().Get("prefix"))
+}
+
+// encodeKey writes key in the encoding r asked for.
+func encodeKey(r *http.Request, key string) string {
+	if b64, _ := keyBase64(r); b64 {
+		return base64.RawURLEncoding.EncodeToString([]byte(key))
+	}
+	return key
+}
+
+func encodeKeys(r *http.Request, keys []string) []string {
+	if b64, _ := keyBase64(r); !b64 {
+		return keys
+	}
+	out := make([]string, len(keys))
+	for i, k := range keys {
+		out[i] = encodeKey(r, k)
+	}
+	return out
+}
+
+func encodeKeyMap(r *http.Request, m map[string]string) map[string]string {
+	if b64, _ := keyBase64(r); !b64 {
+		return m
+	}
+	out := make(map[string]string, len(m))
+	for k, v := range m {
+		out[encodeKey(r, k)] = v
+	}
+	return out
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+var keyEncodingCases = []struct {
+	name string
+	key  string
+}{
+	{"ascii", "plain-key"},
+	{"unicode", "héllo-世界"},
+	{"emoji", "🔑 key"},
+	{"reserved", "a?b#c%d&e=f+g;h"},
+	{"slash", "dir/sub/file"},
+	{"spaces", " lead trail "},
+	{"percent", "%2F%00"},
+	{"binary", "\x00\xff\xfe\x01\n"},
+	{"invalid utf8", "k\xc3\x28"},
+}
+
+// TestKeyEncodingRoundTrip writes each key through the path endpoints and
+// reads it back through every endpoint that names or lists keys, with keys
+// sent as they are and as base64.
+func TestKeyEncodingRoundTrip(t *testing.T) {
+	for i, tc := range keyEncodingCases {
+		for _, b64 := range []bool{false, true} {
+			if !b64 && !utf8.ValidString(tc.key) {
+				continue // JSON can't carry it raw
+			}
+			enc, name := "raw", tc.name
+			if b64 {
+				enc, name = "base64", tc.name+"/base64"
+			}
+			t.Run(name, func(t *testing.T) {
+				bucket := fmt.Sprintf("keys-%d-%s", i, enc)
+				encode := func(key string) string {
+					if b64 {
+						return base64.RawURLEncoding.EncodeToString([]byte(key))
+					}
+					return key
+				}
+				key, other := encode(tc.key), encode(tc.key+"-2")
+				send := func(method string, target string, body string, accept string) *httptest.ResponseRecorder {
+					t.Helper()
+					sep := "?"
+					if strings.Contains(target, "?") {
+						sep = "&"
+					}
+					r := httptest.NewRequest(method, target+sep+"key_encoding="+enc, strings.NewReader(body))
+					if accept != "" {
+						r.Header.Set("Accept", accept)
+					}
+					w := httptest.NewRecorder()
+					test_handler.ServeHTTP(w, r)
+					return w
+				}
+				query := func(params ...string) string {
+					q := url.Values{"bucket": {bucket}}
+					for i := 0; i < len(params); i += 2 {
+						q.Add(params[i], params[i+1])
+					}
+					return q.Encode()
+				}
+				path := "/b/" + bucket + "/" + url.PathEscape(key)
+
+				if w := send(http.MethodPut, path, `{"value":"v1"}`, ""); w.Code != http.StatusOK {
+					t.Fatalf("PUT %s: %d %s", path, w.Code, w.Body)
+				}
+				if w := send(http.MethodGet, path, "", ""); w.Code != http.StatusOK || w.Body.String() != "v1" {
+					t.Fatalf("GET %s: %d %q", path, w.Code, w.Body)
+				}
+				var body valueBody
+				w := send(http.MethodGet, path, "", "application/json")
+				if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body.Key != key || body.Value != "v1" {
+					t.Fatalf("GET %s as JSON: %d %s", path, w.Code, w.Body)
+				}
+				if w := send(http.MethodGet, "/get?"+query("key", key), "", ""); w.Code != http.StatusOK || w.Body.String() != "v1" {
+					t.Fatalf("GET /get: %d %q", w.Code, w.Body)
+				}
+
+				var listed []string
+				w = send(http.MethodGet, "/keys?"+query("prefix", key), "", "")
+				if err := json.Unmarshal(w.Body.Bytes(), &listed); err != nil || len(listed) != 1 || listed[0] != key {
+					t.Fatalf("GET /keys: %d %s, want [%q]", w.Code, w.Body, key)
+				}
+
+				var changes ChangesPage
+				w = send(http.MethodGet, "/changes?"+query("since", "0"), "", "")
+				if err := json.Unmarshal(w.Body.Bytes(), &changes); err != nil || len(changes.Changes) != 1 || changes.Changes[0].Key != key || changes.Changes[0].Op != "put" {
+					t.Fatalf("GET /changes: %d %s", w.Code, w.Body)
+				}
+
+				imp, _ := json.Marshal(exportRecord{Bucket: bucket, Key: other, Value: "v2"})
+				if w := send(http.MethodPost, "/admin/import", string(imp), ""); w.Code != http.StatusOK {
+					t.Fatalf("POST /admin/import: %d %s", w.Code, w.Body)
+				}
+
+				var got map[string]string
+				w = send(http.MethodGet, "/mget?"+query("key", key, "key", other), "", "")
+				if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || len(got) != 2 || got[key] != "v1" || got[other] != "v2" {
+					t.Fatalf("GET /mget: %d %s", w.Code, w.Body)
+				}
+
+				exported := map[string]string{}
+				w = send(http.MethodGet, "/admin/export?"+query(), "", "")
+				sc := bufio.NewScanner(w.Body)
+				for sc.Scan() {
+					var rec exportRecord
+					if err := json.Unmarshal(sc.Bytes(), &rec); err != nil || rec.Bucket != bucket {
+						t.Fatalf("GET /admin/export: bad line %s", sc.Bytes())
+					}
+					exported[rec.Key] = rec.Value
+				}
+				if len(exported) != 2 || exported[key] != "v1" || exported[other] != "v2" {
+					t.Fatalf("GET /admin/export: %d %v", w.Code, exported)
+				}
+
+				var deleted DeleteResult
+				w = send(http.MethodDelete, "/keys?"+query("prefix", key), "", "")
+				if err := json.Unmarshal(w.Body.Bytes(), &deleted); err != nil || deleted.Deleted != 2 {
+					t.Fatalf("DELETE /keys: %d %s", w.Code, w.Body)
+				}
+				if w := send(http.MethodGet, path, "", ""); w.Code != http.StatusNotFound {
+					t.Fatalf("GET %s after delete: %d %q", path, w.Code, w.Body)
+				}
+			})
+		}
+	}
+}
+
+func TestKeyEncodingHeader(t *testing.T) {
+	key := "\x00bin\xff"
+	enc := base64.RawURLEncoding.EncodeToString([]byte(key))
+	r := httptest.NewRequest(http.MethodPut, "/b/keys-header/"+enc, strings.NewReader(`{"value":"v"}`))
+	r.Header.Set(keyEncodingHeader, "base64")
+	w := httptest.NewRecorder()
+	test_handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("PUT: %d %s", w.Code, w.Body)
+	}
+
+	// Padded standard base64 names the same key.
+	std := base64.StdEncoding.EncodeToString([]byte(key))
+	if w := do(http.MethodGet, "/get?bucket=keys-header&key_encoding=base64&key="+url.QueryEscape(std), ""); w.Code != http.StatusOK || w.Body.String() != "v" {
+		t.Fatalf("GET with standard base64: %d %q", w.Code, w.Body)
+	}
+	if w := do(http.MethodGet, "/get?bucket=keys-header&key="+url.QueryEscape(key), ""); w.Code != http.StatusOK || w.Body.String() != "v" {
+		t.Fatalf("GET percent-encoded: %d %q", w.Code, w.Body)
+	}
+}
+
+func TestKeyEncodingInvalid(t *testing.T) {
+	for _, target := range []string{
+		"/get?key=a&key_encoding=hex",
+		"/get?key=!!!&key_encoding=base64",
+		"/keys?prefix=***&key_encoding=base64",
+		"/changes?prefix=***&key_encoding=base64",
+		"/admin/export?prefix=***&key_encoding=base64",
+		"/mget?key=a&key=***&key_encoding=base64",
+	} {
+		if w := do(http.MethodGet, target, ""); w.Code != http.StatusBadRequest {
+			t.Errorf("GET %s: %d, want 400", target, w.Code)
+		}
+	}
+	if w := do(http.MethodPost, "/admin/import?key_encoding=base64", `{"key":"***","value":"v"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("POST /admin/import with a bad key: %d, want 400", w.Code)
+	}
+}
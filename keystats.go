@@ -0,0 +1,294 @@
+package main
+
+// Per-key access statistics for GET /admin/hotkeys. With key_stats on, every
+// store counts the reads and writes of each of its keys and remembers when
+// they last happened: the hottest keys are candidates for caching, and keys
+// nobody has touched in a long time candidates for deletion. Reads are the
+// single-key reads eviction counts too (GET, mget, memcached get), not
+// listings or dumps. Counting starts from zero on startup, with every key's
+// last write taken from its record in the segments, unless
+// key_stats_checkpoint is on: then the counts are saved to <dir>/keystats on
+// every index checkpoint and on shutdown and picked up by the next start.
+
+import (
+	"encoding/gob"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	keyStatsFile   = "keystats"
+	defaultHotKeys = 20
+	maxHotKeys     = 10000
+)
+
+type keyStat struct {
+	Reads     uint64
+	Writes    uint64
+	LastRead  int64 // Unix nanoseconds, 0 for never
+	LastWrite int64
+}
+
+// keyStatsTracker holds the statistics of one store. Like usageTracker it
+// has a lock of its own, since reads are counted under the node's read lock.
+type keyStatsTracker struct {
+	mu    sync.Mutex
+	keys  map[string]*keyStat
+	since time.Time // When counting started
+}
+
+// keyStatsSnapshot is what key_stats_checkpoint writes to disk.
+type keyStatsSnapshot struct {
+	Since time.Time
+	Keys  map[string]keyStat
+}
+
+// KeyStat is one key of the GET /admin/hotkeys response.
+type KeyStat struct {
+	Key       string     `json:"key"`
+	Bucket    string     `json:"bucket,omitempty"`
+	Reads     uint64     `json:"reads"`
+	Writes    uint64     `json:"writes"`
+	LastRead  *time.Time `json:"last_read,omitempty"`
+	LastWrite *time.Time `json:"last_write,omitempty"`
+}
+
+// HotKeys is the body of GET /admin/hotkeys.
+type HotKeys struct {
+	Since time.Time `json:"since"` // Earliest start of counting across the stores
+	By    string    `json:"by"`
+	Keys  []KeyStat `json:"keys"`
+}
+
+func newKeyStatsTracker() *keyStatsTracker {
+	return &keyStatsTracker{keys: make(map[string]*keyStat), since: time.Now()}
+}
+
+// touch counts a read or write of key. Reads of keys the tracker doesn't
+// know, which were deleted meanwhile, are ignored.
+func (t *keyStatsTracker) touch(key string, write bool) {
+	if t == nil {
+		return
+	}
+	now := time.Now().UnixNano()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ks, ok := t.keys[key]
+	if !ok {
+		if !write {
+			return
+		}
+		ks = &keyStat{}
+		t.keys[key] = ks
+	}
+	if write {
+		ks.Writes++
+		ks.LastWrite = now
+	} else {
+		ks.Reads++
+		ks.LastRead = now
+	}
+}
+
+func (t *keyStatsTracker) remove(key string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.keys, key)
+}
+
+func (t *keyStatsTracker) snapshot() keyStatsSnapshot {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := keyStatsSnapshot{Since: t.since, Keys: make(map[string]keyStat, len(t.keys))}
+	for k, ks := range t.keys {
+		out.Keys[k] = *ks
+	}
+	return out
+}
+
+func (n *ServerNode) keyStatsPath() string {
+	return filepath.Join(n.dir, keyStatsFile)
+}
+
+// rebuildAccessLocked starts the statistics of n over from prev, keeping only
+// the keys n still holds and giving new ones their last write time. Must be
+// called with n.mu held.
+func (n *ServerNode) rebuildAccessLocked(prev keyStatsSnapshot) {
+	if n.access == nil {
+		return
+	}
+	keys := make(map[string]*keyStat, len(n.node_store))
+	for k := range n.node_store {
+		ks, ok := prev.Keys[k]
+		if t := n.modTimeLocked(k); !ok && !t.IsZero() {
+			ks.LastWrite = t.UnixNano()
+		}
+		keys[k] = &ks
+	}
+	n.access.mu.Lock()
+	n.access.keys = keys
+	if !prev.Since.IsZero() {
+		n.access.since = prev.Since
+	}
+	n.access.mu.Unlock()
+}
+
+// loadAccessLocked seeds the statistics of n on startup, from the saved
+// ones with key_stats_checkpoint. Must be called with n.mu held.
+func (n *ServerNode) loadAccessLocked() error {
+	var prev keyStatsSnapshot
+	var err error
+	if n.access != nil && cfg().KeyStatsCheckpoint {
+		prev, err = readKeyStats(n.keyStatsPath())
+		if os.IsNotExist(err) {
+			err = nil
+		}
+	}
+	n.rebuildAccessLocked(prev)
+	return err
+}
+
+func readKeyStats(path string) (keyStatsSnapshot, error) {
+	var out keyStatsSnapshot
+	f, err := os.Open(path)
+	if err != nil {
+		return out, err
+	}
+	defer f.Close()
+	err = gob.NewDecoder(f).Decode(&out)
+	return out, err
+}
+
+// saveAccessLocked writes the statistics of n out for the next start. Must
+// be called with n.mu held.
+func (n *ServerNode) saveAccessLocked() error {
+	if n.access == nil || !cfg().KeyStatsCheckpoint || cfg().Memory || n.dropped || n.segs == nil || read_only.Load() {
+		return nil
+	}
+	tmp := n.keyStatsPath() + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = gob.NewEncoder(f).Encode(n.access.snapshot())
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, n.keyStatsPath())
+}
+
+// lastAccess is the later of the key's last read and write.
+func (ks keyStat) lastAccess() int64 {
+	return max(ks.LastRead, ks.LastWrite)
+}
+
+// hotKeys returns the top keys across nodes ordered by by: accesses, reads
+// or writes (most first), or idle (longest since the last access first).
+func hotKeys(nodes []*ServerNode, by string, top int) HotKeys {
+	out := HotKeys{By: by, Keys: []KeyStat{}}
+	type entry struct {
+		key    string
+		bucket string
+		keyStat
+	}
+	var all []entry
+	for _, n := range nodes {
+		if n.access == nil {
+			continue
+		}
+		snap := n.access.snapshot()
+		if out.Since.IsZero() || snap.Since.Before(out.Since) {
+			out.Since = snap.Since
+		}
+		for k, ks := range snap.Keys {
+			all = append(all, entry{k, n.bucket, ks})
+		}
+	}
+	less := map[string]func(a, b keyStat) bool{
+		"accesses": func(a, b keyStat) bool { return a.Reads+a.Writes > b.Reads+b.Writes },
+		"reads":    func(a, b keyStat) bool { return a.Reads > b.Reads },
+		"writes":   func(a, b keyStat) bool { return a.Writes > b.Writes },
+		"idle":     func(a, b keyStat) bool { return a.lastAccess() < b.lastAccess() },
+	}[by]
+	sort.Slice(all, func(i, j int) bool {
+		a, b := all[i], all[j]
+		if less(a.keyStat, b.keyStat) != less(b.keyStat, a.keyStat) {
+			return less(a.keyStat, b.keyStat)
+		}
+		if a.bucket != b.bucket {
+			return a.bucket < b.bucket
+		}
+		return a.key < b.key
+	})
+	for _, e := range all[:min(top, len(all))] {
+		ks := KeyStat{Key: e.key, Bucket: e.bucket, Reads: e.Reads, Writes: e.Writes}
+		if e.LastRead != 0 {
+			t := time.Unix(0, e.LastRead).UTC()
+			ks.LastRead = &t
+		}
+		if e.LastWrite != 0 {
+			t := time.Unix(0, e.LastWrite).UTC()
+			ks.LastWrite = &t
+		}
+		out.Keys = append(out.Keys, ks)
+	}
+	return out
+}
+
+// adminHotKeysHandler answers GET /admin/hotkeys?top=&by=&bucket=.
+func adminHotKeysHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !requestConfig(r).KeyStats {
+		writeError(w, r, http.StatusNotFound, codeKeyStatsDisabled, "key statistics are not enabled; set key_stats")
+		return
+	}
+	q := r.URL.Query()
+	top := defaultHotKeys
+	if q.Has("top") {
+		var err error
+		if top, err = strconv.Atoi(q.Get("top")); err != nil || top < 1 || top > maxHotKeys {
+			writeError(w, r, http.StatusBadRequest, codeBadRequest, "top must be between 1 and "+strconv.Itoa(maxHotKeys))
+			return
+		}
+	}
+	by := q.Get("by")
+	switch by {
+	case "":
+		by = "accesses"
+	case "accesses", "reads", "writes", "idle":
+	default:
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "by must be accesses, reads, writes or idle")
+		return
+	}
+	nodes := allNodes()
+	if q.Has("bucket") {
+		var ok bool
+		if nodes, ok = requestNodes(w, r, false); !ok {
+			return
+		}
+	}
+	hot := hotKeys(nodes, by, top)
+	for i := range hot.Keys {
+		hot.Keys[i].Key = encodeKey(r, hot.Keys[i].Key)
+	}
+	writeJSON(w, hot)
+}
@@ -0,0 +1,40 @@
+package main
+
+// Key and value size limits. Every write path checks a pair against
+// max_key_bytes and max_value_bytes before it reaches the store or the Raft
+// log, so one request can't use up a node's max_store_bytes by itself or
+// overflow the 32-bit lengths in the record formats. HTTP bodies are capped
+// with http.MaxBytesReader as well; both cases answer 413.
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// maxValueBytesLimit keeps a single record well inside maxChangeRecord.
+const maxValueBytesLimit = 256 << 20
+
+var (
+	ErrKeyTooLarge   = errors.New("key too large")
+	ErrValueTooLarge = errors.New("value too large")
+)
+
+// checkSize reports whether key and value are within the limits of the
+// config ctx carries.
+func checkSize(ctx context.Context, key string, value string) error {
+	c := configFrom(ctx)
+	if int64(len(key)) > c.MaxKeyBytes {
+		return ErrKeyTooLarge
+	}
+	if int64(len(value)) > c.MaxValueBytes {
+		return ErrValueTooLarge
+	}
+	return nil
+}
+
+// limitBody caps the request body at what the largest allowed value takes
+// once JSON-encoded, every byte escaped as \u00XX in the worst case.
+func limitBody(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 6*requestConfig(r).MaxValueBytes+1024)
+}
@@ -0,0 +1,188 @@
+package main
+
+// Listeners for the HTTP server and the memcached front-end. Besides
+// host:port the server can serve HTTP on a unix socket (unix_socket), so a
+// sidecar on the same host skips the TCP stack and no port has to be exposed,
+// with tcp turned off to serve on the socket alone. It also accepts sockets
+// passed in by systemd socket activation (LISTEN_FDS): inherited sockets take
+// the place of host:port, and one named "memcached" (FileDescriptorName= in
+// the .socket unit) takes the place of memcached_port. TLS, when configured,
+// applies to every HTTP listener. With max_conns set, the HTTP listeners
+// together hold at most that many connections: accepting pauses at the limit,
+// leaving further clients in the listen backlog rather than refusing them.
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const sdListenFDsStart = 3 // First file descriptor passed by systemd
+
+type listenerSet struct {
+	http      []net.Listener
+	memcached net.Listener // nil when the memcached front-end is off
+}
+
+// openListeners opens every listener the configuration asks for.
+func openListeners() (*listenerSet, error) {
+	ls := &listenerSet{}
+	inherited, err := systemdListeners()
+	if err != nil {
+		return nil, err
+	}
+	for _, sl := range inherited {
+		if sl.name == "memcached" && ls.memcached == nil {
+			ls.memcached = sl.ln
+		} else {
+			ls.http = append(ls.http, sl.ln)
+		}
+	}
+	if len(ls.http) == 0 && cfg().TCP {
+		ln, err := net.Listen("tcp", net.JoinHostPort(cfg().Host, cfg().Port))
+		if err != nil {
+			ls.close()
+			return nil, err
+		}
+		ls.http = append(ls.http, ln)
+	}
+	if cfg().UnixSocket != "" {
+		ln, err := listenUnix(cfg().UnixSocket, cfg().UnixSocketMode)
+		if err != nil {
+			ls.close()
+			return nil, err
+		}
+		ls.http = append(ls.http, ln)
+	}
+	if ls.memcached == nil && cfg().MemcachedPort != "" {
+		ln, err := net.Listen("tcp", net.JoinHostPort(cfg().Host, cfg().MemcachedPort))
+		if err != nil {
+			ls.close()
+			return nil, fmt.Errorf("memcached: %w", err)
+		}
+		ls.memcached = ln
+	}
+	if len(ls.http) == 0 {
+		ls.close()
+		return nil, errors.New("nothing to listen on: tcp is off and neither unix_socket nor systemd sockets are set")
+	}
+	if cfg().MaxConns > 0 {
+		slots := make(chan struct{}, cfg().MaxConns)
+		for i, ln := range ls.http {
+			ls.http[i] = &limitedListener{Listener: ln, slots: slots}
+		}
+	}
+	return ls, nil
+}
+
+// limitedListener takes a slot for each connection it accepts, waiting for
+// one to free up first, and gives it back when the connection is closed.
+type limitedListener struct {
+	net.Listener
+	slots chan struct{}
+}
+
+func (l *limitedListener) Accept() (net.Conn, error) {
+	l.slots <- struct{}{}
+	c, err := l.Listener.Accept()
+	if err != nil {
+		<-l.slots
+		return nil, err
+	}
+	return &limitedConn{Conn: c, release: sync.OnceFunc(func() { <-l.slots })}, nil
+}
+
+type limitedConn struct {
+	net.Conn
+	release func()
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.release()
+	return err
+}
+
+func (ls *listenerSet) close() {
+	for _, ln := range ls.http {
+		ln.Close()
+	}
+	if ls.memcached != nil {
+		ls.memcached.Close()
+	}
+}
+
+// listenUnix listens on a unix socket at path with the given permissions. A
+// socket file left behind by a crash is removed first, unless some process
+// still accepts connections on it.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use by another process", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+type systemdListener struct {
+	name string // From LISTEN_FDNAMES, the socket unit's name by default
+	ln   net.Listener
+}
+
+// systemdListeners returns the sockets systemd passed to this process and
+// clears the variables so they aren't passed on.
+func systemdListeners() ([]systemdListener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 0 {
+		return nil, fmt.Errorf("bad LISTEN_FDS %q", os.Getenv("LISTEN_FDS"))
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	for _, v := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		os.Unsetenv(v)
+	}
+	var listeners []systemdListener
+	for i := range count {
+		fd := sdListenFDsStart + i
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+		// FileListener dups the descriptor close-on-exec, so the inherited one
+		// can be closed straight away.
+		f := os.NewFile(uintptr(fd), name)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, sl := range listeners {
+				sl.ln.Close()
+			}
+			return nil, fmt.Errorf("systemd socket %d: %w", fd, err)
+		}
+		listeners = append(listeners, systemdListener{name: name, ln: ln})
+	}
+	return listeners, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+// Shared setup for the tests, fuzz targets and benchmarks: a server over a
+// temporary data directory, started the way main starts one, with its full
+// middleware chain in test_handler.
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+var test_handler http.Handler
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "kvstore-test")
+	if err != nil {
+		panic(err)
+	}
+	c := defaultConfig()
+	c.DataDir = dir
+	c.SyncPolicy = syncInterval // Don't fsync after every write
+	c.LogSampleRate = 0
+	live_cfg.Store(c)
+	log_level.Set(slog.LevelError)
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	openStores()
+	test_handler = server()
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// do sends a request through test_handler and returns the recorded answer.
+func do(method string, target string, body string) *httptest.ResponseRecorder {
+	var rd io.Reader
+	if body != "" {
+		rd = strings.NewReader(body)
+	}
+	w := httptest.NewRecorder()
+	test_handler.ServeHTTP(w, httptest.NewRequest(method, target, rd))
+	return w
+}
+
+// reopenBucket closes bucket's stores and loads them again from disk, as a
+// restart would.
+func reopenBucket(t testing.TB, bucket string) []*ServerNode {
+	t.Helper()
+	bucket_mu.Lock()
+	defer bucket_mu.Unlock()
+	for _, n := range bucket_nodes[bucket] {
+		n.mu.Lock()
+		if err := n.closeSegments(); err != nil {
+			t.Error(err)
+		}
+		n.dropped = true // Stops its sync and checkpoint loops
+		n.mu.Unlock()
+	}
+	nodes := newBucketNodes(bucket)
+	for _, n := range nodes {
+		if err := n.load(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bucket_nodes[bucket] = nodes
+	return nodes
+}
+
+// withTestConfig runs the rest of the test with the config changed by edit.
+func withTestConfig(t testing.TB, edit func(c *Config)) {
+	t.Helper()
+	old := cfg()
+	c := *old
+	edit(&c)
+	live_cfg.Store(&c)
+	t.Cleanup(func() { live_cfg.Store(old) })
+}
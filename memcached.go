@@ -0,0 +1,360 @@
+package main
+
+// Memcached text protocol front-end so legacy clients can point at a kv node
+// instead of a memcached node. Supports get/gets/set/add/replace/cas/delete
+// plus version and quit. The CAS token gets hands out is the value's version
+// number, which every write of the key changes. Non-zero flags are kept in
+// the system bucket next to the version they were set with, so a value
+// written since through another front-end reads back with flags 0.
+// Expiration times are accepted but ignored.
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	maxMemcachedKeyLen   = 250 // Same limit memcached enforces
+	memcachedFlagsPrefix = "memcached/flags/"
+)
+
+type memcachedListener struct {
+	ln     net.Listener
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	wg     sync.WaitGroup
+	closed bool
+}
+
+// memcachedServer starts accepting memcached connections on ln in the
+// background.
+func memcachedServer(ln net.Listener) *memcachedListener {
+	m := &memcachedListener{ln: ln, conns: make(map[net.Conn]struct{})}
+	slog.Info("memcached listener started", "addr", ln.Addr().String())
+	m.wg.Add(1) // Counts serve itself, so its Adds never race Close's Wait
+	go m.serve()
+	return m
+}
+
+func (m *memcachedListener) serve() {
+	defer m.wg.Done()
+	for {
+		conn, err := m.ln.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				slog.Error("memcached accept failed", "error", err)
+			}
+			return
+		}
+		m.mu.Lock()
+		if m.closed { // Accepted just as Close swept the open ones
+			m.mu.Unlock()
+			conn.Close()
+			return
+		}
+		m.conns[conn] = struct{}{}
+		m.wg.Add(1)
+		m.mu.Unlock()
+		go func() {
+			defer m.wg.Done()
+			handleMemcachedConn(conn)
+			m.mu.Lock()
+			delete(m.conns, conn)
+			m.mu.Unlock()
+		}()
+	}
+}
+
+// Close stops accepting connections, closes the open ones and waits for
+// their handlers to return. A command already being applied finishes first.
+func (m *memcachedListener) Close() error {
+	err := m.ln.Close()
+	m.mu.Lock()
+	m.closed = true
+	for conn := range m.conns {
+		conn.Close()
+	}
+	m.mu.Unlock()
+	m.wg.Wait()
+	return err
+}
+
+func handleMemcachedConn(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				slog.Warn("memcached read failed", "remote", conn.RemoteAddr().String(), "error", err)
+			}
+			return
+		}
+		fields := strings.Fields(strings.TrimRight(line, "\r\n"))
+		if len(fields) == 0 {
+			w.WriteString("ERROR\r\n")
+			w.Flush()
+			continue
+		}
+
+		switch fields[0] {
+		case "get", "gets":
+			memcachedGet(w, fields[1:], fields[0] == "gets")
+		case "set", "add", "replace", "cas":
+			if !memcachedStore(r, w, fields) {
+				w.Flush()
+				return
+			}
+		case "delete":
+			memcachedDelete(w, fields[1:])
+		case "version":
+			w.WriteString("VERSION kvstore\r\n")
+		case "quit":
+			w.Flush()
+			return
+		default:
+			w.WriteString("ERROR\r\n")
+		}
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func validMemcachedKey(key string) bool {
+	if len(key) == 0 || len(key) > maxMemcachedKeyLen {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f { // No whitespace or control characters
+			return false
+		}
+	}
+	return true
+}
+
+func memcachedGet(w *bufio.Writer, keys []string, withCas bool) {
+	if len(keys) == 0 {
+		w.WriteString("ERROR\r\n")
+		return
+	}
+	for _, key := range keys {
+		if !validMemcachedKey(key) {
+			w.WriteString("CLIENT_ERROR bad command line format\r\n")
+			return
+		}
+	}
+	for _, key := range keys {
+		value, err := get(context.Background(), key, server_nodes)
+		if err != nil {
+			continue // Misses are simply left out of the response
+		}
+		ver := valueMetaOf(key, server_nodes).version
+		w.WriteString("VALUE " + key + " " + strconv.FormatUint(uint64(memcachedFlags(key, ver)), 10) + " " + strconv.Itoa(len(value)))
+		if withCas {
+			w.WriteString(" " + strconv.FormatUint(ver, 10))
+		}
+		w.WriteString("\r\n" + value + "\r\n")
+	}
+	w.WriteString("END\r\n")
+}
+
+// memcachedStore handles set/add/replace/cas. It returns false when the
+// connection is no longer usable (the data block could not be read or
+// skipped).
+func memcachedStore(r *bufio.Reader, w *bufio.Writer, fields []string) bool {
+	// <cmd> <key> <flags> <exptime> <bytes> [<cas unique>] [noreply]
+	args := 5
+	if fields[0] == "cas" {
+		args = 6
+	}
+	if len(fields) != args && len(fields) != args+1 {
+		w.WriteString("ERROR\r\n")
+		return true
+	}
+	key := fields[1]
+	noreply := len(fields) == args+1 && fields[args] == "noreply"
+	flags, flagErr := strconv.ParseUint(fields[2], 10, 32)
+	_, expErr := strconv.ParseInt(fields[3], 10, 64)
+	size, sizeErr := strconv.ParseUint(fields[4], 10, 32) // Rejects negative sizes
+	var casErr error
+	var token uint64
+	if fields[0] == "cas" {
+		token, casErr = strconv.ParseUint(fields[5], 10, 64)
+	}
+	if flagErr != nil || expErr != nil || sizeErr != nil || casErr != nil || !validMemcachedKey(key) {
+		w.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return true
+	}
+
+	if int64(size) > cfg().MaxValueBytes {
+		// A block no value could ever fill isn't worth reading past; the
+		// connection is dropped instead.
+		if size > maxValueBytesLimit {
+			w.WriteString("SERVER_ERROR object too large for cache\r\n")
+			return false
+		}
+		if _, err := io.CopyN(io.Discard, r, int64(size)+2); err != nil {
+			return false
+		}
+		if !noreply {
+			w.WriteString("SERVER_ERROR object too large for cache\r\n")
+		}
+		return true
+	}
+
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return false
+	}
+	if data[size] != '\r' || data[size+1] != '\n' {
+		w.WriteString("CLIENT_ERROR bad data chunk\r\n")
+		return true
+	}
+	value := string(data[:size])
+
+	ctx := context.Background()
+	var err error
+	switch {
+	case replica != nil || read_only.Load():
+		err = ErrReadOnly
+	case fields[0] == "set":
+		err = put(ctx, key, value, server_nodes)
+	case fields[0] == "add":
+		err = add(ctx, key, value, server_nodes)
+	case fields[0] == "replace":
+		err = replace(ctx, key, value, server_nodes)
+	case fields[0] == "cas":
+		err = memcachedCAS(ctx, key, value, token)
+	}
+	if err == nil {
+		err = setMemcachedFlags(ctx, key, uint32(flags))
+	}
+
+	var reply string
+	switch {
+	case err == nil:
+		reply = "STORED\r\n"
+	case errors.Is(err, ErrPreconditionFailed):
+		reply = "EXISTS\r\n"
+	case errors.Is(err, ErrKeyNotFound) && fields[0] == "cas":
+		reply = "NOT_FOUND\r\n"
+	case errors.Is(err, ErrKeyExists), errors.Is(err, ErrKeyNotFound):
+		reply = "NOT_STORED\r\n"
+	default:
+		reply = "SERVER_ERROR " + err.Error() + "\r\n"
+	}
+	if !noreply {
+		w.WriteString(reply)
+	}
+	return true
+}
+
+func memcachedDelete(w *bufio.Writer, args []string) {
+	// delete <key> [noreply]
+	if len(args) == 0 || len(args) > 2 || !validMemcachedKey(args[0]) {
+		w.WriteString("CLIENT_ERROR bad command line format\r\n")
+		return
+	}
+	noreply := len(args) == 2 && args[1] == "noreply"
+
+	var reply string
+	err := ErrReadOnly
+	if replica == nil && !read_only.Load() {
+		err = deleteVal(context.Background(), args[0], server_nodes)
+		if err == nil {
+			err = setMemcachedFlags(context.Background(), args[0], 0)
+		}
+	}
+	switch {
+	case err == nil:
+		reply = "DELETED\r\n"
+	case errors.Is(err, ErrKeyNotFound):
+		reply = "NOT_FOUND\r\n"
+	default:
+		reply = "SERVER_ERROR " + err.Error() + "\r\n"
+	}
+	if !noreply {
+		w.WriteString(reply)
+	}
+}
+
+// memcachedCAS stores value under key only while the key's version is still
+// ver, the token gets handed out for it. The write itself is conditional on
+// the value the version was checked against, so a write landing in between
+// is caught too.
+func memcachedCAS(ctx context.Context, key string, value string, ver uint64) error {
+	cur, err := get(ctx, key, server_nodes)
+	if err != nil {
+		return err
+	}
+	if valueMetaOf(key, server_nodes).version != ver {
+		return ErrPreconditionFailed
+	}
+	return putConditional(ctx, key, value, typeNone, etagOf(cur), "", server_nodes)
+}
+
+// memcachedFlagsEntry returns what the system bucket holds for the flags of
+// key: the version they were set with and the flags.
+func memcachedFlagsEntry(key string) (string, bool) {
+	nodes, err := bucketNodes(systemBucket, false)
+	if err != nil {
+		return "", false
+	}
+	n := getServerKey(memcachedFlagsPrefix+key, nodes)
+	if n == nil {
+		return "", false
+	}
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	entry, ok := n.node_store[memcachedFlagsPrefix+key]
+	return entry, ok
+}
+
+// memcachedFlags returns the flags set for version ver of key, 0 when they
+// were set for another version or not at all.
+func memcachedFlags(key string, ver uint64) uint32 {
+	entry, ok := memcachedFlagsEntry(key)
+	if !ok {
+		return 0
+	}
+	setFor, flags, _ := strings.Cut(entry, " ")
+	if setFor != strconv.FormatUint(ver, 10) {
+		return 0
+	}
+	f, _ := strconv.ParseUint(flags, 10, 32)
+	return uint32(f)
+}
+
+// setMemcachedFlags records flags for the version of key just written, or
+// removes the record when flags is 0 or key was deleted.
+func setMemcachedFlags(ctx context.Context, key string, flags uint32) error {
+	if flags == 0 {
+		if _, ok := memcachedFlagsEntry(key); !ok {
+			return nil
+		}
+		nodes, err := bucketNodes(systemBucket, false)
+		if err != nil {
+			return err
+		}
+		if err := deleteVal(ctx, memcachedFlagsPrefix+key, nodes); err != nil && !errors.Is(err, ErrKeyNotFound) {
+			return err
+		}
+		return nil
+	}
+	nodes, err := bucketNodes(systemBucket, true)
+	if err != nil {
+		return err
+	}
+	ver := valueMetaOf(key, server_nodes).version
+	return put(ctx, memcachedFlagsPrefix+key, strconv.FormatUint(ver, 10)+" "+strconv.FormatUint(uint64(flags), 10), nodes)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestMemcachedCAS(t *testing.T) {
+	client, srv := net.Pipe()
+	go handleMemcachedConn(srv)
+	defer client.Close()
+	r := bufio.NewReader(client)
+	send := func(lines ...string) {
+		t.Helper()
+		if _, err := client.Write([]byte(strings.Join(lines, "\r\n") + "\r\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect := func(want string) string {
+		t.Helper()
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if !strings.HasPrefix(line, want) {
+			t.Fatalf("got %q, want %q", line, want)
+		}
+		return line
+	}
+	gets := func(flags string, value string) string {
+		t.Helper()
+		send("gets mc-cas")
+		fields := strings.Fields(expect("VALUE mc-cas " + flags + " "))
+		expect(value)
+		expect("END")
+		return fields[4]
+	}
+
+	send("set mc-cas 42 0 2", "v1")
+	expect("STORED")
+	token := gets("42", "v1")
+
+	send("cas mc-cas 7 0 2 "+token, "v2")
+	expect("STORED")
+	send("cas mc-cas 7 0 2 "+token, "v3") // The token is spent
+	expect("EXISTS")
+	next := gets("7", "v2")
+	if next == token {
+		t.Fatalf("cas token %s didn't change after a write", token)
+	}
+
+	// A write through HTTP leaves no flags behind
+	if w := do(http.MethodPut, "/mc-cas", `{"value":"v4"}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT: %d %s", w.Code, w.Body)
+	}
+	gets("0", "v4")
+
+	send("cas mc-cas-missing 0 0 1 1", "x")
+	expect("NOT_FOUND")
+	send("delete mc-cas")
+	expect("DELETED")
+	if _, ok := memcachedFlagsEntry("mc-cas"); ok {
+		t.Fatal("flags kept after delete")
+	}
+}
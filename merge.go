@@ -0,0 +1,130 @@
+package main
+
+// Merge operators. A merge combines a key's current value with an operand
+// into its new value under the node lock, written as one new record, so
+// clients building a log or list per key don't need a racy and slow
+// GET-modify-PUT. POST /append?key=k appends the request body to the value,
+// creating the key when it doesn't exist yet.
+//
+// Other operators can be added with registerMergeOperator before the server
+// starts. In a cluster the Raft log refers to operators by name, so every
+// member must register the same ones and they must be deterministic.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+)
+
+// MergeOperator returns the new value of a key from its current value, if
+// it exists, and the operand of the merge. Errors wrapping
+// ErrInvalidOperand are reported to the client as a bad request.
+type MergeOperator func(old string, exists bool, operand string) (string, error)
+
+var (
+	ErrUnknownMerge   = errors.New("unknown merge operator")
+	ErrInvalidOperand = errors.New("invalid merge operand")
+)
+
+var merge_operators = map[string]MergeOperator{
+	"append": func(old string, _ bool, operand string) (string, error) { return old + operand, nil },
+}
+
+// registerMergeOperator makes op available to merge as name. It is not safe
+// to call once the server is running.
+func registerMergeOperator(name string, op MergeOperator) {
+	merge_operators[name] = op
+}
+
+func merge(ctx context.Context, op string, key string, operand string, nodes []*ServerNode) (err error) {
+	ctx, span := startOp(ctx, "merge", key, nodes)
+	defer func() { recordOp("merge", err); endSpan(span, err) }()
+	if _, ok := merge_operators[op]; !ok {
+		return fmt.Errorf("%w %q", ErrUnknownMerge, op)
+	}
+	if err := checkSize(ctx, key, operand); err != nil {
+		return err
+	}
+	if cluster != nil {
+		step := startStep(ctx, "raft.apply")
+		err := cluster.apply(ctx, command{Op: "merge", Merge: op, Bucket: nodes[0].bucket, Key: key, Value: operand})
+		endSpan(step, err)
+		return err
+	}
+	return mergeLocal(ctx, op, key, operand, nodes)
+}
+
+func mergeLocal(ctx context.Context, op string, key string, operand string, nodes []*ServerNode) error {
+	fn, ok := merge_operators[op]
+	if !ok {
+		return fmt.Errorf("%w %q", ErrUnknownMerge, op)
+	}
+	n := getServerKey(key, nodes)
+	if n == nil {
+		return errors.New("no node found for key")
+	}
+
+	lock := startStep(ctx, "store.lock_wait")
+	err := n.lockCtx(ctx)
+	endSpan(lock, err)
+	if err != nil {
+		return err
+	}
+	defer n.mu.Unlock()
+	old, exists := n.node_store[key]
+	value, err := fn(old, exists, operand)
+	if err != nil {
+		return err
+	}
+	if err := checkSize(ctx, key, value); err != nil {
+		return err
+	}
+	write := startStep(ctx, "store.write")
+	err = n.setLocked(ctx, key, value, n.keptTypeLocked(key, value))
+	endSpan(write, err)
+	if err != nil {
+		slog.Debug("merge failed", "key", key, "op", op, "node", n.name, "error", err)
+		return err
+	}
+	slog.Debug("merge successful", "key", key, "op", op, "node", n.name, "value_size", len(value))
+
+	return n.persistTraced(ctx)
+}
+
+// appendHandler serves POST /append?key=k[&bucket=b] with the bytes to append
+// as the body.
+func appendHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+	key, ok := requestKey(w, r)
+	if !ok {
+		return
+	}
+	nodes, ok := requestNodes(w, r, true)
+	if !ok {
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, requestConfig(r).MaxValueBytes) // Raw bytes rather than JSON
+	operand, err := io.ReadAll(r.Body)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeStoreError(w, r, ErrValueTooLarge)
+			return
+		}
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "failed to read body")
+		return
+	}
+	if err := merge(r.Context(), "append", key, string(operand), nodes); err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	writeMessage(w, r, "value appended successfully")
+}
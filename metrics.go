@@ -0,0 +1,289 @@
+package main
+
+// Prometheus metrics in the text exposition format, served on /metrics.
+// Counters and histograms are kept in process; gauges are computed from the
+// node stores at scrape time.
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var latencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5}
+
+type histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64 // Per bucket, not cumulative
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		h.counts[i]++
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) write(w io.Writer, name string, labels string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	var cumulative uint64
+	for i, b := range h.buckets {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{%s%sle=\"%s\"} %d\n", name, labels, sep, formatFloat(b), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, sep, h.count)
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, labels, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, h.count)
+}
+
+// histogramVec holds one histogram per label set, keyed by the rendered
+// label string (e.g. `handler="/get",method="GET"`).
+type histogramVec struct {
+	mu      sync.Mutex
+	buckets []float64
+	values  map[string]*histogram
+}
+
+func newHistogramVec(buckets []float64) *histogramVec {
+	return &histogramVec{buckets: buckets, values: make(map[string]*histogram)}
+}
+
+func (v *histogramVec) with(labels string) *histogram {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	h, ok := v.values[labels]
+	if !ok {
+		h = newHistogram(v.buckets)
+		v.values[labels] = h
+	}
+	return h
+}
+
+type counterVec struct {
+	mu     sync.Mutex
+	values map[string]*atomic.Uint64
+}
+
+func newCounterVec() *counterVec {
+	return &counterVec{values: make(map[string]*atomic.Uint64)}
+}
+
+func (v *counterVec) add(labels string, n uint64) {
+	v.mu.Lock()
+	c, ok := v.values[labels]
+	if !ok {
+		c = new(atomic.Uint64)
+		v.values[labels] = c
+	}
+	v.mu.Unlock()
+	c.Add(n)
+}
+
+func sortedLabels[T any](m map[string]T) []string {
+	out := make([]string, 0, len(m))
+	for k := range m {
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
+
+var metrics = struct {
+	ops            *counterVec // op="get|put|delete"
+	errors         *counterVec // op, failures other than missing keys
+	misses         atomic.Uint64
+	bloomNegatives atomic.Uint64 // Misses answered by the bloom filter
+	evictions      atomic.Uint64
+	backups        atomic.Uint64
+	backupErrors   atomic.Uint64
+	bytesWritten   atomic.Uint64
+	syncedBytes    atomic.Uint64 // Segment bytes flushed by syncs
+	httpRequests   *counterVec   // handler, method, code
+	httpLatency    *histogramVec // handler, method
+	saveLatency    *histogram
+}{
+	ops:          newCounterVec(),
+	errors:       newCounterVec(),
+	httpRequests: newCounterVec(),
+	httpLatency:  newHistogramVec(latencyBuckets),
+	saveLatency:  newHistogram(latencyBuckets),
+}
+
+// recordOp counts a store operation and its outcome.
+func recordOp(op string, err error) {
+	metrics.ops.add(`op="`+op+`"`, 1)
+	switch {
+	case err == nil:
+	case err == ErrKeyNotFound:
+		metrics.misses.Add(1)
+	default:
+		metrics.errors.add(`op="`+op+`"`, 1)
+	}
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func labelValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+// methodLabel returns the method label for method. Clients can send any token
+// as a method, so those outside the standard set share "other".
+func methodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	}
+	return "other"
+}
+
+func writeCounterVec(w io.Writer, name string, help string, v *counterVec) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for _, labels := range sortedLabels(v.values) {
+		fmt.Fprintf(w, "%s{%s} %d\n", name, labels, v.values[labels].Load())
+	}
+}
+
+func writeMetric(w io.Writer, name string, kind string, help string, value string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %s\n", name, help, name, kind, name, value)
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	c := requestConfig(r)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	writeCounterVec(w, "kv_operations_total", "Store operations by type.", metrics.ops)
+	writeCounterVec(w, "kv_errors_total", "Failed store operations by type, excluding missing keys.", metrics.errors)
+	writeMetric(w, "kv_get_misses_total", "counter", "Lookups for keys that do not exist.", strconv.FormatUint(metrics.misses.Load(), 10))
+	writeMetric(w, "kv_bloom_negatives_total", "counter", "Lookups the bloom filter answered as definite misses.", strconv.FormatUint(metrics.bloomNegatives.Load(), 10))
+	writeMetric(w, "kv_evictions_total", "counter", "Keys evicted to make room under eviction_policy.", strconv.FormatUint(metrics.evictions.Load(), 10))
+	writeMetric(w, "kv_backups_total", "counter", "Backups uploaded to object storage.", strconv.FormatUint(metrics.backups.Load(), 10))
+	writeMetric(w, "kv_backup_errors_total", "counter", "Backups that failed to upload.", strconv.FormatUint(metrics.backupErrors.Load(), 10))
+	if read_cache != nil {
+		writeMetric(w, "kv_cache_hits_total", "counter", "Reads served from the LRU cache.", strconv.FormatUint(read_cache.hits.Load(), 10))
+		writeMetric(w, "kv_cache_misses_total", "counter", "Reads that missed the LRU cache.", strconv.FormatUint(read_cache.misses.Load(), 10))
+	}
+	writeMetric(w, "kv_bytes_written_total", "counter", "Key and value bytes accepted by writes.", strconv.FormatUint(metrics.bytesWritten.Load(), 10))
+	writeMetric(w, "kv_synced_bytes_total", "counter", "Segment bytes flushed to disk by syncs.", strconv.FormatUint(metrics.syncedBytes.Load(), 10))
+	writeCounterVec(w, "kv_http_requests_total", "HTTP requests by handler, method and status code.", metrics.httpRequests)
+
+	fmt.Fprint(w, "# HELP kv_http_request_duration_seconds HTTP request latency.\n# TYPE kv_http_request_duration_seconds histogram\n")
+	metrics.httpLatency.mu.Lock()
+	for _, labels := range sortedLabels(metrics.httpLatency.values) {
+		metrics.httpLatency.values[labels].write(w, "kv_http_request_duration_seconds", labels)
+	}
+	metrics.httpLatency.mu.Unlock()
+
+	fmt.Fprint(w, "# HELP kv_save_duration_seconds Time spent writing node stores to disk.\n# TYPE kv_save_duration_seconds histogram\n")
+	metrics.saveLatency.write(w, "kv_save_duration_seconds", "")
+
+	type nodeSize struct {
+		labels string
+		keys   int
+		bytes  int64
+	}
+	var nodes []nodeSize
+	for _, n := range allNodes() {
+		n.mu.RLock()
+		nodes = append(nodes, nodeSize{`node="` + labelValue(n.name) + `",bucket="` + labelValue(n.bucket) + `"`, len(n.node_store), n.size})
+		n.mu.RUnlock()
+	}
+	fmt.Fprint(w, "# HELP kv_keys Live keys per node and bucket.\n# TYPE kv_keys gauge\n")
+	for _, n := range nodes {
+		fmt.Fprintf(w, "kv_keys{%s} %d\n", n.labels, n.keys)
+	}
+	fmt.Fprint(w, "# HELP kv_store_bytes Key and value bytes held per node and bucket.\n# TYPE kv_store_bytes gauge\n")
+	for _, n := range nodes {
+		fmt.Fprintf(w, "kv_store_bytes{%s} %d\n", n.labels, n.bytes)
+	}
+	if c.MaxStoreBytes > 0 {
+		fmt.Fprint(w, "# HELP kv_store_utilization_ratio Fraction of max_store_bytes in use per node and bucket.\n# TYPE kv_store_utilization_ratio gauge\n")
+		for _, n := range nodes {
+			fmt.Fprintf(w, "kv_store_utilization_ratio{%s} %s\n", n.labels, formatFloat(float64(n.bytes)/float64(c.MaxStoreBytes)))
+		}
+	}
+	writeMetric(w, "kv_store_max_bytes", "gauge", "Configured max_store_bytes, 0 when unlimited.", strconv.FormatInt(c.MaxStoreBytes, 10))
+}
+
+// routeHolder carries the pattern the mux matched back out to the
+// middlewares around it. Those between them (timeouts, auth) pass copies of
+// the request down, and the mux only sets Pattern on the copy it gets.
+type routeHolder struct {
+	pattern string
+}
+
+type routeContext struct{}
+
+// withRoute returns r with a routeHolder in its context, reusing one an
+// outer middleware put there.
+func withRoute(r *http.Request) (*http.Request, *routeHolder) {
+	if h, ok := r.Context().Value(routeContext{}).(*routeHolder); ok {
+		return r, h
+	}
+	h := &routeHolder{}
+	return r.WithContext(context.WithValue(r.Context(), routeContext{}, h)), h
+}
+
+// recordRoute wraps a mux, noting the pattern it routed each request with in
+// the request's routeHolder.
+func recordRoute(mux http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.ServeHTTP(w, r)
+		if h, ok := r.Context().Value(routeContext{}).(*routeHolder); ok {
+			h.pattern = r.Pattern
+		}
+	})
+}
+
+// instrumentRequests records request counts and latency per route. The
+// route is the ServeMux pattern so keys in the path don't become labels.
+func instrumentRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		r, holder := withRoute(r)
+		next.ServeHTTP(rec, r)
+
+		route := holder.pattern
+		if route == "" {
+			route = "unmatched"
+		}
+		labels := `handler="` + labelValue(route) + `",method="` + methodLabel(r.Method) + `"`
+		metrics.httpLatency.with(labels).observe(time.Since(start).Seconds())
+		metrics.httpRequests.add(labels+`,code="`+strconv.Itoa(rec.status)+`"`, 1)
+	})
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// statusRecorder captures the status code and body size written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// logRequests writes one access log line per request with the method, path,
+// status, latency and byte counts. Successful requests are sampled at
+// log_sample_rate; client and server errors are always logged.
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		r = withConfig(r)
+		c := requestConfig(r)
+		next.ServeHTTP(rec, r)
+
+		if rec.status < 400 && (c.LogSampleRate <= 0 || rand.Float64() >= c.LogSampleRate) {
+			return
+		}
+		level := slog.LevelInfo
+		if rec.status >= 500 {
+			level = slog.LevelError
+		}
+		slog.Log(r.Context(), level, "http request",
+			"method", r.Method,
+			"path", logPath(r.URL, c.LogRedact),
+			"status", rec.status,
+			"latency", time.Since(start),
+			"bytes_in", max(r.ContentLength, 0),
+			"bytes_out", rec.bytes,
+			"remote", r.RemoteAddr,
+		)
+	})
+}
+
+// logPath renders the request path for the access log, hiding the value
+// parameter of /put-style requests when redact is set.
+func logPath(u *url.URL, redact bool) string {
+	if u.RawQuery == "" {
+		return u.Path
+	}
+	q := u.Query()
+	if redact && q.Has("value") {
+		q.Set("value", "REDACTED")
+	}
+	return u.Path + "?" + q.Encode()
+}
@@ -0,0 +1,191 @@
+package main
+
+// kvstore import: a one-shot migration from Redis or BoltDB into the data
+// directory of a stopped server, configured by any server flags given after
+// --, e.g.
+//
+//	kvstore import -from-redis dump.rdb -- -data-dir /var/lib/kvstore
+//	kvstore import -from-bolt my.db -- -config kvstore.yaml
+//
+// Keys are streamed out of the file and written in batches of
+// importBatchSize, each node store synced once per batch as with POST
+// /admin/import. Redis keys of one database (-redis-db, 0 by default) go to
+// the default store or -bucket; see rdb.go for how non-string values are
+// converted. Each top-level Bolt bucket becomes a bucket of the same name,
+// with keys of nested buckets prefixed by their names and "/", or with
+// -bucket every key goes to that bucket prefixed by its full Bolt bucket path.
+// The server must not be running on the data directory meanwhile.
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+)
+
+type importConfig struct {
+	fromRedis string
+	fromBolt  string
+	redisDB   int
+	bucket    string
+}
+
+func parseImportFlags(args []string) (*importConfig, []string, error) {
+	c := &importConfig{}
+	fs := flag.NewFlagSet("kvstore import", flag.ContinueOnError)
+	fs.StringVar(&c.fromRedis, "from-redis", "", "Redis RDB file to import")
+	fs.StringVar(&c.fromBolt, "from-bolt", "", "BoltDB file to import")
+	fs.IntVar(&c.redisDB, "redis-db", 0, "Redis database to import")
+	fs.StringVar(&c.bucket, "bucket", "", "bucket to import into instead of the default store (Redis) or one bucket per Bolt bucket")
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+	var errs []error
+	if (c.fromRedis == "") == (c.fromBolt == "") {
+		errs = append(errs, errors.New("exactly one of -from-redis or -from-bolt is required"))
+	}
+	if c.redisDB < 0 {
+		errs = append(errs, errors.New("-redis-db must not be negative"))
+	}
+	if c.bucket != "" && !validBucketName(c.bucket) {
+		errs = append(errs, fmt.Errorf("invalid -bucket %q", c.bucket))
+	}
+	return c, fs.Args(), errors.Join(errs...)
+}
+
+// runImport runs the import subcommand and returns the process exit code.
+func runImport(args []string) int {
+	ic, serverArgs, err := parseImportFlags(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return 0
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "invalid import configuration:", err)
+		return 2
+	}
+	c, err := loadConfig(serverArgs)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		fmt.Fprintln(os.Stderr, "invalid configuration:", err)
+		return 2
+	}
+	live_cfg.Store(c)
+	log_level.Set(cfg().LogLevel)
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: log_level})))
+	if cfg().Memory || cfg().Proxy || len(cfg().RaftPeers) > 0 || cfg().ReplicaOf != "" {
+		fmt.Fprintln(os.Stderr, "import writes a standalone data directory; it can't run in memory, proxy, raft or replica mode")
+		return 2
+	}
+	if _, err := os.Stat(ic.fromRedis + ic.fromBolt); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	openStores()
+
+	ctx := context.Background()
+	imported := 0
+	batch := make([]exportRecord, 0, importBatchSize)
+	flush := func() error {
+		if err := importBatch(ctx, batch); err != nil {
+			return err
+		}
+		imported += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+	add := func(rec exportRecord) error {
+		batch = append(batch, rec)
+		if len(batch) < importBatchSize {
+			return nil
+		}
+		return flush()
+	}
+
+	var skipped []string
+	if ic.fromRedis != "" {
+		var f *os.File
+		if f, err = os.Open(ic.fromRedis); err == nil {
+			var st rdbStats
+			st, err = readRDB(f, ic.redisDB, func(key string, value string) error {
+				return add(exportRecord{Bucket: ic.bucket, Key: key, Value: value})
+			})
+			f.Close()
+			skipped = st.summary()
+		}
+	} else {
+		err = readBolt(ic.fromBolt, func(buckets []string, key string, value string) error {
+			rec := exportRecord{Bucket: buckets[0], Key: key}
+			if ic.bucket != "" {
+				rec.Bucket = ic.bucket
+			} else {
+				buckets = buckets[1:]
+				if !validBucketName(rec.Bucket) {
+					return fmt.Errorf("bolt bucket %q is not a valid bucket name; use -bucket", rec.Bucket)
+				}
+			}
+			if len(buckets) > 0 {
+				rec.Key = strings.Join(buckets, "/") + "/" + key
+			}
+			rec.Value = value
+			return add(rec)
+		})
+	}
+	if err == nil {
+		err = flush()
+	}
+
+	clean := true
+	for _, n := range allNodes() {
+		n.mu.Lock()
+		if cerr := n.closeSegments(); cerr != nil {
+			slog.Error("final sync failed", "node", n.name, "bucket", n.bucket, "error", cerr)
+			clean = false
+		}
+		n.mu.Unlock()
+	}
+	if cerr := changes.close(); cerr != nil {
+		slog.Error("failed to close change log", "error", cerr)
+		clean = false
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "import failed after %d keys: %v\n", imported, err)
+		return 1
+	}
+	fmt.Printf("imported %d keys\n", imported)
+	for _, s := range skipped {
+		fmt.Println("skipped", s)
+	}
+	if !clean {
+		return 1
+	}
+	return 0
+}
+
+// summary describes the keys that were left out, one line each.
+func (st rdbStats) summary() []string {
+	var out []string
+	if st.expired > 0 {
+		out = append(out, fmt.Sprintf("%d expired keys", st.expired))
+	}
+	if st.otherDB > 0 {
+		out = append(out, fmt.Sprintf("%d keys of other databases", st.otherDB))
+	}
+	if st.emptyKey > 0 {
+		out = append(out, fmt.Sprintf("%d empty keys", st.emptyKey))
+	}
+	kinds := make([]string, 0, len(st.skipped))
+	for kind := range st.skipped {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	for _, kind := range kinds {
+		out = append(out, fmt.Sprintf("%d %s keys", st.skipped[kind], kind))
+	}
+	return out
+}
@@ -0,0 +1,63 @@
+package main
+
+// Write times. Every segment record carries the time it was written (see
+// segment.go), so a key's last modification is the time on its current
+// record. GET answers with Last-Modified and honours If-Modified-Since,
+// GET /keys?modified_since=T lists the keys written after T, and
+// /admin/stats reports each store's latest write. Records from before
+// versioned segments have no time and are treated as never modified; in
+// memory mode there are no records, so no times either.
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrNoTimestamps = errors.New("write times are not kept in memory mode")
+
+// modTimeLocked returns when key was last written, or the zero time when that
+// isn't known. Must be called with n.mu held.
+func (n *ServerNode) modTimeLocked(key string) time.Time {
+	if n.segs == nil {
+		return time.Time{}
+	}
+	loc, ok := n.segs.idx[key]
+	if !ok || loc.ts == 0 || loc.del {
+		return time.Time{}
+	}
+	return time.Unix(0, loc.ts).UTC()
+}
+
+// keysModifiedSince is keys limited to those written after since.
+func keysModifiedSince(prefix string, since time.Time, nodes []*ServerNode) ([]string, error) {
+	if cfg().Memory {
+		return nil, ErrNoTimestamps
+	}
+	out := []string{}
+	for _, n := range nodes {
+		n.mu.RLock()
+		for k := range n.node_store {
+			if strings.HasPrefix(k, prefix) && n.modTimeLocked(k).After(since) {
+				out = append(out, k)
+			}
+		}
+		n.mu.RUnlock()
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// parseModifiedSince accepts an RFC 3339 time or Unix seconds.
+func parseModifiedSince(v string) (time.Time, error) {
+	if secs, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, v)
+	if err != nil {
+		return time.Time{}, errors.New("modified_since must be an RFC 3339 time or Unix seconds")
+	}
+	return t, nil
+}
@@ -0,0 +1,440 @@
+package main
+
+// OpenAPI description of the HTTP API, served at GET /openapi.json. The
+// routes server() registers are listed here together with their methods and
+// parameters, and the document is built from the same table, so a route
+// can't be added without appearing in it. Request and response schemas are
+// derived from the Go types the handlers decode and encode.
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const apiVersion = "1.0"
+
+type route struct {
+	pattern string // ServeMux pattern
+	handler http.HandlerFunc
+	ops     []operation
+}
+
+type operation struct {
+	path       string // OpenAPI path, when it isn't the pattern
+	method     string
+	summary    string
+	params     []param
+	body       any            // Value of the request body type, nil for none
+	bodyType   string         // Request content type; JSON when empty
+	bodies     map[string]any // Request bodies by content type, when there is more than one
+	result     any            // Value of the response type; nil for a write confirmation
+	resultType string         // Response content type; JSON when empty
+}
+
+type param struct {
+	in       string // "path", "query" or "header"
+	name     string
+	desc     string
+	integer  bool
+	required bool
+}
+
+// putBody is the request body of a key write.
+type putBody struct {
+	Value string `json:"value"`
+	Type  string `json:"type,omitempty"` // string, int, json or binary; see valuetype.go
+}
+
+var (
+	pathKey     = param{in: "path", name: "key", desc: "Key; may contain slashes", required: true}
+	pathBucket  = param{in: "path", name: "bucket", desc: "Bucket name", required: true}
+	queryBucket = param{in: "query", name: "bucket", desc: "Bucket to use instead of the default store"}
+	queryKey    = param{in: "query", name: "key", required: true}
+	queryPrefix = param{in: "query", name: "prefix", desc: "Only keys starting with prefix"}
+
+	queryKeyEncoding = param{in: "query", name: "key_encoding", desc: "raw (the default) or base64 for keys in the request and response; also X-Key-Encoding"}
+)
+
+// keyOps describes the methods of a key path.
+func keyOps(path string, params ...param) []operation {
+	params = append(params, pathKey, queryKeyEncoding)
+	read := append(params[:len(params):len(params)],
+		param{in: "query", name: "version", desc: "Read this version from the key's history", integer: true},
+		param{in: "header", name: "If-None-Match"},
+		param{in: "header", name: "If-Modified-Since"},
+	)
+	write := append(params[:len(params):len(params)],
+		param{in: "header", name: "If-Match", desc: "Write only if the current value has this ETag; * if the key exists"},
+		param{in: "header", name: "If-None-Match", desc: "Write only if the current value doesn't have this ETag; * if the key doesn't exist"},
+	)
+	return []operation{
+		{path: path, method: http.MethodGet, summary: "Read a key", params: read, result: valueBody{}},
+		{path: path, method: http.MethodHead, summary: "Check that a key exists", params: read},
+		{path: path, method: http.MethodPut, summary: "Write a key", params: write, body: putBody{}},
+		{path: path, method: http.MethodPost, summary: "Write a key (same as PUT)", params: write, body: putBody{}},
+		{path: path, method: http.MethodPatch, summary: "Update part of a JSON value", params: params, bodies: map[string]any{
+			mimeJSONPatch:  []patchOp{},
+			mimeMergePatch: map[string]any{},
+		}},
+		{path: path, method: http.MethodDelete, summary: "Delete a key", params: params},
+	}
+}
+
+// apiRoutes returns the routes of the HTTP API.
+func apiRoutes() []route {
+	return []route{
+		{"/", rootHandler, keyOps("/{key}")},
+		{"/b/", bucketPathHandler, append([]operation{
+			{path: "/b/{bucket}", method: http.MethodGet, summary: "List the keys of a bucket", params: []param{pathBucket, queryPrefix, queryKeyEncoding}, result: []string{}},
+			{path: "/b/{bucket}", method: http.MethodDelete, summary: "Drop a bucket and its keys", params: []param{pathBucket}},
+		}, keyOps("/b/{bucket}/{key}", pathBucket)...)},
+		{"/buckets", bucketsHandler, []operation{
+			{method: http.MethodGet, summary: "List buckets", result: []BucketInfo{}},
+		}},
+		{"/get", getHandler, []operation{
+			{method: http.MethodGet, summary: "Read a key", params: []param{queryKey, queryBucket, queryKeyEncoding}, result: valueBody{}},
+		}},
+		{"/exists", existsHandler, []operation{
+			{method: http.MethodGet, summary: "Check whether a key exists without reading its value", params: []param{queryKey, queryBucket, queryKeyEncoding}, result: ExistsResult{}},
+		}},
+		{"/put", putHandler, []operation{
+			{method: http.MethodGet, summary: "Write a key", params: []param{queryKey, {in: "query", name: "value", required: true}, {in: "query", name: "type", desc: "Type tag of the value: string, int, json or binary"}, queryBucket, queryKeyEncoding}},
+		}},
+		{"/delete", deleteHandler, []operation{
+			{method: http.MethodGet, summary: "Delete a key", params: []param{queryKey, queryBucket, queryKeyEncoding}},
+		}},
+		{"/append", appendHandler, []operation{
+			{method: http.MethodPost, summary: "Append the body to a key's value, creating the key if needed", params: []param{queryKey, queryBucket, queryKeyEncoding}, body: "", bodyType: "application/octet-stream"},
+		}},
+		{"/mget", mgetHandler, []operation{
+			{method: http.MethodGet, summary: "Read several keys; missing keys are left out", params: []param{{in: "query", name: "key", desc: "Repeated for each key"}, queryBucket, queryKeyEncoding}, result: map[string]string{}},
+		}},
+		{"/keys", keysHandler, []operation{
+			{method: http.MethodGet, summary: "List keys", params: []param{queryPrefix, {in: "query", name: "modified_since", desc: "Only keys written after this RFC 3339 time or Unix seconds"}, queryBucket, queryKeyEncoding}, result: []string{}},
+			{method: http.MethodDelete, summary: "Delete every key starting with a prefix", params: []param{
+				{in: "query", name: "prefix", required: true},
+				{in: "query", name: "dry_run", desc: "true to only count the keys"},
+				queryBucket,
+				queryKeyEncoding,
+			}, result: DeleteResult{}},
+		}},
+		{"/count", countHandler, []operation{
+			{method: http.MethodGet, summary: "Count keys", params: []param{queryPrefix, queryBucket, queryKeyEncoding}, result: CountResult{}},
+		}},
+		{"/dump", dumpHandler, []operation{
+			{method: http.MethodGet, summary: "Read every key-value pair", params: []param{queryPrefix, queryBucket, queryKeyEncoding}, result: map[string]string{}},
+		}},
+		{"/stats", statsHandler, []operation{
+			{method: http.MethodGet, summary: "Key and byte counts per node", result: []NodeStats{}},
+		}},
+		{"/query", queryHandler, []operation{
+			{method: http.MethodGet, summary: "Find keys by an indexed JSON field", params: []param{{in: "query", name: "field", required: true}, {in: "query", name: "value"}, queryBucket}, result: []string{}},
+		}},
+		{"/history", historyHandler, []operation{
+			{method: http.MethodGet, summary: "List the versions of a key, newest first", params: []param{queryKey, {in: "query", name: "limit", integer: true}, queryBucket, queryKeyEncoding}, result: KeyHistory{}},
+		}},
+		{"/watch", watchHandler, []operation{
+			{method: http.MethodGet, summary: "Stream changes as server-sent events", params: []param{queryBucket, queryPrefix, queryKeyEncoding}, result: ChangeEvent{}, resultType: "text/event-stream"},
+		}},
+		{"/publish", publishHandler, []operation{
+			{method: http.MethodPost, summary: "Send a message to the subscribers of a channel", params: []param{
+				{in: "query", name: "channel", required: true},
+			}, body: "", bodyType: "application/octet-stream", result: PublishResult{}},
+		}},
+		{"/subscribe", subscribeHandler, []operation{
+			{method: http.MethodGet, summary: "Stream the messages of channels as server-sent events", params: []param{
+				{in: "query", name: "channel", desc: "Channel to subscribe to; repeat for several", required: true},
+			}, result: Message{}, resultType: "text/event-stream"},
+		}},
+		{"/changes", changesHandler, []operation{
+			{method: http.MethodGet, summary: "Read the change log", params: []param{
+				{in: "query", name: "since", desc: "Sequence number to read after", integer: true},
+				{in: "query", name: "limit", integer: true},
+				{in: "query", name: "bucket", desc: "Bucket, or * for every bucket"},
+				queryPrefix,
+				queryKeyEncoding,
+				{in: "query", name: "wait", desc: "Duration to wait for a change when there is none yet"},
+				{in: "query", name: "follower", desc: "ID of the replica asking, so changes are kept for it"},
+			}, result: ChangesPage{}},
+		}},
+		{"/metrics", metricsHandler, []operation{
+			{method: http.MethodGet, summary: "Prometheus metrics", resultType: "text/plain"},
+		}},
+		{"/openapi.json", openapiHandler, []operation{
+			{method: http.MethodGet, summary: "This document", result: map[string]any{}},
+		}},
+		{"/admin/stats", adminStatsHandler, []operation{
+			{method: http.MethodGet, summary: "Storage statistics", result: AdminStats{}},
+		}},
+		{"/admin/reload", adminReloadHandler, []operation{
+			{method: http.MethodPost, summary: "Reload the configuration", result: ReloadResult{}},
+		}},
+		{"/admin/index", adminIndexHandler, []operation{
+			{method: http.MethodGet, summary: "List indexed fields", result: []string{}},
+			{method: http.MethodPost, summary: "Index a JSON field", params: []param{{in: "query", name: "field", required: true}}},
+			{method: http.MethodDelete, summary: "Drop the index on a JSON field", params: []param{{in: "query", name: "field", required: true}}},
+		}},
+		{"/admin/export", exportHandler, []operation{
+			{method: http.MethodGet, summary: "Export pairs as JSON lines", params: []param{queryBucket, queryPrefix, queryKeyEncoding}, result: exportRecord{}, resultType: "application/x-ndjson"},
+		}},
+		{"/admin/import", importHandler, []operation{
+			{method: http.MethodPost, summary: "Import pairs from JSON lines or CSV", params: []param{queryBucket, {in: "query", name: "format", desc: "csv for key,value[,bucket] rows"}, queryKeyEncoding}, body: exportRecord{}, bodyType: "application/x-ndjson", result: ImportResult{}},
+		}},
+		{"/replication/snapshot", snapshotHandler, []operation{
+			{method: http.MethodGet, summary: "Snapshot of every store, for replicas", params: []param{
+				{in: "query", name: "follower", desc: "ID of the replica asking, so changes are kept for it"},
+				{in: "query", name: "register", desc: "true to be issued a follower ID, or keep follower while it is known"},
+				queryKeyEncoding,
+			}, result: Snapshot{}},
+		}},
+		{"/admin/backup", adminBackupHandler, []operation{
+			{method: http.MethodGet, summary: "Backup status", result: BackupStatus{}},
+			{method: http.MethodPost, summary: "Take a backup now", params: []param{{in: "query", name: "full", desc: "true for a full backup rather than the changes since the last one"}}, result: BackupInfo{}},
+		}},
+		{"/admin/apikeys", adminAPIKeysHandler, []operation{
+			{method: http.MethodGet, summary: "List scoped API keys", result: []APIKey{}},
+			{method: http.MethodPost, summary: "Create a scoped API key; the answer holds its secret", body: APIKey{}, result: NewAPIKey{}},
+			{method: http.MethodDelete, summary: "Revoke a scoped API key", params: []param{{in: "query", name: "id", required: true}}},
+		}},
+		{"/admin/compact", adminCompactHandler, []operation{
+			{method: http.MethodPost, summary: "Compact every sealed segment holding garbage, in the background", params: []param{queryBucket}, result: CompactionStatus{}},
+		}},
+		{"/admin/compact/status", adminCompactStatusHandler, []operation{
+			{method: http.MethodGet, summary: "Progress of the current or last compaction run", result: CompactionStatus{}},
+		}},
+		{"/admin/hotkeys", adminHotKeysHandler, []operation{
+			{method: http.MethodGet, summary: "Keys with the most accesses, or the longest idle", params: []param{
+				{in: "query", name: "top", desc: "Number of keys, 20 by default", integer: true},
+				{in: "query", name: "by", desc: "accesses (default), reads, writes or idle"},
+				queryBucket,
+			}, result: HotKeys{}},
+		}},
+		{"/admin/readonly", adminReadOnlyHandler, []operation{
+			{method: http.MethodGet, summary: "Whether the server is in read-only mode", result: ReadOnlyStatus{}},
+			{method: http.MethodPost, summary: "Turn read-only mode on or off", params: []param{
+				{in: "query", name: "enabled", desc: "true or false", required: true},
+			}, result: ReadOnlyStatus{}},
+		}},
+		{"/admin/replication", adminReplicationHandler, []operation{
+			{method: http.MethodGet, summary: "Replication status", result: ReplicationStatus{}},
+		}},
+		{"/admin/cluster", adminClusterHandler, []operation{
+			{method: http.MethodGet, summary: "Raft cluster status", result: ClusterStatus{}},
+		}},
+		{"/admin/members", adminMembersHandler, []operation{
+			{method: http.MethodGet, summary: "Cluster members known through gossip", result: []MemberStatus{}},
+		}},
+		{"/admin/gossip", adminGossipHandler, []operation{
+			{method: http.MethodPost, summary: "Exchange membership tables with another member", body: []Member{}, result: []Member{}},
+		}},
+	}
+}
+
+// schemaBuilder derives JSON schemas from Go types, collecting named structs
+// as components.
+type schemaBuilder struct {
+	defs map[string]any
+}
+
+var (
+	timeType       = reflect.TypeFor[time.Time]()
+	rawMessageType = reflect.TypeFor[json.RawMessage]()
+)
+
+// schemaName is the component name of a named type.
+func schemaName(t reflect.Type) string {
+	r, size := utf8.DecodeRuneInString(t.Name())
+	return string(unicode.ToUpper(r)) + t.Name()[size:]
+}
+
+func (b *schemaBuilder) schema(t reflect.Type) map[string]any {
+	switch t {
+	case timeType:
+		return map[string]any{"type": "string", "format": "date-time"}
+	case rawMessageType:
+		return map[string]any{} // Any JSON value
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return b.schema(t.Elem())
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": b.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": b.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return b.object(t)
+		}
+		name := schemaName(t)
+		if _, ok := b.defs[name]; !ok {
+			b.defs[name] = nil // Taken, in case the type refers to itself
+			b.defs[name] = b.object(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + name}
+	}
+	return map[string]any{}
+}
+
+// object describes a struct by its JSON fields. Fields that are never left
+// out are required.
+func (b *schemaBuilder) object(t reflect.Type) map[string]any {
+	props := map[string]any{}
+	required := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if !f.IsExported() || tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = b.schema(f.Type)
+		if !strings.Contains(opts, "omitempty") && !strings.Contains(opts, "omitzero") {
+			required = append(required, name)
+		}
+	}
+	s := map[string]any{"type": "object", "properties": props}
+	if len(required) > 0 {
+		s["required"] = required
+	}
+	return s
+}
+
+// content describes a body of type mime holding v.
+func (b *schemaBuilder) content(mime string, v any) map[string]any {
+	s := map[string]any{"type": "string"}
+	if v != nil {
+		s = b.schema(reflect.TypeOf(v))
+	}
+	return map[string]any{mime: map[string]any{"schema": s}}
+}
+
+// negotiated describes a body sent as plain text unless the client accepts
+// JSON, as writeValue, writeMessage and writeError do.
+func (b *schemaBuilder) negotiated(v any) map[string]any {
+	c := b.content("application/json", v)
+	c["text/plain"] = map[string]any{"schema": map[string]any{"type": "string"}}
+	return c
+}
+
+func (b *schemaBuilder) operation(op operation) map[string]any {
+	params := []any{}
+	for _, p := range op.params {
+		typ := "string"
+		if p.integer {
+			typ = "integer"
+		}
+		out := map[string]any{"name": p.name, "in": p.in, "schema": map[string]any{"type": typ}}
+		if p.desc != "" {
+			out["description"] = p.desc
+		}
+		if p.required {
+			out["required"] = true
+		}
+		params = append(params, out)
+	}
+
+	ok := map[string]any{"description": "OK"}
+	switch {
+	case op.method == http.MethodHead:
+	case op.resultType != "":
+		ok["content"] = b.content(op.resultType, op.result)
+	case op.result == nil:
+		ok["content"] = b.negotiated(messageBody{})
+	case reflect.TypeOf(op.result) == reflect.TypeFor[valueBody]():
+		ok["content"] = b.negotiated(op.result)
+	default:
+		ok["content"] = b.content("application/json", op.result)
+	}
+	out := map[string]any{
+		"summary": op.summary,
+		"responses": map[string]any{
+			"200":     ok,
+			"default": map[string]any{"description": "Error", "content": b.negotiated(errorResponse{})},
+		},
+	}
+	if len(params) > 0 {
+		out["parameters"] = params
+	}
+	if op.body != nil {
+		mime := op.bodyType
+		if mime == "" {
+			mime = "application/json"
+		}
+		out["requestBody"] = map[string]any{"required": true, "content": b.content(mime, op.body)}
+	}
+	if op.bodies != nil {
+		content := map[string]any{}
+		for mime, v := range op.bodies {
+			content[mime] = b.content(mime, v)[mime]
+		}
+		out["requestBody"] = map[string]any{"required": true, "content": content}
+	}
+	return out
+}
+
+// openapiSpec builds the OpenAPI document for routes.
+func openapiSpec(routes []route) map[string]any {
+	b := &schemaBuilder{defs: map[string]any{}}
+	paths := map[string]any{}
+	for _, rt := range routes {
+		for _, op := range rt.ops {
+			path := op.path
+			if path == "" {
+				path = rt.pattern
+			}
+			item, _ := paths[path].(map[string]any)
+			if item == nil {
+				item = map[string]any{}
+				paths[path] = item
+			}
+			item[strings.ToLower(op.method)] = b.operation(op)
+		}
+	}
+	spec := map[string]any{
+		"openapi": "3.0.3",
+		"info":    map[string]any{"title": "kv store", "version": apiVersion},
+		"paths":   paths,
+		"components": map[string]any{
+			"schemas": b.defs,
+			"securitySchemes": map[string]any{
+				"bearer": map[string]any{"type": "http", "scheme": "bearer"},
+				"apiKey": map[string]any{"type": "apiKey", "in": "header", "name": "X-API-Key"},
+				"basic":  map[string]any{"type": "http", "scheme": "basic"},
+			},
+		},
+	}
+	if cfg().authEnabled() {
+		spec["security"] = []any{
+			map[string]any{"bearer": []string{}},
+			map[string]any{"apiKey": []string{}},
+			map[string]any{"basic": []string{}},
+		}
+	}
+	return spec
+}
+
+func openapiHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, openapiSpec(apiRoutes()))
+}
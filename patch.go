@@ -0,0 +1,359 @@
+package main
+
+// Partial updates of JSON values. PATCH /<key> with an RFC 6902 JSON Patch
+// (Content-Type: application/json-patch+json) or an RFC 7386 merge patch
+// (application/merge-patch+json) updates the stored document in place. Both
+// are merge operators (see merge.go), so the patch is applied to the current
+// value under the node lock and a concurrent write can't be lost in between.
+// A patch is applied whole or not at all; a failed test operation answers
+// 412. Object members come out sorted by name.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	mimeJSONPatch  = "application/json-patch+json"
+	mimeMergePatch = "application/merge-patch+json"
+)
+
+var ErrNotJSON = errors.New("stored value is not a JSON document")
+
+// patchOp is one operation of a JSON Patch.
+type patchOp struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+func init() {
+	registerMergeOperator("json-patch", func(old string, exists bool, operand string) (string, error) {
+		if !exists {
+			return "", ErrKeyNotFound
+		}
+		var ops []patchOp
+		if err := decodeJSON(operand, &ops); err != nil {
+			return "", fmt.Errorf("%w: %v", ErrInvalidOperand, err)
+		}
+		var doc any
+		if err := decodeJSON(old, &doc); err != nil {
+			return "", ErrNotJSON
+		}
+		for i, op := range ops {
+			var err error
+			if doc, err = applyPatchOp(doc, op); err != nil {
+				return "", fmt.Errorf("operation %d: %w", i, err)
+			}
+		}
+		return encodeJSON(doc)
+	})
+	registerMergeOperator("merge-patch", func(old string, exists bool, operand string) (string, error) {
+		if !exists {
+			return "", ErrKeyNotFound
+		}
+		var patch, doc any
+		if err := decodeJSON(operand, &patch); err != nil {
+			return "", fmt.Errorf("%w: %v", ErrInvalidOperand, err)
+		}
+		if err := decodeJSON(old, &doc); err != nil {
+			return "", ErrNotJSON
+		}
+		return encodeJSON(mergePatch(doc, patch))
+	})
+}
+
+// decodeJSON decodes a single JSON document, keeping numbers as written.
+func decodeJSON(s string, v any) error {
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if dec.More() {
+		return errors.New("unexpected data after the JSON document")
+	}
+	return nil
+}
+
+func encodeJSON(v any) (string, error) {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(b.String(), "\n"), nil
+}
+
+// mergePatch applies an RFC 7386 merge patch to target.
+func mergePatch(target any, patch any) any {
+	p, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]any)
+	if !ok {
+		t = map[string]any{}
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+		} else {
+			t[k] = mergePatch(t[k], v)
+		}
+	}
+	return t
+}
+
+// parsePointer splits an RFC 6901 JSON Pointer into its reference tokens.
+func parsePointer(p string) ([]string, error) {
+	if p == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(p, "/") {
+		return nil, fmt.Errorf("%w: pointer %q must start with /", ErrInvalidOperand, p)
+	}
+	tokens := strings.Split(p[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(t, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+// arrayIndex resolves an array reference token; end allows the index one
+// past the last element, where add inserts.
+func arrayIndex(token string, n int, end bool) (int, error) {
+	if token == "-" && end {
+		return n, nil
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || (token != "0" && token[0] == '0') || i > n || (i == n && !end) {
+		return 0, fmt.Errorf("%w: index %q out of range", ErrInvalidOperand, token)
+	}
+	return i, nil
+}
+
+// lookup returns the value at tokens in doc.
+func lookup(doc any, tokens []string) (any, error) {
+	for _, t := range tokens {
+		switch d := doc.(type) {
+		case map[string]any:
+			v, ok := d[t]
+			if !ok {
+				return nil, fmt.Errorf("%w: member %q not found", ErrInvalidOperand, t)
+			}
+			doc = v
+		case []any:
+			i, err := arrayIndex(t, len(d), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = d[i]
+		default:
+			return nil, fmt.Errorf("%w: %q is not inside an object or array", ErrInvalidOperand, t)
+		}
+	}
+	return doc, nil
+}
+
+// applyAt calls fn with the container holding the last of tokens and
+// replaces that container with the one fn returns, as arrays may be
+// reallocated. tokens must not be empty.
+func applyAt(doc any, tokens []string, fn func(parent any, token string) (any, error)) (any, error) {
+	if len(tokens) == 1 {
+		return fn(doc, tokens[0])
+	}
+	switch d := doc.(type) {
+	case map[string]any:
+		child, ok := d[tokens[0]]
+		if !ok {
+			return nil, fmt.Errorf("%w: member %q not found", ErrInvalidOperand, tokens[0])
+		}
+		child, err := applyAt(child, tokens[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		d[tokens[0]] = child
+		return d, nil
+	case []any:
+		i, err := arrayIndex(tokens[0], len(d), false)
+		if err != nil {
+			return nil, err
+		}
+		if d[i], err = applyAt(d[i], tokens[1:], fn); err != nil {
+			return nil, err
+		}
+		return d, nil
+	}
+	return nil, fmt.Errorf("%w: %q is not inside an object or array", ErrInvalidOperand, tokens[0])
+}
+
+func addAt(doc any, tokens []string, value any) (any, error) {
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	return applyAt(doc, tokens, func(parent any, token string) (any, error) {
+		switch p := parent.(type) {
+		case map[string]any:
+			p[token] = value
+			return p, nil
+		case []any:
+			i, err := arrayIndex(token, len(p), true)
+			if err != nil {
+				return nil, err
+			}
+			return append(p[:i], append([]any{value}, p[i:]...)...), nil
+		}
+		return nil, fmt.Errorf("%w: %q is not inside an object or array", ErrInvalidOperand, token)
+	})
+}
+
+func removeAt(doc any, tokens []string) (any, error) {
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("%w: cannot remove the whole document", ErrInvalidOperand)
+	}
+	return applyAt(doc, tokens, func(parent any, token string) (any, error) {
+		switch p := parent.(type) {
+		case map[string]any:
+			if _, ok := p[token]; !ok {
+				return nil, fmt.Errorf("%w: member %q not found", ErrInvalidOperand, token)
+			}
+			delete(p, token)
+			return p, nil
+		case []any:
+			i, err := arrayIndex(token, len(p), false)
+			if err != nil {
+				return nil, err
+			}
+			return append(p[:i], p[i+1:]...), nil
+		}
+		return nil, fmt.Errorf("%w: %q is not inside an object or array", ErrInvalidOperand, token)
+	})
+}
+
+// deepCopy copies a decoded JSON value so it can appear twice in a document.
+func deepCopy(v any) any {
+	switch t := v.(type) {
+	case map[string]any:
+		out := make(map[string]any, len(t))
+		for k, e := range t {
+			out[k] = deepCopy(e)
+		}
+		return out
+	case []any:
+		out := make([]any, len(t))
+		for i, e := range t {
+			out[i] = deepCopy(e)
+		}
+		return out
+	}
+	return v
+}
+
+// jsonEqual compares decoded JSON values, numbers by value.
+func jsonEqual(a any, b any) bool {
+	switch x := a.(type) {
+	case map[string]any:
+		y, ok := b.(map[string]any)
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for k, e := range x {
+			if f, ok := y[k]; !ok || !jsonEqual(e, f) {
+				return false
+			}
+		}
+		return true
+	case []any:
+		y, ok := b.([]any)
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for i := range x {
+			if !jsonEqual(x[i], y[i]) {
+				return false
+			}
+		}
+		return true
+	case json.Number:
+		y, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		if x == y {
+			return true
+		}
+		fx, errx := x.Float64()
+		fy, erry := y.Float64()
+		return errx == nil && erry == nil && fx == fy
+	}
+	return a == b
+}
+
+// applyPatchOp applies one JSON Patch operation to doc.
+func applyPatchOp(doc any, op patchOp) (any, error) {
+	path, err := parsePointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+	var value any
+	switch op.Op {
+	case "add", "replace", "test":
+		if op.Value == nil {
+			return nil, fmt.Errorf("%w: %s needs a value", ErrInvalidOperand, op.Op)
+		}
+		if err := decodeJSON(string(op.Value), &value); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidOperand, err)
+		}
+	}
+
+	switch op.Op {
+	case "add":
+		return addAt(doc, path, value)
+	case "remove":
+		return removeAt(doc, path)
+	case "replace":
+		if len(path) == 0 {
+			return value, nil
+		}
+		if doc, err = removeAt(doc, path); err != nil {
+			return nil, err
+		}
+		return addAt(doc, path, value)
+	case "move", "copy":
+		from, err := parsePointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+		v, err := lookup(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		if op.Op == "copy" {
+			return addAt(doc, path, deepCopy(v))
+		}
+		if op.Path == op.From {
+			return doc, nil
+		}
+		if strings.HasPrefix(op.Path, op.From+"/") {
+			return nil, fmt.Errorf("%w: cannot move a value into itself", ErrInvalidOperand)
+		}
+		if doc, err = removeAt(doc, from); err != nil {
+			return nil, err
+		}
+		return addAt(doc, path, v)
+	case "test":
+		v, err := lookup(doc, path)
+		if err != nil || !jsonEqual(v, value) {
+			return nil, ErrPreconditionFailed
+		}
+		return doc, nil
+	}
+	return nil, fmt.Errorf("%w: unknown op %q", ErrInvalidOperand, op.Op)
+}
@@ -0,0 +1,642 @@
+package main
+
+// Proxy mode. Started with -proxy and -nodes, the server holds no data of its
+// own: it consistent-hashes each key to one of the backend store processes
+// and forwards the request there, fans multi-key requests (mget, keys, dump,
+// query, stats and bucket listings) out to the backends and merges their
+// answers, passes per-store admin requests to every backend, answers 501 for
+// endpoints that only make sense against one store (the change feed, export,
+// backups and the like), and health checks every backend so requests that
+// need a node that is down fail fast with 503 instead of hanging. With gossip
+// on, the stores the proxy hears about from the cluster membership
+// (gossip.go) are added to the ring as they join and dropped from it when
+// they fail or leave, on top of any listed in nodes.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	proxyReplicas  = 100 // Virtual nodes per backend, enough for an even spread
+	healthInterval = 2 * time.Second
+	healthTimeout  = time.Second
+	fanOutTimeout  = 10 * time.Second
+	backendIdle    = 256 // Idle connections kept open to each backend
+)
+
+// backendTransport is shared by forwarded and fanned out requests. It keeps
+// enough idle connections per backend that a busy proxy reuses them rather
+// than opening one per request, which is what the default of two leads to.
+var backendTransport = func() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.MaxIdleConns = 0
+	t.MaxIdleConnsPerHost = backendIdle
+	return t
+}()
+
+var (
+	errBackendDown = errors.New("backend unavailable")
+	errNoBackends  = errors.New("no backends available")
+)
+
+// router is set in proxy mode.
+var router *proxyRouter
+
+type backend struct {
+	addr  string
+	url   *url.URL
+	proxy *httputil.ReverseProxy
+
+	mu         sync.Mutex
+	healthy    bool
+	last_check time.Time
+	last_error string
+}
+
+type BackendStatus struct {
+	Addr      string    `json:"addr"`
+	Healthy   bool      `json:"healthy"`
+	LastCheck time.Time `json:"last_check,omitzero"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+type proxyRouter struct {
+	static []string // Backends from nodes, kept whatever the membership says
+	client *http.Client
+
+	mu     sync.Mutex // Serializes setMembers
+	routes atomic.Pointer[routeTable]
+}
+
+// routeTable is one version of the set of backends. Requests use the table
+// current when they start; membership changes swap in a new one.
+type routeTable struct {
+	ring     *ConsistentHashDS // Read-only once built
+	backends map[string]*backend
+	order    []*backend
+}
+
+// fanOutResult is one backend's answer to a fanned out request.
+type fanOutResult struct {
+	backend     *backend
+	status      int
+	contentType string
+	body        []byte
+	err         error
+}
+
+func newProxyRouter(nodes []string) (*proxyRouter, error) {
+	p := &proxyRouter{static: nodes, client: &http.Client{Timeout: fanOutTimeout, Transport: backendTransport}}
+	t := &routeTable{ring: newConsistentHashDS(proxyReplicas), backends: make(map[string]*backend, len(nodes))}
+	for _, addr := range nodes {
+		if _, dup := t.backends[addr]; dup {
+			return nil, fmt.Errorf("node %s listed twice", addr)
+		}
+		b, err := newBackend(addr)
+		if err != nil {
+			return nil, err
+		}
+		t.add(b)
+	}
+	p.routes.Store(t)
+	slog.Info("proxying to backends", "nodes", len(t.order))
+	return p, nil
+}
+
+func newBackend(addr string) (*backend, error) {
+	u, err := url.Parse(baseURL(addr))
+	if err != nil {
+		return nil, err
+	}
+	b := &backend{addr: addr, url: u, healthy: true}
+	b.proxy = &httputil.ReverseProxy{
+		Transport: backendTransport,
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.SetURL(u)
+			r.SetXForwarded()
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			slog.Warn("backend request failed", "node", b.addr, "error", err)
+			b.setHealth(err)
+			writeError(w, r, http.StatusBadGateway, codeBackendUnavailable, "backend "+b.addr+" unavailable")
+		},
+	}
+	return b, nil
+}
+
+func (t *routeTable) add(b *backend) {
+	t.backends[b.addr] = b
+	t.order = append(t.order, b)
+	t.ring.addServer(b.addr)
+}
+
+// owner is the backend owning key, nil when there are none.
+func (t *routeTable) owner(key string) *backend {
+	return t.backends[t.ring.getServerbyKey(key)]
+}
+
+func (p *proxyRouter) table() *routeTable {
+	return p.routes.Load()
+}
+
+// setMembers rebuilds the ring from the static nodes and the stores the
+// membership currently reports alive. Backends present before and after
+// keep their health state.
+func (p *proxyRouter) setMembers(members []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	old := p.table()
+	t := &routeTable{ring: newConsistentHashDS(proxyReplicas), backends: make(map[string]*backend)}
+	for _, addr := range append(slices.Clone(p.static), members...) {
+		if _, dup := t.backends[addr]; dup {
+			continue
+		}
+		b := old.backends[addr]
+		if b == nil {
+			var err error
+			if b, err = newBackend(addr); err != nil {
+				slog.Warn("ignoring member with a bad address", "node", addr, "error", err)
+				continue
+			}
+			slog.Info("backend added to the ring", "node", addr)
+		}
+		t.add(b)
+	}
+	for _, b := range old.order {
+		if t.backends[b.addr] == nil {
+			slog.Info("backend removed from the ring", "node", b.addr)
+		}
+	}
+	p.routes.Store(t)
+}
+
+func (b *backend) isHealthy() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.healthy
+}
+
+func (b *backend) setHealth(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	healthy := err == nil
+	if healthy != b.healthy {
+		if healthy {
+			slog.Info("backend is healthy", "node", b.addr)
+		} else {
+			slog.Warn("backend is down", "node", b.addr, "error", err)
+		}
+	}
+	b.healthy = healthy
+	b.last_check = time.Now()
+	b.last_error = ""
+	if err != nil {
+		b.last_error = err.Error()
+	}
+}
+
+func (b *backend) status() BackendStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return BackendStatus{Addr: b.addr, Healthy: b.healthy, LastCheck: b.last_check, LastError: b.last_error}
+}
+
+// healthLoop probes every backend until ctx is cancelled.
+func (p *proxyRouter) healthLoop(ctx context.Context) {
+	ticker := time.NewTicker(healthInterval)
+	defer ticker.Stop()
+	for {
+		for _, b := range p.table().order {
+			go p.check(ctx, b)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *proxyRouter) check(ctx context.Context, b *backend) {
+	ctx, cancel := context.WithTimeout(ctx, healthTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.url.String()+"/stats", nil)
+	if err != nil {
+		b.setHealth(err)
+		return
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		if ctx.Err() == nil || errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			b.setHealth(err)
+		}
+		return
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	// Any HTTP answer, even 401 from a backend requiring credentials, means
+	// the process is up.
+	if resp.StatusCode >= 500 {
+		err = fmt.Errorf("health check returned %s", resp.Status)
+	}
+	b.setHealth(err)
+}
+
+// forward sends the request to the backend owning key.
+func (p *proxyRouter) forward(w http.ResponseWriter, r *http.Request, key string) {
+	b := p.table().owner(key)
+	if b == nil {
+		w.Header().Set("Retry-After", "1")
+		writeError(w, r, http.StatusServiceUnavailable, codeBackendUnavailable, errNoBackends.Error())
+		return
+	}
+	if !b.isHealthy() {
+		w.Header().Set("Retry-After", "1")
+		writeError(w, r, http.StatusServiceUnavailable, codeBackendUnavailable, "backend "+b.addr+" unavailable")
+		return
+	}
+	injectTrace(r.Context(), r.Header)
+	b.proxy.ServeHTTP(w, r)
+}
+
+// fanOut sends a copy of r with the given path and query to each backend in
+// parallel. Credentials and the Accept header on r are passed along.
+func (p *proxyRouter) fanOut(r *http.Request, backends []*backend, method string, path string, query func(*backend) url.Values) []fanOutResult {
+	results := make([]fanOutResult, len(backends))
+	var wg sync.WaitGroup
+	for i, b := range backends {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res := fanOutResult{backend: b}
+			defer func() { results[i] = res }()
+			if !b.isHealthy() {
+				res.err = errBackendDown
+				return
+			}
+			u := *b.url
+			u.Path = path
+			u.RawQuery = query(b).Encode()
+			req, err := http.NewRequestWithContext(r.Context(), method, u.String(), nil)
+			if err != nil {
+				res.err = err
+				return
+			}
+			for _, h := range []string{"Authorization", "X-API-Key", "Accept", keyEncodingHeader} {
+				if v := r.Header.Get(h); v != "" {
+					req.Header.Set(h, v)
+				}
+			}
+			injectTrace(r.Context(), req.Header)
+			resp, err := p.client.Do(req)
+			if err != nil {
+				b.setHealth(err)
+				res.err = err
+				return
+			}
+			defer resp.Body.Close()
+			res.status = resp.StatusCode
+			res.contentType = resp.Header.Get("Content-Type")
+			res.body, res.err = io.ReadAll(resp.Body)
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// fanOutAll fans r out unchanged to every backend.
+func (p *proxyRouter) fanOutAll(r *http.Request) []fanOutResult {
+	q := r.URL.Query()
+	return p.fanOut(r, p.table().order, r.Method, r.URL.Path, func(*backend) url.Values { return q })
+}
+
+// checkResults writes an error response and returns false unless every
+// backend answered with 200 (or 404 when notFoundOK, since a bucket only
+// exists on the backends that own one of its keys). A 404 from all of them
+// is passed on as is.
+func checkResults(w http.ResponseWriter, r *http.Request, results []fanOutResult, notFoundOK bool) bool {
+	missing := 0
+	for _, res := range results {
+		switch {
+		case res.err != nil:
+			w.Header().Set("Retry-After", "1")
+			writeError(w, r, http.StatusServiceUnavailable, codeBackendUnavailable, "backend "+res.backend.addr+" unavailable")
+			return false
+		case res.status == http.StatusNotFound && notFoundOK:
+			missing++
+		case res.status != http.StatusOK:
+			w.Header().Set("Content-Type", res.contentType)
+			w.WriteHeader(res.status)
+			w.Write(res.body)
+			return false
+		}
+	}
+	if missing == len(results) && missing > 0 {
+		w.Header().Set("Content-Type", results[0].contentType)
+		w.WriteHeader(http.StatusNotFound)
+		w.Write(results[0].body)
+		return false
+	}
+	return true
+}
+
+// mergeKeys serves list endpoints (keys, query, bucket listings) by merging
+// every backend's sorted list.
+func (p *proxyRouter) mergeKeys(w http.ResponseWriter, r *http.Request) {
+	results := p.fanOutAll(r)
+	if !checkResults(w, r, results, true) {
+		return
+	}
+	out := []string{}
+	for _, res := range results {
+		var part []string
+		if res.status != http.StatusOK {
+			continue
+		}
+		if err := json.Unmarshal(res.body, &part); err != nil {
+			writeError(w, r, http.StatusBadGateway, codeBadGateway, "bad response from backend "+res.backend.addr)
+			return
+		}
+		out = append(out, part...)
+	}
+	sort.Strings(out)
+	writeJSON(w, out)
+}
+
+// deletePrefix serves DELETE /keys, adding up what every backend deleted.
+func (p *proxyRouter) deletePrefix(w http.ResponseWriter, r *http.Request) {
+	results := p.fanOutAll(r)
+	if !checkResults(w, r, results, true) {
+		return
+	}
+	var out DeleteResult
+	for _, res := range results {
+		var part DeleteResult
+		if res.status != http.StatusOK {
+			continue
+		}
+		if err := json.Unmarshal(res.body, &part); err != nil {
+			writeError(w, r, http.StatusBadGateway, codeBadGateway, "bad response from backend "+res.backend.addr)
+			return
+		}
+		out.Deleted += part.Deleted
+		out.DryRun = part.DryRun
+	}
+	writeJSON(w, out)
+}
+
+// count adds up every backend's count.
+func (p *proxyRouter) count(w http.ResponseWriter, r *http.Request) {
+	results := p.fanOutAll(r)
+	if !checkResults(w, r, results, true) {
+		return
+	}
+	out := CountResult{Prefix: r.URL.Query().Get("prefix")}
+	for _, res := range results {
+		var part CountResult
+		if res.status != http.StatusOK {
+			continue
+		}
+		if err := json.Unmarshal(res.body, &part); err != nil {
+			writeError(w, r, http.StatusBadGateway, codeBadGateway, "bad response from backend "+res.backend.addr)
+			return
+		}
+		out.Count += part.Count
+	}
+	writeJSON(w, out)
+}
+
+// mergeMaps serves dump and mget by merging every backend's key-value map.
+func mergeMaps(w http.ResponseWriter, r *http.Request, results []fanOutResult) {
+	if !checkResults(w, r, results, true) {
+		return
+	}
+	out := make(map[string]string)
+	for _, res := range results {
+		var part map[string]string
+		if res.status != http.StatusOK {
+			continue
+		}
+		if err := json.Unmarshal(res.body, &part); err != nil {
+			writeError(w, r, http.StatusBadGateway, codeBadGateway, "bad response from backend "+res.backend.addr)
+			return
+		}
+		for k, v := range part {
+			out[k] = v
+		}
+	}
+	writeJSON(w, out)
+}
+
+// mget asks each backend only for the keys it owns.
+func (p *proxyRouter) mget(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	t := p.table()
+	if len(t.order) == 0 {
+		w.Header().Set("Retry-After", "1")
+		writeError(w, r, http.StatusServiceUnavailable, codeBackendUnavailable, errNoBackends.Error())
+		return
+	}
+	owned := make(map[*backend][]string)
+	for _, key := range q["key"] {
+		decoded, ok := decodeKey(w, r, key)
+		if !ok {
+			return
+		}
+		b := t.owner(decoded)
+		owned[b] = append(owned[b], key)
+	}
+	var targets []*backend
+	for _, b := range t.order {
+		if len(owned[b]) > 0 {
+			targets = append(targets, b)
+		}
+	}
+	mergeMaps(w, r, p.fanOut(r, targets, http.MethodGet, "/mget", func(b *backend) url.Values {
+		bq := url.Values{"key": owned[b]}
+		if bucket := q.Get("bucket"); bucket != "" {
+			bq.Set("bucket", bucket)
+		}
+		if enc := q.Get("key_encoding"); enc != "" {
+			bq.Set("key_encoding", enc)
+		}
+		return bq
+	}))
+}
+
+func (p *proxyRouter) stats(w http.ResponseWriter, r *http.Request) {
+	results := p.fanOutAll(r)
+	if !checkResults(w, r, results, false) {
+		return
+	}
+	out := []json.RawMessage{}
+	for _, res := range results {
+		var part []json.RawMessage
+		if err := json.Unmarshal(res.body, &part); err != nil {
+			writeError(w, r, http.StatusBadGateway, codeBadGateway, "bad response from backend "+res.backend.addr)
+			return
+		}
+		out = append(out, part...)
+	}
+	writeJSON(w, out)
+}
+
+func (p *proxyRouter) buckets(w http.ResponseWriter, r *http.Request) {
+	results := p.fanOutAll(r)
+	if !checkResults(w, r, results, false) {
+		return
+	}
+	merged := make(map[string]*BucketInfo)
+	for _, res := range results {
+		var part []BucketInfo
+		if err := json.Unmarshal(res.body, &part); err != nil {
+			writeError(w, r, http.StatusBadGateway, codeBadGateway, "bad response from backend "+res.backend.addr)
+			return
+		}
+		for _, b := range part {
+			if merged[b.Name] == nil {
+				merged[b.Name] = &BucketInfo{Name: b.Name}
+			}
+			merged[b.Name].Keys += b.Keys
+			merged[b.Name].Bytes += b.Bytes
+		}
+	}
+	out := make([]BucketInfo, 0, len(merged))
+	for _, b := range merged {
+		out = append(out, *b)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	writeJSON(w, out)
+}
+
+// perBackend serves admin endpoints whose answers describe one store, such
+// as compaction status or hot keys, by fanning the request out and returning
+// each backend's answer keyed by its address.
+func (p *proxyRouter) perBackend(w http.ResponseWriter, r *http.Request) {
+	results := p.fanOutAll(r)
+	if !checkResults(w, r, results, false) {
+		return
+	}
+	out := make(map[string]json.RawMessage, len(results))
+	for _, res := range results {
+		if !json.Valid(res.body) {
+			writeError(w, r, http.StatusBadGateway, codeBadGateway, "bad response from backend "+res.backend.addr)
+			return
+		}
+		out[res.backend.addr] = res.body
+	}
+	writeJSON(w, out)
+}
+
+// notProxied answers endpoints the proxy can't serve; clients send them to a
+// backend directly.
+func notProxied(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusNotImplemented, codeNotProxied, r.URL.Path+" is not available through the proxy; send it to a backend")
+}
+
+// proxyServer builds the HTTP handler for proxy mode.
+func proxyServer() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.URL.Path, "/")
+		if key == "" {
+			writeError(w, r, http.StatusNotFound, codeKeyNotFound, "key not found")
+			return
+		}
+		if key, ok := decodeKey(w, r, key); ok {
+			router.forward(w, r, key)
+		}
+	})
+	mux.HandleFunc("/b/", func(w http.ResponseWriter, r *http.Request) {
+		_, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/b/"), "/")
+		if key != "" {
+			if key, ok := decodeKey(w, r, key); ok {
+				router.forward(w, r, key)
+			}
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			router.mergeKeys(w, r)
+		case http.MethodDelete:
+			// Each backend only has the bucket if one of its keys was written.
+			if checkResults(w, r, router.fanOutAll(r), true) {
+				writeMessage(w, r, "bucket deleted successfully")
+			}
+		default:
+			w.Header().Set("Allow", "GET, DELETE")
+			writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		}
+	})
+	for _, path := range []string{"/get", "/exists", "/put", "/delete", "/append", "/history"} {
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			if key, ok := requestKey(w, r); ok {
+				router.forward(w, r, key)
+			}
+		})
+	}
+	// Publishers and subscribers of a channel meet on the backend owning its name
+	for _, path := range []string{"/publish", "/subscribe"} {
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			channels := r.URL.Query()["channel"]
+			if len(channels) != 1 || channels[0] == "" {
+				writeError(w, r, http.StatusBadRequest, codeBadRequest, "exactly one channel is required through the proxy")
+				return
+			}
+			router.forward(w, r, channels[0])
+		})
+	}
+	mux.HandleFunc("/mget", router.mget)
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete {
+			router.deletePrefix(w, r)
+			return
+		}
+		router.mergeKeys(w, r)
+	})
+	mux.HandleFunc("/query", router.mergeKeys)
+	mux.HandleFunc("/count", router.count)
+	mux.HandleFunc("/dump", func(w http.ResponseWriter, r *http.Request) { mergeMaps(w, r, router.fanOutAll(r)) })
+	mux.HandleFunc("/stats", router.stats)
+	mux.HandleFunc("/buckets", router.buckets)
+	for _, path := range []string{"/admin/stats", "/admin/hotkeys", "/admin/compact", "/admin/compact/status"} {
+		mux.HandleFunc(path, router.perBackend)
+	}
+	// These follow one store's change sequence, stream its data or change its
+	// local state, none of which merges across backends. Without a route they
+	// would reach / and be forwarded as keys.
+	for _, path := range []string{"/watch", "/changes", "/replication/snapshot", "/admin/export", "/admin/import", "/admin/backup", "/admin/index", "/admin/apikeys", "/admin/readonly", "/admin/replication", "/admin/cluster", "/openapi.json"} {
+		mux.HandleFunc(path, notProxied)
+	}
+	mux.HandleFunc("/metrics", metricsHandler)
+	mux.HandleFunc("/admin/reload", adminReloadHandler)
+	mux.HandleFunc("/admin/members", adminMembersHandler)
+	mux.HandleFunc("/admin/gossip", adminGossipHandler)
+	registerDebug(mux)
+	mux.HandleFunc("/admin/nodes", func(w http.ResponseWriter, r *http.Request) {
+		order := router.table().order
+		out := make([]BackendStatus, 0, len(order))
+		for _, b := range order {
+			out = append(out, b.status())
+		}
+		writeJSON(w, out)
+	})
+
+	go limiter.cleanupLoop()
+
+	return logRequests(traceRequests(instrumentRequests(gzipResponses(authenticate(limitRequests(timeoutRequests(recordRoute(mux))))))))
+}
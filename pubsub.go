@@ -0,0 +1,229 @@
+package main
+
+// Pub/sub channels, independent of keys. POST /publish?channel=c sends the
+// request body as a message to every client subscribed to c with GET
+// /subscribe?channel=c (repeat channel to subscribe to several), streamed as
+// Server-Sent Events like /watch. Messages are ephemeral: they aren't
+// stored, logged or replicated, and a subscriber only gets the messages
+// published to the same server while it is connected. One broker goroutine
+// owns the subscriptions and does the fan-out; a subscriber whose buffer
+// fills up is disconnected rather than holding up publishers. Behind a proxy
+// both endpoints are routed by channel name, so the publishers and
+// subscribers of a channel meet on the same backend.
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	pubsubBuffer      = 256
+	maxChannelLen     = 256
+	maxSubscribeChans = 64
+)
+
+// Message is one event of GET /subscribe.
+type Message struct {
+	Seq     uint64    `json:"seq"` // Numbers every message this server publishes
+	Time    time.Time `json:"time"`
+	Channel string    `json:"channel"`
+	Data    string    `json:"data"`
+}
+
+type PublishResult struct {
+	Receivers int `json:"receivers"` // Subscribers the message was delivered to
+}
+
+type subscriber struct {
+	channels []string
+	messages chan Message
+}
+
+type publishRequest struct {
+	msg       Message
+	receivers chan int
+}
+
+type pubsubBroker struct {
+	publishes    chan publishRequest
+	subscribes   chan *subscriber
+	unsubscribes chan *subscriber
+	closing      chan struct{}
+
+	// Owned by the run goroutine
+	seq      uint64
+	channels map[string]map[*subscriber]struct{}
+	subs     map[*subscriber]struct{}
+}
+
+var pubsub = newPubsubBroker()
+
+func newPubsubBroker() *pubsubBroker {
+	b := &pubsubBroker{
+		publishes:    make(chan publishRequest),
+		subscribes:   make(chan *subscriber),
+		unsubscribes: make(chan *subscriber),
+		closing:      make(chan struct{}),
+		channels:     make(map[string]map[*subscriber]struct{}),
+		subs:         make(map[*subscriber]struct{}),
+	}
+	go b.run()
+	return b
+}
+
+func (b *pubsubBroker) run() {
+	for {
+		select {
+		case s := <-b.subscribes:
+			b.subs[s] = struct{}{}
+			for _, c := range s.channels {
+				if b.channels[c] == nil {
+					b.channels[c] = make(map[*subscriber]struct{})
+				}
+				b.channels[c][s] = struct{}{}
+			}
+		case s := <-b.unsubscribes:
+			b.drop(s)
+		case req := <-b.publishes:
+			b.seq++
+			req.msg.Seq = b.seq
+			delivered := 0
+			for s := range b.channels[req.msg.Channel] {
+				select {
+				case s.messages <- req.msg:
+					delivered++
+				default: // Subscriber can't keep up; drop it so it reconnects
+					b.drop(s)
+				}
+			}
+			req.receivers <- delivered
+		case <-b.closing:
+			for s := range b.subs {
+				b.drop(s)
+			}
+		}
+	}
+}
+
+// drop ends a subscription unless it has ended already.
+func (b *pubsubBroker) drop(s *subscriber) {
+	if _, ok := b.subs[s]; !ok {
+		return
+	}
+	delete(b.subs, s)
+	for _, c := range s.channels {
+		delete(b.channels[c], s)
+		if len(b.channels[c]) == 0 {
+			delete(b.channels, c)
+		}
+	}
+	close(s.messages)
+}
+
+// publish delivers data to the current subscribers of channel and returns
+// how many there were.
+func (b *pubsubBroker) publish(channel string, data string) int {
+	req := publishRequest{msg: Message{Time: time.Now().UTC(), Channel: channel, Data: data}, receivers: make(chan int, 1)}
+	b.publishes <- req
+	return <-req.receivers
+}
+
+func (b *pubsubBroker) subscribe(channels []string) *subscriber {
+	s := &subscriber{channels: channels, messages: make(chan Message, pubsubBuffer)}
+	b.subscribes <- s
+	return s
+}
+
+func (b *pubsubBroker) unsubscribe(s *subscriber) {
+	b.unsubscribes <- s
+}
+
+// closeAll disconnects every subscriber, used on shutdown so open streams
+// don't hold up draining.
+func (b *pubsubBroker) closeAll() {
+	b.closing <- struct{}{}
+}
+
+func validChannel(c string) bool {
+	return c != "" && len(c) <= maxChannelLen
+}
+
+// publishHandler serves POST /publish?channel=c with the message as the body.
+func publishHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+	channel := r.URL.Query().Get("channel")
+	if !validChannel(channel) {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "channel is required and must be at most "+strconv.Itoa(maxChannelLen)+" bytes")
+		return
+	}
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, requestConfig(r).MaxValueBytes))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeStoreError(w, r, ErrValueTooLarge)
+			return
+		}
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "failed to read message")
+		return
+	}
+	writeJSON(w, PublishResult{Receivers: pubsub.publish(channel, string(data))})
+}
+
+// subscribeHandler serves GET /subscribe?channel=c[&channel=d...].
+func subscribeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+	channels := r.URL.Query()["channel"]
+	if len(channels) == 0 || len(channels) > maxSubscribeChans {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "between 1 and "+strconv.Itoa(maxSubscribeChans)+" channel parameters are required")
+		return
+	}
+	for _, c := range channels {
+		if !validChannel(c) {
+			writeError(w, r, http.StatusBadRequest, codeBadRequest, "channel names must be 1 to "+strconv.Itoa(maxChannelLen)+" bytes")
+			return
+		}
+	}
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	sub := pubsub.subscribe(channels)
+	defer pubsub.unsubscribe(sub)
+	heartbeat := time.NewTicker(watchHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			w.Write([]byte(": keepalive\n\n"))
+		case msg, ok := <-sub.messages:
+			if !ok {
+				return
+			}
+			data, _ := json.Marshal(msg)
+			w.Write([]byte("id: " + strconv.FormatUint(msg.Seq, 10) + "\nevent: message\ndata: " + string(data) + "\n\n"))
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+// Bucket quotas. bucket_quotas gives a bucket a byte budget for its keys and
+// values summed over all of its node stores (max_store_bytes still caps each
+// store on its own); "*" sets the budget of buckets not listed. A write that
+// would take a bucket over its quota fails with 507 and QUOTA_EXCEEDED, while
+// deletes and shrinking overwrites always go through. The system bucket is
+// exempt from both quotas and max_store_bytes. The stores of a bucket
+// share one usage counter, so concurrent writes landing on different stores
+// can overshoot the quota by at most one value each.
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+var ErrQuotaExceeded = errors.New("bucket quota exceeded")
+
+type QuotaStats struct {
+	Bucket      string  `json:"bucket"`
+	UsedBytes   int64   `json:"used_bytes"`
+	QuotaBytes  int64   `json:"quota_bytes"`
+	Utilization float64 `json:"utilization"`
+}
+
+// bucketQuota returns the byte budget of bucket under c, 0 for none. The
+// system bucket has none, so credentials can always be created.
+func bucketQuota(c *Config, bucket string) int64 {
+	if bucket == "" || bucket == systemBucket {
+		return 0
+	}
+	if q, ok := c.BucketQuotas[bucket]; ok {
+		return q
+	}
+	return c.BucketQuotas["*"]
+}
+
+// newBucketNodes returns one store per server node for bucket, sharing a
+// usage counter.
+func newBucketNodes(bucket string) []*ServerNode {
+	usage := new(atomic.Int64)
+	nodes := make([]*ServerNode, len(server_nodes))
+	for i, parent := range server_nodes {
+		nodes[i] = newBucketNode(parent, bucket)
+		nodes[i].usage = usage
+	}
+	return nodes
+}
+
+// setSizeLocked records that the store now holds size bytes. Must be called
+// with n.mu held.
+func (n *ServerNode) setSizeLocked(size int64) {
+	if n.usage != nil {
+		n.usage.Add(size - n.size)
+	}
+	n.size = size
+}
+
+// checkQuotaLocked reports whether growing the store by delta bytes keeps its
+// bucket within quota. Must be called with n.mu held.
+func (n *ServerNode) checkQuotaLocked(c *Config, delta int64) error {
+	if n.usage == nil || delta <= 0 {
+		return nil
+	}
+	if q := bucketQuota(c, n.bucket); q > 0 && n.usage.Load()+delta > q {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+// quotaStats reports usage of every bucket that has a quota.
+func quotaStats() []QuotaStats {
+	out := []QuotaStats{}
+	for _, b := range listBuckets() {
+		if b.Quota > 0 {
+			out = append(out, QuotaStats{b.Name, b.Bytes, b.Quota, float64(b.Bytes) / float64(b.Quota)})
+		}
+	}
+	return out
+}
+
+// parseQuotas parses bucket=size pairs.
+func parseQuotas(items []string) (map[string]int64, error) {
+	out := make(map[string]int64, len(items))
+	for _, item := range items {
+		name, size, ok := strings.Cut(item, "=")
+		if !ok || (name != "*" && !validBucketName(name)) {
+			return nil, fmt.Errorf("bucket quota %q is not bucket=size", item)
+		}
+		n, err := parseSize(size)
+		if err != nil {
+			return nil, fmt.Errorf("bucket quota %q: %w", item, err)
+		}
+		out[name] = n
+	}
+	return out, nil
+}
+
+func formatQuotas(quotas map[string]int64) string {
+	items := make([]string, 0, len(quotas))
+	for name, n := range quotas {
+		items = append(items, fmt.Sprintf("%s=%d", name, n))
+	}
+	sort.Strings(items)
+	return strings.Join(items, ",")
+}
@@ -0,0 +1,346 @@
+package main
+
+// Durable log and stable storage for Raft. Log entries are kept in memory and
+// mirrored to an append-only file (raft/log) using the same length+checksum
+// framing as the change log; deletions are appended as range tombstones and
+// the file is rewritten once they make up most of it. Raft itself caps the
+// number of entries kept between snapshots. Term and vote bookkeeping lives
+// in raft/stable.json, rewritten atomically on every change.
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+const (
+	raftRecordLog    = byte(1)
+	raftRecordDelete = byte(2)
+	raftLogFixedLen  = 1 + 8 + 8 + 1 + 8 + 4 + 4 // Record type, index, term, log type, time, data len, extensions len
+)
+
+var errStableNotFound = errors.New("not found") // Text raft checks for
+
+type raftStore struct {
+	mu      sync.RWMutex
+	path    string
+	f       *os.File
+	logs    map[uint64]*raft.Log
+	first   uint64
+	last    uint64
+	deleted int // Entries deleted since the file was last rewritten
+
+	stable_path string
+	stable      map[string][]byte
+}
+
+func openRaftStore(logPath string, stablePath string) (*raftStore, error) {
+	s := &raftStore{path: logPath, stable_path: stablePath, logs: make(map[uint64]*raft.Log), stable: make(map[string][]byte)}
+	if data, err := os.ReadFile(stablePath); err == nil {
+		if err := json.Unmarshal(data, &s.stable); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(logPath, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	s.f = f
+	if err := s.replay(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// replay rebuilds the in-memory log from the file, truncating a torn tail.
+func (s *raftStore) replay() error {
+	r := bufio.NewReader(s.f)
+	var off int64
+	for {
+		p, n, err := readFrame(r)
+		if err == nil {
+			err = s.applyRecord(p)
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			slog.Warn("truncating damaged raft log tail", "path", s.path, "offset", off, "error", err)
+			if err := s.f.Truncate(off); err != nil {
+				return err
+			}
+			break
+		}
+		off += n
+	}
+	_, err := s.f.Seek(off, io.SeekStart)
+	return err
+}
+
+func (s *raftStore) applyRecord(p []byte) error {
+	if len(p) == 0 {
+		return ErrCorruptRecord
+	}
+	switch p[0] {
+	case raftRecordLog:
+		l, err := decodeRaftLog(p)
+		if err != nil {
+			return err
+		}
+		s.addLocked(l)
+	case raftRecordDelete:
+		if len(p) != 17 {
+			return ErrCorruptRecord
+		}
+		s.deleteLocked(binary.LittleEndian.Uint64(p[1:]), binary.LittleEndian.Uint64(p[9:]))
+	default:
+		return ErrCorruptRecord
+	}
+	return nil
+}
+
+func encodeRaftLog(l *raft.Log) []byte {
+	p := make([]byte, raftLogFixedLen+len(l.Data)+len(l.Extensions))
+	p[0] = raftRecordLog
+	binary.LittleEndian.PutUint64(p[1:], l.Index)
+	binary.LittleEndian.PutUint64(p[9:], l.Term)
+	p[17] = byte(l.Type)
+	binary.LittleEndian.PutUint64(p[18:], uint64(l.AppendedAt.UnixNano()))
+	binary.LittleEndian.PutUint32(p[26:], uint32(len(l.Data)))
+	binary.LittleEndian.PutUint32(p[30:], uint32(len(l.Extensions)))
+	n := copy(p[raftLogFixedLen:], l.Data)
+	copy(p[raftLogFixedLen+n:], l.Extensions)
+	return frame(p)
+}
+
+func decodeRaftLog(p []byte) (*raft.Log, error) {
+	if len(p) < raftLogFixedLen {
+		return nil, ErrCorruptRecord
+	}
+	dataLen := uint64(binary.LittleEndian.Uint32(p[26:]))
+	extLen := uint64(binary.LittleEndian.Uint32(p[30:]))
+	if raftLogFixedLen+dataLen+extLen != uint64(len(p)) {
+		return nil, ErrCorruptRecord
+	}
+	rest := p[raftLogFixedLen:]
+	l := &raft.Log{
+		Index:      binary.LittleEndian.Uint64(p[1:]),
+		Term:       binary.LittleEndian.Uint64(p[9:]),
+		Type:       raft.LogType(p[17]),
+		AppendedAt: time.Unix(0, int64(binary.LittleEndian.Uint64(p[18:]))),
+		Data:       append([]byte(nil), rest[:dataLen]...),
+	}
+	if extLen > 0 {
+		l.Extensions = append([]byte(nil), rest[dataLen:]...)
+	}
+	return l, nil
+}
+
+func (s *raftStore) addLocked(l *raft.Log) {
+	s.logs[l.Index] = l
+	if s.first == 0 || l.Index < s.first {
+		s.first = l.Index
+	}
+	if l.Index > s.last {
+		s.last = l.Index
+	}
+}
+
+func (s *raftStore) deleteLocked(lo uint64, hi uint64) {
+	for i := lo; i <= hi; i++ {
+		if _, ok := s.logs[i]; ok {
+			delete(s.logs, i)
+			s.deleted++
+		}
+	}
+	if lo <= s.first {
+		s.first = hi + 1
+	}
+	if hi >= s.last {
+		s.last = lo - 1
+	}
+	if s.first > s.last {
+		s.first, s.last = 0, 0
+	}
+}
+
+func (s *raftStore) FirstIndex() (uint64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.first, nil
+}
+
+func (s *raftStore) LastIndex() (uint64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.last, nil
+}
+
+func (s *raftStore) GetLog(index uint64, log *raft.Log) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	l, ok := s.logs[index]
+	if !ok {
+		return raft.ErrLogNotFound
+	}
+	*log = *l
+	return nil
+}
+
+func (s *raftStore) StoreLog(log *raft.Log) error {
+	return s.StoreLogs([]*raft.Log{log})
+}
+
+func (s *raftStore) StoreLogs(logs []*raft.Log) error {
+	var buf []byte
+	for _, l := range logs {
+		buf = append(buf, encodeRaftLog(l)...)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.write(buf); err != nil {
+		return err
+	}
+	for _, l := range logs {
+		c := *l
+		s.addLocked(&c)
+	}
+	return nil
+}
+
+func (s *raftStore) DeleteRange(lo uint64, hi uint64) error {
+	p := make([]byte, 17)
+	p[0] = raftRecordDelete
+	binary.LittleEndian.PutUint64(p[1:], lo)
+	binary.LittleEndian.PutUint64(p[9:], hi)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.write(frame(p)); err != nil {
+		return err
+	}
+	s.deleteLocked(lo, hi)
+	if s.deleted > 2*len(s.logs)+1024 {
+		if err := s.rewriteLocked(); err != nil {
+			slog.Error("failed to compact raft log", "error", err)
+		}
+	}
+	return nil
+}
+
+// write appends buf to the log file and syncs it. Must be called with s.mu
+// held.
+func (s *raftStore) write(buf []byte) error {
+	if _, err := s.f.Write(buf); err != nil {
+		return err
+	}
+	return s.f.Sync()
+}
+
+// rewriteLocked replaces the log file with just the live entries. Must be
+// called with s.mu held.
+func (s *raftStore) rewriteLocked() error {
+	tmp := s.path + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(out)
+	for i := s.first; i != 0 && i <= s.last; i++ {
+		if l, ok := s.logs[i]; ok {
+			w.Write(encodeRaftLog(l))
+		}
+	}
+	if err = w.Flush(); err == nil {
+		err = out.Sync()
+	}
+	if err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	f, err := replaceFile(out, s.f, s.path, os.O_RDWR|os.O_APPEND)
+	if f != nil {
+		s.f = f
+	}
+	if err != nil {
+		return err
+	}
+	s.deleted = 0
+	return nil
+}
+
+func (s *raftStore) Set(key []byte, val []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stable[string(key)] = append([]byte(nil), val...)
+	return s.saveStableLocked()
+}
+
+func (s *raftStore) Get(key []byte) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	val, ok := s.stable[string(key)]
+	if !ok {
+		return nil, errStableNotFound
+	}
+	return val, nil
+}
+
+func (s *raftStore) SetUint64(key []byte, val uint64) error {
+	return s.Set(key, binary.LittleEndian.AppendUint64(nil, val))
+}
+
+func (s *raftStore) GetUint64(key []byte) (uint64, error) {
+	val, err := s.Get(key)
+	if errors.Is(err, errStableNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(val) != 8 {
+		return 0, ErrCorruptRecord
+	}
+	return binary.LittleEndian.Uint64(val), nil
+}
+
+func (s *raftStore) saveStableLocked() error {
+	data, err := json.Marshal(s.stable)
+	if err != nil {
+		return err
+	}
+	tmp := s.stable_path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, s.stable_path)
+}
+
+func (s *raftStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.f.Close()
+}
@@ -0,0 +1,117 @@
+package main
+
+// Per-client token bucket rate limiting plus a global cap on in-flight
+// requests. Clients are identified by their credential when they sent one,
+// otherwise by remote IP. Scoped API keys may have a rate of their own (see
+// apikeys.go). Rejected requests get 429 Too Many Requests.
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const bucketIdleTimeout = 5 * time.Minute // Buckets unused this long are dropped
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type rateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+var (
+	limiter   = &rateLimiter{buckets: make(map[string]*tokenBucket)}
+	in_flight atomic.Int64
+)
+
+// allow takes a token from the client's bucket. When the bucket is empty it
+// returns false and how long until the next token is available.
+func (l *rateLimiter) allow(client string, rate float64, burst int, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &tokenBucket{tokens: float64(burst), last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// cleanupLoop drops idle buckets so the map doesn't grow with every client
+// ever seen.
+func (l *rateLimiter) cleanupLoop() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		l.mu.Lock()
+		for client, b := range l.buckets {
+			if now.Sub(b.last) > bucketIdleTimeout {
+				delete(l.buckets, client)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// clientID identifies the caller for rate limiting.
+func clientID(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return "key:" + key
+	}
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		if user, _, ok := r.BasicAuth(); ok {
+			return "user:" + user
+		}
+		return "auth:" + auth
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return "ip:" + r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+func limitRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := requestConfig(r)
+		if limit := int64(c.MaxInFlight); limit > 0 {
+			if in_flight.Add(1) > limit {
+				in_flight.Add(-1)
+				w.Header().Set("Retry-After", "1")
+				writeError(w, r, http.StatusTooManyRequests, codeRateLimited, "too many requests in flight")
+				return
+			}
+			defer in_flight.Add(-1)
+		}
+		rate, burst := c.RateLimit, c.RateBurst
+		if k := requestAPIKey(r); k != nil && k.RateLimit > 0 {
+			rate = k.RateLimit
+			if k.RateBurst > 0 {
+				burst = k.RateBurst
+			}
+		}
+		if rate > 0 {
+			ok, wait := limiter.allow(clientID(r), rate, burst, time.Now())
+			if !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				writeError(w, r, http.StatusTooManyRequests, codeRateLimited, "rate limit exceeded")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,895 @@
+package main
+
+// Reading Redis RDB files for kvstore import. Strings are imported as they
+// are; hashes become JSON objects, lists and sets JSON arrays (sets sorted)
+// and sorted sets JSON objects of member to score, whichever encoding Redis
+// chose for them. Keys already expired when the file is read are left out.
+// Streams and module values have no equivalent here and are skipped; module
+// values written by modules predating Redis 4 can't even be skipped and stop
+// the import, as do value types newer than this reader.
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const rdbMaxVersion = 12
+
+// rdbReadChunk is the largest read allocated in full before any of it arrives.
+const rdbReadChunk = 64 << 10
+
+// Opcodes preceding the next key, or ending the file.
+const (
+	rdbOpSlotInfo     = 0xF4
+	rdbOpFunction2    = 0xF6
+	rdbOpFreq         = 0xF7
+	rdbOpIdle         = 0xF8
+	rdbOpModuleAux    = 0xF9
+	rdbOpAux          = 0xFA
+	rdbOpResizeDB     = 0xFB
+	rdbOpExpireTimeMs = 0xFC
+	rdbOpExpireTime   = 0xFD
+	rdbOpSelectDB     = 0xFE
+	rdbOpEOF          = 0xFF
+)
+
+// Value types.
+const (
+	rdbTypeString         = 0
+	rdbTypeList           = 1
+	rdbTypeSet            = 2
+	rdbTypeZset           = 3
+	rdbTypeHash           = 4
+	rdbTypeZset2          = 5
+	rdbTypeModule         = 6
+	rdbTypeModule2        = 7
+	rdbTypeHashZipmap     = 9
+	rdbTypeListZiplist    = 10
+	rdbTypeSetIntset      = 11
+	rdbTypeZsetZiplist    = 12
+	rdbTypeHashZiplist    = 13
+	rdbTypeListQuicklist  = 14
+	rdbTypeStream         = 15
+	rdbTypeHashListpack   = 16
+	rdbTypeZsetListpack   = 17
+	rdbTypeListQuicklist2 = 18
+	rdbTypeStream2        = 19
+	rdbTypeSetListpack    = 20
+	rdbTypeStream3        = 21
+)
+
+// crc64Jones is the CRC-64 variant Redis checksums RDB files with.
+var crc64Jones = crc64.MakeTable(0x95AC9329AC4BC9B5)
+
+type rdbStats struct {
+	expired  int
+	otherDB  int
+	skipped  map[string]int // Keys of types that aren't imported, by type
+	emptyKey int
+}
+
+type rdbDecoder struct {
+	r       *bufio.Reader
+	crc     uint64 // Complement of the checksum of everything read so far
+	version int
+}
+
+// readRDB calls emit with the key and value of every live key of database db
+// in the RDB file r.
+func readRDB(r io.Reader, db int, emit func(key string, value string) error) (rdbStats, error) {
+	d := &rdbDecoder{r: bufio.NewReaderSize(r, 1<<16), crc: ^uint64(0)}
+	st := rdbStats{skipped: make(map[string]int)}
+	magic, err := d.read(9)
+	if err != nil {
+		return st, err
+	}
+	if string(magic[:5]) != "REDIS" {
+		return st, errors.New("not an RDB file")
+	}
+	if d.version, err = strconv.Atoi(string(magic[5:])); err != nil {
+		return st, errors.New("not an RDB file")
+	}
+	if d.version < 1 || d.version > rdbMaxVersion {
+		return st, fmt.Errorf("unsupported RDB version %d", d.version)
+	}
+
+	now := time.Now().UnixMilli()
+	cur, expireAt := 0, int64(-1)
+	for {
+		op, err := d.readByte()
+		if err != nil {
+			return st, err
+		}
+		switch op {
+		case rdbOpEOF:
+			return st, d.checkChecksum()
+		case rdbOpSelectDB:
+			n, err := d.readLength()
+			if err != nil {
+				return st, err
+			}
+			cur = int(n)
+		case rdbOpExpireTime:
+			b, err := d.read(4)
+			if err != nil {
+				return st, err
+			}
+			expireAt = int64(binary.LittleEndian.Uint32(b)) * 1000
+		case rdbOpExpireTimeMs:
+			b, err := d.read(8)
+			if err != nil {
+				return st, err
+			}
+			expireAt = int64(binary.LittleEndian.Uint64(b))
+		case rdbOpResizeDB:
+			err = d.skipLengths(2)
+		case rdbOpSlotInfo:
+			err = d.skipLengths(3)
+		case rdbOpAux:
+			err = d.skipStrings(2)
+		case rdbOpFunction2:
+			err = d.skipStrings(1)
+		case rdbOpIdle:
+			err = d.skipLengths(1)
+		case rdbOpFreq:
+			_, err = d.readByte()
+		case rdbOpModuleAux:
+			if err = d.skipLengths(3); err == nil { // Module id, when opcode and when
+				err = d.skipModuleValue()
+			}
+		default:
+			key, err := d.readString()
+			if err != nil {
+				return st, err
+			}
+			value, kind, err := d.readValue(op)
+			if err != nil {
+				return st, fmt.Errorf("key %q: %w", key, err)
+			}
+			switch {
+			case cur != db:
+				st.otherDB++
+			case expireAt >= 0 && expireAt <= now:
+				st.expired++
+			case kind != "":
+				st.skipped[kind]++
+			case key == "":
+				st.emptyKey++
+			default:
+				if err := emit(key, value); err != nil {
+					return st, err
+				}
+			}
+			expireAt = -1
+		}
+		if err != nil {
+			return st, err
+		}
+	}
+}
+
+// read returns the next n bytes, adding them to the checksum. Lengths come
+// from the file, so past rdbReadChunk the buffer grows with what is actually
+// read rather than being allocated up front.
+func (d *rdbDecoder) read(n uint64) ([]byte, error) {
+	if n > math.MaxInt32 {
+		return nil, fmt.Errorf("length %d out of range", n)
+	}
+	var b []byte
+	var err error
+	if n <= rdbReadChunk {
+		b = make([]byte, n)
+		_, err = io.ReadFull(d.r, b)
+	} else if b, err = io.ReadAll(io.LimitReader(d.r, int64(n))); err == nil && uint64(len(b)) < n {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	d.crc = crc64.Update(d.crc, crc64Jones, b)
+	return b, nil
+}
+
+func (d *rdbDecoder) readByte() (byte, error) {
+	b, err := d.read(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+// checkChecksum reads the checksum following the EOF opcode, which files
+// written with rdbchecksum off leave zero.
+func (d *rdbDecoder) checkChecksum() error {
+	if d.version < 5 {
+		return nil
+	}
+	want := ^d.crc
+	b, err := d.read(8)
+	if err != nil {
+		return err
+	}
+	if got := binary.LittleEndian.Uint64(b); got != 0 && got != want {
+		return errors.New("RDB checksum mismatch")
+	}
+	return nil
+}
+
+// readLengthEnc reads a length, or with special set the format of a specially
+// encoded string.
+func (d *rdbDecoder) readLengthEnc() (n uint64, special bool, err error) {
+	b, err := d.readByte()
+	if err != nil {
+		return 0, false, err
+	}
+	switch b >> 6 {
+	case 0:
+		return uint64(b & 0x3f), false, nil
+	case 1:
+		next, err := d.readByte()
+		return uint64(b&0x3f)<<8 | uint64(next), false, err
+	case 3:
+		return uint64(b & 0x3f), true, nil
+	}
+	switch b {
+	case 0x80:
+		p, err := d.read(4)
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(binary.BigEndian.Uint32(p)), false, nil
+	case 0x81:
+		p, err := d.read(8)
+		if err != nil {
+			return 0, false, err
+		}
+		return binary.BigEndian.Uint64(p), false, nil
+	}
+	return 0, false, fmt.Errorf("bad length encoding %#x", b)
+}
+
+func (d *rdbDecoder) readLength() (uint64, error) {
+	n, special, err := d.readLengthEnc()
+	if err == nil && special {
+		err = errors.New("unexpected encoded string")
+	}
+	return n, err
+}
+
+func (d *rdbDecoder) readString() (string, error) {
+	n, special, err := d.readLengthEnc()
+	if err != nil {
+		return "", err
+	}
+	if !special {
+		b, err := d.read(n)
+		return string(b), err
+	}
+	switch n {
+	case 0, 1, 2: // 8, 16 or 32 bit integer
+		b, err := d.read(1 << n)
+		if err != nil {
+			return "", err
+		}
+		var v int64
+		switch n {
+		case 0:
+			v = int64(int8(b[0]))
+		case 1:
+			v = int64(int16(binary.LittleEndian.Uint16(b)))
+		case 2:
+			v = int64(int32(binary.LittleEndian.Uint32(b)))
+		}
+		return strconv.FormatInt(v, 10), nil
+	case 3: // LZF compressed
+		clen, err := d.readLength()
+		if err != nil {
+			return "", err
+		}
+		ulen, err := d.readLength()
+		if err != nil {
+			return "", err
+		}
+		b, err := d.read(clen)
+		if err != nil {
+			return "", err
+		}
+		out, err := lzfDecompress(b, ulen)
+		return string(out), err
+	}
+	return "", fmt.Errorf("unknown string encoding %d", n)
+}
+
+func (d *rdbDecoder) skipLengths(n int) error {
+	for range n {
+		if _, err := d.readLength(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *rdbDecoder) skipStrings(n int) error {
+	for range n {
+		if _, err := d.readString(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readStrings reads a length followed by that many strings, times n strings
+// per entry.
+func (d *rdbDecoder) readStrings(n uint64) ([]string, error) {
+	count, err := d.readLength()
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	for range count * n {
+		s, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, s)
+	}
+	return out, nil
+}
+
+// readScore reads a sorted set score in the text form of RDB_TYPE_ZSET.
+func (d *rdbDecoder) readScore() (float64, error) {
+	n, err := d.readByte()
+	if err != nil {
+		return 0, err
+	}
+	switch n {
+	case 253:
+		return math.NaN(), nil
+	case 254:
+		return math.Inf(1), nil
+	case 255:
+		return math.Inf(-1), nil
+	}
+	b, err := d.read(uint64(n))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(string(b), 64)
+}
+
+// skipModuleValue skips a module value saved with the opcodes of
+// RDB_TYPE_MODULE_2.
+func (d *rdbDecoder) skipModuleValue() error {
+	for {
+		op, err := d.readLength()
+		if err != nil {
+			return err
+		}
+		switch op {
+		case 0: // EOF
+			return nil
+		case 1, 2: // Signed and unsigned integers
+			err = d.skipLengths(1)
+		case 3: // Float
+			_, err = d.read(4)
+		case 4: // Double
+			_, err = d.read(8)
+		case 5: // String
+			err = d.skipStrings(1)
+		default:
+			return fmt.Errorf("bad module opcode %d", op)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// skipStream skips a stream of type t.
+func (d *rdbDecoder) skipStream(t byte) error {
+	n, err := d.readLength()
+	if err != nil {
+		return err
+	}
+	if err := d.skipStrings(int(2 * n)); err != nil { // Master ID and listpack of each node
+		return err
+	}
+	meta := 3 // Length and last ID
+	if t >= rdbTypeStream2 {
+		meta += 5 // First ID, max deleted ID and entries added
+	}
+	if err := d.skipLengths(meta); err != nil {
+		return err
+	}
+	groups, err := d.readLength()
+	if err != nil {
+		return err
+	}
+	for range groups {
+		if err := d.skipStrings(1); err != nil {
+			return err
+		}
+		meta := 2 // Last ID
+		if t >= rdbTypeStream2 {
+			meta++ // Entries read
+		}
+		if err := d.skipLengths(meta); err != nil {
+			return err
+		}
+		pending, err := d.readLength()
+		if err != nil {
+			return err
+		}
+		for range pending {
+			if _, err := d.read(16 + 8); err != nil { // ID and delivery time
+				return err
+			}
+			if err := d.skipLengths(1); err != nil { // Delivery count
+				return err
+			}
+		}
+		consumers, err := d.readLength()
+		if err != nil {
+			return err
+		}
+		for range consumers {
+			if err := d.skipStrings(1); err != nil {
+				return err
+			}
+			times := 8 // Seen time
+			if t >= rdbTypeStream3 {
+				times += 8 // Active time
+			}
+			if _, err := d.read(uint64(times)); err != nil {
+				return err
+			}
+			owned, err := d.readLength()
+			if err != nil {
+				return err
+			}
+			if _, err := d.read(16 * owned); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readValue reads a value of type t as the string to store, or returns the
+// kind of value it skipped.
+func (d *rdbDecoder) readValue(t byte) (value string, skipped string, err error) {
+	var list []string  // Lists and sets
+	var pairs []string // Hashes and sorted sets, with scores in text form
+	var scores map[string]float64
+	switch t {
+	case rdbTypeString:
+		value, err = d.readString()
+		return value, "", err
+	case rdbTypeList, rdbTypeSet:
+		list, err = d.readStrings(1)
+	case rdbTypeHash:
+		pairs, err = d.readStrings(2)
+	case rdbTypeZset, rdbTypeZset2:
+		var n uint64
+		if n, err = d.readLength(); err != nil {
+			break
+		}
+		scores = make(map[string]float64, n)
+		for range n {
+			var member string
+			var score float64
+			if member, err = d.readString(); err != nil {
+				break
+			}
+			if t == rdbTypeZset {
+				score, err = d.readScore()
+			} else {
+				var b []byte
+				b, err = d.read(8)
+				if err == nil {
+					score = math.Float64frombits(binary.LittleEndian.Uint64(b))
+				}
+			}
+			if err != nil {
+				break
+			}
+			scores[member] = score
+		}
+	case rdbTypeListQuicklist, rdbTypeListQuicklist2:
+		var n uint64
+		if n, err = d.readLength(); err != nil {
+			break
+		}
+		for range n {
+			container := uint64(2) // Packed
+			if t == rdbTypeListQuicklist2 {
+				if container, err = d.readLength(); err != nil {
+					break
+				}
+			}
+			var blob string
+			if blob, err = d.readString(); err != nil {
+				break
+			}
+			var entries []string
+			switch {
+			case container == 1: // Plain, a single large element
+				entries = []string{blob}
+			case t == rdbTypeListQuicklist:
+				entries, err = ziplistEntries([]byte(blob))
+			default:
+				entries, err = listpackEntries([]byte(blob))
+			}
+			if err != nil {
+				break
+			}
+			list = append(list, entries...)
+		}
+	case rdbTypeHashZipmap, rdbTypeListZiplist, rdbTypeSetIntset, rdbTypeZsetZiplist, rdbTypeHashZiplist,
+		rdbTypeHashListpack, rdbTypeZsetListpack, rdbTypeSetListpack:
+		var blob string
+		if blob, err = d.readString(); err != nil {
+			break
+		}
+		var entries []string
+		switch t {
+		case rdbTypeHashZipmap:
+			entries, err = zipmapEntries([]byte(blob))
+		case rdbTypeListZiplist, rdbTypeZsetZiplist, rdbTypeHashZiplist:
+			entries, err = ziplistEntries([]byte(blob))
+		case rdbTypeSetIntset:
+			entries, err = intsetEntries([]byte(blob))
+		default:
+			entries, err = listpackEntries([]byte(blob))
+		}
+		if err != nil {
+			break
+		}
+		switch t {
+		case rdbTypeZsetZiplist, rdbTypeZsetListpack:
+			if len(entries)%2 != 0 {
+				return "", "", errors.New("odd number of sorted set entries")
+			}
+			scores = make(map[string]float64, len(entries)/2)
+			for i := 0; i < len(entries); i += 2 {
+				score, err := strconv.ParseFloat(entries[i+1], 64)
+				if err != nil {
+					return "", "", fmt.Errorf("bad score %q", entries[i+1])
+				}
+				scores[entries[i]] = score
+			}
+		case rdbTypeHashZipmap, rdbTypeHashZiplist, rdbTypeHashListpack:
+			pairs = entries
+		default:
+			list = entries
+		}
+	case rdbTypeStream, rdbTypeStream2, rdbTypeStream3:
+		return "", "stream", d.skipStream(t)
+	case rdbTypeModule2:
+		if err = d.skipLengths(1); err == nil { // Module id
+			err = d.skipModuleValue()
+		}
+		return "", "module", err
+	case rdbTypeModule:
+		return "", "", errors.New("values of pre-release Redis modules can't be read")
+	default:
+		return "", "", fmt.Errorf("unsupported value type %d", t)
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	var v any
+	switch t {
+	case rdbTypeSet, rdbTypeSetIntset, rdbTypeSetListpack:
+		sort.Strings(list)
+		v = list
+	case rdbTypeList, rdbTypeListZiplist, rdbTypeListQuicklist, rdbTypeListQuicklist2:
+		v = list
+	case rdbTypeZset, rdbTypeZset2, rdbTypeZsetZiplist, rdbTypeZsetListpack:
+		obj := make(map[string]any, len(scores))
+		for m, s := range scores {
+			switch {
+			case math.IsNaN(s):
+				obj[m] = "nan" // JSON has no NaN or infinities
+			case math.IsInf(s, 1):
+				obj[m] = "inf"
+			case math.IsInf(s, -1):
+				obj[m] = "-inf"
+			default:
+				obj[m] = s
+			}
+		}
+		v = obj
+	default:
+		if len(pairs)%2 != 0 {
+			return "", "", errors.New("odd number of hash entries")
+		}
+		obj := make(map[string]string, len(pairs)/2)
+		for i := 0; i < len(pairs); i += 2 {
+			obj[pairs[i]] = pairs[i+1]
+		}
+		v = obj
+	}
+	if list, ok := v.([]string); ok && list == nil {
+		v = []string{}
+	}
+	value, err = encodeJSON(v)
+	return value, "", err
+}
+
+// lzfDecompress expands LZF compressed data to its size n.
+func lzfDecompress(in []byte, n uint64) ([]byte, error) {
+	errCorrupt := errors.New("corrupt LZF data")
+	if n > math.MaxInt32 {
+		return nil, errCorrupt
+	}
+	out := make([]byte, 0, n)
+	for i := 0; i < len(in); {
+		ctrl := int(in[i])
+		i++
+		if ctrl < 32 { // Literal run
+			run := ctrl + 1
+			if i+run > len(in) {
+				return nil, errCorrupt
+			}
+			out = append(out, in[i:i+run]...)
+			i += run
+			continue
+		}
+		run := ctrl >> 5
+		if run == 7 {
+			if i >= len(in) {
+				return nil, errCorrupt
+			}
+			run += int(in[i])
+			i++
+		}
+		run += 2
+		if i >= len(in) {
+			return nil, errCorrupt
+		}
+		ref := len(out) - (ctrl&0x1f)<<8 - int(in[i]) - 1
+		i++
+		if ref < 0 {
+			return nil, errCorrupt
+		}
+		for j := range run { // Back references may overlap what they write
+			out = append(out, out[ref+j])
+		}
+	}
+	if uint64(len(out)) != n {
+		return nil, errCorrupt
+	}
+	return out, nil
+}
+
+var errCorruptEncoding = errors.New("corrupt compact encoding")
+
+// ziplistEntries returns the elements of a ziplist, integers in decimal.
+func ziplistEntries(b []byte) ([]string, error) {
+	var out []string
+	i := 10 // Total bytes, tail offset and length
+	for {
+		if i >= len(b) {
+			return nil, errCorruptEncoding
+		}
+		if b[i] == 0xff {
+			return out, nil
+		}
+		if b[i] == 0xfe { // Previous entry length
+			i += 5
+		} else {
+			i++
+		}
+		if i >= len(b) {
+			return nil, errCorruptEncoding
+		}
+		enc := b[i]
+		var n, skip int // String length, and header bytes before it
+		var v int64
+		isInt := true
+		switch {
+		case enc>>6 == 0:
+			n, skip, isInt = int(enc&0x3f), 1, false
+		case enc>>6 == 1:
+			if i+2 > len(b) {
+				return nil, errCorruptEncoding
+			}
+			n, skip, isInt = int(enc&0x3f)<<8|int(b[i+1]), 2, false
+		case enc>>6 == 2:
+			if i+5 > len(b) {
+				return nil, errCorruptEncoding
+			}
+			n, skip, isInt = int(binary.BigEndian.Uint32(b[i+1:])), 5, false
+		case enc == 0xc0, enc == 0xd0, enc == 0xe0, enc == 0xf0, enc == 0xfe:
+			size := 1
+			switch enc {
+			case 0xc0:
+				size = 2
+			case 0xd0:
+				size = 4
+			case 0xe0:
+				size = 8
+			case 0xf0:
+				size = 3
+			}
+			if i+1+size > len(b) {
+				return nil, errCorruptEncoding
+			}
+			v = littleEndianInt(b[i+1 : i+1+size])
+			skip = 1 + size
+		case enc >= 0xf1 && enc <= 0xfd:
+			v, skip = int64(enc&0x0f)-1, 1
+		default:
+			return nil, errCorruptEncoding
+		}
+		i += skip
+		if isInt {
+			out = append(out, strconv.FormatInt(v, 10))
+			continue
+		}
+		if n < 0 || i+n > len(b) {
+			return nil, errCorruptEncoding
+		}
+		out = append(out, string(b[i:i+n]))
+		i += n
+	}
+}
+
+// listpackEntries returns the elements of a listpack, integers in decimal.
+func listpackEntries(b []byte) ([]string, error) {
+	var out []string
+	i := 6 // Total bytes and length
+	for {
+		if i >= len(b) {
+			return nil, errCorruptEncoding
+		}
+		enc := b[i]
+		if enc == 0xff {
+			return out, nil
+		}
+		var n, skip int // String length, and header bytes before it
+		var v int64
+		isInt := true
+		switch {
+		case enc&0x80 == 0:
+			v, skip = int64(enc), 1
+		case enc&0xc0 == 0x80:
+			n, skip, isInt = int(enc&0x3f), 1, false
+		case enc&0xe0 == 0xc0:
+			if i+2 > len(b) {
+				return nil, errCorruptEncoding
+			}
+			v, skip = int64(enc&0x1f)<<8|int64(b[i+1]), 2
+			if v >= 1<<12 {
+				v -= 1 << 13
+			}
+		case enc&0xf0 == 0xe0:
+			if i+2 > len(b) {
+				return nil, errCorruptEncoding
+			}
+			n, skip, isInt = int(enc&0x0f)<<8|int(b[i+1]), 2, false
+		case enc == 0xf0:
+			if i+5 > len(b) {
+				return nil, errCorruptEncoding
+			}
+			n, skip, isInt = int(binary.LittleEndian.Uint32(b[i+1:])), 5, false
+		case enc >= 0xf1 && enc <= 0xf4:
+			size := []int{2, 3, 4, 8}[enc-0xf1]
+			if i+1+size > len(b) {
+				return nil, errCorruptEncoding
+			}
+			v, skip = littleEndianInt(b[i+1:i+1+size]), 1+size
+		default:
+			return nil, errCorruptEncoding
+		}
+		entry := skip
+		if isInt {
+			out = append(out, strconv.FormatInt(v, 10))
+		} else {
+			if n < 0 || i+skip+n > len(b) {
+				return nil, errCorruptEncoding
+			}
+			out = append(out, string(b[i+skip:i+skip+n]))
+			entry += n
+		}
+		i += entry + listpackBacklen(entry)
+	}
+}
+
+// listpackBacklen is the size of the length trailing an entry of n bytes.
+func listpackBacklen(n int) int {
+	switch {
+	case n <= 127:
+		return 1
+	case n < 16383:
+		return 2
+	case n < 2097151:
+		return 3
+	case n < 268435455:
+		return 4
+	}
+	return 5
+}
+
+// intsetEntries returns the integers of an intset in decimal.
+func intsetEntries(b []byte) ([]string, error) {
+	if len(b) < 8 {
+		return nil, errCorruptEncoding
+	}
+	size := int(binary.LittleEndian.Uint32(b))
+	n := int(binary.LittleEndian.Uint32(b[4:]))
+	if (size != 2 && size != 4 && size != 8) || n < 0 || 8+n*size > len(b) {
+		return nil, errCorruptEncoding
+	}
+	out := make([]string, n)
+	for i := range n {
+		out[i] = strconv.FormatInt(littleEndianInt(b[8+i*size:8+(i+1)*size]), 10)
+	}
+	return out, nil
+}
+
+// zipmapEntries returns the fields and values of a zipmap, alternately.
+func zipmapEntries(b []byte) ([]string, error) {
+	var out []string
+	i := 1 // Length
+	for {
+		if i >= len(b) {
+			return nil, errCorruptEncoding
+		}
+		if b[i] == 0xff {
+			return out, nil
+		}
+		for field := 0; field < 2; field++ {
+			if i >= len(b) {
+				return nil, errCorruptEncoding
+			}
+			n := int(b[i])
+			i++
+			if n == 254 {
+				if i+4 > len(b) {
+					return nil, errCorruptEncoding
+				}
+				n = int(binary.LittleEndian.Uint32(b[i:]))
+				i += 4
+			} else if n == 255 {
+				return nil, errCorruptEncoding
+			}
+			free := 0
+			if field == 1 { // Values are followed by unused bytes
+				if i >= len(b) {
+					return nil, errCorruptEncoding
+				}
+				free = int(b[i])
+				i++
+			}
+			if n < 0 || i+n+free > len(b) {
+				return nil, errCorruptEncoding
+			}
+			out = append(out, string(b[i:i+n]))
+			i += n + free
+		}
+	}
+}
+
+// littleEndianInt decodes a signed little endian integer of len(b) bytes.
+func littleEndianInt(b []byte) int64 {
+	var u uint64
+	for i := len(b) - 1; i >= 0; i-- {
+		u = u<<8 | uint64(b[i])
+	}
+	shift := 64 - 8*len(b)
+	return int64(u<<shift) >> shift
+}
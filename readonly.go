@@ -0,0 +1,104 @@
+package main
+
+// Read-only mode, turned on by read_only at startup or POST
+// /admin/readonly?enabled=true at runtime: writes are refused with 403 while
+// reads are served as usual, e.g. for read replicas started from a restored
+// backup. Besides the HTTP check, the segment stores refuse to append or
+// rewrite while it is on, so no other front-end (memcached, POST
+// /admin/import) can change the data either, and compaction is paused.
+// Storage itself is left untouched: segments are opened for reading only, a
+// torn or damaged tail is reported rather than truncated or repaired, and no
+// index checkpoint, bloom filter or key statistics file is written. With
+// read_only set at startup the stores are opened that way from the start; a
+// restore_from restore runs before read-only mode takes effect. Turning the
+// mode off reopens the active segments for appending.
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+var ErrReadOnly = errors.New("server is read-only")
+
+var read_only atomic.Bool
+
+// ReadOnlyStatus is the body of GET and POST /admin/readonly.
+type ReadOnlyStatus struct {
+	ReadOnly bool `json:"read_only"`
+}
+
+// rejectReadOnlyWrites answers write requests with 403 in read-only mode.
+// Admin endpoints stay available apart from imports.
+func rejectReadOnlyWrites(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if read_only.Load() && requiredAccess(r) == accessWrite &&
+			(r.URL.Path == "/admin/import" || !strings.HasPrefix(r.URL.Path, "/admin/") && !strings.HasPrefix(r.URL.Path, "/debug/")) {
+			writeError(w, r, http.StatusForbidden, codeReadOnly, "server is in read-only mode")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// reopenStores reopens the active segment of every store, for reading only
+// or for appending.
+func reopenStores(readOnly bool) error {
+	var errs []error
+	for _, n := range allNodes() {
+		n.mu.Lock()
+		if n.segs != nil && !n.dropped && n.segs.readOnly != readOnly {
+			if readOnly {
+				errs = append(errs, n.segs.sync()) // Last appends before the file turns read-only
+			}
+			errs = append(errs, n.segs.openActive(readOnly))
+		}
+		n.mu.Unlock()
+	}
+	return errors.Join(errs...)
+}
+
+// adminReadOnlyHandler reports read-only mode on GET and switches it with
+// POST ?enabled=true|false.
+func adminReadOnlyHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, ReadOnlyStatus{ReadOnly: read_only.Load()})
+		return
+	case http.MethodPost:
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+	enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "enabled must be true or false")
+		return
+	}
+	if enabled && (cluster != nil || replica != nil) {
+		writeError(w, r, http.StatusConflict, codeBadRequest, "raft members and replicas apply writes from elsewhere and can't be made read-only")
+		return
+	}
+	if !enabled && read_only.Load() {
+		// Writable before writes are let through
+		if err := reopenStores(false); err != nil {
+			writeStoreError(w, r, err)
+			return
+		}
+	}
+	if read_only.Swap(enabled) != enabled {
+		slog.Info("read-only mode changed", "read_only", enabled)
+		if enabled {
+			reopenStores(true)
+		} else {
+			for _, n := range allNodes() {
+				go n.compactSegments() // Catch up on what was skipped
+			}
+		}
+	}
+	writeJSON(w, ReadOnlyStatus{ReadOnly: enabled})
+}
@@ -0,0 +1,201 @@
+package main
+
+// Parallel recovery. Startup time of a large store goes into reading and
+// checksumming its segments, so the segments to replay are read and decoded
+// by up to recovery_workers goroutines at once, one segment each, ahead of a
+// single merge step that applies them oldest first: later records override
+// earlier ones, and clear markers, history and damaged segments are dealt
+// with exactly as in a sequential replay, with the records of a group held
+// back until its commit marker. At most recovery_workers decoded segments
+// wait to be applied, which bounds the extra memory to about that many times
+// segment_bytes. Reading the values of a checkpoint is split by
+// segment the same way.
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+)
+
+type replayedRecord struct {
+	rec  segRecord
+	off  int64
+	size int64
+}
+
+// replayedSegment is a segment read ahead of being applied.
+type replayedSegment struct {
+	recs []replayedRecord
+	end  int64 // Offset reading stopped at
+	err  error // Why reading stopped short of the end of the file, if it did
+}
+
+func recoveryWorkers() int {
+	if cfg().RecoveryWorkers > 0 {
+		return cfg().RecoveryWorkers
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
+// readSegment decodes the records of the segment at path from offset from
+// on. Only failing to open the file is returned as an error; damage ends the
+// records early and is left to the merge step.
+func readSegment(path string, from int64) (replayedSegment, error) {
+	rs := replayedSegment{end: from}
+	f, err := os.Open(path)
+	if err != nil {
+		return rs, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(from, io.SeekStart); err != nil {
+		return rs, err
+	}
+	r := bufio.NewReader(f)
+	for {
+		p, n, err := readFrame(r)
+		var rec segRecord
+		if err == nil {
+			rec, err = decodeSegmentRecord(p)
+		}
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				rs.err = err
+			}
+			return rs, nil
+		}
+		rs.recs = append(rs.recs, replayedRecord{rec: rec, off: rs.end, size: n})
+		rs.end += n
+	}
+}
+
+// replaySegments replays segs, the last of which is the active segment when
+// last is set, through apply in order.
+func (s *segmentStore) replaySegments(segs []*segment, last bool, apply func(op byte, key string, value string)) error {
+	if len(segs) == 0 {
+		return nil
+	}
+	start := time.Now()
+	workers := min(recoveryWorkers(), len(segs))
+	type result struct {
+		rs  replayedSegment
+		err error
+	}
+	results := make([]chan result, len(segs))
+	for i := range results {
+		results[i] = make(chan result, 1)
+	}
+	slots := make(chan struct{}, workers)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for i, seg := range segs {
+			select {
+			case slots <- struct{}{}:
+			case <-done:
+				return
+			}
+			go func() {
+				rs, err := readSegment(seg.path, seg.size)
+				results[i] <- result{rs, err}
+			}()
+		}
+	}()
+
+	var bytes int64
+	records := 0
+	for i, seg := range segs {
+		res := <-results[i]
+		<-slots
+		if res.err != nil {
+			return res.err
+		}
+		bytes += res.rs.end - seg.size
+		records += len(res.rs.recs)
+		replay := func(r replayedRecord) {
+			if s.track(r.rec, segLoc{seg: seg.id, off: r.off, size: r.size}) {
+				apply(r.rec.op, r.rec.key, r.rec.value)
+			}
+		}
+		// Records of a group wait for its commit marker
+		var group []replayedRecord
+		groupAt := int64(-1) // Offset of the open group's begin marker
+		for _, r := range res.rs.recs {
+			if groupAt >= 0 && !r.rec.grouped && r.rec.op != opCommit {
+				slog.Warn("rolled back uncommitted record group", "path", seg.path, "offset", groupAt, "records", len(group))
+				groupAt, group = -1, nil
+			}
+			switch {
+			case r.rec.op == opBegin:
+				groupAt, group = r.off, nil
+			case r.rec.op == opCommit:
+				if groupAt >= 0 && len(r.rec.value) == 4 && int(binary.LittleEndian.Uint32([]byte(r.rec.value))) == len(group) {
+					for _, g := range group {
+						replay(g)
+					}
+				} else if groupAt >= 0 {
+					slog.Warn("rolled back record group with a wrong count", "path", seg.path, "offset", groupAt, "records", len(group))
+				}
+				groupAt, group = -1, nil
+			case groupAt >= 0:
+				group = append(group, r)
+			default:
+				replay(r)
+			}
+		}
+		active := last && i == len(segs)-1
+		seg.size = res.rs.end
+		if res.rs.err != nil {
+			if err := s.damaged(seg, active, res.rs.err); err != nil {
+				return err
+			}
+		}
+		if groupAt >= 0 {
+			// A crash cut the group short; only the active segment can end in
+			// one, since segments aren't sealed while a group is open
+			slog.Warn("rolled back uncommitted record group", "path", seg.path, "offset", groupAt, "records", len(group))
+			if active && !seg.damaged && !read_only.Load() {
+				if err := os.Truncate(seg.path, groupAt); err != nil {
+					return err
+				}
+				seg.size = groupAt
+			}
+		}
+	}
+
+	elapsed := time.Since(start)
+	if bytes > 0 {
+		slog.Info("segments replayed", "dir", s.dir, "segments", len(segs), "records", records, "bytes", bytes,
+			"workers", workers, "elapsed", elapsed, "mb_per_sec", int64(float64(bytes)/(1<<20)/max(elapsed.Seconds(), 1e-6)))
+	}
+	return nil
+}
+
+// forEachParallel runs fn for 0 <= i < n on up to recovery_workers
+// goroutines and returns the first error.
+func forEachParallel(n int, fn func(i int) error) error {
+	errs := make([]error, n)
+	slots := make(chan struct{}, recoveryWorkers())
+	var wg sync.WaitGroup
+	for i := range n {
+		slots <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = fn(i)
+			<-slots
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// openTestSegments opens the segments in dir the way a restart does and
+// returns them with what they replayed to. Closing f alone, as cleanup
+// does, leaves the files as a crash would: synced, with no checkpoint.
+func openTestSegments(t *testing.T, dir string) (*segmentStore, map[string]string) {
+	t.Helper()
+	got := map[string]string{}
+	s, err := openSegments(dir, func(op byte, key string, value string) {
+		switch op {
+		case opPut:
+			got[key] = value
+		case opDelete:
+			delete(got, key)
+		case opClear:
+			clear(got)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.f.Close() })
+	return s, got
+}
+
+func TestGroupWithoutCommitMarker(t *testing.T) {
+	for _, torn := range []bool{false, true} {
+		name := "missing"
+		if torn {
+			name = "torn"
+		}
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			s, _ := openTestSegments(t, dir)
+			if err := s.append(opPut, "a", "1", typeNone); err != nil {
+				t.Fatal(err)
+			}
+			before := s.active().size
+			if err := s.beginGroup(); err != nil {
+				t.Fatal(err)
+			}
+			s.append(opPut, "b", "2", typeNone)
+			s.append(opPut, "a", "3", typeNone)
+			if torn {
+				s.commitGroup()
+			}
+			path, size := s.active().path, s.active().size
+			if err := s.sync(); err != nil {
+				t.Fatal(err)
+			}
+			s.f.Close()
+			if torn {
+				if err := os.Truncate(path, size-3); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			_, got := openTestSegments(t, dir)
+			if want := map[string]string{"a": "1"}; !maps.Equal(got, want) {
+				t.Fatalf("replayed %v, want %v", got, want)
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Size() != before {
+				t.Fatalf("segment is %d bytes, want it truncated back to the group at %d", info.Size(), before)
+			}
+		})
+	}
+}
+
+func TestFailedCommitTurnsReadOnly(t *testing.T) {
+	s, _ := openTestSegments(t, t.TempDir())
+	if err := s.beginGroup(); err != nil {
+		t.Fatal(err)
+	}
+	s.append(opPut, "a", "1", typeNone)
+	ro, err := os.Open(s.active().path) // Writes to a read-only handle fail
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := s.f
+	s.f = ro
+	t.Cleanup(func() {
+		read_only.Store(false)
+		f.Close()
+	})
+	if err := s.commitGroup(); err == nil {
+		t.Fatal("commit marker written to a read-only file")
+	}
+	if !read_only.Load() {
+		t.Fatal("server still writable after a group failed to commit")
+	}
+}
+
+// writeTestSegments fills a fresh store in dir with puts and deletes spread
+// over several small segments, and returns it with the contents it holds.
+func writeTestSegments(t *testing.T, dir string) (*segmentStore, map[string]string) {
+	t.Helper()
+	s, want := openTestSegments(t, dir)
+	for i := range 60 {
+		key := fmt.Sprintf("key-%02d", i%20)
+		if i%7 == 6 {
+			if err := s.append(opDelete, key, "", typeNone); err != nil {
+				t.Fatal(err)
+			}
+			delete(want, key)
+			continue
+		}
+		value := fmt.Sprintf("value-%d", i)
+		if err := s.append(opPut, key, value, typeNone); err != nil {
+			t.Fatal(err)
+		}
+		want[key] = value
+	}
+	if len(s.segments) < 3 {
+		t.Fatalf("wrote %d segments, want several", len(s.segments))
+	}
+	if err := s.sync(); err != nil {
+		t.Fatal(err)
+	}
+	return s, want
+}
+
+func TestRecoveryTornTail(t *testing.T) {
+	withTestConfig(t, func(c *Config) { c.SegmentBytes = 512 })
+	dir := t.TempDir()
+	s, want := writeTestSegments(t, dir)
+	if err := s.append(opPut, "torn", "lost", typeNone); err != nil {
+		t.Fatal(err)
+	}
+	path, size := s.active().path, s.active().size
+	s.f.Close()
+	if err := os.Truncate(path, size-4); err != nil {
+		t.Fatal(err)
+	}
+
+	s, got := openTestSegments(t, dir)
+	if !maps.Equal(got, want) {
+		t.Fatalf("replayed %v, want %v", got, want)
+	}
+	if s.active().damaged {
+		t.Fatal("torn tail left the active segment marked damaged")
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != s.active().size {
+		t.Fatalf("segment is %d bytes, want the torn tail truncated to %d", info.Size(), s.active().size)
+	}
+	if err := s.append(opPut, "after", "v", typeNone); err != nil {
+		t.Fatal(err)
+	}
+	want["after"] = "v"
+	s.sync()
+	s.f.Close()
+	if _, got := openTestSegments(t, dir); !maps.Equal(got, want) {
+		t.Fatalf("after appending past the truncation, replayed %v, want %v", got, want)
+	}
+}
+
+func TestRecoveryDamageInPlace(t *testing.T) {
+	for _, repair := range []bool{false, true} {
+		t.Run(fmt.Sprintf("repair=%t", repair), func(t *testing.T) {
+			withTestConfig(t, func(c *Config) {
+				c.SegmentBytes = 512
+				c.Repair = repair
+			})
+			dir := t.TempDir()
+			s, _ := writeTestSegments(t, dir)
+			first := s.segments[0].path
+			s.f.Close()
+			data, err := os.ReadFile(first)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, n, _ := decodeFrame(data)
+			data[n+changeHeaderLen+segmentMetaLen] ^= 0xff // Inside the second record's key
+			if err := os.WriteFile(first, data, 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			s, _ = openTestSegments(t, dir)
+			info, err := os.Stat(first)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if repair {
+				if info.Size() != n || s.segments[0].damaged {
+					t.Fatalf("repair left the segment at %d bytes (damaged %t), want it truncated to %d", info.Size(), s.segments[0].damaged, n)
+				}
+				return
+			}
+			if info.Size() != int64(len(data)) || !s.segments[0].damaged {
+				t.Fatalf("segment is %d bytes (damaged %t), want it kept at %d and reported", info.Size(), s.segments[0].damaged, len(data))
+			}
+		})
+	}
+}
+
+func TestRecoveryCheckpointMatchesFullReplay(t *testing.T) {
+	withTestConfig(t, func(c *Config) { c.SegmentBytes = 512 })
+	dir := t.TempDir()
+	s, _ := writeTestSegments(t, dir)
+	if err := s.checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	// A tail after the checkpoint, with an open group a crash cut short
+	s.append(opPut, "key-00", "tail", typeNone)
+	s.append(opDelete, "key-01", "", typeNone)
+	s.append(opPut, "new", "tail", typeNone)
+	s.beginGroup()
+	s.append(opPut, "key-02", "uncommitted", typeNone)
+	if err := s.sync(); err != nil {
+		t.Fatal(err)
+	}
+	s.f.Close()
+
+	s, fromCheckpoint := openTestSegments(t, dir)
+	if s.checkpointed.id == 0 {
+		t.Fatal("checkpoint wasn't used")
+	}
+	if fromCheckpoint["key-02"] == "uncommitted" {
+		t.Fatal("uncommitted group replayed")
+	}
+	s.f.Close()
+	if err := os.Remove(filepath.Join(dir, checkpointFile)); err != nil {
+		t.Fatal(err)
+	}
+	if _, full := openTestSegments(t, dir); !maps.Equal(fromCheckpoint, full) {
+		t.Fatalf("checkpoint and tail replayed to %v, full replay to %v", fromCheckpoint, full)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+// Config reload. SIGHUP or POST /admin/reload resolves the configuration again
+// the way startup does (config file, environment, then the original flags,
+// which still win) and applies the fields marked reload: log level and
+// sampling, rate limits, credentials, sync policy, size limits, quotas,
+// compaction thresholds, mutex profiling and the TLS files, which are read
+// again even when their paths are unchanged. Other fields that differ are
+// reported as needing a restart. A config that doesn't validate, or TLS files
+// that don't load, leave the running config as it was. The listener, stores
+// and segment files are untouched.
+//
+// A Config is never modified once it is in use; a reload builds a copy with
+// the new values and swaps it in atomically. Each request pins the config
+// that was running when it came in (see withConfig) and its writes carry it
+// in their context down to the stores (configFrom), so the size limits,
+// quotas and sync policy it is held to come from one config, old or new,
+// never a mix. In a cluster the store size limit, quotas and sync policy are
+// those current when a write's Raft log entry is applied; background work
+// reads whichever config is current each time round.
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"runtime"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	reload_mu sync.Mutex
+	tls_certs *certReloader // nil unless the listener uses TLS
+)
+
+type ReloadResult struct {
+	Changed         []string `json:"changed"`
+	RestartRequired []string `json:"restart_required,omitempty"`
+}
+
+// reloadConfig applies the reloadable fields of a freshly loaded config.
+func reloadConfig() (ReloadResult, error) {
+	reload_mu.Lock()
+	defer reload_mu.Unlock()
+	loaded, err := loadConfig(os.Args[1:])
+	if err != nil {
+		return ReloadResult{}, err
+	}
+	if (loaded.TLSCert == "") != (tls_certs == nil) {
+		return ReloadResult{}, errors.New("turning TLS on or off needs a restart")
+	}
+
+	next := *cfg()
+	res := ReloadResult{Changed: []string{}}
+	for _, f := range configFields {
+		v := f.get(loaded)
+		if v == f.get(cfg()) {
+			continue
+		}
+		if !f.reload {
+			res.RestartRequired = append(res.RestartRequired, f.name)
+			continue
+		}
+		if err := f.set(&next, v); err != nil {
+			return ReloadResult{}, err
+		}
+		res.Changed = append(res.Changed, f.name)
+	}
+	if tls_certs != nil {
+		if err := tls_certs.reload(&next); err != nil {
+			return ReloadResult{}, err
+		}
+	}
+	live_cfg.Store(&next)
+	log_level.Set(next.LogLevel)
+	runtime.SetMutexProfileFraction(next.MutexProfileFraction)
+	if slices.Contains(res.Changed, "compact_auto") || slices.Contains(res.Changed, "compact_dead_bytes") {
+		for _, n := range allNodes() {
+			go n.compactSegments() // Pick up what the old settings held back
+		}
+	}
+	return res, nil
+}
+
+// reload runs a reload and logs the outcome.
+func reload(source string) (ReloadResult, error) {
+	res, err := reloadConfig()
+	if err != nil {
+		slog.Error("config reload failed, keeping the running config", "source", source, "error", err)
+		return res, err
+	}
+	slog.Info("config reloaded", "source", source, "changed", res.Changed)
+	if len(res.RestartRequired) > 0 {
+		slog.Warn("changed settings need a restart to take effect", "fields", res.RestartRequired)
+	}
+	return res, nil
+}
+
+func reloadOnSIGHUP() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		reload("SIGHUP")
+	}
+}
+
+// adminReloadHandler serves POST /admin/reload.
+func adminReloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+	res, err := reload("admin")
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "reload failed: "+err.Error())
+		return
+	}
+	writeJSON(w, res)
+}
+
+// syncEvery returns how often syncLoop runs.
+func syncEvery() time.Duration {
+	if cfg().SyncInterval > 0 {
+		return cfg().SyncInterval
+	}
+	return time.Second // Nothing to sync under the always policy
+}
@@ -0,0 +1,70 @@
+package main
+
+// Segment damage. A record that fails its checksum, or doesn't decode, ends
+// the replay of its segment. When nothing after it parses either, it is the
+// torn tail of an interrupted write and the active segment is truncated back
+// to the last good record, as always. Intact records after the damage mean
+// the file was corrupted in place: the segment is then left as it is, apart
+// from no longer taking appends, and the records that could not be replayed
+// are reported. Starting with -repair truncates such segments at the damage
+// instead, logging every record that is dropped, so later starts are clean.
+// In read-only mode neither happens: damaged segments are only reported.
+
+import (
+	"log/slog"
+	"os"
+)
+
+// scanDamaged looks for intact records in path after off, where replay
+// stopped. It returns them along with the number of bytes after off.
+func scanDamaged(path string, off int64) ([]segRecord, int64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	if off > int64(len(data)) {
+		return nil, 0, nil
+	}
+	rest := data[off:]
+	var found []segRecord
+	for pos := 0; pos < len(rest); {
+		if p, n, err := decodeFrame(rest[pos:]); err == nil {
+			if rec, err := decodeSegmentRecord(p); err == nil {
+				found = append(found, rec)
+				pos += int(n)
+				continue
+			}
+		}
+		pos++
+	}
+	return found, int64(len(rest)), nil
+}
+
+// damaged deals with a segment whose replay stopped at seg.size because of
+// cause.
+func (s *segmentStore) damaged(seg *segment, active bool, cause error) error {
+	found, bytes, err := scanDamaged(seg.path, seg.size)
+	if err != nil {
+		return err
+	}
+	if read_only.Load() {
+		seg.damaged = true
+		slog.Warn("segment is damaged; left as it is in read-only mode", "path", seg.path, "offset", seg.size, "bytes", bytes, "intact_records", len(found), "error", cause)
+		return nil
+	}
+	if len(found) == 0 && (active || cfg().Repair) {
+		slog.Warn("truncating damaged segment tail", "path", seg.path, "offset", seg.size, "bytes", bytes, "error", cause)
+		return os.Truncate(seg.path, seg.size)
+	}
+	if !cfg().Repair {
+		seg.damaged = true
+		slog.Error("segment is damaged; records after the damage were not loaded, start with -repair to drop them",
+			"path", seg.path, "offset", seg.size, "bytes", bytes, "intact_records", len(found), "error", cause)
+		return nil
+	}
+	for _, rec := range found {
+		slog.Warn("repair dropped record", "path", seg.path, "key", rec.key, "op", rec.op, "version", rec.ver)
+	}
+	slog.Warn("repaired damaged segment", "path", seg.path, "offset", seg.size, "dropped_bytes", bytes, "dropped_records", len(found), "error", cause)
+	return os.Truncate(seg.path, seg.size)
+}
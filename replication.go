@@ -0,0 +1,468 @@
+package main
+
+// Primary/follower replication. A server started with replica_of pointing at
+// another server becomes a read-only follower: it copies the primary's
+// contents from GET /replication/snapshot, then tails the primary's change
+// log with long-polling GET /changes requests and applies every record to
+// its own stores. Followers identify themselves with an ID the primary
+// issues with the first snapshot, so it keeps the changes they miss while
+// unreachable (handoff.go). The last applied sequence number is kept in
+// replication.json so a restarted follower resumes where it stopped; if the
+// primary has already discarded those changes the follower takes a fresh
+// snapshot instead.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	replicaPollWait   = 30 * time.Second // How long the primary holds an idle /changes request
+	replicaBatch      = 1000
+	replicaMaxBackoff = 30 * time.Second
+	maxChangesWait    = time.Minute
+)
+
+// errResync means the follower fell too far behind and needs a new snapshot.
+var errResync = errors.New("primary no longer has the changes needed; resyncing")
+
+// replica is set when this server follows a primary.
+var replica *replicator
+
+type Snapshot struct {
+	Seq      uint64                       `json:"seq"`                // Changes after this are not included
+	Stores   map[string]map[string]string `json:"stores"`             // Bucket ("" for the default store) -> contents
+	Follower string                       `json:"follower,omitempty"` // ID issued with register=true
+}
+
+type ReplicationStatus struct {
+	Role        string           `json:"role"` // "primary" or "replica"
+	Primary     string           `json:"primary,omitempty"`
+	AppliedSeq  uint64           `json:"applied_seq"`
+	PrimarySeq  uint64           `json:"primary_seq,omitempty"`
+	Lag         uint64           `json:"lag"` // Changes the replica has yet to apply
+	LastContact time.Time        `json:"last_contact,omitzero"`
+	LastError   string           `json:"last_error,omitempty"`
+	Followers   []FollowerStatus `json:"followers,omitempty"` // On a primary, the replicas following it
+}
+
+type replicator struct {
+	primary string // Base URL of the primary
+	id      string // Identifies this replica to the primary, see handoff.go
+	client  *http.Client
+
+	mu           sync.Mutex
+	applied      uint64
+	primary_seq  uint64
+	synced       bool // applied refers to the primary's log
+	last_contact time.Time
+	last_error   string
+}
+
+type replicationState struct {
+	Primary  string `json:"primary"`
+	Seq      uint64 `json:"seq"`
+	Follower string `json:"follower,omitempty"`
+}
+
+func replicationFile() string {
+	return filepath.Join(cfg().DataDir, "replication.json")
+}
+
+// primaryURL turns a replica_of value into a base URL; host:port means plain
+// HTTP.
+func baseURL(addr string) string {
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	return strings.TrimSuffix(addr, "/")
+}
+
+func newReplicator(addr string) *replicator {
+	r := &replicator{
+		primary: baseURL(addr),
+		client:  &http.Client{Timeout: replicaPollWait + 30*time.Second},
+	}
+	if cfg().Memory {
+		return r // Nothing was kept, so start with a full sync
+	}
+	data, err := os.ReadFile(replicationFile())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Error("failed to read replication state", "error", err)
+		}
+		return r
+	}
+	var st replicationState
+	if err := json.Unmarshal(data, &st); err != nil {
+		slog.Error("failed to parse replication state", "error", err)
+		return r
+	}
+	if st.Follower != "" {
+		r.id = st.Follower
+	}
+	if st.Primary == r.primary {
+		r.applied, r.synced = st.Seq, true
+	}
+	return r
+}
+
+func (r *replicator) saveState() error {
+	if cfg().Memory {
+		return nil
+	}
+	r.mu.Lock()
+	data, err := json.Marshal(replicationState{Primary: r.primary, Seq: r.applied, Follower: r.id})
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp := replicationFile() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, replicationFile())
+}
+
+// run follows the primary until ctx is cancelled, backing off while it is
+// unreachable.
+func (r *replicator) run(ctx context.Context) {
+	slog.Info("replicating from primary", "primary", r.primary, "applied_seq", r.applied)
+	backoff := time.Second
+	for ctx.Err() == nil {
+		err := r.step(ctx)
+		r.mu.Lock()
+		if err != nil {
+			r.last_error = err.Error()
+		} else {
+			r.last_error = ""
+		}
+		r.mu.Unlock()
+
+		switch {
+		case err == nil:
+			backoff = time.Second
+		case errors.Is(err, errResync):
+			slog.Warn("replica fell behind the primary's change log", "primary", r.primary)
+			r.mu.Lock()
+			r.synced = false
+			r.mu.Unlock()
+		case ctx.Err() != nil:
+			return
+		default:
+			slog.Error("replication failed", "primary", r.primary, "error", err, "retry_in", backoff)
+			select {
+			case <-ctx.Done():
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, replicaMaxBackoff)
+		}
+	}
+}
+
+// step takes a snapshot if needed, otherwise applies the next batch of
+// changes.
+func (r *replicator) step(ctx context.Context) error {
+	r.mu.Lock()
+	synced, since := r.synced, r.applied
+	r.mu.Unlock()
+	if !synced {
+		return r.resync(ctx)
+	}
+
+	q := url.Values{}
+	q.Set("since", strconv.FormatUint(since, 10))
+	q.Set("limit", strconv.Itoa(replicaBatch))
+	q.Set("bucket", "*")
+	q.Set("wait", replicaPollWait.String())
+	if r.id != "" {
+		q.Set("follower", r.id)
+	}
+	q.Set("key_encoding", "base64") // Binary keys don't survive JSON otherwise
+	var page ChangesPage
+	if err := r.fetch(ctx, "/changes?"+q.Encode(), &page); err != nil {
+		return err
+	}
+	for _, ev := range page.Changes {
+		key, err := decodeBase64Key(ev.Key)
+		if err != nil {
+			return fmt.Errorf("change %d has a bad key: %w", ev.Seq, err)
+		}
+		ev.Key = key
+		if err := applyChange(ev); err != nil {
+			return fmt.Errorf("applying change %d: %w", ev.Seq, err)
+		}
+		r.mu.Lock()
+		r.applied = ev.Seq
+		r.mu.Unlock()
+	}
+	r.mu.Lock()
+	r.applied = max(r.applied, page.Next)
+	r.primary_seq = page.LastSeq
+	r.mu.Unlock()
+	if page.Next == since {
+		return nil
+	}
+	return r.saveState()
+}
+
+// resync replaces every local store with a snapshot of the primary.
+func (r *replicator) resync(ctx context.Context) error {
+	var snap Snapshot
+	if err := r.fetch(ctx, "/replication/snapshot?key_encoding=base64&register=true&follower="+r.id, &snap); err != nil {
+		return err
+	}
+	for bucket, data := range snap.Stores {
+		decoded := make(map[string]string, len(data))
+		for k, v := range data {
+			key, err := decodeBase64Key(k)
+			if err != nil {
+				return fmt.Errorf("snapshot has a bad key: %w", err)
+			}
+			decoded[key] = v
+		}
+		snap.Stores[bucket] = decoded
+	}
+	if err := restoreSnapshot(snap); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.applied, r.primary_seq, r.synced = snap.Seq, snap.Seq, true
+	if snap.Follower != "" {
+		r.id = snap.Follower
+	}
+	r.mu.Unlock()
+	slog.Info("replica synced from snapshot", "primary", r.primary, "seq", snap.Seq, "stores", len(snap.Stores))
+	return r.saveState()
+}
+
+func (r *replicator) fetch(ctx context.Context, path string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.primary+path, nil)
+	if err != nil {
+		return err
+	}
+	if cfg().ReplicaAPIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg().ReplicaAPIKey)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusGone:
+		return errResync
+	default:
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("primary returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	r.mu.Lock()
+	r.last_contact = time.Now()
+	r.mu.Unlock()
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// applyChange replays a change read from the primary's log.
+func applyChange(ev ChangeEvent) error {
+	if ev.Op == "drop_bucket" {
+		if err := deleteBucket(ev.Bucket); err != nil && !errors.Is(err, ErrBucketNotFound) {
+			return err
+		}
+		return nil
+	}
+	nodes := server_nodes
+	if ev.Bucket != "" {
+		var err error
+		if nodes, err = bucketNodes(ev.Bucket, true); err != nil {
+			return err
+		}
+	}
+	switch ev.Op {
+	case "put":
+		return putTyped(context.Background(), ev.Key, ev.Value, ev.Type, nodes)
+	case "delete":
+		if err := deleteVal(context.Background(), ev.Key, nodes); err != nil && !errors.Is(err, ErrKeyNotFound) {
+			return err
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown op %q", ev.Op)
+}
+
+// restoreSnapshot replaces every store with the contents of snap, dropping
+// buckets it doesn't have.
+func restoreSnapshot(snap Snapshot) error {
+	for bucket, data := range snap.Stores {
+		nodes := server_nodes
+		if bucket != "" {
+			var err error
+			if nodes, err = bucketNodes(bucket, true); err != nil {
+				return err
+			}
+		}
+		if err := loadSnapshot(data, nodes); err != nil {
+			return err
+		}
+	}
+	for _, b := range listBuckets() {
+		if _, ok := snap.Stores[b.Name]; !ok {
+			if err := deleteBucket(b.Name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// loadSnapshot replaces the contents of nodes with data. Size limits are not
+// enforced since the primary already accepted these values.
+func loadSnapshot(data map[string]string, nodes []*ServerNode) error {
+	parts := make(map[*ServerNode]map[string]string, len(nodes))
+	for _, n := range nodes {
+		parts[n] = make(map[string]string)
+	}
+	for k, v := range data {
+		n := getServerKey(k, nodes)
+		if n == nil {
+			return errors.New("no node found for key")
+		}
+		parts[n][k] = v
+	}
+
+	var errs []error
+	for n, part := range parts {
+		n.mu.Lock()
+		n.node_store = part
+		clearReadCache()
+		size := int64(0)
+		for k, v := range part {
+			size += int64(len(k) + len(v))
+		}
+		n.setSizeLocked(size)
+		n.rebuildIndexesLocked()
+		n.rebuildUseLocked()
+		n.rebuildAccessLocked(keyStatsSnapshot{})
+		n.rebuildBloomLocked()
+		errs = append(errs, n.rewriteLocked())
+		n.mu.Unlock()
+	}
+	return errors.Join(errs...)
+}
+
+// snapshot copies every store as of one sequence number (see iterator.go).
+func snapshot() Snapshot {
+	seq, stores := freeze(allNodes(), "")
+	snap := Snapshot{Seq: seq, Stores: map[string]map[string]string{}}
+	for _, fs := range stores {
+		if snap.Stores[fs.bucket] == nil {
+			snap.Stores[fs.bucket] = fs.data
+		} else {
+			maps.Copy(snap.Stores[fs.bucket], fs.data)
+		}
+	}
+	if snap.Stores[""] == nil {
+		snap.Stores[""] = map[string]string{}
+	}
+	return snap
+}
+
+func replicationStatus() ReplicationStatus {
+	if replica == nil {
+		changes.mu.Lock()
+		seq := changes.seq
+		changes.mu.Unlock()
+		return ReplicationStatus{Role: "primary", AppliedSeq: seq, Followers: followers.status(seq)}
+	}
+	replica.mu.Lock()
+	defer replica.mu.Unlock()
+	st := ReplicationStatus{
+		Role:        "replica",
+		Primary:     replica.primary,
+		AppliedSeq:  replica.applied,
+		PrimarySeq:  replica.primary_seq,
+		LastContact: replica.last_contact,
+		LastError:   replica.last_error,
+	}
+	if st.PrimarySeq > st.AppliedSeq {
+		st.Lag = st.PrimarySeq - st.AppliedSeq
+	}
+	return st
+}
+
+func snapshotHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+	id := r.URL.Query().Get("follower")
+	if id != "" && !validFollowerID(id) {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "invalid follower")
+		return
+	}
+	register, err := strconv.ParseBool(r.URL.Query().Get("register"))
+	if err != nil && r.URL.Query().Has("register") {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "register must be true or false")
+		return
+	}
+	if (id != "" || register) && !replicaScope(r) {
+		writeError(w, r, http.StatusForbidden, codeForbidden, "forbidden: following needs replication credentials")
+		return
+	}
+	if _, err := keyBase64(r); err != nil {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+	snap := snapshot()
+	if !adminScope(r) {
+		delete(snap.Stores, systemBucket)
+	}
+	switch {
+	case register:
+		if snap.Follower, err = followers.register(id, r.RemoteAddr, snap.Seq); err != nil {
+			writeError(w, r, http.StatusServiceUnavailable, codeTooManyFollowers, err.Error())
+			return
+		}
+	case id != "" && !followers.seen(id, r.RemoteAddr, snap.Seq):
+		writeError(w, r, http.StatusNotFound, codeUnknownFollower, "unknown follower; take a snapshot with register=true")
+		return
+	}
+	for bucket, data := range snap.Stores {
+		snap.Stores[bucket] = encodeKeyMap(r, data)
+	}
+	writeJSON(w, snap)
+}
+
+func adminReplicationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSON(w, replicationStatus())
+}
+
+// replicaReadOnly rejects writes on a follower; they must go to the primary.
+// Admin endpoints stay available since they only touch local state.
+func replicaReadOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if replica != nil && requiredAccess(r) == accessWrite && !strings.HasPrefix(r.URL.Path, "/admin/") {
+			writeError(w, r, http.StatusForbidden, codeReadOnly, "read-only replica; send writes to "+replica.primary)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
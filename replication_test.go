@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestReplicaAppliesBucketDrop(t *testing.T) {
+	const bucket = "repl-drop"
+	if w := do(http.MethodPut, "/b/"+bucket+"/k", `{"value":"v"}`); w.Code != http.StatusOK {
+		t.Fatalf("PUT: %d %s", w.Code, w.Body)
+	}
+	var before ChangesPage
+	json.Unmarshal(do(http.MethodGet, "/changes?bucket="+bucket, "").Body.Bytes(), &before)
+	if w := do(http.MethodDelete, "/b/"+bucket, ""); w.Code != http.StatusOK {
+		t.Fatalf("DELETE bucket: %d %s", w.Code, w.Body)
+	}
+
+	// The primary's feed carries the drop.
+	var feed ChangesPage
+	w := do(http.MethodGet, "/changes?key_encoding=base64&bucket=*&since="+strconv.FormatUint(before.Next, 10), "")
+	if err := json.Unmarshal(w.Body.Bytes(), &feed); err != nil || len(feed.Changes) != 1 {
+		t.Fatalf("changes after the drop: %d %s", w.Code, w.Body)
+	}
+	if ev := feed.Changes[0]; ev.Op != "drop_bucket" || ev.Bucket != bucket || ev.Key != "" {
+		t.Fatalf("change after the drop is %+v", ev)
+	}
+	if w := do(http.MethodGet, "/changes?bucket="+bucket+"&prefix=k&since="+strconv.FormatUint(before.Next, 10), ""); !strings.Contains(w.Body.String(), "drop_bucket") {
+		t.Fatalf("drop missing from a prefix read: %s", w.Body)
+	}
+
+	// A replica still holding the bucket drops it too.
+	nodes, err := bucketNodes(bucket, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := put(context.Background(), "k", "v", nodes); err != nil {
+		t.Fatal(err)
+	}
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, feed)
+	}))
+	defer primary.Close()
+	t.Cleanup(func() { os.Remove(replicationFile()) })
+	rep := &replicator{primary: primary.URL, id: "replica-test", client: primary.Client(), applied: before.Next, synced: true}
+	if err := rep.step(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bucketNodes(bucket, false); !errors.Is(err, ErrBucketNotFound) {
+		t.Fatalf("bucket still on the replica (%v)", err)
+	}
+	if rep.applied != feed.Changes[0].Seq {
+		t.Fatalf("replica applied up to %d, want %d", rep.applied, feed.Changes[0].Seq)
+	}
+}
+
+func TestFollowerRegistration(t *testing.T) {
+	var issued []string
+	t.Cleanup(func() {
+		followers.mu.Lock()
+		for _, id := range issued {
+			followers.dropLocked(id)
+		}
+		followers.saveLocked()
+		followers.mu.Unlock()
+	})
+
+	if w := do(http.MethodGet, "/changes?follower=made-up", ""); w.Code != http.StatusGone {
+		t.Fatalf("changes for an unissued follower: %d %s", w.Code, w.Body)
+	}
+	if w := do(http.MethodGet, "/replication/snapshot?follower=made-up", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("snapshot for an unissued follower: %d %s", w.Code, w.Body)
+	}
+
+	var snap Snapshot
+	w := do(http.MethodGet, "/replication/snapshot?register=true&follower=made-up", "")
+	if err := json.Unmarshal(w.Body.Bytes(), &snap); err != nil || snap.Follower == "" || snap.Follower == "made-up" {
+		t.Fatalf("register: %d %s", w.Code, w.Body)
+	}
+	issued = append(issued, snap.Follower)
+	if w := do(http.MethodGet, "/changes?follower="+snap.Follower, ""); w.Code != http.StatusOK {
+		t.Fatalf("changes for an issued follower: %d %s", w.Code, w.Body)
+	}
+	var again Snapshot
+	json.Unmarshal(do(http.MethodGet, "/replication/snapshot?register=true&follower="+snap.Follower, "").Body.Bytes(), &again)
+	if again.Follower != snap.Follower {
+		t.Fatalf("registering again issued %q, want %q kept", again.Follower, snap.Follower)
+	}
+
+	for range maxFollowers {
+		var s Snapshot
+		w := do(http.MethodGet, "/replication/snapshot?register=true", "")
+		if w.Code == http.StatusServiceUnavailable {
+			break
+		}
+		json.Unmarshal(w.Body.Bytes(), &s)
+		issued = append(issued, s.Follower)
+	}
+	if w := do(http.MethodGet, "/replication/snapshot?register=true", ""); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("register past %d followers: %d", maxFollowers, w.Code)
+	}
+}
+
+func TestFollowerNeedsReplicaScope(t *testing.T) {
+	withTestConfig(t, func(c *Config) { c.APIKeysRW = []string{"rw-secret"} })
+	var created NewAPIKey
+	r := httptest.NewRequest(http.MethodPost, "/admin/apikeys", strings.NewReader(`{"buckets":["*"],"access":"read"}`))
+	r.Header.Set("Authorization", "Bearer rw-secret")
+	w := httptest.NewRecorder()
+	test_handler.ServeHTTP(w, r)
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil || created.Key == "" {
+		t.Fatalf("creating a scoped key: %d %s", w.Code, w.Body)
+	}
+	t.Cleanup(func() {
+		r := httptest.NewRequest(http.MethodDelete, "/admin/apikeys?id="+created.ID, nil)
+		r.Header.Set("Authorization", "Bearer rw-secret")
+		test_handler.ServeHTTP(httptest.NewRecorder(), r)
+	})
+
+	for _, target := range []string{"/changes?follower=abc", "/changes?bucket=x&follower=abc"} {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		r.Header.Set("Authorization", "Bearer "+created.Key)
+		w := httptest.NewRecorder()
+		test_handler.ServeHTTP(w, r)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("GET %s with a scoped key: %d %s", target, w.Code, w.Body)
+		}
+	}
+}
+
+// TestChangeLogFailureTurnsReadOnly checks that a write the change log can't
+// record fails and stops further writes, since followers would never see it.
+func TestChangeLogFailureTurnsReadOnly(t *testing.T) {
+	changes.mu.Lock()
+	l := changes.log
+	changes.mu.Unlock()
+	ro, err := os.Open(l.path) // Appends to a read-only handle fail
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.mu.Lock()
+	f := l.f
+	l.f = ro
+	l.mu.Unlock()
+	t.Cleanup(func() {
+		l.mu.Lock()
+		l.f = f
+		l.mu.Unlock()
+		ro.Close()
+		read_only.Store(false)
+	})
+
+	if w := do(http.MethodPut, "/b/feed-fail/k", `{"value":"v"}`); w.Code != http.StatusInternalServerError {
+		t.Fatalf("PUT with a failing change log: %d %s", w.Code, w.Body)
+	}
+	if !read_only.Load() {
+		t.Fatal("server still writable after the change log failed")
+	}
+	if w := do(http.MethodPut, "/b/feed-fail/k2", `{"value":"v"}`); w.Code != http.StatusForbidden {
+		t.Fatalf("PUT after the failure: %d %s", w.Code, w.Body)
+	}
+}
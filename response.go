@@ -0,0 +1,184 @@
+package main
+
+// Response formats. Clients get plain text by default, as they always have;
+// those sending Accept: application/json get errors as
+// {"error":{"code":"KEY_NOT_FOUND","message":"key not found"}}, write
+// confirmations as {"ok":true,"message":"..."} and values as
+// {"key":"k","value":"v","etag":"..."} along with the value's type, version
+// and write time when they are known (see valuetype.go). Endpoints that
+// already answer in JSON are the same either way. The codes are stable;
+// messages may change.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Machine-readable error codes.
+const (
+	codeBadRequest           = "BAD_REQUEST"
+	codeMethodNotAllowed     = "METHOD_NOT_ALLOWED"
+	codeUnauthorized         = "UNAUTHORIZED"
+	codeForbidden            = "FORBIDDEN"
+	codeReadOnly             = "READ_ONLY"
+	codeRateLimited          = "RATE_LIMITED"
+	codeKeyNotFound          = "KEY_NOT_FOUND"
+	codeVersionNotFound      = "VERSION_NOT_FOUND"
+	codeInvalidBucket        = "INVALID_BUCKET"
+	codeBucketNotFound       = "BUCKET_NOT_FOUND"
+	codeNoIndex              = "NO_INDEX"
+	codeHistoryUnavailable   = "HISTORY_UNAVAILABLE"
+	codePreconditionFailed   = "PRECONDITION_FAILED"
+	codeUnsupportedMediaType = "UNSUPPORTED_MEDIA_TYPE"
+	codeNotJSON              = "NOT_JSON"
+	codeTypeMismatch         = "TYPE_MISMATCH"
+	codeStoreFull            = "STORE_FULL"
+	codeQuotaExceeded        = "QUOTA_EXCEEDED"
+	codeKeyTooLarge          = "KEY_TOO_LARGE"
+	codeValueTooLarge        = "VALUE_TOO_LARGE"
+	codeChangesTrimmed       = "CHANGES_TRIMMED"
+	codeUnknownFollower      = "UNKNOWN_FOLLOWER"
+	codeTooManyFollowers     = "TOO_MANY_FOLLOWERS"
+	codeClusterDisabled      = "CLUSTER_DISABLED"
+	codeBackupsDisabled      = "BACKUPS_DISABLED"
+	codeBackupFailed         = "BACKUP_FAILED"
+	codeCompactionRunning    = "COMPACTION_RUNNING"
+	codeKeyStatsDisabled     = "KEY_STATS_DISABLED"
+	codeGossipDisabled       = "GOSSIP_DISABLED"
+	codeNotLeader            = "NOT_LEADER"
+	codeNoLeader             = "NO_LEADER"
+	codeBackendUnavailable   = "BACKEND_UNAVAILABLE"
+	codeBadGateway           = "BAD_GATEWAY"
+	codeNotProxied           = "NOT_PROXIED"
+	codeTimeout              = "TIMEOUT"
+	codeInternal             = "INTERNAL_ERROR"
+)
+
+type errorBody struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type errorResponse struct {
+	Error errorBody `json:"error"`
+}
+
+type messageBody struct {
+	OK      bool   `json:"ok"`
+	Message string `json:"message"`
+}
+
+type valueBody struct {
+	Key      string    `json:"key"`
+	Value    string    `json:"value"`
+	Type     valueType `json:"type,omitempty"`
+	Version  uint64    `json:"version,omitempty"`
+	Modified time.Time `json:"modified,omitzero"`
+	ETag     string    `json:"etag"`
+}
+
+// wantsJSON reports whether the client asked for JSON responses.
+func wantsJSON(r *http.Request) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mt, _, err := mime.ParseMediaType(strings.TrimSpace(part)); err == nil && mt == "application/json" {
+			return true
+		}
+	}
+	return false
+}
+
+// writeError answers with an error in the format the client negotiated.
+func writeError(w http.ResponseWriter, r *http.Request, status int, code string, message string) {
+	if !wantsJSON(r) {
+		http.Error(w, message, status)
+		return
+	}
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(errorResponse{errorBody{code, message}}); err != nil {
+		slog.Error("failed to encode response", "error", err)
+	}
+}
+
+// writeMessage confirms a successful request.
+func writeMessage(w http.ResponseWriter, r *http.Request, message string) {
+	if wantsJSON(r) {
+		writeJSON(w, messageBody{true, message})
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(message))
+}
+
+// writeValue answers a read of key. The body is left out for HEAD.
+func writeValue(w http.ResponseWriter, r *http.Request, key string, value string, meta valueMeta) {
+	if wantsJSON(r) {
+		if r.Method == http.MethodHead {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		writeJSON(w, valueBody{encodeKey(r, key), value, meta.typ, meta.version, meta.modified, etagOf(value)})
+		return
+	}
+	w.Header().Set("Content-Type", meta.typ.contentType())
+	w.Header().Set("Content-Length", strconv.Itoa(len(value)))
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		w.Write([]byte(value))
+	}
+}
+
+// writeStoreError answers with the status and code for an error returned by
+// the store.
+func writeStoreError(w http.ResponseWriter, r *http.Request, err error) {
+	c := requestConfig(r)
+	switch {
+	case errors.Is(err, ErrKeyNotFound):
+		writeError(w, r, http.StatusNotFound, codeKeyNotFound, "key not found")
+	case errors.Is(err, ErrVersionNotFound):
+		writeError(w, r, http.StatusNotFound, codeVersionNotFound, "version not found")
+	case errors.Is(err, ErrNoHistory):
+		writeError(w, r, http.StatusBadRequest, codeHistoryUnavailable, err.Error())
+	case errors.Is(err, ErrNoTimestamps), errors.Is(err, ErrUnknownMerge), errors.Is(err, ErrInvalidOperand):
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, err.Error())
+	case errors.Is(err, ErrInvalidBucket):
+		writeError(w, r, http.StatusBadRequest, codeInvalidBucket, "invalid bucket name")
+	case errors.Is(err, ErrBucketNotFound):
+		writeError(w, r, http.StatusNotFound, codeBucketNotFound, "bucket not found")
+	case errors.Is(err, ErrTypeMismatch):
+		writeError(w, r, http.StatusBadRequest, codeTypeMismatch, err.Error())
+	case errors.Is(err, ErrNotJSON):
+		writeError(w, r, http.StatusConflict, codeNotJSON, err.Error())
+	case errors.Is(err, ErrPreconditionFailed):
+		writeError(w, r, http.StatusPreconditionFailed, codePreconditionFailed, "precondition failed")
+	case errors.Is(err, ErrStoreFull):
+		writeError(w, r, http.StatusInsufficientStorage, codeStoreFull, "store full")
+	case errors.Is(err, ErrQuotaExceeded):
+		writeError(w, r, http.StatusInsufficientStorage, codeQuotaExceeded, "bucket quota exceeded")
+	case errors.Is(err, ErrKeyTooLarge):
+		writeError(w, r, http.StatusRequestEntityTooLarge, codeKeyTooLarge, fmt.Sprintf("key exceeds %d bytes", c.MaxKeyBytes))
+	case errors.Is(err, ErrValueTooLarge):
+		writeError(w, r, http.StatusRequestEntityTooLarge, codeValueTooLarge, fmt.Sprintf("value exceeds %d bytes", c.MaxValueBytes))
+	case errors.Is(err, context.DeadlineExceeded):
+		writeError(w, r, http.StatusGatewayTimeout, codeTimeout, "request timed out")
+	case errors.Is(err, context.Canceled):
+		writeError(w, r, http.StatusServiceUnavailable, codeTimeout, "request canceled")
+	case errors.Is(err, ErrReadOnly):
+		writeError(w, r, http.StatusForbidden, codeReadOnly, "server is in read-only mode")
+	case errors.Is(err, ErrNotLeader):
+		writeError(w, r, http.StatusServiceUnavailable, codeNotLeader, ErrNotLeader.Error())
+	default:
+		writeError(w, r, http.StatusInternalServerError, codeInternal, "internal server error")
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+// A minimal S3 client for backups: just enough of the API (PutObject,
+// GetObject and ListObjectsV2) with AWS Signature Version 4 signing to talk
+// to AWS S3 or an S3-compatible store such as MinIO. With backup_endpoint
+// unset, requests go to the AWS endpoint for backup_region with the bucket
+// in the host name; a custom endpoint is addressed with the bucket in the
+// path, which S3-compatible stores generally expect.
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const s3TimeFormat = "20060102T150405Z"
+
+type s3Client struct {
+	endpoint     *url.URL
+	pathStyle    bool
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	client       *http.Client
+}
+
+// S3Error is an error response from S3.
+type S3Error struct {
+	Status  int
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *S3Error) Error() string {
+	return fmt.Sprintf("s3: %d %s: %s", e.Status, e.Code, e.Message)
+}
+
+// parseS3URL splits s3://bucket/key into the bucket and key.
+func parseS3URL(s string) (bucket string, key string, err error) {
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme != "s3" || u.Host == "" {
+		return "", "", fmt.Errorf("%q is not an s3://bucket/key URL", s)
+	}
+	return u.Host, strings.TrimPrefix(u.Path, "/"), nil
+}
+
+func newS3Client() (*s3Client, error) {
+	c := &s3Client{
+		region:       cfg().BackupRegion,
+		accessKey:    cfg().BackupAccessKeyID,
+		secretKey:    cfg().BackupSecretAccessKey,
+		sessionToken: cfg().BackupSessionToken,
+		client:       &http.Client{Timeout: 10 * time.Minute},
+	}
+	endpoint := cfg().BackupEndpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + c.region + ".amazonaws.com"
+	} else {
+		c.pathStyle = true
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("backup_endpoint %q must be an http(s) URL", endpoint)
+	}
+	c.endpoint = u
+	return c, nil
+}
+
+// objectURL returns the URL of key in bucket, or of the bucket itself when
+// key is empty. The path is escaped as it will be signed.
+func (c *s3Client) objectURL(bucket string, key string) *url.URL {
+	u := *c.endpoint
+	if c.pathStyle {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + bucket + "/" + key
+	} else {
+		u.Host = bucket + "." + u.Host
+		u.Path = "/" + key
+	}
+	u.RawPath = s3Escape(u.Path, true)
+	return &u
+}
+
+func (c *s3Client) put(ctx context.Context, bucket string, key string, body []byte, contentType string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, c.objectURL(bucket, key).String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	resp, err := c.do(req, body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// get returns the body of an object; the caller closes it.
+func (c *s3Client) get(ctx context.Context, bucket string, key string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.objectURL(bucket, key).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(req, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// list returns the keys in bucket starting with prefix, sorted.
+func (c *s3Client) list(ctx context.Context, bucket string, prefix string) ([]string, error) {
+	var keys []string
+	token := ""
+	for {
+		u := c.objectURL(bucket, "")
+		q := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		u.RawQuery = q.Encode()
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := c.do(req, nil)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Contents []struct {
+				Key string `xml:"Key"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("s3: bad list response: %w", err)
+		}
+		for _, obj := range page.Contents {
+			keys = append(keys, obj.Key)
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			break
+		}
+		token = page.NextContinuationToken
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// do signs and sends req, turning error responses into *S3Error.
+func (c *s3Client) do(req *http.Request, body []byte) (*http.Response, error) {
+	c.sign(req, body, time.Now())
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	e := &S3Error{Status: resp.StatusCode}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if xml.Unmarshal(msg, e) != nil || e.Code == "" {
+		e.Code, e.Message = http.StatusText(resp.StatusCode), strings.TrimSpace(string(msg))
+	}
+	return nil, e
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Escape percent-encodes s the way SigV4 canonical requests want it.
+func s3Escape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		if ch >= 'A' && ch <= 'Z' || ch >= 'a' && ch <= 'z' || ch >= '0' && ch <= '9' ||
+			ch == '-' || ch == '_' || ch == '.' || ch == '~' || (ch == '/' && keepSlash) {
+			b.WriteByte(ch)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", ch)
+		}
+	}
+	return b.String()
+}
+
+// sign adds AWS Signature Version 4 headers to req. Every header already set
+// on req is signed along with the host.
+func (c *s3Client) sign(req *http.Request, body []byte, now time.Time) {
+	if c.accessKey == "" {
+		return // Anonymous access
+	}
+	sum := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(sum[:])
+	stamp := now.UTC().Format(s3TimeFormat)
+	req.Header.Set("X-Amz-Date", stamp)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if c.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.Join(values, ",")
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonHeaders strings.Builder
+	for _, name := range names {
+		canonHeaders.WriteString(name + ":" + strings.TrimSpace(headers[name]) + "\n")
+	}
+	signed := strings.Join(names, ";")
+
+	query := req.URL.Query()
+	params := make([]string, 0, len(query))
+	for k, vs := range query {
+		for _, v := range vs {
+			params = append(params, s3Escape(k, false)+"="+s3Escape(v, false))
+		}
+	}
+	sort.Strings(params)
+	canonical := strings.Join([]string{req.Method, req.URL.EscapedPath(), strings.Join(params, "&"), canonHeaders.String(), signed, payloadHash}, "\n")
+
+	scope := stamp[:8] + "/" + c.region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + stamp + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), stamp[:8])
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKey, scope, signed, hex.EncodeToString(hmacSHA256(key, toSign))))
+}
@@ -0,0 +1,862 @@
+package main
+
+// Segmented storage. Each node store (and each bucket's store) lives in its
+// own directory of numbered segment files (<node>.segments/00000001.seg, ...).
+// Writes are appended to the newest, active segment using the same
+// length+checksum framing as the change log; once it reaches segment_bytes it
+// is sealed and a new one is started, so a store is never rewritten as a
+// whole. idx records where the current record of every key lives, which lets
+// each segment count its live bytes. A sealed segment that is mostly garbage
+// is compacted on its own by copying its live records to the active segment
+// and removing the file. Startup replays the segments oldest first. Every
+// record carries the key's version number and write time; when history
+// retention is on, older versions stay referenced (see history.go) and are
+// copied forward by compaction like current ones.
+// Writes that must survive a crash together, like a batch or a rewrite, are
+// bracketed by begin and commit markers: a group is written to one segment,
+// which isn't sealed until the group is committed, and replay applies its
+// records only once it reaches the commit marker, rolling back (and
+// truncating) a group that a crash cut short instead of indexing half of it.
+// Compaction needs no group of its own, since copying a record forward twice
+// replays to the same state.
+// Segments use plain file reads and writes rather than memory mapping, and
+// files are closed before they are renamed or removed, so the store behaves
+// the same on Windows as on Unix.
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	segmentSuffix    = ".seg"
+	segmentDirSuffix = ".segments"
+	segmentFixedLen  = 1 + 4             // Op and key length, for records written before versions
+	segmentMetaLen   = 1 + 1 + 8 + 8 + 4 // Op, flags, version, time and key length
+	opClear          = byte(3)
+	opBegin          = byte(4)    // Opens a group of records, see beginGroup
+	opCommit         = byte(5)    // Closes a group; the value holds its record count
+	opVersioned      = byte(0x80) // Set on the op of records laid out with segmentMetaLen
+	recHistoric      = byte(1)    // Flag: an older version copied forward by compaction
+	recTypeMask      = byte(0x0e) // Flags: the value's type tag shifted left by one, see valuetype.go
+	recGrouped       = byte(0x10) // Flag: written inside a group, see beginGroup
+	compactRatio     = 0.5        // Garbage share at which a sealed segment is compacted
+)
+
+type segment struct {
+	id   uint32
+	path string
+	size int64
+	live int64 // Bytes of records that idx or hist still point at
+
+	damaged bool // Replay stopped short of the end, see repair.go
+	missing bool // Stands in for the first segment of a store loaded read-only, not created yet
+}
+
+type segLoc struct {
+	seg  uint32
+	off  int64 // Offset of the record's frame
+	size int64 // Framed length
+	ver  uint64
+	ts   int64 // Unix nanoseconds of the write, 0 for records without versions
+	del  bool  // A tombstone, only kept in hist
+	typ  valueType
+}
+
+type segRecord struct {
+	op       byte
+	historic bool // Never replaces the current version on replay
+	grouped  bool // Part of the group opened by the last begin marker
+	ver      uint64
+	ts       int64
+	typ      valueType
+	key      string
+	value    string
+}
+
+// segmentStore holds the segment files of one node store. Callers serialize
+// access with the owning node's lock.
+type segmentStore struct {
+	dir      string
+	segments []*segment // Oldest first; the last one takes appends
+	f        *os.File   // Active segment
+	idx      map[string]segLoc
+	hist     map[string][]segLoc // Older versions by key, oldest first
+	sealed   bool                // A segment was sealed since the last compaction check
+	cleared  uint32              // Segment holding the latest clear marker, 0 if none
+	grouping bool                // A group was begun and not committed yet
+	grouped  uint32              // Records written in the open group
+
+	checkpointed segSize // End of the active segment at the last checkpoint
+	synced       int64   // End of the active segment at the last sync
+	readOnly     bool    // f was opened for reading only, see openActive
+}
+
+func segmentPath(dir string, id uint32) string {
+	return filepath.Join(dir, fmt.Sprintf("%08d%s", id, segmentSuffix))
+}
+
+func encodeSegmentRecord(rec segRecord) []byte {
+	p := make([]byte, segmentMetaLen+len(rec.key)+len(rec.value))
+	p[0] = rec.op | opVersioned
+	if rec.historic {
+		p[1] = recHistoric
+	}
+	p[1] |= byte(rec.typ) << 1 & recTypeMask
+	if rec.grouped {
+		p[1] |= recGrouped
+	}
+	binary.LittleEndian.PutUint64(p[2:], rec.ver)
+	binary.LittleEndian.PutUint64(p[10:], uint64(rec.ts))
+	binary.LittleEndian.PutUint32(p[18:], uint32(len(rec.key)))
+	n := copy(p[segmentMetaLen:], rec.key)
+	copy(p[segmentMetaLen+n:], rec.value)
+	return frame(p)
+}
+
+func decodeSegmentRecord(p []byte) (segRecord, error) {
+	if len(p) == 0 {
+		return segRecord{}, ErrCorruptRecord
+	}
+	var rec segRecord
+	fixed := segmentFixedLen
+	if p[0]&opVersioned != 0 {
+		fixed = segmentMetaLen
+	}
+	if len(p) < fixed {
+		return segRecord{}, ErrCorruptRecord
+	}
+	rec.op = p[0] &^ opVersioned
+	if fixed == segmentMetaLen {
+		rec.historic = p[1]&recHistoric != 0
+		rec.grouped = p[1]&recGrouped != 0
+		rec.typ = valueType(p[1] & recTypeMask >> 1)
+		rec.ver = binary.LittleEndian.Uint64(p[2:])
+		rec.ts = int64(binary.LittleEndian.Uint64(p[10:]))
+	}
+	keyLen := uint64(binary.LittleEndian.Uint32(p[fixed-4:]))
+	if keyLen > uint64(len(p)-fixed) {
+		return segRecord{}, ErrCorruptRecord
+	}
+	if rec.op != opPut && rec.op != opDelete && rec.op != opClear && rec.op != opBegin && rec.op != opCommit {
+		return segRecord{}, ErrCorruptRecord
+	}
+	rest := p[fixed:]
+	rec.key, rec.value = string(rest[:keyLen]), string(rest[keyLen:])
+	return rec, nil
+}
+
+// openSegments replays every segment in dir through apply, oldest first, and
+// opens the newest one for appending. Segments covered by the index
+// checkpoint are skipped, apart from reading their live values. Damaged
+// segments are handled as described in repair.go.
+func openSegments(dir string, apply func(op byte, key string, value string)) (*segmentStore, error) {
+	if !read_only.Load() {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+	}
+	s := &segmentStore{dir: dir, idx: make(map[string]segLoc), hist: make(map[string][]segLoc)}
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, e := range entries {
+		id, err := strconv.ParseUint(strings.TrimSuffix(e.Name(), segmentSuffix), 10, 32)
+		if err != nil || !strings.HasSuffix(e.Name(), segmentSuffix) {
+			continue
+		}
+		s.segments = append(s.segments, &segment{id: uint32(id), path: filepath.Join(dir, e.Name())})
+	}
+	sort.Slice(s.segments, func(i, j int) bool { return s.segments[i].id < s.segments[j].id })
+
+	from := 0
+	if len(s.segments) > 0 {
+		n, err := s.loadCheckpoint(apply)
+		if err != nil && !os.IsNotExist(err) {
+			slog.Warn("ignoring index checkpoint, replaying all segments", "dir", dir, "error", err)
+		} else if err == nil {
+			slog.Debug("index checkpoint loaded", "dir", dir, "keys", len(s.idx), "segments", n)
+		}
+		from = max(n-1, 0) // The checkpoint's last segment may have grown since
+	}
+	if err := s.replaySegments(s.segments[from:], true, apply); err != nil {
+		return nil, err
+	}
+	// Segments before a clear marker are left over from a rewrite that was
+	// interrupted before it could remove them
+	if !read_only.Load() {
+		if err := s.dropBefore(s.cleared); err != nil {
+			return nil, err
+		}
+	}
+	s.trimAllHistory(time.Now()) // The retention policy may have changed
+	if err := s.openActive(read_only.Load()); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// openActive opens the active segment for appending, starting a new one when
+// there is none yet or the last one is damaged. In read-only mode nothing is
+// created: the active segment is opened for reading only, or stood in for
+// until writes resume when the store has none.
+func (s *segmentStore) openActive(readOnly bool) error {
+	if s.f != nil {
+		s.f.Close()
+		s.f = nil
+	}
+	if len(s.segments) > 0 && s.active().missing {
+		s.segments = s.segments[:len(s.segments)-1]
+	}
+	s.readOnly = readOnly
+	var err error
+	switch {
+	case readOnly && len(s.segments) == 0:
+		s.segments = append(s.segments, &segment{id: 1, path: segmentPath(s.dir, 1), missing: true})
+		s.synced = 0
+	case readOnly:
+		s.f, err = os.Open(s.active().path)
+		s.synced = s.active().size
+	case len(s.segments) == 0:
+		if err = os.MkdirAll(s.dir, 0o755); err == nil {
+			err = s.create(1)
+		}
+	case s.active().damaged:
+		err = s.create(s.active().id + 1) // Appending would bury the damage
+	default:
+		s.f, err = os.OpenFile(s.active().path, os.O_WRONLY|os.O_APPEND, 0o644)
+		s.synced = s.active().size
+	}
+	return err
+}
+
+// track points idx (or hist) at a record just written or replayed and moves
+// the live byte counts to match. It reports whether the record is now the
+// key's current state; historic records never are, since newer versions were
+// written before compaction copied them.
+func (s *segmentStore) track(rec segRecord, loc segLoc) bool {
+	if rec.op == opClear {
+		// Markers always open a segment, so everything live so far is older
+		for _, seg := range s.segments {
+			seg.live = 0
+		}
+		clear(s.idx)
+		clear(s.hist)
+		s.cleared = loc.seg
+		return true
+	}
+	loc.ver, loc.ts, loc.del, loc.typ = rec.ver, rec.ts, rec.op == opDelete, rec.typ
+	if rec.historic {
+		if historyEnabled() {
+			s.addHistory(rec.key, loc)
+		}
+		return false
+	}
+	if old, ok := s.idx[rec.key]; ok {
+		delete(s.idx, rec.key)
+		s.release(old)
+		// Unless the same version was copied again, addHistory counts it anew
+		if historyEnabled() && old.ver != loc.ver {
+			s.addHistory(rec.key, old)
+		}
+	}
+	if rec.op == opPut {
+		s.idx[rec.key] = loc
+		s.segment(loc.seg).live += loc.size
+	} else if historyEnabled() {
+		s.addHistory(rec.key, loc)
+	}
+	s.trimHistory(rec.key, time.Now())
+	return true
+}
+
+// release stops counting a record as live.
+func (s *segmentStore) release(loc segLoc) {
+	if seg := s.segment(loc.seg); seg != nil {
+		seg.live -= loc.size
+	}
+}
+
+// nextVersion returns the version number for the next write of key.
+func (s *segmentStore) nextVersion(key string) uint64 {
+	var ver uint64
+	if loc, ok := s.idx[key]; ok {
+		ver = loc.ver
+	}
+	if h := s.hist[key]; len(h) > 0 {
+		ver = max(ver, h[len(h)-1].ver)
+	}
+	return ver + 1
+}
+
+func (s *segmentStore) segment(id uint32) *segment {
+	for _, seg := range s.segments {
+		if seg.id == id {
+			return seg
+		}
+	}
+	return nil
+}
+
+func (s *segmentStore) active() *segment {
+	return s.segments[len(s.segments)-1]
+}
+
+// create starts a new, empty active segment.
+func (s *segmentStore) create(id uint32) error {
+	f, err := os.OpenFile(segmentPath(s.dir, id), os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	s.f = f
+	s.segments = append(s.segments, &segment{id: id, path: f.Name()})
+	s.synced = 0
+	return nil
+}
+
+// rotate seals the active segment and starts the next one.
+func (s *segmentStore) rotate() error {
+	if err := s.f.Sync(); err != nil {
+		return err
+	}
+	if err := s.f.Close(); err != nil {
+		return err
+	}
+	s.sealed = true
+	return s.create(s.active().id + 1)
+}
+
+// append writes a new version of key, of type typ, to the active segment.
+// The record reaches the disk on the next sync.
+func (s *segmentStore) append(op byte, key string, value string, typ valueType) error {
+	rec := segRecord{op: op, key: key, value: value, typ: typ}
+	if op != opClear {
+		rec.ver, rec.ts = s.nextVersion(key), time.Now().UnixNano()
+	}
+	loc, err := s.write(rec)
+	if err != nil {
+		return err
+	}
+	s.track(rec, loc)
+	return nil
+}
+
+// write appends rec to the active segment, sealing it first when it is full,
+// and returns where it landed without tracking it.
+func (s *segmentStore) write(rec segRecord) (segLoc, error) {
+	if active := s.active(); active.size > 0 && active.size >= cfg().SegmentBytes && !s.grouping {
+		if err := s.rotate(); err != nil {
+			return segLoc{}, err
+		}
+	}
+	rec.grouped = s.grouping && rec.op != opCommit
+	buf := encodeSegmentRecord(rec)
+	active := s.active()
+	if _, err := s.f.Write(buf); err != nil {
+		// Drop whatever part of the record made it out so the next append
+		// doesn't land behind garbage.
+		s.f.Truncate(active.size)
+		return segLoc{}, err
+	}
+	loc := segLoc{seg: active.id, off: active.size, size: int64(len(buf)), ver: rec.ver, ts: rec.ts, del: rec.op == opDelete, typ: rec.typ}
+	active.size += int64(len(buf))
+	if rec.grouped {
+		s.grouped++
+	}
+	return loc, nil
+}
+
+// beginGroup opens a group of records that replay applies all or none of.
+// The group's records go to the active segment, which can't be sealed while
+// the group is open, so compaction never parts them from their markers.
+func (s *segmentStore) beginGroup() error {
+	if active := s.active(); active.size > 0 && active.size >= cfg().SegmentBytes {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	if _, err := s.write(segRecord{op: opBegin}); err != nil {
+		return err
+	}
+	s.grouping, s.grouped = true, 0
+	return nil
+}
+
+// commitGroup closes the open group, even when writing the marker fails. Its
+// records reach the disk on the next sync like any others; until the commit
+// marker does, replay rolls them back. The group's changes are already
+// applied in memory, so when the marker can't be written the server turns
+// read-only rather than keep serving, and building on, writes that a restart
+// would undo.
+func (s *segmentStore) commitGroup() error {
+	var count [4]byte
+	binary.LittleEndian.PutUint32(count[:], s.grouped)
+	_, err := s.write(segRecord{op: opCommit, value: string(count[:])})
+	s.grouping = false
+	if err != nil {
+		read_only.Store(true)
+		slog.Error("failed to commit record group; server is now read-only", "dir", s.dir, "error", err)
+	}
+	return err
+}
+
+// sync flushes the records appended since the last sync. Sealed segments
+// were synced in full when they were sealed, so the only dirty range is the
+// tail of the active segment from synced on: a store with no writes since
+// the last sync skips the flush, and otherwise only that range's data and
+// the new file size are written out (see datasync_linux.go). Under the
+// interval sync policy every write in between is committed by one flush.
+func (s *segmentStore) sync() error {
+	active := s.active()
+	if active.size == s.synced {
+		return nil
+	}
+	if err := syncData(s.f); err != nil {
+		return err
+	}
+	metrics.syncedBytes.Add(uint64(active.size - s.synced))
+	s.synced = active.size
+	return nil
+}
+
+// unsynced is the number of appended bytes not yet flushed.
+func (s *segmentStore) unsynced() int64 {
+	return s.active().size - s.synced
+}
+
+// rewrite replaces the whole store with data. The new records start with a
+// clear marker in a fresh segment, all in one group, so a crash part way
+// through still replays to either the old or the new contents, and the old
+// segments are removed once the new ones are synced.
+func (s *segmentStore) rewrite(data map[string]string) error {
+	if err := s.rotate(); err != nil {
+		return err
+	}
+	if err := s.beginGroup(); err != nil {
+		return err
+	}
+	err := s.append(opClear, "", "", typeNone)
+	for k, v := range data {
+		if err != nil {
+			break
+		}
+		err = s.append(opPut, k, v, typeNone)
+	}
+	if err := errors.Join(err, s.commitGroup()); err != nil {
+		return err
+	}
+	if err := s.sync(); err != nil {
+		return err
+	}
+	return s.dropBefore(s.cleared)
+}
+
+// dropBefore removes every segment older than id.
+func (s *segmentStore) dropBefore(id uint32) error {
+	var errs []error
+	kept := s.segments[:0]
+	for _, seg := range s.segments {
+		if seg.id >= id {
+			kept = append(kept, seg)
+			continue
+		}
+		if err := os.Remove(seg.path); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err)
+		}
+	}
+	s.segments = kept
+	return errors.Join(errs...)
+}
+
+// copyForward rewrites the record found at at into the active segment when
+// idx or hist still points at it, keeping its version. Copies of anything but
+// the key's current state are marked historic so they can't overtake newer
+// versions on replay. Tombstones nothing points at are kept too while older
+// segments might hold a put they hide. It reports whether the record was
+// copied.
+func (s *segmentStore) copyForward(rec segRecord, at segLoc) (bool, error) {
+	cur, isCurrent := s.idx[rec.key]
+	if isCurrent && cur.seg == at.seg && cur.off == at.off {
+		rec.historic = false
+		loc, err := s.write(rec)
+		if err != nil {
+			return false, err
+		}
+		s.idx[rec.key] = loc
+		s.move(cur, loc)
+		return true, nil
+	}
+	h := s.hist[rec.key]
+	for i, old := range h {
+		if old.seg == at.seg && old.off == at.off {
+			rec.historic = !(i == len(h)-1 && old.del && !isCurrent)
+			loc, err := s.write(rec)
+			if err != nil {
+				return false, err
+			}
+			h[i] = loc
+			s.move(old, loc)
+			return true, nil
+		}
+	}
+	if rec.op == opDelete && !isCurrent && len(h) == 0 && s.segments[0].id < at.seg {
+		rec.historic = false
+		_, err := s.write(rec)
+		return err == nil, err
+	}
+	return false, nil
+}
+
+// move shifts a record's live bytes to the copy at to.
+func (s *segmentStore) move(from segLoc, to segLoc) {
+	s.release(from)
+	s.segment(to.seg).live += to.size
+}
+
+// compactable returns the sealed segment with the most garbage, provided at
+// least compactRatio of it is garbage.
+func (s *segmentStore) compactable() *segment {
+	var best *segment
+	for _, seg := range s.segments[:len(s.segments)-1] {
+		garbage := seg.size - seg.live
+		if seg.size > 0 && float64(garbage) >= compactRatio*float64(seg.size) && (best == nil || garbage > best.size-best.live) {
+			best = seg
+		}
+	}
+	return best
+}
+
+func (s *segmentStore) fileBytes() (total int64, live int64) {
+	for _, seg := range s.segments {
+		total += seg.size
+		live += seg.live
+	}
+	return total, live
+}
+
+// fingerprint identifies the current end of the store, so files derived from
+// it (the bloom filter) can tell whether they are still current.
+func (s *segmentStore) fingerprint() uint32 {
+	active := s.active()
+	var b [12]byte
+	binary.LittleEndian.PutUint32(b[0:], active.id)
+	binary.LittleEndian.PutUint64(b[4:], uint64(active.size))
+	return crc32.ChecksumIEEE(b[:])
+}
+
+func (s *segmentStore) close() error {
+	if s.readOnly {
+		if s.f == nil {
+			return nil
+		}
+		return s.f.Close()
+	}
+	return errors.Join(s.checkpoint(), s.f.Sync(), s.f.Close())
+}
+
+// load replays the node store from its segments, importing the gob snapshot
+// written by older versions when there are no segments yet.
+func (n *ServerNode) load() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	_, statErr := os.Stat(n.dir)
+	segs, err := openSegments(n.dir, func(op byte, key string, value string) {
+		switch op {
+		case opPut:
+			n.node_store[key] = value
+		case opDelete:
+			delete(n.node_store, key)
+		case opClear:
+			n.node_store = make(map[string]string)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	n.segs = segs
+	if os.IsNotExist(statErr) {
+		if err := n.importSnapshotLocked(); err != nil {
+			return err
+		}
+	}
+	size := int64(0)
+	for k, v := range n.node_store {
+		size += int64(len(k) + len(v))
+	}
+	n.setSizeLocked(size)
+	n.rebuildIndexesLocked()
+	n.rebuildUseLocked()
+	if err := n.loadAccessLocked(); err != nil {
+		slog.Warn("ignoring saved key statistics", "node", n.name, "bucket", n.bucket, "error", err)
+	}
+	n.loadBloomLocked(segs.fingerprint())
+	slog.Info("node store loaded", "node", n.name, "bucket", n.bucket, "node entries", len(n.node_store), "segments", len(segs.segments))
+	go n.compactSegments()
+	return nil
+}
+
+// importSnapshotLocked moves the single-file gob snapshot of older versions
+// (<node>.bin) into segments. Must be called with n.mu held.
+func (n *ServerNode) importSnapshotLocked() error {
+	legacy := strings.TrimSuffix(n.dir, segmentDirSuffix) + ".bin"
+	f, err := os.Open(legacy)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := gob.NewDecoder(f).Decode(&n.node_store); err != nil {
+		return fmt.Errorf("importing %s: %w", legacy, err)
+	}
+	f.Close() // Windows can't remove open files
+	if read_only.Load() {
+		slog.Info("loaded snapshot without importing it in read-only mode", "file", legacy, "keys", len(n.node_store))
+		return nil
+	}
+	if err := n.segs.rewrite(n.node_store); err != nil {
+		return err
+	}
+	slog.Info("imported snapshot into segments", "file", legacy, "keys", len(n.node_store))
+	os.Remove(legacy + ".bloom")
+	return os.Remove(legacy)
+}
+
+// appendLocked records a write in the active segment. Writes in memory mode
+// are not recorded, and a store whose bucket was dropped refuses them with
+// ErrBucketNotFound, since callers that looked the bucket up before the drop
+// would otherwise change a store nothing reads any more. Must be called with
+// n.mu held.
+func (n *ServerNode) appendLocked(op byte, key string, value string, typ valueType) error {
+	if read_only.Load() {
+		return ErrReadOnly
+	}
+	if n.dropped {
+		return ErrBucketNotFound
+	}
+	if cfg().Memory {
+		return nil
+	}
+	if err := n.openLocked(); err != nil {
+		return err
+	}
+	if err := n.segs.append(op, key, value, typ); err != nil {
+		return err
+	}
+	if n.segs.sealed {
+		n.segs.sealed = false
+		go n.compactSegments()
+	}
+	return nil
+}
+
+// beginGroupLocked opens a group of writes that replay applies all or none
+// of, closed by commitGroupLocked, so a crash in the middle of a batch can't
+// leave half of it behind. Must be called with n.mu held.
+func (n *ServerNode) beginGroupLocked() error {
+	if read_only.Load() {
+		return ErrReadOnly
+	}
+	if n.dropped {
+		return ErrBucketNotFound
+	}
+	if cfg().Memory {
+		return nil
+	}
+	if err := n.openLocked(); err != nil {
+		return err
+	}
+	return n.segs.beginGroup()
+}
+
+// commitGroupLocked closes the group opened by beginGroupLocked, if any. Must
+// be called with n.mu held.
+func (n *ServerNode) commitGroupLocked() error {
+	if n.segs == nil || !n.segs.grouping {
+		return nil
+	}
+	return n.segs.commitGroup()
+}
+
+// rewriteLocked replaces the store's segments with the contents of
+// node_store. Must be called with n.mu held.
+func (n *ServerNode) rewriteLocked() error {
+	if read_only.Load() {
+		return ErrReadOnly
+	}
+	if n.dropped {
+		return ErrBucketNotFound
+	}
+	if cfg().Memory {
+		return nil
+	}
+	if err := n.openLocked(); err != nil {
+		return err
+	}
+	return n.segs.rewrite(n.node_store)
+}
+
+// openLocked creates the segment directory of a store that was never loaded,
+// such as a new bucket. Must be called with n.mu held.
+func (n *ServerNode) openLocked() error {
+	if n.segs != nil {
+		return nil
+	}
+	segs, err := openSegments(n.dir, func(byte, string, string) {})
+	if err != nil {
+		return err
+	}
+	n.segs = segs
+	return nil
+}
+
+// compactSegments compacts sealed segments one at a time for as long as any
+// of them is mostly garbage, provided automatic compaction is on and the
+// store holds at least compact_dead_bytes of garbage.
+func (n *ServerNode) compactSegments() {
+	for {
+		n.mu.Lock()
+		if n.compacting || n.dropped || n.segs == nil || read_only.Load() || !cfg().CompactAuto {
+			n.mu.Unlock()
+			return
+		}
+		if cfg().HistoryMaxAge > 0 {
+			n.segs.trimAllHistory(time.Now())
+		}
+		seg := n.segs.compactable()
+		if total, live := n.segs.fileBytes(); seg == nil || total-live < cfg().CompactDeadBytes {
+			n.mu.Unlock()
+			return
+		}
+		n.compacting = true
+		n.mu.Unlock()
+
+		if err := n.runCompaction(seg, nil); err != nil {
+			return
+		}
+	}
+}
+
+// runCompaction compacts seg once n was marked as compacting, counting the
+// records it reads into run unless that is nil, and clears the mark.
+func (n *ServerNode) runCompaction(seg *segment, run *compactionRun) error {
+	start := time.Now()
+	_, span := tracer.Start(context.Background(), "kv.compact", trace.WithAttributes(
+		attribute.String("kv.node", n.name),
+		attribute.String("kv.bucket", n.bucket),
+		attribute.String("kv.segment", seg.path),
+	))
+	err := n.compactSegment(seg, run)
+	endSpan(span, err)
+	n.mu.Lock()
+	n.compacting = false
+	n.mu.Unlock()
+	if err != nil {
+		slog.Error("segment compaction failed", "node", n.name, "bucket", n.bucket, "segment", seg.path, "error", err)
+		return err
+	}
+	slog.Info("segment compacted", "node", n.name, "bucket", n.bucket, "segment", seg.path, "duration", time.Since(start))
+	return nil
+}
+
+// compactSegment copies the live records of a sealed segment to the active
+// one and removes it. The segment is read without the lock since sealed
+// segments never change; each record is checked against idx and hist under
+// the lock so writes that land meanwhile win.
+func (n *ServerNode) compactSegment(seg *segment, run *compactionRun) error {
+	n.mu.Lock()
+	gone := n.dropped || n.segs.segment(seg.id) == nil
+	n.mu.Unlock()
+	if gone {
+		return nil // Compacted or rewritten since it was picked
+	}
+	f, err := os.Open(seg.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(io.LimitReader(f, seg.size))
+	var off int64
+	for off < seg.size {
+		p, size, err := readFrame(r)
+		if err != nil {
+			return err
+		}
+		rec, err := decodeSegmentRecord(p)
+		if err != nil {
+			return err
+		}
+		n.mu.Lock()
+		if n.dropped || n.segs.segment(seg.id) == nil {
+			n.mu.Unlock()
+			return nil // Dropped or rewritten meanwhile
+		}
+		copied, err := n.segs.copyForward(rec, segLoc{seg: seg.id, off: off, size: size})
+		n.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		run.record(size, copied)
+		off += size
+	}
+	f.Close() // Windows can't remove open files
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.dropped || n.segs.segment(seg.id) == nil {
+		return nil
+	}
+	if err := n.segs.sync(); err != nil {
+		return err
+	}
+	if err := os.Remove(seg.path); err != nil {
+		return err
+	}
+	kept := n.segs.segments[:0]
+	for _, s := range n.segs.segments {
+		if s != seg {
+			kept = append(kept, s)
+		}
+	}
+	n.segs.segments = kept
+	n.last_compaction = time.Now()
+	n.rebuildBloomLocked() // Drops deleted keys
+	// The last checkpoint still lists the removed segment
+	if err := n.segs.checkpoint(); err != nil {
+		slog.Warn("failed to write index checkpoint", "node", n.name, "bucket", n.bucket, "error", err)
+	}
+	return nil
+}
+
+// closeSegments syncs and closes the store's files, saving the bloom filter
+// for the next start. Must be called with n.mu held.
+func (n *ServerNode) closeSegments() error {
+	if n.segs == nil || n.dropped {
+		return nil
+	}
+	if err := n.saveBloomLocked(n.segs.fingerprint()); err != nil {
+		slog.Warn("failed to save bloom filter", "node", n.name, "error", err)
+	}
+	if err := n.saveAccessLocked(); err != nil {
+		slog.Warn("failed to save key statistics", "node", n.name, "bucket", n.bucket, "error", err)
+	}
+	return n.segs.close()
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// benchNodes returns a fresh bucket for a benchmark, holding count keys of
+// size bytes each.
+func benchNodes(b *testing.B, count int, size int) []*ServerNode {
+	b.Helper()
+	nodes, err := bucketNodes(strings.ToLower(strings.NewReplacer("/", "-", "=", "-").Replace(b.Name())), true)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if count == 0 {
+		return nodes
+	}
+	values := make(map[string]string, count)
+	for i := range count {
+		values[fmt.Sprintf("key-%08d", i)] = strings.Repeat("v", size)
+	}
+	if err := putBatchLocal(context.Background(), values, nodes); err != nil {
+		b.Fatal(err)
+	}
+	return nodes
+}
+
+func BenchmarkPut(b *testing.B) {
+	for _, size := range []int{16, 1024, 64 << 10} {
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			nodes := benchNodes(b, 0, 0)
+			value := strings.Repeat("v", size)
+			ctx := context.Background()
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			for i := 0; b.Loop(); i++ {
+				if err := put(ctx, fmt.Sprintf("key-%08d", i%10000), value, nodes); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkGet(b *testing.B) {
+	const count = 10000
+	nodes := benchNodes(b, count, 128)
+	ctx := context.Background()
+	b.ReportAllocs()
+	for i := 0; b.Loop(); i++ {
+		if _, err := get(ctx, fmt.Sprintf("key-%08d", i%count), nodes); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGetParallel(b *testing.B) {
+	const count = 10000
+	nodes := benchNodes(b, count, 128)
+	ctx := context.Background()
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			if _, err := get(ctx, fmt.Sprintf("key-%08d", i%count), nodes); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkScan(b *testing.B) {
+	for _, count := range []int{1000, 100000} {
+		b.Run(fmt.Sprintf("keys=%d", count), func(b *testing.B) {
+			nodes := benchNodes(b, count, 32)
+			b.ReportAllocs()
+			for b.Loop() {
+				if _, ks := keys("key-", nodes); len(ks) != count {
+					b.Fatalf("scanned %d keys, want %d", len(ks), count)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkBatch(b *testing.B) {
+	for _, size := range []int{10, 100, 1000} {
+		b.Run(fmt.Sprintf("batch=%d", size), func(b *testing.B) {
+			nodes := benchNodes(b, 0, 0)
+			values := make(map[string]string, size)
+			for i := range size {
+				values[fmt.Sprintf("key-%08d", i)] = strings.Repeat("v", 128)
+			}
+			ctx := context.Background()
+			b.ReportAllocs()
+			for b.Loop() {
+				if err := putBatchLocal(ctx, values, nodes); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -1,15 +1,30 @@
 package main
 
 import (
-	"encoding/gob"
+	"context"
 	"encoding/json"
 	"errors"
+	"flag"
+	"fmt"
+	"io"
 	"log/slog"
+	"maps"
+	"mime"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
-	"flag"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
 )
 
 const storeFile = "store.bin"
@@ -19,6 +34,19 @@ type ServerNode struct {
 	name string 
 	node_store map[string] string 
 	mu sync.RWMutex
+	dir string // Directory holding this node's segment files
+	segs *segmentStore // nil until the store is loaded or first written
+	size int64 // Bytes of keys and values held in node_store
+	dirty bool // Unsynced writes pending under the interval sync policy
+	compacting bool // A segment compaction is running
+	last_compaction time.Time
+	bucket string // Empty for the default key space
+	dropped bool // Set once the bucket owning this store is deleted
+	indexes map[string]map[string]map[string]struct{} // Field -> field value -> keys
+	bloom atomic.Pointer[bloomFilter] // nil unless bloom_filter is enabled
+	usage *atomic.Int64 // Bytes held by all stores of the bucket, nil for the default key space
+	use *usageTracker // nil unless eviction_policy is set
+	access *keyStatsTracker // nil unless key_stats is on
 }
 
 var (
@@ -27,6 +55,8 @@ var (
 )
 
 var ErrKeyNotFound = errors.New("key not found")
+var ErrKeyExists = errors.New("key already exists")
+var ErrStoreFull = errors.New("store full")
 
 // Run docker for KV Store
 // docker build -t kvstore:latest .
@@ -35,53 +65,354 @@ var ErrKeyNotFound = errors.New("key not found")
 // docker run -d -e NODE_NAME=kvNode3 -e PORT=8093 --name kv3 -p 8093:8093 kvstore:latest
 
 func main() {
-	port := flag.String("port", "8090", "port to listen on")
-	nodeName := flag.String("node", "kvNode1", "node name")
-	flag.Parse()
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		os.Exit(runBench(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		os.Exit(runImport(os.Args[2:]))
+	}
+	c, err := loadConfig(os.Args[1:])
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(0)
+		}
+		fmt.Fprintln(os.Stderr, "invalid configuration:", err)
+		os.Exit(2)
+	}
+	live_cfg.Store(c)
+	log_level.Set(cfg().LogLevel)
+	runtime.SetMutexProfileFraction(cfg().MutexProfileFraction)
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: log_level})))
+	stopTracing, err := startTracing(context.Background())
+	if err != nil {
+		slog.Error("failed to start tracing", "error", err)
+		os.Exit(1)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	var failed atomic.Bool
+	var handler http.Handler
+	if cfg().Proxy {
+		if router, err = newProxyRouter(cfg().Nodes); err != nil {
+			slog.Error("failed to start proxy", "error", err)
+			os.Exit(1)
+		}
+		go router.healthLoop(ctx)
+		if cfg().Gossip {
+			members = newGossiper(router.setMembers)
+		}
+		handler = proxyServer()
+	} else {
+		// Storage is opened read-only, unless a restore has to write to it first
+		if cfg().ReadOnly && cfg().RestoreFrom == "" {
+			read_only.Store(true)
+		}
+		openStores()
+		if len(cfg().RaftPeers) > 0 {
+			if cluster, err = startCluster(); err != nil {
+				slog.Error("failed to start raft", "error", err)
+				os.Exit(1)
+			}
+		}
+		if cfg().ReplicaOf != "" {
+			replica = newReplicator(cfg().ReplicaOf)
+			go replica.run(ctx)
+		}
+		if cfg().RestoreFrom != "" {
+			if err := restoreBackup(ctx); err != nil {
+				slog.Error("failed to restore backup", "from", cfg().RestoreFrom, "error", err)
+				os.Exit(1)
+			}
+		}
+		if cfg().BackupURL != "" {
+			if backups, err = newBackupper(); err != nil {
+				slog.Error("failed to set up backups", "error", err)
+				os.Exit(1)
+			}
+			go backups.run(ctx)
+		}
+		if cfg().ReadOnly {
+			if !read_only.Swap(true) {
+				if err := reopenStores(true); err != nil {
+					slog.Error("failed to reopen stores read-only", "error", err)
+					os.Exit(1)
+				}
+			}
+			slog.Info("read-only mode: writes are refused and storage is left untouched")
+		}
+		if cfg().Gossip {
+			members = newGossiper(nil)
+		}
+		handler = server()
+	}
+
+	listeners, err := openListeners()
+	if err != nil {
+		slog.Error("failed to listen", "error", err)
+		os.Exit(1)
+	}
+	var mc *memcachedListener
+	if listeners.memcached != nil {
+		if cfg().authEnabled() {
+			slog.Warn("memcached listener does not authenticate clients; restrict access to it separately")
+		}
+		mc = memcachedServer(listeners.memcached)
+	}
+
+	srv := newHTTPServer(handler)
+	srv.RegisterOnShutdown(changes.closeAll)
+	srv.RegisterOnShutdown(pubsub.closeAll)
+	if cfg().TLSCert != "" {
+		certs, err := newCertReloader()
+		if err != nil {
+			slog.Error("failed to load TLS certificates", "error", err)
+			os.Exit(1)
+		}
+		srv.TLSConfig = certs.tlsConfig()
+		tls_certs = certs
+	}
+	go reloadOnSIGHUP()
+	if members != nil {
+		go members.run(ctx)
+	}
+	for _, ln := range listeners.http {
+		go func() {
+			slog.Info("Server is listening on", "addr", ln.Addr().String(), "network", ln.Addr().Network(), "tls", srv.TLSConfig != nil)
+			var err error
+			if srv.TLSConfig != nil {
+				err = srv.ServeTLS(ln, "", "")
+			} else {
+				err = srv.Serve(ln)
+			}
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("Server failed", "addr", ln.Addr().String(), "error", err)
+				failed.Store(true)
+				stop()
+			}
+		}()
+	}
 
-	node := &ServerNode{name: *nodeName, node_store: make(map[string]string)}
+	<-ctx.Done()
+	stop() // A second signal kills the process immediately
+	clean := shutdown(srv, mc)
+	flushCtx, cancel := context.WithTimeout(context.Background(), cfg().ShutdownTimeout)
+	if err := stopTracing(flushCtx); err != nil {
+		slog.Error("failed to flush traces", "error", err)
+	}
+	cancel()
+	if !clean || failed.Load() {
+		os.Exit(1)
+	}
+}
+
+// openStores loads the node store, its buckets and the files that go with
+// them from the data directory. In memory mode the stores start out empty and
+// the data directory is never touched.
+func openStores() {
+	if cfg().Memory {
+		slog.Info("memory mode: data is kept in RAM only and lost on exit")
+	} else {
+		if err := os.MkdirAll(cfg().DataDir, 0o755); err != nil {
+			slog.Error("failed to create data directory", "dir", cfg().DataDir, "error", err)
+			os.Exit(1)
+		}
+		if err := loadIndexFields(); err != nil {
+			slog.Error("failed to load index definitions", "error", err)
+		}
+		if err := changes.open(changeLogPath()); err != nil {
+			slog.Error("failed to open change log", "error", err)
+			os.Exit(1)
+		}
+		if err := followers.open(handoffPath()); err != nil {
+			slog.Error("failed to load replication followers", "error", err)
+			os.Exit(1)
+		}
+	}
+	if cfg().CacheBytes > 0 {
+		read_cache = newLRUCache(cfg().CacheBytes)
+	}
+	node := newServerNode(cfg().NodeName, cfg().DataDir)
 	server_nodes = []*ServerNode{node}
 	con_hash = newConsistentHashDS(3)
-	if err := node.loadFromFile(); err != nil && !os.IsNotExist(err) {
+	con_hash.addServer(node.name)
+	if cfg().Memory {
+		return
+	}
+	if err := node.load(); err != nil {
 		slog.Error("failed to load node store", "node", node.name, "error", err)
+		os.Exit(1)
 	}
-	con_hash.addServer(node.name)
+	if err := loadBuckets(); err != nil {
+		slog.Error("failed to load buckets", "error", err)
+	}
+	go node.syncLoop()
+	if cfg().CheckpointInterval > 0 {
+		go node.checkpointLoop(cfg().CheckpointInterval)
+	}
+}
 
-	server()
+// shutdown drains in-flight requests and connections, then saves every node
+// store one last time. It reports whether everything was flushed cleanly.
+func shutdown(srv *http.Server, mc *memcachedListener) bool {
+	slog.Info("shutting down", "timeout", cfg().ShutdownTimeout)
+	clean := true
+	if members != nil {
+		members.leave() // Before draining, so proxies stop sending requests here
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cfg().ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		slog.Error("failed to drain http requests", "error", err)
+		clean = false
+	}
+	if mc != nil {
+		mc.Close()
+	}
+	if cluster != nil {
+		if err := cluster.shutdown(); err != nil {
+			slog.Error("failed to stop raft", "error", err)
+			clean = false
+		}
+	}
+	if backups != nil && backups.final() != nil {
+		clean = false
+	}
 
-	addr := ":" + *port
-	slog.Info("Server is listening on", "port", *port)
-	if err := http.ListenAndServe(addr, nil); err != nil {
-		slog.Error("Server failed", "error", err)
+	for _, n := range allNodes() {
+		n.mu.Lock()
+		if err := n.closeSegments(); err != nil {
+			slog.Error("final sync failed", "node", n.name, "bucket", n.bucket, "error", err)
+			clean = false
+		} else {
+			n.dirty = false
+		}
+		n.mu.Unlock()
+	}
+	if err := changes.close(); err != nil {
+		slog.Error("failed to close change log", "error", err)
+		clean = false
 	}
+	if err := followers.close(); err != nil {
+		slog.Error("failed to close spill files", "error", err)
+		clean = false
+	}
+	if clean {
+		slog.Info("server stopped cleanly")
+	}
+	return clean
 }
 
-func (n *ServerNode) loadFromFile() error {
-	f, err := os.Open(n.name + ".bin")
-	if err != nil {
+func newServerNode(name string, dir string) *ServerNode {
+	n := &ServerNode{
+		name: name,
+		node_store: make(map[string]string),
+		dir: filepath.Join(dir, name+segmentDirSuffix),
+	}
+	if cfg().EvictionPolicy != evictNone {
+		n.use = newUsageTracker()
+	}
+	if cfg().KeyStats {
+		n.access = newKeyStatsTracker()
+	}
+	n.rebuildBloomLocked()
+	return n
+}
+
+// syncLocked flushes appended records to disk, together with the change log
+// records published for them, so a write that is durable is also in the
+// change feed. Must be called with n.mu held.
+func (n *ServerNode) syncLocked() error {
+	if n.segs == nil || n.dropped {
+		return nil
+	}
+	start := time.Now()
+	defer func() { metrics.saveLatency.observe(time.Since(start).Seconds()) }()
+	if err := n.segs.sync(); err != nil {
 		return err
 	}
-	defer f.Close()
-	n.mu.Lock()
-	defer n.mu.Unlock()
-	if err = gob.NewDecoder(f).Decode(&n.node_store); err != nil {
+	return changes.sync()
+}
+
+// persist syncs the node store according to the sync policy of the request
+// ctx belongs to. Must be called with n.mu held.
+func (n *ServerNode) persist(ctx context.Context) error {
+	if configFrom(ctx).SyncPolicy == syncInterval {
+		n.dirty = true
+		return nil
+	}
+	if err := n.syncLocked(); err != nil {
+		slog.Error("failed to sync node store", "node", n.name, "error", err)
 		return err
 	}
-	slog.Info("node store loaded", "node", n.name, "node entries", len(n.node_store))
 	return nil
 }
 
-func (n *ServerNode) saveToFile() error {
-	f, err := os.Create(n.name + ".bin")
-	if err != nil {
+// syncLoop syncs the node store every sync_interval when it has unsynced
+// writes, until the store's bucket is dropped. It runs under either sync
+// policy, since a reload can switch between them.
+func (n *ServerNode) syncLoop() {
+	interval := syncEvery()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if d := syncEvery(); d != interval {
+			interval = d
+			ticker.Reset(interval)
+		}
+		n.mu.Lock()
+		if n.dropped {
+			n.mu.Unlock()
+			return
+		}
+		if n.dirty {
+			if err := n.syncLocked(); err != nil {
+				slog.Error("failed to sync node store", "node", n.name, "error", err)
+			} else {
+				n.dirty = false
+			}
+		}
+		n.mu.Unlock()
+	}
+}
+
+// setLocked stores value under key, enforcing the store size limit and
+// quota of the config ctx carries. Must be called with n.mu held.
+func (n *ServerNode) setLocked(ctx context.Context, key string, value string, typ valueType) error {
+	c := configFrom(ctx)
+	size := n.size + int64(len(value))
+	old, exists := n.node_store[key]
+	if exists {
+		size -= int64(len(old))
+	} else {
+		size += int64(len(key))
+	}
+	if err := n.checkQuotaLocked(c, size-n.size); err != nil {
 		return err
 	}
-	defer f.Close()
-	if err := gob.NewEncoder(f).Encode(n.node_store); err != nil {
+	if c.MaxStoreBytes > 0 && size > c.MaxStoreBytes && n.bucket != systemBucket {
+		before := n.size
+		if err := n.evictLocked(size-c.MaxStoreBytes, key); err != nil {
+			return err
+		}
+		size -= before - n.size
+	}
+	if err := n.appendLocked(opPut, key, value, typ); err != nil {
 		return err
 	}
-	slog.Info("node store saved", "node", n.name, "node entries", len(n.node_store))
-	return nil
+	n.node_store[key] = value
+	n.cacheInvalidateLocked(key)
+	n.setSizeLocked(size)
+	if exists {
+		n.unindexLocked(key, old)
+	} else {
+		n.bloomAddLocked(key)
+	}
+	n.indexLocked(key, value)
+	n.use.touch(key, true)
+	n.access.touch(key, true)
+	metrics.bytesWritten.Add(uint64(len(key) + len(value)))
+	return n.notifyLocked("put", key, value, typ)
 }
 
 func getServerKey(server_key string, nodes []*ServerNode) *ServerNode {
@@ -96,152 +427,598 @@ func getServerKey(server_key string, nodes []*ServerNode) *ServerNode {
 
 }
 
-func get(key string, nodes []*ServerNode) (string, error) {
+func get(ctx context.Context, key string, nodes []*ServerNode) (value string, err error) {
+	ctx, span := startOp(ctx, "get", key, nodes)
+	defer func() { recordOp("get", err); endSpan(span, err) }()
 	n := getServerKey(key, nodes)
 	if n == nil {
 		return "", errors.New("no node found for key")
 	}
 
-	n.mu.RLock()
+	if f := n.bloom.Load(); f != nil && !f.mayContain(key) {
+		metrics.bloomNegatives.Add(1)
+		return "", ErrKeyNotFound
+	}
+	if value, ok := n.cacheLookup(key); ok {
+		span.SetAttributes(attribute.Bool("kv.cache_hit", true))
+		n.use.touch(key, false)
+		n.access.touch(key, false)
+		return value, nil
+	}
+	lock := startStep(ctx, "store.lock_wait")
+	err = n.rlockCtx(ctx)
+	endSpan(lock, err)
+	if err != nil {
+		return "", err
+	}
 	defer n.mu.RUnlock()
 	value, exists := n.node_store[key]
 	if !exists {
-		slog.Warn("get failed: key not found", "key", key)
+		slog.Debug("get failed: key not found", "key", key)
 		return "", ErrKeyNotFound
 	}
-	slog.Info("get successful", "key", key, "value", value)
+	n.cacheFillLocked(key, value)
+	n.use.touch(key, false)
+	n.access.touch(key, false)
+	slog.Debug("get successful", "key", key, "value_size", len(value))
 	return value, nil
 }
 
-func put(key string, value string, nodes []*ServerNode) error {
+func put(ctx context.Context, key string, value string, nodes []*ServerNode) error {
+	return putTyped(ctx, key, value, typeNone, nodes)
+}
+
+// putTyped writes value tagged with typ, see valuetype.go.
+func putTyped(ctx context.Context, key string, value string, typ valueType, nodes []*ServerNode) (err error) {
+	ctx, span := startOp(ctx, "put", key, nodes)
+	defer func() { recordOp("put", err); endSpan(span, err) }()
+	if err := checkSize(ctx, key, value); err != nil {
+		return err
+	}
+	if err := typ.check(value); err != nil {
+		return err
+	}
+	if cluster != nil {
+		step := startStep(ctx, "raft.apply")
+		err := cluster.apply(ctx, command{Op: "put", Bucket: nodes[0].bucket, Key: key, Value: value, Type: typ})
+		endSpan(step, err)
+		return err
+	}
+	return putLocal(ctx, key, value, typ, nodes)
+}
+
+// putLocal, putIfLocal and deleteLocal change this server's stores directly;
+// in a cluster they run when the Raft log entry is applied.
+func putLocal(ctx context.Context, key string, value string, typ valueType, nodes []*ServerNode) error {
 	n := getServerKey(key, nodes)
 	if n == nil {
 		return errors.New("no node found for key")
 	}
 
-	slog.Info(
+	slog.Debug(
 		"put request received",
 		"key", key,
 		"value_size", len(value),
 		"node", n.name,
 	)
-	n.mu.Lock()
+	lock := startStep(ctx, "store.lock_wait")
+	err := n.lockCtx(ctx)
+	endSpan(lock, err)
+	if err != nil {
+		return err
+	}
 	defer n.mu.Unlock()
-	n.node_store[key] = value
-	slog.Info("put successful", "key", key, "node", n.name)
+	write := startStep(ctx, "store.write")
+	err = n.setLocked(ctx, key, value, typ)
+	endSpan(write, err)
+	if err != nil {
+		slog.Debug("put failed", "key", key, "node", n.name, "error", err)
+		return err
+	}
+	slog.Debug("put successful", "key", key, "node", n.name)
+
+	return n.persistTraced(ctx)
+}
+
+// add and replace are the memcached-style conditional writes: add only stores
+// when the key is absent, replace only when it is already present.
+func add(ctx context.Context, key string, value string, nodes []*ServerNode) error {
+	return putIf(ctx, "add", key, value, nodes)
+}
 
-	if err := n.saveToFile(); err != nil {
-		slog.Error("failed to save node store", "node", n.name, "error", err)
+func replace(ctx context.Context, key string, value string, nodes []*ServerNode) error {
+	return putIf(ctx, "replace", key, value, nodes)
+}
+
+func putIf(ctx context.Context, op string, key string, value string, nodes []*ServerNode) (err error) {
+	defer func() { recordOp("put", err) }()
+	if err := checkSize(ctx, key, value); err != nil {
 		return err
 	}
-	return nil
+	if cluster != nil {
+		return cluster.apply(ctx, command{Op: op, Bucket: nodes[0].bucket, Key: key, Value: value})
+	}
+	return putIfLocal(ctx, op, key, value, nodes)
 }
 
-func deleteVal(key string, nodes []*ServerNode) error {
+func putIfLocal(ctx context.Context, op string, key string, value string, nodes []*ServerNode) error {
 	n := getServerKey(key, nodes)
 	if n == nil {
 		return errors.New("no node found for key")
 	}
 
-	n.mu.Lock()
+	if err := n.lockCtx(ctx); err != nil {
+		return err
+	}
 	defer n.mu.Unlock()
 	_, exists := n.node_store[key]
+	switch {
+	case op == "add" && exists:
+		return ErrKeyExists
+	case op == "replace" && !exists:
+		return ErrKeyNotFound
+	}
+	if err := n.setLocked(ctx, key, value, typeNone); err != nil {
+		slog.Debug("conditional put failed", "key", key, "node", n.name, "error", err)
+		return err
+	}
+	slog.Debug("conditional put successful", "key", key, "node", n.name)
+
+	return n.persist(ctx)
+}
+
+func deleteVal(ctx context.Context, key string, nodes []*ServerNode) (err error) {
+	ctx, span := startOp(ctx, "delete", key, nodes)
+	defer func() { recordOp("delete", err); endSpan(span, err) }()
+	if cluster != nil {
+		step := startStep(ctx, "raft.apply")
+		err := cluster.apply(ctx, command{Op: "delete", Bucket: nodes[0].bucket, Key: key})
+		endSpan(step, err)
+		return err
+	}
+	return deleteLocal(ctx, key, nodes)
+}
+
+func deleteLocal(ctx context.Context, key string, nodes []*ServerNode) error {
+	n := getServerKey(key, nodes)
+	if n == nil {
+		return errors.New("no node found for key")
+	}
+
+	lock := startStep(ctx, "store.lock_wait")
+	err := n.lockCtx(ctx)
+	endSpan(lock, err)
+	if err != nil {
+		return err
+	}
+	defer n.mu.Unlock()
+	value, exists := n.node_store[key]
 	if !exists {
-		slog.Warn("delete failed: key not found", "key", key)
+		slog.Debug("delete failed: key not found", "key", key)
 
 		return ErrKeyNotFound
 	}
-	delete(n.node_store, key)
-	slog.Info("delete successful", "key", key)
+	write := startStep(ctx, "store.write")
+	err = n.appendLocked(opDelete, key, "", typeNone)
+	endSpan(write, err)
+	if err != nil {
+		return err
+	}
+	if err := n.removeLocked(key, value); err != nil {
+		return err
+	}
+	slog.Debug("delete successful", "key", key)
+
+	return n.persistTraced(ctx)
+}
 
-	return n.saveToFile()
+// removeLocked drops key from n once its delete has been recorded. Must be
+// called with n.mu held.
+func (n *ServerNode) removeLocked(key string, value string) error {
+	delete(n.node_store, key)
+	n.cacheInvalidateLocked(key)
+	n.unindexLocked(key, value)
+	n.use.remove(key)
+	n.access.remove(key)
+	n.setSizeLocked(n.size - int64(len(key)+len(value)))
+	return n.notifyLocked("delete", key, "", typeNone)
 }
 
-func server() {
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		key := strings.TrimPrefix(r.URL.Path, "/")
-		if key == "" {
-			return 
+// mget returns the values of every key in keys that exists.
+func mget(ctx context.Context, keys []string, nodes []*ServerNode) map[string]string {
+	out := make(map[string]string, len(keys))
+	for _, key := range keys {
+		if value, err := get(ctx, key, nodes); err == nil {
+			out[key] = value
 		}
-		defer r.Body.Close()
-		switch r.Method {
-		case http.MethodGet:
-			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-			value, err := get(key, server_nodes)
+	}
+	return out
+}
+
+// keys returns the sorted keys across all nodes that start with prefix, and
+// the sequence number of the last change they reflect.
+func keys(prefix string, nodes []*ServerNode) (uint64, []string) {
+	it := newIterator(nodes, prefix)
+	out := []string{}
+	for it.Next() {
+		out = append(out, it.Key())
+	}
+	sort.Strings(out) // Each node's keys come sorted on their own
+	return it.Seq(), out
+}
+
+// dump returns a copy of every key-value pair across all nodes whose key
+// starts with prefix, and the sequence number of the last change it reflects.
+func dump(prefix string, nodes []*ServerNode) (uint64, map[string]string) {
+	seq, stores := freeze(nodes, prefix)
+	if len(stores) == 1 {
+		return seq, stores[0].data
+	}
+	out := make(map[string]string)
+	for _, fs := range stores {
+		maps.Copy(out, fs.data)
+	}
+	return seq, out
+}
+
+type NodeStats struct {
+	Node  string `json:"node"`
+	Keys  int    `json:"keys"`
+	Bytes int    `json:"bytes"` // Sum of key and value lengths
+}
+
+func stats(nodes []*ServerNode) []NodeStats {
+	out := make([]NodeStats, 0, len(nodes))
+	for _, n := range nodes {
+		s := NodeStats{Node: n.name}
+		n.mu.RLock()
+		s.Keys = len(n.node_store)
+		s.Bytes = int(n.size)
+		n.mu.RUnlock()
+		out = append(out, s)
+	}
+	return out
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("failed to encode response", "error", err)
+	}
+}
+
+// keyHandler serves GET, HEAD, POST, PUT and DELETE on a single key of the
+// given node stores, with the conditional headers described in etag.go.
+func keyHandler(w http.ResponseWriter, r *http.Request, key string, nodes []*ServerNode) {
+	defer r.Body.Close()
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		if v := r.URL.Query().Get("version"); v != "" {
+			ver, err := strconv.ParseUint(v, 10, 64)
 			if err != nil {
-				if errors.Is(err, ErrKeyNotFound) {
-					http.Error(w, "key not found", http.StatusNotFound)
-				} else {
-					http.Error(w, "internal server error", http.StatusInternalServerError)
-				}
+				writeError(w, r, http.StatusBadRequest, codeBadRequest, "invalid version")
 				return
 			}
-			w.WriteHeader(http.StatusOK)
-			w.Write([]byte(value))
-			
-		case http.MethodPost:
-			var payload struct {
-				Value string `json:"value"`
-			}
-			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
-				http.Error(w, "invalid JSON", http.StatusBadRequest)
+			value, meta, err := getVersion(r.Context(), key, ver, nodes)
+			if err != nil {
+				writeStoreError(w, r, err)
 				return
 			}
-			if err := put(key, payload.Value, server_nodes); err != nil {
-				http.Error(w, "internal server error", http.StatusInternalServerError)
+			meta.modified = time.Time{} // The version never changes, so no Last-Modified
+			writeRead(w, r, key, value, meta, true)
+			return
+		}
+		value, err := get(r.Context(), key, nodes)
+		if err != nil {
+			writeStoreError(w, r, err)
+			return
+		}
+		writeRead(w, r, key, value, valueMetaOf(key, nodes), false)
+
+	case http.MethodPost, http.MethodPut:
+		var payload putBody
+		limitBody(w, r)
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				writeStoreError(w, r, ErrValueTooLarge)
 				return
 			}
-			w.WriteHeader(http.StatusOK)
-			w.Write([]byte("ok"))
+			writeError(w, r, http.StatusBadRequest, codeBadRequest, "invalid JSON")
+			return
+		}
+		typ, err := parseValueType(payload.Type)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, codeBadRequest, err.Error())
+			return
 		}
-	})
+		ifMatch, ifNoneMatch := r.Header.Get("If-Match"), r.Header.Get("If-None-Match")
+		if ifMatch != "" || ifNoneMatch != "" {
+			err = putConditional(r.Context(), key, payload.Value, typ, ifMatch, ifNoneMatch, nodes)
+		} else {
+			err = putTyped(r.Context(), key, payload.Value, typ, nodes)
+		}
+		if err != nil {
+			writeStoreError(w, r, err)
+			return
+		}
+		w.Header().Set("ETag", etagOf(payload.Value))
+		writeMessage(w, r, "ok")
 
-	http.HandleFunc("/get", func(w http.ResponseWriter, r *http.Request) {
-		key := r.URL.Query().Get("key")
-		if key == "" {
-			http.Error(w, "key is required and cannot be empty", http.StatusBadRequest)
+	case http.MethodPatch:
+		var op string
+		mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		switch mt {
+		case mimeJSONPatch:
+			op = "json-patch"
+		case mimeMergePatch:
+			op = "merge-patch"
+		default:
+			w.Header().Set("Accept-Patch", mimeJSONPatch+", "+mimeMergePatch)
+			writeError(w, r, http.StatusUnsupportedMediaType, codeUnsupportedMediaType, "patch must be "+mimeJSONPatch+" or "+mimeMergePatch)
 			return
 		}
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		value, err := get(key, server_nodes)
+		limitBody(w, r)
+		patch, err := io.ReadAll(r.Body)
 		if err != nil {
-			if errors.Is(err, ErrKeyNotFound) {
-				http.Error(w, "key not found", http.StatusNotFound)
-			} else {
-				http.Error(w, "internal server error", http.StatusInternalServerError)
+			var tooLarge *http.MaxBytesError
+			if errors.As(err, &tooLarge) {
+				writeStoreError(w, r, ErrValueTooLarge)
+				return
 			}
+			writeError(w, r, http.StatusBadRequest, codeBadRequest, "failed to read body")
+			return
+		}
+		if err := merge(r.Context(), op, key, string(patch), nodes); err != nil {
+			writeStoreError(w, r, err)
 			return
 		}
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(value))
-	})
+		writeMessage(w, r, "ok")
 
-	http.HandleFunc("/put", func(w http.ResponseWriter, r *http.Request) {
-		key := r.URL.Query().Get("key")
-		value := r.URL.Query().Get("value")
-		if key == "" || value == "" {
-			http.Error(w, "key and value are required and cannot be empty", http.StatusBadRequest)
+	case http.MethodDelete:
+		if err := deleteVal(r.Context(), key, nodes); err != nil {
+			writeStoreError(w, r, err)
+			return
+		}
+		writeMessage(w, r, "ok")
+
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST, PUT, PATCH, DELETE")
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+	}
+}
+
+// bucketHandler serves /b/<bucket>: GET lists its keys, DELETE drops it.
+func bucketHandler(w http.ResponseWriter, r *http.Request, bucket string) {
+	switch r.Method {
+	case http.MethodGet:
+		nodes, err := bucketNodes(bucket, false)
+		if err != nil {
+			writeStoreError(w, r, err)
+			return
+		}
+		prefix, ok := requestPrefix(w, r)
+		if !ok {
 			return
 		}
-		if err := put(key, value, server_nodes); err != nil {
-			http.Error(w, "internal server error", http.StatusInternalServerError)
+		seq, out := keys(prefix, nodes)
+		setSnapshotSeq(w, seq)
+		writeJSON(w, encodeKeys(r, out))
+	case http.MethodDelete:
+		if err := dropBucket(r.Context(), bucket); err != nil {
+			writeStoreError(w, r, err)
 			return
 		}
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("key-value pair added successfully"))
-	})
+		writeMessage(w, r, "bucket deleted successfully")
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		writeError(w, r, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+	}
+}
+
+// requestNodes resolves the optional bucket query parameter to the node
+// stores a request works on.
+func requestNodes(w http.ResponseWriter, r *http.Request, create bool) ([]*ServerNode, bool) {
+	bucket := r.URL.Query().Get("bucket")
+	if bucket == "" {
+		return server_nodes, true
+	}
+	nodes, err := bucketNodes(bucket, create)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return nil, false
+	}
+	return nodes, true
+}
+
+// rootHandler serves /<key> on the default store.
+func rootHandler(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/")
+	if key == "" {
+		writeError(w, r, http.StatusNotFound, codeKeyNotFound, "key not found")
+		return
+	}
+	key, ok := decodeKey(w, r, key)
+	if !ok {
+		return
+	}
+	keyHandler(w, r, key, server_nodes)
+}
+
+// bucketPathHandler serves /b/<bucket> and /b/<bucket>/<key>.
+func bucketPathHandler(w http.ResponseWriter, r *http.Request) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/b/"), "/")
+	if key == "" {
+		bucketHandler(w, r, bucket)
+		return
+	}
+	key, ok := decodeKey(w, r, key)
+	if !ok {
+		return
+	}
+	nodes, err := bucketNodes(bucket, r.Method == http.MethodPost || r.Method == http.MethodPut)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	keyHandler(w, r, key, nodes)
+}
 
-	http.HandleFunc("/delete", func(w http.ResponseWriter, r *http.Request) {
-		key := r.URL.Query().Get("key")
-		if key == "" {
-			http.Error(w, "key is required and cannot be empty", http.StatusBadRequest)
+func bucketsHandler(w http.ResponseWriter, r *http.Request) {
+	buckets := slices.DeleteFunc(listBuckets(), func(b BucketInfo) bool { return b.Name == systemBucket })
+	writeJSON(w, buckets)
+}
+
+func getHandler(w http.ResponseWriter, r *http.Request) {
+	key, ok := requestKey(w, r)
+	if !ok {
+		return
+	}
+	nodes, ok := requestNodes(w, r, false)
+	if !ok {
+		return
+	}
+	value, err := get(r.Context(), key, nodes)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	writeRead(w, r, key, value, valueMetaOf(key, nodes), false)
+}
+
+func putHandler(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	value := r.URL.Query().Get("value")
+	if key == "" || value == "" {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "key and value are required and cannot be empty")
+		return
+	}
+	key, ok := decodeKey(w, r, key)
+	if !ok {
+		return
+	}
+	typ, err := parseValueType(r.URL.Query().Get("type"))
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, err.Error())
+		return
+	}
+	nodes, ok := requestNodes(w, r, true)
+	if !ok {
+		return
+	}
+	if err := putTyped(r.Context(), key, value, typ, nodes); err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	writeMessage(w, r, "key-value pair added successfully")
+}
+
+func deleteHandler(w http.ResponseWriter, r *http.Request) {
+	key, ok := requestKey(w, r)
+	if !ok {
+		return
+	}
+	nodes, ok := requestNodes(w, r, false)
+	if !ok {
+		return
+	}
+	if err := deleteVal(r.Context(), key, nodes); err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	writeMessage(w, r, "key-value pair deleted successfully")
+}
+
+func mgetHandler(w http.ResponseWriter, r *http.Request) {
+	nodes, ok := requestNodes(w, r, false)
+	if !ok {
+		return
+	}
+	keys := r.URL.Query()["key"]
+	for i, k := range keys {
+		if keys[i], ok = decodeKey(w, r, k); !ok {
 			return
 		}
-		if err := deleteVal(key, server_nodes); err != nil {
-			http.Error(w, "internal server error", http.StatusInternalServerError)
+	}
+	writeJSON(w, encodeKeyMap(r, mget(r.Context(), keys, nodes)))
+}
+
+func keysHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodDelete {
+		deletePrefixHandler(w, r)
+		return
+	}
+	nodes, ok := requestNodes(w, r, false)
+	if !ok {
+		return
+	}
+	prefix, ok := requestPrefix(w, r)
+	if !ok {
+		return
+	}
+	if v := r.URL.Query().Get("modified_since"); v != "" {
+		since, err := parseModifiedSince(v)
+		if err != nil {
+			writeError(w, r, http.StatusBadRequest, codeBadRequest, err.Error())
+			return
+		}
+		out, err := keysModifiedSince(prefix, since, nodes)
+		if err != nil {
+			writeStoreError(w, r, err)
 			return
 		}
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("key-value pair deleted successfully"))
-	})
+		writeJSON(w, encodeKeys(r, out))
+		return
+	}
+	seq, out := keys(prefix, nodes)
+	setSnapshotSeq(w, seq)
+	writeJSON(w, encodeKeys(r, out))
+}
+
+func dumpHandler(w http.ResponseWriter, r *http.Request) {
+	nodes, ok := requestNodes(w, r, false)
+	if !ok {
+		return
+	}
+	prefix, ok := requestPrefix(w, r)
+	if !ok {
+		return
+	}
+	seq, out := dump(prefix, nodes)
+	setSnapshotSeq(w, seq)
+	writeJSON(w, encodeKeyMap(r, out))
+}
+
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, stats(server_nodes))
+}
+
+func queryHandler(w http.ResponseWriter, r *http.Request) {
+	field := r.URL.Query().Get("field")
+	if field == "" {
+		writeError(w, r, http.StatusBadRequest, codeBadRequest, "field is required and cannot be empty")
+		return
+	}
+	nodes, ok := requestNodes(w, r, false)
+	if !ok {
+		return
+	}
+	matches, err := query(field, r.URL.Query().Get("value"), nodes)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, codeNoIndex, "no index on field")
+		return
+	}
+	writeJSON(w, encodeKeys(r, matches))
+}
+
+func server() http.Handler {
+	for _, rt := range apiRoutes() {
+		http.HandleFunc(rt.pattern, rt.handler)
+	}
+	registerDebug(http.DefaultServeMux)
+
+	go limiter.cleanupLoop()
+
+	return logRequests(traceRequests(instrumentRequests(gzipResponses(authenticate(limitRequests(timeoutRequests(clusterRedirect(replicaReadOnly(rejectReadOnlyWrites(recordRoute(http.DefaultServeMux)))))))))))
 }
@@ -0,0 +1,116 @@
+package main
+
+// Timeouts. The HTTP server drops clients that are slow to send headers or a
+// body, or that hold idle connections, and every request carries a deadline
+// of request_timeout in its context. Store operations take that context: a
+// request waiting for a node lock held by a slow write (a sync stuck on a
+// busy disk, say) gives up at its deadline with 504 instead of queueing
+// forever, and a cluster write stops waiting on the Raft log. A write that
+// already started is never interrupted. Streaming endpoints (/watch,
+// /changes, /subscribe, export, import and pprof) run without the deadline.
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+// lockCtx takes n.mu for writing, giving up when ctx is done first.
+func (n *ServerNode) lockCtx(ctx context.Context) error {
+	if n.mu.TryLock() {
+		return nil
+	}
+	if ctx.Done() == nil {
+		n.mu.Lock()
+		return nil
+	}
+	locked := make(chan struct{})
+	go func() {
+		n.mu.Lock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		return nil
+	case <-ctx.Done():
+		go func() {
+			<-locked
+			n.mu.Unlock()
+		}()
+		return ctx.Err()
+	}
+}
+
+// rlockCtx is lockCtx for reading.
+func (n *ServerNode) rlockCtx(ctx context.Context) error {
+	if n.mu.TryRLock() {
+		return nil
+	}
+	if ctx.Done() == nil {
+		n.mu.RLock()
+		return nil
+	}
+	locked := make(chan struct{})
+	go func() {
+		n.mu.RLock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		return nil
+	case <-ctx.Done():
+		go func() {
+			<-locked
+			n.mu.RUnlock()
+		}()
+		return ctx.Err()
+	}
+}
+
+// streamingPath reports whether requests to path may legitimately run for
+// longer than request_timeout.
+func streamingPath(path string) bool {
+	switch path {
+	case "/watch", "/changes", "/subscribe", "/admin/export", "/admin/import":
+		return true
+	}
+	return strings.HasPrefix(path, "/admin/debug/pprof/")
+}
+
+// timeoutRequests gives each request a deadline of request_timeout.
+func timeoutRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := requestConfig(r)
+		if c.RequestTimeout <= 0 || streamingPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), c.RequestTimeout)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// newHTTPServer returns the server for every HTTP listener with the
+// configured timeouts and connection settings. HTTP/2 is negotiated over TLS
+// as always; with h2c on, plaintext listeners also take HTTP/2 from clients
+// that start with its preface, so one connection carries many concurrent
+// requests instead of one at a time.
+func newHTTPServer(handler http.Handler) *http.Server {
+	c := cfg()
+	var protocols http.Protocols
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(c.H2C)
+	srv := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: c.ReadHeaderTimeout,
+		ReadTimeout:       c.ReadTimeout,
+		WriteTimeout:      c.WriteTimeout,
+		IdleTimeout:       c.IdleTimeout,
+		MaxHeaderBytes:    int(c.MaxHeaderBytes),
+		Protocols:         &protocols,
+	}
+	srv.SetKeepAlivesEnabled(c.KeepAlives)
+	return srv
+}
@@ -0,0 +1,79 @@
+package main
+
+// TLS for the HTTP listener. The certificate, key and client CA bundle are
+// read from disk at startup and again on every config reload (see
+// reload.go), so rotated certificates are picked up without restarting or
+// dropping the listener.
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+type certReloader struct {
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	client_ca *x509.CertPool // nil unless tls_client_ca is set
+}
+
+func newCertReloader() (*certReloader, error) {
+	c := &certReloader{}
+	if err := c.reload(cfg()); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// reload reads the files named in conf. On failure the previous certificates
+// stay in use.
+func (c *certReloader) reload(conf *Config) error {
+	cert, err := tls.LoadX509KeyPair(conf.TLSCert, conf.TLSKey)
+	if err != nil {
+		return fmt.Errorf("loading TLS key pair: %w", err)
+	}
+	var pool *x509.CertPool
+	if conf.TLSClientCA != "" {
+		pem, err := os.ReadFile(conf.TLSClientCA)
+		if err != nil {
+			return fmt.Errorf("reading client CA: %w", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return errors.New("client CA file contains no PEM certificates")
+		}
+	}
+
+	c.mu.Lock()
+	c.cert = &cert
+	c.client_ca = pool
+	c.mu.Unlock()
+	return nil
+}
+
+// tlsConfig builds the server config. Each handshake asks for a fresh config
+// so reloaded certificates and client CAs apply to new connections.
+func (c *certReloader) tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			c.mu.RLock()
+			defer c.mu.RUnlock()
+			conf := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*c.cert},
+				ClientCAs:    c.client_ca,
+			}
+			switch {
+			case cfg().TLSRequireClientCert:
+				conf.ClientAuth = tls.RequireAndVerifyClientCert
+			case c.client_ca != nil:
+				conf.ClientAuth = tls.VerifyClientCertIfGiven
+			}
+			return conf, nil
+		},
+	}
+}
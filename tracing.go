@@ -0,0 +1,126 @@
+package main
+
+// OpenTelemetry tracing. Tracing is off unless an OTLP endpoint is set in the
+// standard environment variables (OTEL_EXPORTER_OTLP_ENDPOINT or
+// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT); the exporter, its headers and the
+// sampler are configured the same way (OTEL_EXPORTER_OTLP_HEADERS,
+// OTEL_TRACES_SAMPLER, ...) and spans are sent over OTLP/HTTP. Every HTTP
+// request gets a server span, joined to the caller's trace when it sends a
+// traceparent header. get, put and delete add a span of their own with
+// children for waiting on the node lock, writing the segment record and
+// syncing it to disk; compaction runs are traced as their own root spans.
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.34.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("key-value-store")
+
+// startTracing installs the OTLP exporter when one is configured. The
+// returned function flushes pending spans on shutdown.
+func startTracing(ctx context.Context) (func(context.Context) error, error) {
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		semconv.ServiceInstanceID(cfg().NodeName),
+	))
+	if err != nil {
+		return nil, err
+	}
+	if os.Getenv("OTEL_SERVICE_NAME") == "" {
+		res, _ = resource.Merge(res, resource.NewSchemaless(semconv.ServiceName("kvstore")))
+	}
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(tp)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return tp.Shutdown, nil
+}
+
+// traceRequests starts a server span for each request.
+func traceRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.URLPath(r.URL.Path),
+				semconv.ClientAddress(r.RemoteAddr),
+			))
+		defer span.End()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		r, route := withRoute(r.WithContext(ctx))
+		next.ServeHTTP(rec, r)
+		if route.pattern != "" { // Set once the mux has routed the request
+			span.SetName(r.Method + " " + route.pattern)
+			span.SetAttributes(semconv.HTTPRoute(route.pattern))
+		}
+		span.SetAttributes(semconv.HTTPResponseStatusCode(rec.status))
+		if rec.status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(rec.status))
+		}
+	})
+}
+
+// injectTrace adds the trace context of ctx to outgoing request headers.
+func injectTrace(ctx context.Context, h http.Header) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(h))
+}
+
+// startOp starts the span of a store operation on key.
+func startOp(ctx context.Context, op string, key string, nodes []*ServerNode) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "kv."+op, trace.WithAttributes(
+		attribute.String("kv.key", key),
+		attribute.String("kv.bucket", nodes[0].bucket),
+	))
+}
+
+// startStep starts a child span for one step of an operation, unless ctx
+// carries no span: writes applied from the Raft log or by a replica would
+// otherwise each start a trace of their own.
+func startStep(ctx context.Context, name string) trace.Span {
+	if !trace.SpanFromContext(ctx).IsRecording() {
+		return trace.SpanFromContext(ctx)
+	}
+	_, span := tracer.Start(ctx, name)
+	return span
+}
+
+// persistTraced is persist with a span for the sync. Must be called with
+// n.mu held.
+func (n *ServerNode) persistTraced(ctx context.Context) error {
+	span := startStep(ctx, "store.sync")
+	err := n.persist(ctx)
+	endSpan(span, err)
+	return err
+}
+
+// endSpan records err on span and ends it. A missing key is an answer rather
+// than a failure.
+func endSpan(span trace.Span, err error) {
+	if errors.Is(err, ErrKeyNotFound) {
+		span.SetAttributes(attribute.Bool("kv.found", false))
+	} else if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,143 @@
+package main
+
+// Value types. A write may tag its value as a string, an int, JSON or binary,
+// with "type" next to "value" in the body of PUT /{key} or with /put?type=.
+// The tag is checked against the value (an int must be a 64-bit integer, JSON
+// must be well formed and a string valid UTF-8) and kept in the flags byte of
+// the value's segment record (see segment.go) and index checkpoint entry, so
+// it survives compaction and restarts at no extra space. A write without a tag leaves the value untyped,
+// like every value written before tags existed. Plain reads answer with the
+// Content-Type of the tag, and reads accepting application/json get the value
+// wrapped with its type, version, write time and ETag. Tags travel in the
+// change log and Raft commands, so replicas and cluster members keep them,
+// but not in replication snapshots: a replica that resyncs from one has its
+// values untyped until they are written again. In memory mode there are no
+// records, so no tags either.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+type valueType byte
+
+const (
+	typeNone valueType = iota
+	typeString
+	typeInt
+	typeJSON
+	typeBinary
+	typeMax = typeBinary
+)
+
+var valueTypeNames = [...]string{typeNone: "", typeString: "string", typeInt: "int", typeJSON: "json", typeBinary: "binary"}
+
+var ErrTypeMismatch = errors.New("value does not match its type")
+
+func parseValueType(s string) (valueType, error) {
+	for t, name := range valueTypeNames {
+		if name == s {
+			return valueType(t), nil
+		}
+	}
+	return typeNone, fmt.Errorf("unknown value type %q: must be string, int, json or binary", s)
+}
+
+func (t valueType) String() string {
+	if t > typeMax {
+		return "type" + strconv.Itoa(int(t))
+	}
+	return valueTypeNames[t]
+}
+
+func (t valueType) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+func (t *valueType) UnmarshalText(b []byte) error {
+	v, err := parseValueType(string(b))
+	*t = v
+	return err
+}
+
+// check reports whether value is valid for the type.
+func (t valueType) check(value string) error {
+	var ok bool
+	switch t {
+	case typeString:
+		ok = utf8.ValidString(value)
+	case typeInt:
+		_, err := strconv.ParseInt(value, 10, 64)
+		ok = err == nil
+	case typeJSON:
+		ok = json.Valid([]byte(value))
+	default:
+		ok = true
+	}
+	if !ok {
+		return fmt.Errorf("%w: not a valid %s", ErrTypeMismatch, t)
+	}
+	return nil
+}
+
+// contentType is what plain reads of a value of the type answer with.
+func (t valueType) contentType() string {
+	switch t {
+	case typeJSON:
+		return "application/json"
+	case typeBinary:
+		return "application/octet-stream"
+	}
+	return "text/plain; charset=utf-8"
+}
+
+// valueMeta describes the current (or a requested) version of a key.
+type valueMeta struct {
+	typ      valueType
+	version  uint64    // 0 when unknown
+	modified time.Time // Zero when unknown
+}
+
+func metaOfLoc(loc segLoc) valueMeta {
+	m := valueMeta{typ: loc.typ, version: loc.ver}
+	if loc.ts != 0 {
+		m.modified = time.Unix(0, loc.ts).UTC()
+	}
+	return m
+}
+
+// valueMetaOf returns what is known about the current value of key.
+func valueMetaOf(key string, nodes []*ServerNode) valueMeta {
+	n := getServerKey(key, nodes)
+	if n == nil {
+		return valueMeta{}
+	}
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	if n.segs == nil {
+		return valueMeta{}
+	}
+	loc, ok := n.segs.idx[key]
+	if !ok || loc.del {
+		return valueMeta{}
+	}
+	return metaOfLoc(loc)
+}
+
+// keptTypeLocked is the type of key's current value if newValue still
+// matches it, so merges and patches don't drop a key's tag. Must be called
+// with n.mu held.
+func (n *ServerNode) keptTypeLocked(key string, newValue string) valueType {
+	if n.segs == nil {
+		return typeNone
+	}
+	typ := n.segs.idx[key].typ
+	if typ.check(newValue) != nil {
+		return typeNone
+	}
+	return typ
+}
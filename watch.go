@@ -0,0 +1,215 @@
+package main
+
+// Change notifications. Every put and delete, and the drop of a bucket, is
+// published to a broker that records it in the change log (see changelog.go)
+// and fans it out to watchers; GET /watch?prefix=... streams the matching
+// events to HTTP clients as Server-Sent Events. Slow watchers whose buffer fills up are
+// disconnected rather than blocking writers.
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	watchBuffer    = 256
+	watchHeartbeat = 15 * time.Second
+)
+
+type ChangeEvent struct {
+	Seq    uint64    `json:"seq"`
+	Time   time.Time `json:"time"`
+	Op     string    `json:"op"` // "put", "delete" or "drop_bucket"
+	Bucket string    `json:"bucket,omitempty"`
+	Key    string    `json:"key"`
+	Value  string    `json:"value,omitempty"`
+	Type   valueType `json:"type,omitempty"` // The value's type tag, see valuetype.go
+}
+
+// under reports whether the event concerns keys starting with prefix. A
+// dropped bucket takes all of them with it.
+func (ev ChangeEvent) under(prefix string) bool {
+	return ev.Op == "drop_bucket" || strings.HasPrefix(ev.Key, prefix)
+}
+
+type watcher struct {
+	bucket string
+	prefix string
+	events chan ChangeEvent
+}
+
+type changeBroker struct {
+	order    sync.Mutex // Serializes publish, open and close; held across log I/O
+	mu       sync.Mutex // Guards the fields below; never held across I/O
+	seq      uint64
+	log      *changeLog    // nil until open is called
+	advanced chan struct{} // Closed and replaced on every publish
+	watchers map[*watcher]struct{}
+}
+
+var changes = &changeBroker{advanced: make(chan struct{}), watchers: make(map[*watcher]struct{})}
+
+// open attaches the change log at path and resumes numbering after the last
+// sequence number it holds.
+func (b *changeBroker) open(path string) error {
+	b.order.Lock()
+	defer b.order.Unlock()
+	l, err := openChangeLog(path)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.log = l
+	_, b.seq = l.bounds()
+	slog.Info("change log opened", "path", path, "last_seq", b.seq)
+	return nil
+}
+
+func (b *changeBroker) close() error {
+	b.order.Lock()
+	defer b.order.Unlock()
+	b.mu.Lock()
+	l := b.log
+	b.log = nil
+	b.mu.Unlock()
+	if l == nil {
+		return nil
+	}
+	return l.Close()
+}
+
+// publish assigns the next sequence number to an event, records it in the
+// change log and delivers it to every interested watcher. The change is
+// already applied when it is published, so if it can't be recorded the
+// server turns read-only rather than take writes its followers will never
+// see, and the error is returned.
+func (b *changeBroker) publish(op string, bucket string, key string, value string, typ valueType) error {
+	b.order.Lock()
+	defer b.order.Unlock()
+	b.mu.Lock()
+	ev := ChangeEvent{Seq: b.seq + 1, Time: time.Now().UTC(), Op: op, Bucket: bucket, Key: key, Value: value, Type: typ}
+	l := b.log
+	b.mu.Unlock()
+	if l != nil {
+		if err := l.append(ev); err != nil {
+			read_only.Store(true)
+			slog.Error("failed to record change; server is now read-only", "seq", ev.Seq, "error", err)
+			return fmt.Errorf("recording change %d: %w", ev.Seq, err)
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.seq = ev.Seq
+	close(b.advanced)
+	b.advanced = make(chan struct{})
+	for w := range b.watchers {
+		if w.bucket != bucket || !ev.under(w.prefix) {
+			continue
+		}
+		select {
+		case w.events <- ev:
+		default: // Watcher can't keep up; drop it so it reconnects
+			delete(b.watchers, w)
+			close(w.events)
+		}
+	}
+	return nil
+}
+
+// sync flushes the change log, if there is one, to disk.
+func (b *changeBroker) sync() error {
+	b.mu.Lock()
+	l := b.log
+	b.mu.Unlock()
+	if l == nil {
+		return nil
+	}
+	return l.sync()
+}
+
+func (b *changeBroker) subscribe(bucket string, prefix string) *watcher {
+	w := &watcher{bucket: bucket, prefix: prefix, events: make(chan ChangeEvent, watchBuffer)}
+	b.mu.Lock()
+	b.watchers[w] = struct{}{}
+	b.mu.Unlock()
+	return w
+}
+
+func (b *changeBroker) unsubscribe(w *watcher) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.watchers[w]; ok {
+		delete(b.watchers, w)
+		close(w.events)
+	}
+}
+
+// closeAll disconnects every watcher and wakes long-polling /changes
+// requests, used on shutdown so open streams don't hold up draining.
+func (b *changeBroker) closeAll() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	close(b.advanced)
+	b.advanced = make(chan struct{})
+	for w := range b.watchers {
+		delete(b.watchers, w)
+		close(w.events)
+	}
+}
+
+// notifyLocked publishes a change to n. Called with n.mu held so events for
+// a key are published in the order they were applied.
+func (n *ServerNode) notifyLocked(op string, key string, value string, typ valueType) error {
+	return changes.publish(op, n.bucket, key, value, typ)
+}
+
+func watchHandler(w http.ResponseWriter, r *http.Request) {
+	bucket := r.URL.Query().Get("bucket")
+	if bucket != "" && !validBucketName(bucket) {
+		writeError(w, r, http.StatusBadRequest, codeInvalidBucket, "invalid bucket name")
+		return
+	}
+	prefix, ok := requestPrefix(w, r)
+	if !ok {
+		return
+	}
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	sub := changes.subscribe(bucket, prefix)
+	defer changes.unsubscribe(sub)
+	heartbeat := time.NewTicker(watchHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			w.Write([]byte(": keepalive\n\n"))
+		case ev, ok := <-sub.events:
+			if !ok {
+				return
+			}
+			ev.Key = encodeKey(r, ev.Key)
+			data, _ := json.Marshal(ev)
+			w.Write([]byte("id: " + strconv.FormatUint(ev.Seq, 10) + "\nevent: " + ev.Op + "\ndata: " + string(data) + "\n\n"))
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}